@@ -0,0 +1,47 @@
+// Package admin provides the administrative operations on the rpcx services registered in consul.
+//
+// The administrative flags are stored under Prefix, outside of the base paths of services,
+// so they never show up as servers.
+package admin
+
+import (
+	"strings"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+// Prefix is the KV prefix of all administrative flags.
+const Prefix = "_rpcx_admin"
+
+// FreezeKey returns the key of the freeze flag of the service path, for example rpcx/Arith.
+func FreezeKey(servicePath string) string {
+	return Prefix + "/freeze/" + strings.Trim(servicePath, "/")
+}
+
+// Freeze sets the freeze flag of the service path. The discoveries honoring it keep their current servers
+// and ignore all changes until Unfreeze is called.
+func Freeze(kv store.Store, servicePath string) error {
+	return kv.Put(FreezeKey(servicePath), []byte("true"), nil)
+}
+
+// Unfreeze clears the freeze flag of the service path.
+func Unfreeze(kv store.Store, servicePath string) error {
+	return kv.Put(FreezeKey(servicePath), []byte("false"), nil)
+}
+
+// IsFrozen reports whether the service path is frozen.
+func IsFrozen(kv store.Store, servicePath string) (bool, error) {
+	p, err := kv.Get(FreezeKey(servicePath))
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return IsTrue(p.Value), nil
+}
+
+// IsTrue reports whether the value of a flag is set.
+func IsTrue(value []byte) bool {
+	return string(value) == "true"
+}
@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+type mapStore struct {
+	store.Store
+	data map[string][]byte
+	// called before the next AtomicPut, e.g. to modify the key concurrently
+	beforeAtomicPut func()
+}
+
+func (s *mapStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.data[key] = value
+	return nil
+}
+
+func (s *mapStore) Get(key string) (*store.KVPair, error) {
+	v, ok := s.data[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return &store.KVPair{Key: key, Value: v}, nil
+}
+
+func (s *mapStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if f := s.beforeAtomicPut; f != nil {
+		s.beforeAtomicPut = nil
+		f()
+	}
+	v, ok := s.data[key]
+	if previous == nil && ok {
+		return false, nil, store.ErrKeyExists
+	}
+	if previous != nil && string(previous.Value) != string(v) {
+		return false, nil, store.ErrKeyModified
+	}
+	s.data[key] = value
+	return true, &store.KVPair{Key: key, Value: value}, nil
+}
+
+func TestFreeze(t *testing.T) {
+	kv := &mapStore{data: make(map[string][]byte)}
+
+	if frozen, err := IsFrozen(kv, "/rpcx/Arith"); err != nil || frozen {
+		t.Fatalf("expect not frozen but got %v, %v", frozen, err)
+	}
+	if err := Freeze(kv, "/rpcx/Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if frozen, err := IsFrozen(kv, "rpcx/Arith"); err != nil || !frozen {
+		t.Fatalf("expect frozen but got %v, %v", frozen, err)
+	}
+	if err := Unfreeze(kv, "rpcx/Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if frozen, _ := IsFrozen(kv, "rpcx/Arith"); frozen {
+		t.Fatal("expect unfrozen")
+	}
+	if _, ok := kv.data["_rpcx_admin/freeze/rpcx/Arith"]; !ok {
+		t.Fatalf("unexpected keys: %v", kv.data)
+	}
+}
+
+func TestRestartKey(t *testing.T) {
+	if key := RestartKey("/rpcx/Arith/"); key != "_rpcx_admin/restart/rpcx/Arith" {
+		t.Fatalf("unexpected key: %s", key)
+	}
+	if _, err := AcquireRestartSlot(context.Background(), nil, "rpcx", 0); err == nil {
+		t.Fatal("expect error of non-positive maxConcurrent")
+	}
+}
+
+func TestGroupWeights(t *testing.T) {
+	kv := &mapStore{data: make(map[string][]byte)}
+
+	if weights, err := GroupWeights(kv, "rpcx/Arith"); err != nil || weights != nil {
+		t.Fatalf("expect no weights but got %v, %v", weights, err)
+	}
+	if err := SetGroupWeights(kv, "rpcx/Arith", map[string]int{"v1": -1}); err == nil {
+		t.Fatal("expect an error of the negative weight")
+	}
+	if err := SetGroupWeights(kv, "/rpcx/Arith", map[string]int{"v1": 90, "v2": 10}); err != nil {
+		t.Fatal(err)
+	}
+	weights, err := GroupWeights(kv, "rpcx/Arith")
+	if err != nil || weights["v1"] != 90 || weights["v2"] != 10 {
+		t.Fatalf("unexpected weights: %v, %v", weights, err)
+	}
+	if err := ClearGroupWeights(kv, "rpcx/Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if weights, err := GroupWeights(kv, "rpcx/Arith"); err != nil || weights != nil {
+		t.Fatalf("expect the weights cleared but got %v, %v", weights, err)
+	}
+}
+
+func TestExpel(t *testing.T) {
+	kv := &mapStore{data: make(map[string][]byte)}
+
+	if expelled, err := Expelled(kv, "rpcx/Arith"); err != nil || expelled != nil {
+		t.Fatalf("expect no expelled instances but got %v, %v", expelled, err)
+	}
+	// another operator expels an instance at the same time
+	kv.beforeAtomicPut = func() {
+		kv.data[ExpelKey("rpcx/Arith")] = []byte(`{"tcp@10.0.0.2:8972":{"at":"2022-01-01T00:00:00Z"}}`)
+	}
+	if err := Expel(kv, "/rpcx/Arith", "tcp@10.0.0.1:8972", "bad disk"); err != nil {
+		t.Fatal(err)
+	}
+	expelled, err := Expelled(kv, "rpcx/Arith")
+	if err != nil || len(expelled) != 2 || expelled["tcp@10.0.0.1:8972"].Reason != "bad disk" {
+		t.Fatalf("unexpected expelled instances: %v, %v", expelled, err)
+	}
+
+	if err := Unexpel(kv, "rpcx/Arith", "tcp@10.0.0.2:8972"); err != nil {
+		t.Fatal(err)
+	}
+	if expelled, _ := Expelled(kv, "rpcx/Arith"); len(expelled) != 1 {
+		t.Fatalf("unexpected expelled instances: %v", expelled)
+	}
+	if err := Expel(kv, "rpcx/Arith", "", ""); err == nil {
+		t.Fatal("expect an error of the empty instance")
+	}
+}
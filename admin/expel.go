@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+// maxExpelRetries is how many times the expelled instances are read and written again when operators
+// expel instances of the same service path concurrently.
+const maxExpelRetries = 5
+
+// Expulsion is why and when an instance was expelled.
+type Expulsion struct {
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// ExpelKey returns the key of the expelled instances of the service path, for example rpcx/Arith.
+func ExpelKey(servicePath string) string {
+	return Prefix + "/expel/" + strings.Trim(servicePath, "/")
+}
+
+// Expel expels the instance of the service path, e.g. tcp@10.0.0.1:8972, for the emergency removal of a bad node.
+// The discoveries honoring the expel markers remove it at once, whatever its key and state in consul,
+// until Unexpel is called.
+func Expel(kv store.Store, servicePath, instance, reason string) error {
+	if instance == "" {
+		return errors.New("instance can't be empty")
+	}
+	return updateExpelled(kv, servicePath, func(expelled map[string]Expulsion) {
+		expelled[instance] = Expulsion{Reason: reason, At: time.Now()}
+	})
+}
+
+// Unexpel lets the discoveries use the instance of the service path again.
+func Unexpel(kv store.Store, servicePath, instance string) error {
+	return updateExpelled(kv, servicePath, func(expelled map[string]Expulsion) {
+		delete(expelled, instance)
+	})
+}
+
+// Expelled returns the expelled instances of the service path.
+func Expelled(kv store.Store, servicePath string) (map[string]Expulsion, error) {
+	p, err := kv.Get(ExpelKey(servicePath))
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseExpelled(p.Value)
+}
+
+// ParseExpelled parses the value of ExpelKey, nil if it is empty.
+func ParseExpelled(value []byte) (map[string]Expulsion, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var expelled map[string]Expulsion
+	if err := json.Unmarshal(value, &expelled); err != nil {
+		return nil, fmt.Errorf("malformed expelled instances: %w", err)
+	}
+	return expelled, nil
+}
+
+// updateExpelled modifies the expelled instances of the service path with CAS,
+// so that the instances expelled by others at the same time are not lost.
+func updateExpelled(kv store.Store, servicePath string, update func(expelled map[string]Expulsion)) error {
+	key := ExpelKey(servicePath)
+	for i := 0; i < maxExpelRetries; i++ {
+		p, err := kv.Get(key)
+		if err == store.ErrKeyNotFound {
+			p, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		expelled := make(map[string]Expulsion)
+		if p != nil {
+			old, err := ParseExpelled(p.Value)
+			if err != nil {
+				return err
+			}
+			for instance, e := range old {
+				expelled[instance] = e
+			}
+		}
+		update(expelled)
+
+		data, err := json.Marshal(expelled)
+		if err != nil {
+			return err
+		}
+		_, _, err = kv.AtomicPut(key, data, p, nil)
+		if err == store.ErrKeyModified || err == store.ErrKeyExists {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("expelled instances of %s are modified concurrently %d times", servicePath, maxExpelRetries)
+}
@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// RestartKey returns the prefix of the restart slots of the service path.
+func RestartKey(servicePath string) string {
+	return Prefix + "/restart/" + strings.Trim(servicePath, "/")
+}
+
+// RestartSlot is a slot of the restart barrier of a service path, held by a consul session.
+type RestartSlot struct {
+	sem  *api.Semaphore
+	lost <-chan struct{}
+}
+
+// AcquireRestartSlot blocks until one of the maxConcurrent restart slots of the service path is free and holds it,
+// so that a fleet limits how many instances restart or deregister at the same time without external orchestration.
+// It returns ctx.Err() if ctx is done before a slot is acquired. The slot is freed by Release,
+// or by consul when the session of a crashed instance expires.
+func AcquireRestartSlot(ctx context.Context, consul *api.Client, servicePath string, maxConcurrent int) (*RestartSlot, error) {
+	if maxConcurrent <= 0 {
+		return nil, errors.New("maxConcurrent must be positive")
+	}
+
+	sem, err := consul.SemaphoreOpts(&api.SemaphoreOptions{
+		Prefix:      RestartKey(servicePath),
+		Limit:       maxConcurrent,
+		SessionName: "rpcx restart slot of " + strings.Trim(servicePath, "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stopCh := make(chan struct{})
+	acquired := make(chan struct{})
+	defer close(acquired)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stopCh)
+		case <-acquired:
+		}
+	}()
+
+	lost, err := sem.Acquire(stopCh)
+	if err != nil {
+		return nil, err
+	}
+	if lost == nil { // stopped by ctx
+		return nil, ctx.Err()
+	}
+	return &RestartSlot{sem: sem, lost: lost}, nil
+}
+
+// Lost returns a chan closed if the slot is lost before it is released, e.g. the session is invalidated.
+func (s *RestartSlot) Lost() <-chan struct{} {
+	return s.lost
+}
+
+// Release frees the slot for other instances.
+func (s *RestartSlot) Release() error {
+	return s.sem.Release()
+}
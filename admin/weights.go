@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+// GroupWeightsKey returns the key of the group weights of the service path, for example rpcx/Arith.
+func GroupWeightsKey(servicePath string) string {
+	return Prefix + "/group_weights/" + strings.Trim(servicePath, "/")
+}
+
+// SetGroupWeights sets the relative traffic weights of the groups of the service path, e.g. {"v1": 90, "v2": 10}.
+// The discoveries honoring them split the traffic between the groups by the weights, see meta.Group.
+func SetGroupWeights(kv store.Store, servicePath string, weights map[string]int) error {
+	for group, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("weight %d of group %s is negative", w, group)
+		}
+	}
+	data, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+	return kv.Put(GroupWeightsKey(servicePath), data, nil)
+}
+
+// ClearGroupWeights clears the group weights of the service path, so that the servers keep their own weights.
+// The key is emptied instead of deleted, so that the watches of the discoveries see the change.
+func ClearGroupWeights(kv store.Store, servicePath string) error {
+	return kv.Put(GroupWeightsKey(servicePath), nil, nil)
+}
+
+// GroupWeights returns the group weights of the service path, nil if they are not set.
+func GroupWeights(kv store.Store, servicePath string) (map[string]int, error) {
+	p, err := kv.Get(GroupWeightsKey(servicePath))
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseGroupWeights(p.Value)
+}
+
+// ParseGroupWeights parses the value of the group weights key, nil if it is empty.
+func ParseGroupWeights(value []byte) (map[string]int, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var weights map[string]int
+	if err := json.Unmarshal(value, &weights); err != nil {
+		return nil, fmt.Errorf("malformed group weights: %w", err)
+	}
+	return weights, nil
+}
@@ -0,0 +1,101 @@
+// Package budget counts the goroutines spawned by the discoveries and the register plugins, such as the watches,
+// the notifiers and the heartbeats, against a process-wide limit. A leak of discoveries or watchers fails with
+// an ExceededError instead of growing the goroutines until the process runs out of memory.
+package budget
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	mu     sync.Mutex
+	limit  int
+	counts = make(map[string]int)
+	total  int
+)
+
+// ExceededError is returned when a goroutine is refused because the budget is used up.
+type ExceededError struct {
+	// Kind of the refused goroutine, e.g. watch
+	Kind  string
+	Limit int
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("goroutine budget of %d is exceeded, refuse to start %s", e.Limit, e.Kind)
+}
+
+// SetLimit sets how many goroutines the package may run at the same time, zero or negative means no limit.
+// The running goroutines are not affected if they already exceed it.
+func SetLimit(n int) {
+	mu.Lock()
+	limit = n
+	mu.Unlock()
+}
+
+// Limit returns the limit set by SetLimit, zero means no limit.
+func Limit() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return limit
+}
+
+// Count returns how many goroutines are running.
+func Count() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return total
+}
+
+// Usage is the running goroutines of a kind.
+type Usage struct {
+	Kind  string `json:"kind"`
+	Count int    `json:"count"`
+}
+
+// Usages returns the running goroutines by their kinds, sorted by kind.
+func Usages() []Usage {
+	mu.Lock()
+	usages := make([]Usage, 0, len(counts))
+	for kind, n := range counts {
+		usages = append(usages, Usage{Kind: kind, Count: n})
+	}
+	mu.Unlock()
+
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Kind < usages[j].Kind })
+	return usages
+}
+
+// Go runs f in a goroutine of the kind, e.g. watch, if the budget allows it, otherwise it returns an ExceededError.
+func Go(kind string, f func()) error {
+	if err := acquire(kind); err != nil {
+		return err
+	}
+	go func() {
+		defer release(kind)
+		f()
+	}()
+	return nil
+}
+
+func acquire(kind string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if limit > 0 && total >= limit {
+		return &ExceededError{Kind: kind, Limit: limit}
+	}
+	total++
+	counts[kind]++
+	return nil
+}
+
+func release(kind string) {
+	mu.Lock()
+	defer mu.Unlock()
+	total--
+	if counts[kind]--; counts[kind] <= 0 {
+		delete(counts, kind)
+	}
+}
@@ -0,0 +1,42 @@
+package budget
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	SetLimit(2)
+	defer SetLimit(0)
+
+	stop := make(chan struct{})
+	started := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		if err := Go("watch", func() { started <- struct{}{}; <-stop }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	<-started
+	if Count() != 2 {
+		t.Fatalf("expect 2 goroutines but got %d", Count())
+	}
+	if u := Usages(); len(u) != 1 || u[0] != (Usage{Kind: "watch", Count: 2}) {
+		t.Fatalf("unexpected usages %v", u)
+	}
+
+	err := Go("notifier", func() {})
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || exceeded.Kind != "notifier" || exceeded.Limit != 2 {
+		t.Fatalf("expect the budget exceeded but got %v", err)
+	}
+
+	close(stop)
+	for Count() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if len(Usages()) != 0 {
+		t.Fatalf("unexpected usages %v", Usages())
+	}
+}
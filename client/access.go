@@ -0,0 +1,43 @@
+package client
+
+import (
+	"runtime"
+	"time"
+)
+
+// AccessInfo describes one GetServices call.
+type AccessInfo struct {
+	// base path of the discovery which was read
+	BasePath string
+	// function, file and line of the caller of GetServices
+	Caller string
+	File   string
+	Line   int
+	// number of returned servers
+	Servers int
+	Time    time.Time
+}
+
+// AccessHook is invoked on every GetServices call.
+// It is called synchronously and must be cheap.
+type AccessHook func(info AccessInfo)
+
+// WithAccessHook sets the hook invoked on every GetServices call,
+// so that the readers of service paths and their frequency can be audited.
+func WithAccessHook(hook AccessHook) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.accessHook = hook
+	}
+}
+
+// callerInfo fills the caller of the function skip frames above callerInfo.
+func callerInfo(info *AccessInfo, skip int) {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return
+	}
+	info.File, info.Line = file, line
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		info.Caller = fn.Name()
+	}
+}
@@ -0,0 +1,18 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestAccessHook(t *testing.T) {
+	var got AccessInfo
+	d := &ConsulDiscovery{basePath: "a", cache: &pairSlot{pairs: []*client.KVPair{{Key: "x"}}, set: true}}
+	WithAccessHook(func(i AccessInfo) { got = i })(d)
+	d.GetServices()
+	if !strings.HasSuffix(got.Caller, "TestAccessHook") || got.Servers != 1 {
+		t.Fatalf("unexpected %v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// DialAddress selects which of the published addresses of a server is dialed.
+type DialAddress int
+
+const (
+	// DialRegistered dials the address the server is registered with.
+	DialRegistered DialAddress = iota
+	// DialHostname dials the hostname published by the server.
+	DialHostname
+	// DialIP dials the numeric IP published by the server.
+	DialIP
+)
+
+// WithDialAddress rewrites the keys of the servers which publish their hostname and IP
+// (see serverplugin.WithConsulHostname) to the selected address.
+// Servers without the selected address keep their registered key.
+func WithDialAddress(a DialAddress) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.dialAddress = a
+	}
+}
+
+// Addresses returns the hostname and the IP published by the server with the key.
+func (d *ConsulDiscovery) Addresses(key string) (meta.Addresses, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return meta.Addresses{}, false
+	}
+	return meta.AddressesOf(p.Value), true
+}
+
+// rewriteAddress replaces the host in the key of the server with the selected address.
+func (d *ConsulDiscovery) rewriteAddress(pair *client.KVPair) {
+	if d.dialAddress == DialRegistered {
+		return
+	}
+
+	addrs := meta.AddressesOf(pair.Value)
+	host := addrs.Hostname
+	if d.dialAddress == DialIP {
+		host = addrs.IP
+	}
+	if host == "" {
+		return
+	}
+	registered := pair.Key
+	if pair.Key = meta.ReplaceHost(registered, host); pair.Key != registered && d.honorExpel {
+		d.expelledMu.Lock()
+		if d.registeredKeys == nil {
+			d.registeredKeys = make(map[string]string)
+		}
+		d.registeredKeys[pair.Key] = registered
+		d.expelledMu.Unlock()
+	}
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestDialAddress(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@10.0.0.1:8972", Value: []byte("hostname=h1&ip=10.0.0.1")}, &store.KVPair{Key: "rpcx/A/tcp@10.0.0.2:8972"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithDialAddress(DialHostname))
+	defer d.Close()
+	ps := d.GetServices()
+	if ps[0].Key != "tcp@h1:8972" || ps[1].Key != "tcp@10.0.0.2:8972" {
+		t.Fatalf("unexpected services %v, %v", ps[0], ps[1])
+	}
+	if a, ok := d.Addresses("tcp@h1:8972"); !ok || a.IP != "10.0.0.1" {
+		t.Fatalf("unexpected addresses %v", a)
+	}
+}
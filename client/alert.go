@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/smallnest/rpcx/log"
+)
+
+// AlertKind is the kind of a membership anomaly.
+type AlertKind string
+
+const (
+	// AlertNoServers means the service dropped to zero servers.
+	AlertNoServers AlertKind = "no_servers"
+	// AlertMassRemoval means more than half of the servers were removed in one update.
+	AlertMassRemoval AlertKind = "mass_removal"
+	// AlertWatchDisconnected means the watch of consul has been disconnected for a long time.
+	AlertWatchDisconnected AlertKind = "watch_disconnected"
+)
+
+// Alert is a membership anomaly of a discovery.
+type Alert struct {
+	Kind     AlertKind `json:"kind"`
+	BasePath string    `json:"base_path"`
+	Message  string    `json:"text"`
+	Time     time.Time `json:"time"`
+}
+
+// AlertSink receives the anomalies of discoveries.
+type AlertSink interface {
+	Alert(a Alert) error
+}
+
+// WithAlertSink sends the anomalies to the sink.
+// The watch is reported as disconnected once it has failed for disconnectedAfter, 0 disables this alert.
+func WithAlertSink(sink AlertSink, disconnectedAfter time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.alertSink = sink
+		d.disconnectedAfter = disconnectedAfter
+	}
+}
+
+// alertQueueSize is the number of alerts queued for the sink, alerts are dropped if it is full.
+const alertQueueSize = 16
+
+// webhookClient posts the alerts of the WebhookSinks without a client.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookSink posts the alerts as JSON to a webhook.
+// The message is sent in the "text" field, so it works with slack incoming webhooks too.
+type WebhookSink struct {
+	URL string
+	// a client with a timeout of 10s is used if it is nil
+	Client *http.Client
+}
+
+// Alert posts the alert to the webhook.
+func (s *WebhookSink) Alert(a Alert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	c := s.Client
+	if c == nil {
+		c = webhookClient
+	}
+	resp, err := c.Post(s.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returns %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// alert queues the alert for the sender goroutine, which is started by the first alert,
+// so that a slow sink neither blocks the watch nor piles up goroutines.
+func (d *ConsulDiscovery) alert(kind AlertKind, format string, args ...interface{}) {
+	a := Alert{
+		Kind:     kind,
+		BasePath: d.basePath,
+		Message:  fmt.Sprintf(format, args...),
+		Time:     time.Now(),
+	}
+	d.alertOnce.Do(func() {
+		d.alerts = make(chan Alert, alertQueueSize)
+		if err := d.spawn("alert sender", d.sendAlerts); err != nil {
+			log.Warnf("cannot send alerts of %s: %v", d.basePath, err)
+		}
+	})
+	select {
+	case d.alerts <- a:
+	default:
+		log.Warnf("alert queue of %s is full and alert %s has been dropped: %s", d.basePath, a.Kind, a.Message)
+	}
+}
+
+// sendAlerts sends the queued alerts to the sink one by one until the discovery is closed.
+func (d *ConsulDiscovery) sendAlerts() {
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case a := <-d.alerts:
+			if err := d.alertSink.Alert(a); err != nil {
+				log.Warnf("cannot send alert %s of %s: %v", a.Kind, a.BasePath, err)
+			}
+		}
+	}
+}
+
+// checkChange alerts if the change from old servers is an anomaly.
+func (d *ConsulDiscovery) checkChange(old int, c Change, now int) {
+	switch {
+	case old > 0 && now == 0:
+		d.alert(AlertNoServers, "all %d servers of %s are removed", old, d.basePath)
+	case len(c.Left)*2 > old:
+		d.alert(AlertMassRemoval, "%d of %d servers of %s are removed in one update", len(c.Left), old, d.basePath)
+	}
+}
+
+// watchFailed records the failure of the watch, reports err and alerts if it has failed for too long.
+func (d *ConsulDiscovery) watchFailed(err error) {
+	atomic.StoreInt32(&d.disconnected, 1)
+	d.reportError(err)
+	if d.hook != nil {
+		d.hook.WatchError(d.basePath, err)
+	}
+
+	d.watchStateMu.Lock()
+	defer d.watchStateMu.Unlock()
+
+	if d.disconnectedAt.IsZero() {
+		d.disconnectedAt = time.Now()
+		return
+	}
+	if d.alertSink == nil || d.disconnectedAfter <= 0 {
+		return
+	}
+	if !d.disconnectAlerted && time.Since(d.disconnectedAt) > d.disconnectedAfter {
+		d.disconnectAlerted = true
+		d.alert(AlertWatchDisconnected, "watch of %s has been disconnected since %s", d.basePath, d.disconnectedAt.Format(time.RFC3339))
+	}
+}
+
+// Connected reports whether the watch of consul works, it is false after the watch fails until it receives the servers again.
+func (d *ConsulDiscovery) Connected() bool {
+	return atomic.LoadInt32(&d.disconnected) == 0
+}
+
+// watchRecovered records that the watch works again.
+func (d *ConsulDiscovery) watchRecovered() {
+	if atomic.SwapInt32(&d.disconnected, 0) == 0 {
+		return
+	}
+
+	d.watchStateMu.Lock()
+	disconnectedAt := d.disconnectedAt
+	d.disconnectedAt = time.Time{}
+	d.disconnectAlerted = false
+	d.watchStateMu.Unlock()
+
+	if d.hook != nil {
+		var disconnected time.Duration
+		if !disconnectedAt.IsZero() {
+			disconnected = time.Since(disconnectedAt)
+		}
+		d.hook.WatchReconnected(d.basePath, disconnected)
+	}
+}
+
+// WithEventHook calls the hook on the watch errors and reconnects, the updates of the servers and the dropped notifications,
+// e.g. hook.NewMetricsHook(nil) to record them as metrics.
+func WithEventHook(h hook.EventHook) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.hook = h
+	}
+}
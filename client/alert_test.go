@@ -0,0 +1,75 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+)
+
+type memSink struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (s *memSink) Alert(a Alert) error {
+	s.mu.Lock()
+	s.alerts = append(s.alerts, a)
+	s.mu.Unlock()
+	return nil
+}
+
+func TestAlerts(t *testing.T) {
+	sink := &memSink{}
+	d := &ConsulDiscovery{basePath: "x", cache: &pairSlot{}}
+	WithAlertSink(sink, 0)(d)
+	d.setPairs([]*client.KVPair{{Key: "a"}, {Key: "b"}, {Key: "c"}})
+	d.setPairs([]*client.KVPair{{Key: "a"}})
+	d.setPairs(nil)
+	if !waitFor(func() bool { sink.mu.Lock(); defer sink.mu.Unlock(); return len(sink.alerts) == 2 }) {
+		t.Fatalf("unexpected alerts %v", sink.alerts)
+	}
+}
+
+// blockingSink blocks every alert until release is closed.
+type blockingSink struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (s *blockingSink) Alert(a Alert) error {
+	atomic.AddInt32(&s.calls, 1)
+	<-s.release
+	return nil
+}
+
+func TestAlertQueue(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	d := &ConsulDiscovery{basePath: "x", cache: &pairSlot{}, stopCh: make(chan struct{})}
+	WithAlertSink(sink, 0)(d)
+	before := budget.Count()
+	d.setPairs([]*client.KVPair{{Key: "a"}})
+	d.setPairs(nil)
+	if !waitFor(func() bool { return atomic.LoadInt32(&sink.calls) == 1 }) {
+		t.Fatal("alert is not sent")
+	}
+	for i := 0; i < 100; i++ {
+		d.setPairs([]*client.KVPair{{Key: "a"}})
+		d.setPairs(nil)
+	}
+	if n := budget.Count() - before; n != 1 {
+		t.Fatalf("expect one sender goroutine but got %d", n)
+	}
+	if len(d.alerts) != alertQueueSize {
+		t.Fatalf("expect a full queue but got %d alerts", len(d.alerts))
+	}
+
+	close(sink.release)
+	if !waitFor(func() bool { return atomic.LoadInt32(&sink.calls) == alertQueueSize+1 }) {
+		t.Fatalf("unexpected calls %d", atomic.LoadInt32(&sink.calls))
+	}
+	d.stop()
+	d.wg.Wait()
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// metaNetwork is the service meta field of the network published by serverplugin.ConsulServiceRegisterPlugin.
+const metaNetwork = "rpcx_network"
+
+// ConsulCatalogDiscovery is a consul service discovery based on the health endpoint instead of KV,
+// for services registered as consul services, e.g. by serverplugin.ConsulServiceRegisterPlugin.
+// It only returns the instances whose checks are passing. The service meta and the tags
+// (as tags=a,b) are encoded in the value of the servers, so that the selectors keep working.
+type ConsulCatalogDiscovery struct {
+	consul  *api.Client
+	service string
+
+	pairsMu sync.RWMutex
+	pairs   []*client.KVPair
+	chans   []chan []*client.KVPair
+	mu      sync.Mutex
+
+	filter client.ServiceDiscoveryFilter
+	// resolve the addresses through consul Connect
+	connect bool
+	opts    []CatalogDiscoveryOpt
+
+	// the store created by NewConsulCatalogDiscovery, closed with the discovery
+	store *consulkv.Store
+	// canceled by Close to stop the blocking queries
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+type CatalogDiscoveryOpt func(*ConsulCatalogDiscovery)
+
+// WithConnect resolves the addresses of the service through consul Connect, they are the addresses of
+// the sidecar proxies or of the Connect native instances. Dial them with the tls.Config of consulkv.ConnectTLS.
+func WithConnect() CatalogDiscoveryOpt {
+	return func(d *ConsulCatalogDiscovery) {
+		d.connect = true
+	}
+}
+
+// NewConsulCatalogDiscovery returns a ConsulCatalogDiscovery of the consul service named servicePath.
+// cfg is optional.
+func NewConsulCatalogDiscovery(servicePath string, consulAddr []string, cfg *consulkv.Config, opts ...CatalogDiscoveryOpt) (*ConsulCatalogDiscovery, error) {
+	s, err := consulkv.New(consulAddr, nil, cfg)
+	if err != nil {
+		log.Infof("cannot create consul client: %v", err)
+		return nil, err
+	}
+	d, err := NewConsulCatalogDiscoveryClient(servicePath, s.Client(), opts...)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	d.store = s
+	return d, nil
+}
+
+// NewConsulCatalogDiscoveryClient returns a ConsulCatalogDiscovery with specified consul client.
+func NewConsulCatalogDiscoveryClient(servicePath string, consul *api.Client, opts ...CatalogDiscoveryOpt) (*ConsulCatalogDiscovery, error) {
+	d := &ConsulCatalogDiscovery{consul: consul, service: servicePath, opts: opts, stopCh: make(chan struct{})}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	entries, qm, err := d.passing((&api.QueryOptions{}).WithContext(d.ctx))
+	if err != nil {
+		d.cancel()
+		log.Infof("cannot get services of %s from consul catalog: %v", servicePath, err)
+		return nil, err
+	}
+	d.setPairs(entries)
+
+	if err := budget.Go("catalog watch", func() { d.watch(qm.LastIndex) }); err != nil {
+		d.cancel()
+		return nil, err
+	}
+	return d, nil
+}
+
+// watch watches the passing instances with blocking queries.
+func (d *ConsulCatalogDiscovery) watch(index uint64) {
+	var tempDelay time.Duration
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		default:
+		}
+
+		opts := (&api.QueryOptions{WaitIndex: index, WaitTime: consulkv.DefaultWatchWaitTime}).WithContext(d.ctx)
+		entries, qm, err := d.passing(opts)
+		if err != nil {
+			if d.ctx.Err() != nil {
+				// canceled by Close
+				return
+			}
+			if tempDelay == 0 {
+				tempDelay = 1 * time.Second
+			} else {
+				tempDelay *= 2
+			}
+			if max := 30 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			log.Warnf("cannot watch service %s in consul catalog (sleep %v): %v", d.service, tempDelay, err)
+			select {
+			case <-d.stopCh:
+				return
+			case <-time.After(tempDelay):
+			}
+			continue
+		}
+		tempDelay = 0
+
+		// the index didn't change, so the query returned because of the WaitTime
+		if qm.LastIndex == index {
+			continue
+		}
+		// the index went backwards, e.g. consul servers were restored, so query from the beginning
+		if qm.LastIndex < index {
+			index = 0
+			continue
+		}
+		index = qm.LastIndex
+		d.setPairs(entries)
+	}
+}
+
+// passing queries the passing instances, or the passing Connect endpoints if Connect is used.
+func (d *ConsulCatalogDiscovery) passing(opts *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	if d.connect {
+		return d.consul.Health().Connect(d.service, "", true, opts)
+	}
+	return d.consul.Health().Service(d.service, "", true, opts)
+}
+
+// entryPair converts a service instance to a server.
+func entryPair(e *api.ServiceEntry) *client.KVPair {
+	addr := e.Service.Address
+	if addr == "" {
+		addr = e.Node.Address
+	}
+	network := e.Service.Meta[metaNetwork]
+	if network == "" {
+		network = "tcp"
+	}
+
+	v := make(url.Values, len(e.Service.Meta)+1)
+	for key, value := range e.Service.Meta {
+		if key != metaNetwork {
+			v.Set(key, value)
+		}
+	}
+	meta.SetTags(v, e.Service.Tags)
+	// the weights of consul are 1 by default, which is also the default weight of rpcx
+	if w := e.Service.Weights.Passing; w > 1 && v.Get(meta.Weight) == "" {
+		v.Set(meta.Weight, strconv.Itoa(w))
+	}
+
+	return &client.KVPair{
+		Key:   network + "@" + net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+		Value: v.Encode(),
+	}
+}
+
+func (d *ConsulCatalogDiscovery) setPairs(entries []*api.ServiceEntry) {
+	pairs := make([]*client.KVPair, 0, len(entries))
+	for _, e := range entries {
+		pair := entryPair(e)
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	d.pairsMu.Lock()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		select {
+		case ch <- pairs:
+		default:
+			log.Warn("chan is full and new change has been dropped")
+		}
+	}
+	d.mu.Unlock()
+}
+
+// Clone clones this ServiceDiscovery with new servicePath, which is the name of another consul service.
+// The clone shares the consul client of this discovery.
+func (d *ConsulCatalogDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	return NewConsulCatalogDiscoveryClient(servicePath, d.consul, d.opts...)
+}
+
+// SetFilter sets the filer.
+func (d *ConsulCatalogDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {
+	d.filter = filter
+}
+
+// GetServices returns the servers
+func (d *ConsulCatalogDiscovery) GetServices() []*client.KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive the changes of servers.
+func (d *ConsulCatalogDiscovery) WatchService() chan []*client.KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*client.KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *ConsulCatalogDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*client.KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// Close stops watching the service, and closes the store created by NewConsulCatalogDiscovery.
+func (d *ConsulCatalogDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stopCh)
+		d.cancel()
+		if d.store != nil {
+			d.store.Close()
+		}
+	})
+}
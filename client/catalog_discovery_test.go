@@ -0,0 +1,117 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestCatalogDiscovery(t *testing.T) {
+	var mu sync.Mutex
+	index := 1
+	entries := []*api.ServiceEntry{{Node: &api.Node{Address: "10.0.0.9"}, Service: &api.AgentService{Port: 8972, Meta: map[string]string{"group": "a", "rpcx_network": "quic"}, Tags: []string{"x", "y"}}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/Arith" || r.URL.Query().Get("passing") != "1" {
+			t.Errorf("bad request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer srv.Close()
+	d, err := NewConsulCatalogDiscovery("Arith", []string{strings.TrimPrefix(srv.URL, "http://")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ps := d.GetServices()
+	if len(ps) != 1 || ps[0].Key != "quic@10.0.0.9:8972" || ps[0].Value != "group=a&tags=x%2Cy" {
+		t.Fatalf("unexpected service %v", ps[0])
+	}
+	ch := d.WatchService()
+	mu.Lock()
+	index = 2
+	entries = nil
+	mu.Unlock()
+	if ps := <-ch; len(ps) != 0 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
+
+func TestCatalogConnect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/connect/Arith" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode([]*api.ServiceEntry{{Node: &api.Node{Address: "10.0.0.9"}, Service: &api.AgentService{Port: 21000}}})
+	}))
+	defer srv.Close()
+	d, err := NewConsulCatalogDiscovery("Arith", []string{strings.TrimPrefix(srv.URL, "http://")}, nil, WithConnect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@10.0.0.9:21000" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	c, err := d.Clone("Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestCatalogDiscoveryClose(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			// block like consul until the client gives up
+			<-r.Context().Done()
+			canceled <- struct{}{}
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode([]*api.ServiceEntry{})
+	}))
+	defer srv.Close()
+
+	d, err := NewConsulCatalogDiscovery("Arith", []string{strings.TrimPrefix(srv.URL, "http://")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	d.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("blocking query is not canceled by Close")
+	}
+}
+
+func TestEntryWeight(t *testing.T) {
+	e := &api.ServiceEntry{Node: &api.Node{Address: "10.0.0.1"}, Service: &api.AgentService{Port: 1, Weights: api.AgentWeights{Passing: 4, Warning: 1}}}
+	if p := entryPair(e); p.Value != "weight=4" {
+		t.Fatalf("unexpected value %q", p.Value)
+	}
+	e.Service.Weights.Passing = 1
+	if p := entryPair(e); p.Value != "" {
+		t.Fatalf("unexpected value %q", p.Value)
+	}
+	e.Service.Weights.Passing = 4
+	e.Service.Meta = map[string]string{"weight": "7"}
+	if p := entryPair(e); p.Value != "weight=7" {
+		t.Fatalf("unexpected value %q", p.Value)
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sort"
+	"time"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+// Change is a membership change of the servers of a discovery.
+type Change struct {
+	Time time.Time
+	// keys of the servers which are added, removed, or whose value is modified
+	Joined  []string
+	Left    []string
+	Updated []string
+}
+
+// IsEmpty reports whether nothing is changed.
+func (c Change) IsEmpty() bool {
+	return len(c.Joined) == 0 && len(c.Left) == 0 && len(c.Updated) == 0
+}
+
+// WithChangeLogging logs the joined, left and updated servers at Info level on every change.
+func WithChangeLogging(enabled bool) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.logChanges = enabled
+	}
+}
+
+// diffPairs returns the change from old servers to new servers.
+func diffPairs(old, new []*client.KVPair) Change {
+	c := Change{Time: time.Now()}
+
+	values := make(map[string]string, len(old))
+	for _, p := range old {
+		values[p.Key] = p.Value
+	}
+	for _, p := range new {
+		v, ok := values[p.Key]
+		if !ok {
+			c.Joined = append(c.Joined, p.Key)
+			continue
+		}
+		if v != p.Value {
+			c.Updated = append(c.Updated, p.Key)
+		}
+		delete(values, p.Key)
+	}
+	for k := range values {
+		c.Left = append(c.Left, k)
+	}
+
+	sort.Strings(c.Joined)
+	sort.Strings(c.Left)
+	sort.Strings(c.Updated)
+	return c
+}
@@ -0,0 +1,15 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestDiffPairs(t *testing.T) {
+	c := diffPairs([]*client.KVPair{{Key: "a"}, {Key: "b", Value: "1"}}, []*client.KVPair{{Key: "b", Value: "2"}, {Key: "c"}})
+	if !reflect.DeepEqual(c.Joined, []string{"c"}) || !reflect.DeepEqual(c.Left, []string{"a"}) || !reflect.DeepEqual(c.Updated, []string{"b"}) {
+		t.Fatalf("unexpected %v", c)
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+)
+
+// defaultCloneConcurrency is how many services CloneAll loads at the same time by default.
+const defaultCloneConcurrency = 16
+
+// CloneErrors is the errors of CloneAll by service path.
+type CloneErrors map[string]error
+
+func (e CloneErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for path := range e {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	msgs := make([]string, 0, len(paths))
+	for _, path := range paths {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", path, e[path]))
+	}
+	return fmt.Sprintf("cannot clone %d services: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// CloneAll clones this ServiceDiscovery for all servicePaths, with at most concurrency initial listings
+// running at the same time (16 if it is not positive), which cuts the cold start of gateways with many upstreams.
+// It returns the discoveries which are cloned successfully, and CloneErrors if any of them fails.
+// A service path which is repeated is cloned once. The lifetime of the clones is bounded by ctx like WithContext.
+func (d *ConsulDiscovery) CloneAll(ctx context.Context, servicePaths []string, concurrency int) (map[string]*ConsulDiscovery, error) {
+	servicePaths = distinctPaths(servicePaths)
+	if concurrency <= 0 {
+		concurrency = defaultCloneConcurrency
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		clones = make(map[string]*ConsulDiscovery, len(servicePaths))
+		errs   = make(CloneErrors)
+		sem    = make(chan struct{}, concurrency)
+	)
+	for _, servicePath := range servicePaths {
+		servicePath := servicePath
+		wg.Add(1)
+		sem <- struct{}{}
+		err := budget.Go("clone", func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			opts, shadow, err := d.cloneOpts(servicePath)
+			var c *ConsulDiscovery
+			if err == nil {
+				c, err = NewConsulDiscoveryStoreContext(ctx, d.basePath+"/"+servicePath, d.kv, opts...)
+				if err != nil && shadow != nil {
+					shadow.Close()
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[servicePath] = err
+				return
+			}
+			clones[servicePath] = c
+		})
+		if err != nil {
+			<-sem
+			wg.Done()
+			mu.Lock()
+			errs[servicePath] = err
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return clones, errs
+	}
+	return clones, nil
+}
+
+// distinctPaths returns the service paths without the repeated ones, in their order.
+func distinctPaths(servicePaths []string) []string {
+	seen := make(map[string]bool, len(servicePaths))
+	paths := make([]string, 0, len(servicePaths))
+	for _, path := range servicePaths {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestCloneAll(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/B/b"})
+	d, _ := NewConsulDiscoveryStore("rpcx", kv)
+	cs, err := d.CloneAll(context.Background(), []string{"A", "B", "C"}, 2)
+	if err != nil || len(cs) != 3 || len(cs["A"].GetServices()) != 1 {
+		t.Fatalf("unexpected clones %v, error %v", cs, err)
+	}
+	kv.listErr = store.ErrCallNotSupported
+	cs, err = d.CloneAll(context.Background(), []string{"A", "B"}, 0)
+	if errs, ok := err.(CloneErrors); !ok || len(errs) != 2 || len(cs) != 0 {
+		t.Fatal(err)
+	}
+	t.Log(err)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+const (
+	// maxClones is the default number of service paths cloned for requests of remote callers.
+	maxClones = 256
+	// cloneIdleTimeout is how long a clone nobody uses is kept for the next request.
+	cloneIdleTimeout = 5 * time.Minute
+)
+
+// ErrTooManyClones is returned if a service path can't be cloned because all clones are in use.
+var ErrTooManyClones = errors.New("too many service paths are in use")
+
+// clones caches the discoveries cloned from a template discovery by service path.
+// The service paths come from remote callers, so the clones are bounded: the clones
+// nobody uses are closed once they are idle for idle, or to make room for another path
+// if there are max of them.
+type clones struct {
+	d    client.ServiceDiscovery
+	max  int
+	idle time.Duration
+
+	mu sync.Mutex
+	m  map[string]*clone
+}
+
+type clone struct {
+	d    client.ServiceDiscovery
+	refs int
+	used time.Time
+}
+
+func newClones(d client.ServiceDiscovery) *clones {
+	return &clones{d: d, max: maxClones, idle: cloneIdleTimeout, m: make(map[string]*clone)}
+}
+
+// get returns the discovery of servicePath, empty servicePath means the template itself.
+// The caller must call release when it doesn't use the discovery any more.
+func (c *clones) get(servicePath string) (d client.ServiceDiscovery, release func(), err error) {
+	if servicePath == "" {
+		return c.d, func() {}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictIdle(time.Now())
+	cl, ok := c.m[servicePath]
+	if !ok {
+		if len(c.m) >= c.max && !c.evictOldest() {
+			return nil, nil, ErrTooManyClones
+		}
+		d, err := c.d.Clone(servicePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		cl = &clone{d: d}
+		c.m[servicePath] = cl
+	}
+	cl.refs++
+
+	var once sync.Once
+	return cl.d, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			cl.refs--
+			cl.used = time.Now()
+			c.mu.Unlock()
+		})
+	}, nil
+}
+
+// evictIdle closes the clones nobody used since idle before now.
+func (c *clones) evictIdle(now time.Time) {
+	for servicePath, cl := range c.m {
+		if cl.refs == 0 && now.Sub(cl.used) >= c.idle {
+			cl.d.Close()
+			delete(c.m, servicePath)
+		}
+	}
+}
+
+// evictOldest closes the clone nobody used for the longest time, it returns false if all clones are in use.
+func (c *clones) evictOldest() bool {
+	var oldest string
+	for servicePath, cl := range c.m {
+		if cl.refs == 0 && (oldest == "" || cl.used.Before(c.m[oldest].used)) {
+			oldest = servicePath
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	c.m[oldest].d.Close()
+	delete(c.m, oldest)
+	return true
+}
+
+// close closes all cloned discoveries.
+func (c *clones) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cl := range c.m {
+		cl.d.Close()
+	}
+	c.m = make(map[string]*clone)
+}
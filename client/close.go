@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+)
+
+// defaultCloseTimeout is how long Close waits for the background goroutines by default.
+const defaultCloseTimeout = 5 * time.Second
+
+// WithContext bounds the lifetime of the discovery by ctx, e.g. the lifetime of the application or a hot-reloaded module:
+// the initial listing is canceled and the discovery is closed once ctx is done. The clones inherit it.
+// The ctx of the constructors such as NewConsulDiscoveryContext is the same, and it replaces the ctx of WithContext.
+func WithContext(ctx context.Context) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.ctx = ctx
+	}
+}
+
+// WithCloseTimeout sets how long Close waits for the background goroutines to exit, 5s by default.
+func WithCloseTimeout(timeout time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.closeTimeout = timeout
+	}
+}
+
+// Shutdown stops watching the servers and waits until the watch goroutines exit and the store is closed
+// (a clone leaves the shared store open), or returns an error when ctx is done first. It can be called more than once.
+func (d *ConsulDiscovery) Shutdown(ctx context.Context) error {
+	d.stop()
+
+	done := make(chan struct{})
+	err := budget.Go("shutdown", func() {
+		d.wg.Wait()
+		close(done)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("goroutines of discovery %s didn't exit: %w", d.basePath, ctx.Err())
+	}
+}
+
+// stop signals the background goroutines to exit without waiting for them.
+func (d *ConsulDiscovery) stop() {
+	d.closeOnce.Do(func() {
+		close(d.stopCh)
+	})
+}
+
+// closeWhenDone stops the discovery when ctx is done.
+func (d *ConsulDiscovery) closeWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		d.stop()
+	case <-d.stopCh:
+	}
+}
+
+// spawn runs f in a background goroutine of the kind which Close waits for,
+// it returns a budget.ExceededError if the goroutine budget is used up.
+func (d *ConsulDiscovery) spawn(kind string, f func()) error {
+	d.wg.Add(1)
+	err := budget.Go(kind, func() {
+		defer d.wg.Done()
+		f()
+	})
+	if err != nil {
+		d.wg.Done()
+	}
+	return err
+}
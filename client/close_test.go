@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+type errWatchStore struct{ *fakeStore }
+
+func (s errWatchStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return nil, errors.New("down")
+}
+
+func TestShutdown(t *testing.T) {
+	kv := errWatchStore{newFakeStore(&store.KVPair{Key: "rpcx/A/a"})}
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // in backoff sleep
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("slow")
+	}
+	d.Close() // again
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	d2, _ := NewConsulDiscoveryStore("rpcx/A", newFakeStore(), WithContext(ctx2))
+	cancel2()
+	if !waitFor(func() bool {
+		select {
+		case <-d2.stopCh:
+			return true
+		default:
+			return false
+		}
+	}) {
+		t.Fatal("not stopped")
+	}
+	if err := d2.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseSharedStore(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/B/b"})
+	d, err := NewConsulDiscoveryStore("rpcx", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.Clone("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	clones, err := d.CloneAll(context.Background(), []string{"A", "B"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clones {
+		c.Close()
+	}
+	_, stop, err := d.WatchServices(context.Background(), []string{"A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if kv.isClosed() {
+		t.Fatal("store is closed by the clones")
+	}
+
+	d.Close()
+	if !kv.isClosed() {
+		t.Fatal("store is not closed with the discovery")
+	}
+}
+
+func TestContextLifetime(t *testing.T) {
+	stopped := func(d *ConsulDiscovery) bool {
+		return waitFor(func() bool {
+			select {
+			case <-d.stopCh:
+				return true
+			default:
+				return false
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, err := NewConsulDiscoveryStoreContext(ctx, "rpcx", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Clone("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if !stopped(d) || !stopped(c.(*ConsulDiscovery)) {
+		t.Fatal("expect the template and its clone to be closed with the ctx of the constructor")
+	}
+}
@@ -1,13 +1,21 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rpcxio/libkv"
 	"github.com/rpcxio/libkv/store"
 	"github.com/rpcxio/libkv/store/consul"
+	"github.com/rpcxio/rpcx-consul/admin"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
 	"github.com/smallnest/rpcx/client"
 	"github.com/smallnest/rpcx/log"
 )
@@ -19,33 +27,221 @@ func init() {
 // ConsulDiscovery is a consul service discovery.
 // It always returns the registered servers in consul.
 type ConsulDiscovery struct {
+	// number of malformed values, accessed atomically and kept first for alignment
+	malformed uint64
+	// number of servers rejected by the address validator, accessed atomically
+	rejected uint64
+	// number of panics and timeouts of the filter, accessed atomically
+	filterPanics   uint64
+	filterTimeouts uint64
+	// 1 if the servers are pinned by the freeze flag, accessed atomically
+	frozen int32
+	// 1 if the watch failed and hasn't received the servers since, accessed atomically
+	disconnected int32
+	// 1 if the servers are served from the snapshot, accessed atomically
+	fromSnapshot int32
+
 	basePath string
 	kv       store.Store
+	// the store is closed with the discovery unless it is shared with the discovery it is cloned from
+	ownStore bool
 	pairsMu  sync.RWMutex
-	pairs    []*client.KVPair
-	chans    []chan []*client.KVPair
-	mu       sync.Mutex
+	// the servers, guarded by pairsMu
+	cache PairCache
+	// when the servers were updated last time
+	updatedAt time.Time
+	watchers  []*watcher
+	mu        sync.Mutex
+	// number of watchers ever created, to name the unnamed ones
+	watcherSeq int
 	// -1 means it always retry to watch until zookeeper is ok, 0 means no retry.
 	RetriesAfterWatchFailed int
 
-	filter client.ServiceDiscoveryFilter
-
+	filter        client.ServiceDiscoveryFilter
+	filterTimeout time.Duration
+	// slots of the filter goroutines, which are held until the filter returns even after it timed out
+	filterSlots chan struct{}
+	// options to create clones
+	opts []ConsulDiscoveryOpt
+
+	// serializes the updates of the watches and the refreshes
+	updateMu sync.Mutex
+	// the servers of every shard and of the catch-all shard last, guarded by updateMu
+	shardPairs [][]*client.KVPair
+
+	// key prefixes (relative to basePath) watched by separate goroutines
+	shardPrefixes []string
+	keyDepth      int
+	keyPatterns   []string
+	initTimeout   time.Duration
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+	watchBuffer   int
+	accessHook    AccessHook
+	logChanges    bool
+	history       *changeHistory
+	verifySource  VerifySource
+	// the removals held until the verify source confirms them, see holdRemovals
+	verifyMu   sync.Mutex
+	verifying  bool
+	held       map[string]bool
+	confirmed  map[string]bool
+	unverified []*client.KVPair
+
+	malformedPolicy  MalformedPolicy
+	malformedHandler MalformedHandler
+	statePolicy      StatePolicy
+	drainingGrace    time.Duration
+	tagFilterMu      sync.RWMutex
+	tagFilter        client.ServiceDiscoveryFilter
+	pollAfter        int
+	pollInterval     time.Duration
+	drainingMu       sync.Mutex
+	draining         map[string]*drainingServer
+	honorFreeze      bool
+	dialAddress      DialAddress
+	addressValidator AddressValidator
+	locality         *Locality
+	cacheDir         string
+	redactor         *meta.Redactor
+	hook             hook.EventHook
+	tombstonesMu     sync.Mutex
+	tombstones       map[string]tombstone
+
+	// list the servers in segments of at most segmentSize keys on startup
+	segmentSize  int
+	listProgress func(ListProgress)
+
+	// honorExpel removes the instances expelled by admin.Expel
+	honorExpel bool
+	expelledMu sync.RWMutex
+	expelled   map[string]admin.Expulsion
+	// the registered keys of the servers rewritten to their dial addresses, guarded by expelledMu
+	registeredKeys map[string]string
+
+	// honorGroupWeights weights the servers by the group weights set by admin.SetGroupWeights
+	honorGroupWeights bool
+	groupWeightsMu    sync.RWMutex
+	groupWeights      map[string]int
+
+	// shadow is compared with the servers to verify a migration
+	shadow        client.ServiceDiscovery
+	shadowGrace   time.Duration
+	ownShadow     bool
+	shadowMu      sync.Mutex
+	divergedSince time.Time
+	divergence    Divergence
+
+	strictErrors bool
+	crashOnPanic bool
+	errCh        chan error
+
+	alertSink         AlertSink
+	alertOnce         sync.Once
+	alerts            chan Alert
+	disconnectedAfter time.Duration
+	watchStateMu      sync.Mutex
+	disconnectedAt    time.Time
+	disconnectAlerted bool
+
+	refreshMu sync.Mutex
+	// closed when the running refresh finishes
+	refreshing chan struct{}
+	refreshErr error
+
+	ctx          context.Context
+	closeTimeout time.Duration
+	closeOnce    sync.Once
+	// background goroutines which Close waits for
+	wg     sync.WaitGroup
 	stopCh chan struct{}
 }
 
+// ConsulDiscoveryOpt configures a ConsulDiscovery.
+type ConsulDiscoveryOpt func(*ConsulDiscovery)
+
+// WithWatchShards partitions the watched tree into shards, one per key prefix.
+// Each prefix is relative to the base path and is watched by its own goroutine,
+// and the results of all shards are merged into one pair list.
+// The keys matching none of the prefixes are kept by a catch-all shard, which watches the whole tree,
+// so the prefixes should cover the keys to spare the catch-all shard most changes.
+func WithWatchShards(prefixes ...string) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.shardPrefixes = prefixes
+	}
+}
+
 // NewConsulDiscovery returns a new ConsulDiscovery.
-func NewConsulDiscovery(basePath, servicePath string, consulAddr []string, options *store.Config) (*ConsulDiscovery, error) {
+func NewConsulDiscovery(basePath, servicePath string, consulAddr []string, options *store.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
 	kv, err := libkv.NewStore(store.CONSUL, consulAddr, options)
 	if err != nil {
 		log.Infof("cannot create store: %v", err)
 		return nil, err
 	}
 
-	return NewConsulDiscoveryStore(basePath+"/"+servicePath, kv)
+	return NewConsulDiscoveryStore(basePath+"/"+servicePath, kv, opts...)
+}
+
+// NewConsulDiscoveryWithConfig returns a new ConsulDiscovery with the consul settings which store.Config can't express,
+// such as the ACL token, mTLS client certificates and the datacenter. options and cfg are optional.
+// The servers are watched with blocking queries, which can be served by any consul server if cfg.AllowStale is set.
+func NewConsulDiscoveryWithConfig(basePath, servicePath string, consulAddr []string, options *store.Config, cfg *consulkv.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	kv, err := consulkv.New(consulAddr, options, cfg)
+	if err != nil {
+		log.Infof("cannot create store: %v", err)
+		return nil, err
+	}
+
+	d, err := NewConsulDiscoveryStore(basePath+"/"+servicePath, kv, opts...)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewConsulDiscoveryWithConfigContext returns a new ConsulDiscovery with the consul settings which store.Config can't express,
+// whose lifetime is bounded by ctx like WithContext.
+func NewConsulDiscoveryWithConfigContext(ctx context.Context, basePath, servicePath string, consulAddr []string, options *store.Config, cfg *consulkv.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	kv, err := consulkv.New(consulAddr, options, cfg)
+	if err != nil {
+		log.Infof("cannot create store: %v", err)
+		return nil, err
+	}
+
+	d, err := NewConsulDiscoveryStoreContext(ctx, basePath+"/"+servicePath, kv, opts...)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewConsulDiscoveryContext returns a new ConsulDiscovery whose lifetime is bounded by ctx like WithContext:
+// the initial listing of servers is canceled and the discovery is closed once ctx is done.
+func NewConsulDiscoveryContext(ctx context.Context, basePath, servicePath string, consulAddr []string, options *store.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	kv, err := libkv.NewStore(store.CONSUL, consulAddr, options)
+	if err != nil {
+		log.Infof("cannot create store: %v", err)
+		return nil, err
+	}
+
+	d, err := NewConsulDiscoveryStoreContext(ctx, basePath+"/"+servicePath, kv, opts...)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
 }
 
 // NewConsulDiscoveryStore returns a new ConsulDiscovery with specified store.
-func NewConsulDiscoveryStore(basePath string, kv store.Store) (*ConsulDiscovery, error) {
+func NewConsulDiscoveryStore(basePath string, kv store.Store, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	return NewConsulDiscoveryStoreContext(context.Background(), basePath, kv, opts...)
+}
+
+// NewConsulDiscoveryStoreContext returns a new ConsulDiscovery with specified store,
+// whose lifetime is bounded by ctx like WithContext.
+func NewConsulDiscoveryStoreContext(ctx context.Context, basePath string, kv store.Store, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
 	if basePath[0] == '/' {
 		basePath = basePath[1:]
 	}
@@ -54,38 +250,158 @@ func NewConsulDiscoveryStore(basePath string, kv store.Store) (*ConsulDiscovery,
 		basePath = basePath[:len(basePath)-1]
 	}
 
-	d := &ConsulDiscovery{basePath: basePath, kv: kv}
+	d := &ConsulDiscovery{basePath: basePath, kv: kv, ownStore: true, opts: opts}
 	d.stopCh = make(chan struct{})
+	d.backoffMin, d.backoffMax = time.Second, 30*time.Second
+	d.watchBuffer = 10
+	d.closeTimeout = defaultCloseTimeout
+	for _, opt := range opts {
+		opt(d)
+	}
+	// the options may replace the store by a view of it, e.g. WithProfile
+	kv = d.kv
+	if ctx.Done() != nil {
+		d.ctx = ctx
+		d.opts = append(opts[:len(opts):len(opts)], WithContext(ctx))
+	} else if d.ctx != nil {
+		ctx = d.ctx
+	}
+	if d.strictErrors {
+		d.errCh = make(chan error, errChanSize)
+	}
+	if d.cache == nil {
+		d.cache = &pairSlot{}
+	}
 
-	ps, err := kv.List(basePath)
+	if d.initTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.initTimeout)
+		defer cancel()
+	}
+	if d.honorGroupWeights {
+		weights, err := admin.GroupWeights(kv, basePath)
+		if err != nil {
+			log.Warnf("cannot get group weights of %s: %v", basePath, err)
+		}
+		d.setGroupWeights(weights)
+	}
+	if d.honorExpel {
+		expelled, err := admin.Expelled(kv, basePath)
+		if err != nil {
+			log.Warnf("cannot get expelled instances of %s: %v", basePath, err)
+		}
+		d.setExpelled(expelled)
+	}
+	ps, err := d.list(ctx, kv, basePath+"/")
 	if err != nil && err != store.ErrKeyNotFound {
-		log.Infof("cannot get services of from registry: %v, err: %v", basePath, err)
+		if !d.serveSnapshot(err) {
+			log.Infof("cannot get services of from registry: %v, err: %v", basePath, err)
+			return nil, err
+		}
+	} else {
+		parsed := d.parse(ps)
+		if len(d.shardPrefixes) > 0 {
+			d.splitShards(parsed)
+		}
+		pairs := d.applyGroupWeights(d.preferLocal(d.expel(parsed)))
+		d.pairsMu.Lock()
+		d.cache.Set(d.basePath, pairs)
+		d.updatedAt = time.Now()
+		d.pairsMu.Unlock()
+		if d.cacheDir != "" {
+			d.saveSnapshot(pairs, d.updatedAt)
+		}
+		if d.hook != nil {
+			d.hook.ServicesUpdated(d.basePath, len(pairs))
+		}
+	}
+	d.RetriesAfterWatchFailed = -1
+	if d.honorFreeze {
+		frozen, err := admin.IsFrozen(kv, basePath)
+		if err != nil {
+			log.Warnf("cannot get freeze flag of %s: %v", basePath, err)
+		}
+		d.setFrozen(frozen)
+		if err := d.spawn("freeze watch", d.watchFreeze); err != nil {
+			d.stop()
+			return nil, err
+		}
+	}
+	if d.honorGroupWeights {
+		if err := d.spawn("group weights watch", d.watchGroupWeights); err != nil {
+			d.stop()
+			return nil, err
+		}
+	}
+	if d.honorExpel {
+		if err := d.spawn("expel watch", d.watchExpelled); err != nil {
+			d.stop()
+			return nil, err
+		}
+	}
+	if err := d.spawn("watch", d.watch); err != nil {
+		d.stop()
 		return nil, err
 	}
-
-	pairs := make([]*client.KVPair, 0, len(ps))
-	prefix := d.basePath + "/"
-	for _, p := range ps {
-		if !strings.HasPrefix(p.Key, prefix) { // avoid prefix issue of consul List
-			continue
+	if d.shadow != nil {
+		if err := d.spawn("shadow watch", d.watchShadow); err != nil {
+			d.stop()
+			return nil, err
 		}
-		k := strings.TrimPrefix(p.Key, prefix)
-		pair := &client.KVPair{Key: k, Value: string(p.Value)}
-		if d.filter != nil && !d.filter(pair) {
-			continue
+	}
+	if d.ctx != nil {
+		if err := d.spawn("context watch", func() { d.closeWhenDone(d.ctx) }); err != nil {
+			d.stop()
+			return nil, err
 		}
-		pairs = append(pairs, pair)
 	}
-	d.pairsMu.Lock()
-	d.pairs = pairs
-	d.pairsMu.Unlock()
-	d.RetriesAfterWatchFailed = -1
-	go d.watch()
 	return d, nil
 }
 
+// WithInitTimeout limits how long the constructors wait for the initial listing of servers,
+// so that applications don't hang on startup when consul is unreachable but connecting to it doesn't fail fast.
+func WithInitTimeout(timeout time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.initTimeout = timeout
+	}
+}
+
+// listContext lists the directory until ctx is done.
+// The store can't cancel the listing, so it is left running in the background.
+func listContext(ctx context.Context, kv store.Store, directory string) ([]*store.KVPair, error) {
+	if ctx.Done() == nil {
+		return kv.List(directory)
+	}
+
+	type result struct {
+		ps  []*store.KVPair
+		err error
+	}
+	ch := make(chan result, 1)
+	err := budget.Go("list", func() {
+		ps, err := kv.List(directory)
+		ch <- result{ps, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.ps, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("cannot list %s: %w", directory, ctx.Err())
+	}
+}
+
 // NewConsulDiscoveryTemplate returns a new ConsulDiscovery template.
-func NewConsulDiscoveryTemplate(basePath string, consulAddr []string, options *store.Config) (*ConsulDiscovery, error) {
+func NewConsulDiscoveryTemplate(basePath string, consulAddr []string, options *store.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	return NewConsulDiscoveryTemplateContext(context.Background(), basePath, consulAddr, options, opts...)
+}
+
+// NewConsulDiscoveryTemplateContext returns a new ConsulDiscovery template whose lifetime, and the lifetime of its clones,
+// is bounded by ctx like WithContext.
+func NewConsulDiscoveryTemplateContext(ctx context.Context, basePath string, consulAddr []string, options *store.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
 	if basePath[0] == '/' {
 		basePath = basePath[1:]
 	}
@@ -100,12 +416,79 @@ func NewConsulDiscoveryTemplate(basePath string, consulAddr []string, options *s
 		return nil, err
 	}
 
-	return NewConsulDiscoveryStore(basePath, kv)
+	d, err := NewConsulDiscoveryStoreContext(ctx, basePath, kv, opts...)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewConsulDiscoveryTemplateWithConfig returns a new ConsulDiscovery template with the consul settings
+// which store.Config can't express. options and cfg are optional.
+func NewConsulDiscoveryTemplateWithConfig(basePath string, consulAddr []string, options *store.Config, cfg *consulkv.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	return NewConsulDiscoveryTemplateWithConfigContext(context.Background(), basePath, consulAddr, options, cfg, opts...)
+}
+
+// NewConsulDiscoveryTemplateWithConfigContext returns a new ConsulDiscovery template with the consul settings
+// which store.Config can't express, whose lifetime, and the lifetime of its clones, is bounded by ctx like WithContext.
+func NewConsulDiscoveryTemplateWithConfigContext(ctx context.Context, basePath string, consulAddr []string, options *store.Config, cfg *consulkv.Config, opts ...ConsulDiscoveryOpt) (*ConsulDiscovery, error) {
+	if basePath[0] == '/' {
+		basePath = basePath[1:]
+	}
+
+	if len(basePath) > 1 && strings.HasSuffix(basePath, "/") {
+		basePath = basePath[:len(basePath)-1]
+	}
+
+	kv, err := consulkv.New(consulAddr, options, cfg)
+	if err != nil {
+		log.Infof("cannot create store: %v", err)
+		return nil, err
+	}
+
+	d, err := NewConsulDiscoveryStoreContext(ctx, basePath, kv, opts...)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// withSharedStore doesn't close the store with the discovery, because it is shared with the discovery
+// the discovery is cloned from and its other clones.
+func withSharedStore() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.ownStore = false
+	}
+}
+
+// cloneOpts returns the options of the clone of the service path, and its shadow which must be closed
+// if the clone isn't created.
+func (d *ConsulDiscovery) cloneOpts(servicePath string) ([]ConsulDiscoveryOpt, client.ServiceDiscovery, error) {
+	opts := append(d.opts[:len(d.opts):len(d.opts)], withSharedStore())
+	if d.shadow == nil {
+		return opts, nil, nil
+	}
+	shadow, err := d.shadow.Clone(servicePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot clone the shadow of %s: %w", servicePath, err)
+	}
+	return append(opts, withClonedShadow(shadow, d.shadowGrace)), shadow, nil
 }
 
 // Clone clones this ServiceDiscovery with new servicePath.
+// The clone shares the store of this discovery, which is only closed when this discovery is closed.
 func (d *ConsulDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
-	return NewConsulDiscoveryStore(d.basePath+"/"+servicePath, d.kv)
+	opts, shadow, err := d.cloneOpts(servicePath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConsulDiscoveryStore(d.basePath+"/"+servicePath, d.kv, opts...)
+	if err != nil && shadow != nil {
+		shadow.Close()
+	}
+	return c, err
 }
 
 // SetFilter sets the filer.
@@ -113,77 +496,308 @@ func (d *ConsulDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {
 	d.filter = filter
 }
 
+// refreshWait is how long GetServices waits for the servers evicted from the shared cache to be listed again.
+const refreshWait = 5 * time.Second
+
 // GetServices returns the servers
 func (d *ConsulDiscovery) GetServices() []*client.KVPair {
 	d.pairsMu.RLock()
-	defer d.pairsMu.RUnlock()
-	return d.pairs
+	pairs, ok := d.cache.Get(d.basePath)
+	d.pairsMu.RUnlock()
+	if !ok {
+		// evicted from the shared cache, list them again
+		select {
+		case <-d.refresh():
+		case <-time.After(refreshWait):
+			log.Warnf("servers of %s are not listed again in %v", d.basePath, refreshWait)
+		}
+		d.pairsMu.RLock()
+		pairs = d.loadPairs()
+		d.pairsMu.RUnlock()
+	}
+
+	if d.accessHook != nil {
+		info := AccessInfo{BasePath: d.basePath, Servers: len(pairs), Time: time.Now()}
+		callerInfo(&info, 1)
+		d.accessHook(info)
+	}
+	return pairs
 }
 
-// WatchService returns a nil chan.
-func (d *ConsulDiscovery) WatchService() chan []*client.KVPair {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// GetServicesFresh returns the servers if they were updated within maxAge,
+// otherwise it lists the servers from consul and waits for the result until ctx is done.
+func (d *ConsulDiscovery) GetServicesFresh(ctx context.Context, maxAge time.Duration) ([]*client.KVPair, error) {
+	d.pairsMu.RLock()
+	pairs, updatedAt := d.loadPairs(), d.updatedAt
+	d.pairsMu.RUnlock()
+	if time.Since(updatedAt) <= maxAge {
+		return pairs, nil
+	}
+
+	done := d.refresh()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
 
-	ch := make(chan []*client.KVPair, 10)
-	d.chans = append(d.chans, ch)
-	return ch
+	d.refreshMu.Lock()
+	err := d.refreshErr
+	d.refreshMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return d.GetServices(), nil
 }
 
-func (d *ConsulDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// refresh lists the servers from consul in background unless a refresh is running,
+// and returns a chan closed when the refresh finishes.
+func (d *ConsulDiscovery) refresh() <-chan struct{} {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
 
-	var chans []chan []*client.KVPair
-	for _, c := range d.chans {
-		if c == ch {
-			continue
+	if d.refreshing != nil {
+		return d.refreshing
+	}
+	done := make(chan struct{})
+	d.refreshing = done
+
+	err := budget.Go("refresh", func() {
+		ps, err := d.kv.List(d.basePath + "/")
+		if err == store.ErrKeyNotFound {
+			err = nil
+		}
+		if err != nil {
+			log.Warnf("cannot refresh services of %s: %v", d.basePath, err)
+		} else {
+			d.update(-1, ps)
 		}
 
-		chans = append(chans, c)
+		d.refreshMu.Lock()
+		d.refreshErr = err
+		d.refreshing = nil
+		d.refreshMu.Unlock()
+		close(done)
+	})
+	if err != nil {
+		log.Warnf("cannot refresh services of %s: %v", d.basePath, err)
+		d.refreshErr = err
+		d.refreshing = nil
+		close(done)
 	}
+	return done
+}
 
-	d.chans = chans
+// WatchService returns a nil chan.
+func (d *ConsulDiscovery) WatchService() chan []*client.KVPair {
+	return d.WatchServiceWith()
+}
+
+func (d *ConsulDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
+	d.removeWatchers(func(w *watcher) bool { return w.ch == ch })
 }
 
 func (d *ConsulDiscovery) watch() {
 	defer func() {
-		d.kv.Close()
+		if d.ownStore {
+			d.kv.Close()
+		}
 	}()
+
+	if len(d.shardPrefixes) == 0 {
+		d.watchTree(d.basePath+"/", func(ps []*store.KVPair) {
+			d.update(-1, ps)
+		})
+		return
+	}
+
+	var wg sync.WaitGroup
+	// the last shard is the catch-all shard of the whole tree
+	prefixes := append(d.shardPrefixes[:len(d.shardPrefixes):len(d.shardPrefixes)], "")
+	for i, prefix := range prefixes {
+		i, prefix := i, prefix
+		wg.Add(1)
+		err := budget.Go("shard watch", func() {
+			defer wg.Done()
+			d.watchTree(d.basePath+"/"+prefix, func(ps []*store.KVPair) {
+				d.update(i, ps)
+			})
+		})
+		if err != nil {
+			wg.Done()
+			log.Errorf("cannot watch shard %s of %s: %v", prefix, d.basePath, err)
+			d.reportError(err)
+		}
+	}
+	wg.Wait()
+}
+
+// update applies the servers listed under the shard i of the watches, or under basePath if i is -1.
+// The shard len(shardPrefixes) is the catch-all shard.
+// The listings of the refreshes are always applied: the indexes of the keys can't tell a listing
+// missing deleted servers from an older one, and the next change of the watches overwrites them.
+func (d *ConsulDiscovery) update(i int, ps []*store.KVPair) {
+	d.updateMu.Lock()
+	defer d.updateMu.Unlock()
+
+	pairs := d.parse(ps)
+	if len(d.shardPrefixes) > 0 {
+		switch {
+		case i < 0 || d.shardPairs == nil:
+			d.splitShards(pairs)
+		case i == len(d.shardPrefixes):
+			d.shardPairs[i] = d.uncovered(pairs)
+		default:
+			d.shardPairs[i] = pairs
+		}
+		pairs = mergeShards(d.shardPairs)
+	}
+	d.setPairs(pairs)
+}
+
+// splitShards replaces the servers of every shard with the servers listed under basePath.
+func (d *ConsulDiscovery) splitShards(pairs []*client.KVPair) {
+	d.shardPairs = make([][]*client.KVPair, len(d.shardPrefixes)+1)
+	for i, prefix := range d.shardPrefixes {
+		for _, p := range pairs {
+			if strings.HasPrefix(p.Key, prefix) {
+				d.shardPairs[i] = append(d.shardPairs[i], p)
+			}
+		}
+	}
+	d.shardPairs[len(d.shardPrefixes)] = d.uncovered(pairs)
+}
+
+// uncovered returns the servers of the catch-all shard, whose keys match none of the shard prefixes.
+func (d *ConsulDiscovery) uncovered(pairs []*client.KVPair) []*client.KVPair {
+	var ps []*client.KVPair
+	for _, p := range pairs {
+		if !d.inShards(p.Key) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// mergeShards merges the servers of the shards, a server listed by several overlapping shards is kept once.
+func mergeShards(shards [][]*client.KVPair) []*client.KVPair {
+	var merged []*client.KVPair
+	seen := make(map[string]bool)
+	for _, ps := range shards {
+		for _, p := range ps {
+			if seen[p.Key] {
+				continue
+			}
+			seen[p.Key] = true
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// parse converts the pairs under basePath to the servers.
+func (d *ConsulDiscovery) parse(ps []*store.KVPair) []*client.KVPair {
+	pairs := make([]*client.KVPair, 0, len(ps))
+	draining := make(map[string]bool)
+	prefix := d.basePath + "/"
+	for _, p := range ps {
+		if !strings.HasPrefix(p.Key, prefix) { // avoid prefix issue of consul List
+			continue
+		}
+		k := strings.TrimPrefix(p.Key, prefix)
+		if !d.matchKey(k) {
+			continue
+		}
+		if !d.checkTombstone(k, p) {
+			continue
+		}
+		pair := &client.KVPair{Key: k, Value: string(p.Value)}
+		if !d.checkValue(pair) || !d.checkAddress(pair) {
+			continue
+		}
+		d.rewriteAddress(pair)
+		if !d.checkDraining(pair, draining) || !d.checkState(pair) || !d.matchTags(pair) {
+			continue
+		}
+		if d.filter != nil && !d.applyFilter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	// a shard only lists a part of the servers
+	if d.drainingGrace > 0 && len(d.shardPrefixes) == 0 {
+		d.pruneDraining(draining)
+	}
+	return pairs
+}
+
+// inShards reports whether the key matches the prefix of a watch shard.
+func (d *ConsulDiscovery) inShards(key string) bool {
+	for _, prefix := range d.shardPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchTree watches the directory and calls update with the latest servers on every change.
+func (d *ConsulDiscovery) watchTree(directory string, update func(ps []*store.KVPair)) {
+	var failures int
+	var sum string // checksum of the servers updated by the last poll
 	for {
 		var err error
 		var c <-chan []*store.KVPair
 		var tempDelay time.Duration
 
+		if d.pollAfter > 0 && failures >= d.pollAfter {
+			if !d.pollTree(directory, update, &sum) {
+				return
+			}
+			// one more failure degrades to polling again
+			failures = d.pollAfter - 1
+		}
+
 		retry := d.RetriesAfterWatchFailed
 		for d.RetriesAfterWatchFailed < 0 || retry >= 0 {
-			c, err = d.kv.WatchTree(d.basePath, d.stopCh)
+			c, err = d.kv.WatchTree(directory, d.stopCh)
 			if err != nil {
+				d.watchFailed(fmt.Errorf("cannot watch %s: %w", directory, err))
+				if failures++; d.pollAfter > 0 && failures >= d.pollAfter {
+					break
+				}
 				if d.RetriesAfterWatchFailed > 0 {
 					retry--
 				}
 				if tempDelay == 0 {
-					tempDelay = 1 * time.Second
+					tempDelay = d.backoffMin
 				} else {
 					tempDelay *= 2
 				}
-				if max := 30 * time.Second; tempDelay > max {
+				if max := d.backoffMax; tempDelay > max {
 					tempDelay = max
 				}
-				log.Warnf("can not watchtree (with retry %d, sleep %v): %s: %v", retry, tempDelay, d.basePath, err)
-				time.Sleep(tempDelay)
+				log.Warnf("can not watchtree (with retry %d, sleep %v): %s: %v", retry, tempDelay, directory, err)
+				select {
+				case <-d.stopCh:
+					log.Info("discovery has been closed")
+					return
+				case <-time.After(tempDelay):
+				}
 				continue
 			}
 			break
 		}
 
 		if err != nil {
-			log.Errorf("can't watch %s: %v", d.basePath, err)
+			if d.pollAfter > 0 && failures >= d.pollAfter {
+				continue
+			}
+			log.Errorf("can't watch %s: %v", directory, err)
 			return
 		}
 
-		prefix := d.basePath + "/"
-
+		watchedAt := time.Now()
 	readChanges:
 		for {
 			select {
@@ -194,50 +808,93 @@ func (d *ConsulDiscovery) watch() {
 				if !ok {
 					break readChanges
 				}
-				var pairs []*client.KVPair // latest servers
-				if ps == nil {
-					d.pairsMu.Lock()
-					d.pairs = pairs
-					d.pairsMu.Unlock()
-					continue
-				}
-				for _, p := range ps {
-					if !strings.HasPrefix(p.Key, prefix) { // avoid prefix issue of consul List
-						continue
-					}
-					k := strings.TrimPrefix(p.Key, prefix)
-					pair := &client.KVPair{Key: k, Value: string(p.Value)}
-					if d.filter != nil && !d.filter(pair) {
-						continue
-					}
-					pairs = append(pairs, pair)
-				}
-				d.pairsMu.Lock()
-				d.pairs = pairs
-				d.pairsMu.Unlock()
-
-				d.mu.Lock()
-				for _, ch := range d.chans {
-					ch := ch
-					go func() {
-						defer func() {
-							recover()
-						}()
-						select {
-						case ch <- pairs:
-						default:
-							log.Warn("chan is full and new change has been dropped")
-						}
-					}()
-				}
-				d.mu.Unlock()
+				d.watchRecovered()
+				sum = ""
+				update(ps)
 			}
 		}
 
+		d.watchFailed(fmt.Errorf("watch of %s is closed", directory))
 		log.Warn("chan is closed and will rewatch")
+		// a watch which lasts longer than a poll works
+		if time.Since(watchedAt) > d.pollInterval {
+			failures = 0
+		}
+		failures++
 	}
 }
 
+// setPairs stores the latest servers and notifies all watchers.
+func (d *ConsulDiscovery) setPairs(pairs []*client.KVPair) {
+	d.pairsMu.RLock()
+	current, cached := d.cache.Get(d.basePath)
+	d.pairsMu.RUnlock()
+	// the frozen servers evicted from the shared cache are replaced by the latest ones
+	if d.IsFrozen() && cached {
+		// the expelled instances are removed from the frozen servers too
+		if pairs = d.expel(current); len(pairs) == len(current) {
+			return
+		}
+	} else {
+		raw := pairs
+		pairs = d.applyGroupWeights(d.preferLocal(d.expel(pairs)))
+		if d.verifySource != nil {
+			// the removals of the expelled instances are not verified
+			pairs = d.expel(d.holdRemovals(raw, current, pairs))
+		}
+	}
+
+	d.pruneRegisteredKeys(pairs)
+
+	d.pairsMu.Lock()
+	old := d.loadPairs()
+	d.cache.Set(d.basePath, pairs)
+	d.updatedAt = time.Now()
+	updatedAt := d.updatedAt
+	d.pairsMu.Unlock()
+	if d.hook != nil {
+		d.hook.ServicesUpdated(d.basePath, len(pairs))
+	}
+
+	if d.cacheDir != "" {
+		// the servers of the snapshot are replaced even if they are the same
+		if atomic.CompareAndSwapInt32(&d.fromSnapshot, 1, 0) || !diffPairs(old, pairs).IsEmpty() {
+			d.saveSnapshot(pairs, updatedAt)
+		}
+	}
+
+	if d.logChanges || d.history != nil || d.alertSink != nil {
+		if c := diffPairs(old, pairs); !c.IsEmpty() {
+			if d.logChanges {
+				log.Infof("services of %s changed, joined: %v, left: %v, updated: %v", d.basePath, c.Joined, c.Left, c.Updated)
+			}
+			if d.history != nil {
+				d.history.add(c)
+			}
+			if d.alertSink != nil {
+				d.checkChange(len(old), c, len(pairs))
+			}
+		}
+	}
+
+	d.notifyWatchers(pairs)
+}
+
+// Close stops watching the servers and waits for the background goroutines to exit,
+// at most 5s or the timeout set by WithCloseTimeout. Use Shutdown to know whether they exited.
 func (d *ConsulDiscovery) Close() {
-	close(d.stopCh)
+	ctx, cancel := context.WithTimeout(context.Background(), d.closeTimeout)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		log.Warn(err)
+	}
+	// the servers in the memory of the discovery are still returned after it is closed
+	if _, ok := d.cache.(*pairSlot); !ok {
+		d.pairsMu.Lock()
+		d.cache.Delete(d.basePath)
+		d.pairsMu.Unlock()
+	}
+	if d.ownShadow {
+		d.shadow.Close()
+	}
 }
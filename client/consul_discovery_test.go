@@ -0,0 +1,262 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestBudgetDiscovery(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	budget.SetLimit(budget.Count())
+	defer budget.SetLimit(0)
+	var exceeded *budget.ExceededError
+	if _, err := NewConsulDiscoveryStore("rpcx/A", kv, WithFreezeFlag()); !errors.As(err, &exceeded) {
+		t.Fatal(err)
+	}
+	ch := d.WatchServiceWith(WithPolicy(CoalesceLatest))
+	if ch == nil {
+		t.Fatal("expect a watcher beyond the budget")
+	}
+	d.mu.Lock()
+	p := d.watchers[len(d.watchers)-1].policy
+	d.mu.Unlock()
+	if p != DropOldest {
+		t.Fatalf("unexpected %v", p)
+	}
+}
+
+func TestBudgetSpawns(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	budget.SetLimit(budget.Count())
+	defer budget.SetLimit(0)
+
+	var exceeded *budget.ExceededError
+	if _, _, err := NewResolver(d).Watch(""); !errors.As(err, &exceeded) {
+		t.Fatalf("unexpected resolver watch error %v", err)
+	}
+	if _, err := d.GetServicesFresh(context.Background(), 0); !errors.As(err, &exceeded) {
+		t.Fatalf("unexpected refresh error %v", err)
+	}
+	if _, err := NewMultiDCDiscoveryStore("rpcx/A", []string{"dc1"}, []store.Store{kv}); !errors.As(err, &exceeded) {
+		t.Fatalf("unexpected multi-dc error %v", err)
+	}
+}
+
+func TestGetServicesFresh(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/Arith/tcp@1:1", Value: []byte("")})
+	d, err := NewConsulDiscoveryStore("rpcx/Arith", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	kv.Put("rpcx/Arith/tcp@1:2", nil, nil)
+	ps, _ := d.GetServicesFresh(context.Background(), time.Hour)
+	if len(ps) != 1 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	ps, err = d.GetServicesFresh(context.Background(), 0)
+	if err != nil || len(ps) != 2 {
+		t.Fatalf("unexpected services %v, error %v", ps, err)
+	}
+}
+
+type recHook struct {
+	hook.NopHook
+	mu                      sync.Mutex
+	errs, reconnects, drops int
+	servers                 []int
+}
+
+func (h *recHook) WatchError(path string, err error) { h.mu.Lock(); h.errs++; h.mu.Unlock() }
+func (h *recHook) WatchReconnected(path string, d time.Duration) {
+	h.mu.Lock()
+	h.reconnects++
+	h.mu.Unlock()
+}
+func (h *recHook) ServicesUpdated(path string, n int) {
+	h.mu.Lock()
+	h.servers = append(h.servers, n)
+	h.mu.Unlock()
+}
+func (h *recHook) NotificationDropped(path, w string) { h.mu.Lock(); h.drops++; h.mu.Unlock() }
+
+func TestHook(t *testing.T) {
+	h := &recHook{}
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithEventHook(h))
+	defer d.Close()
+	d.WatchServiceWith(WithBuffer(0))
+	d.watchFailed(errors.New("x"))
+	d.watchFailed(errors.New("x"))
+	kv.watchCh <- []*store.KVPair{{Key: "rpcx/A/a"}, {Key: "rpcx/A/b"}}
+	if !waitFor(func() bool { h.mu.Lock(); defer h.mu.Unlock(); return len(h.servers) == 2 }) {
+		t.Fatalf("unexpected updates %v", h.servers)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.errs != 2 || h.reconnects != 1 || h.drops != 1 || h.servers[0] != 1 || h.servers[1] != 2 {
+		t.Fatalf("unexpected errors %d, reconnects %d, drops %d, updates %v", h.errs, h.reconnects, h.drops, h.servers)
+	}
+}
+
+type slowStore struct {
+	*fakeStore
+	block chan struct{}
+}
+
+func (s *slowStore) List(directory string) ([]*store.KVPair, error) {
+	<-s.block
+	return s.fakeStore.List(directory)
+}
+
+func TestInitTimeout(t *testing.T) {
+	kv := &slowStore{newFakeStore(), make(chan struct{})}
+	defer close(kv.block)
+	start := time.Now()
+	_, err := NewConsulDiscoveryStore("rpcx/A", kv, WithInitTimeout(50*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewConsulDiscoveryStoreContext(ctx, "rpcx/A", kv); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeShards(t *testing.T) {
+	cases := []struct {
+		name   string
+		shards [][]*client.KVPair
+		want   []string
+	}{
+		{"empty", nil, nil},
+		{"disjoint", [][]*client.KVPair{kvs("a", "b"), kvs("c")}, []string{"a", "b", "c"}},
+		{"overlapping", [][]*client.KVPair{kvs("a", "ab"), kvs("ab", "ac")}, []string{"a", "ab", "ac"}},
+		{"unwatched shard", [][]*client.KVPair{nil, kvs("a")}, []string{"a"}},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, p := range mergeShards(c.shards) {
+			got = append(got, p.Key)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: expected %v but got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestWatchShards(t *testing.T) {
+	kv := &dirStore{fakeStore: newFakeStore(), chs: map[string]chan []*store.KVPair{}}
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithWatchShards("tcp@10.", "tcp@10.0."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	kv.ch("rpcx/A/tcp@10.") <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.1:8972"}, {Key: "rpcx/A/tcp@10.1.0.1:8972"}}
+	kv.ch("rpcx/A/tcp@10.0.") <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.1:8972"}}
+	if !waitFor(func() bool { return len(d.GetServices()) == 2 }) {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ps := d.GetServices(); len(ps) != 2 || ps[0].Key == ps[1].Key {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
+
+func TestWatchShardsCatchAll(t *testing.T) {
+	kv := &dirStore{fakeStore: newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@192.168.0.1:8972"}), chs: map[string]chan []*store.KVPair{}}
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithWatchShards("tcp@10.0."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 {
+		t.Fatalf("the server matching no shard is dropped: %v", ps)
+	}
+
+	kv.ch("rpcx/A/tcp@10.0.") <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.1:8972"}}
+	kv.ch("rpcx/A/") <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.1:8972"}, {Key: "rpcx/A/tcp@192.168.0.2:8972"}}
+	want := []string{"tcp@10.0.0.1:8972", "tcp@192.168.0.2:8972"}
+	if !waitFor(func() bool {
+		var keys []string
+		for _, p := range d.GetServices() {
+			keys = append(keys, p.Key)
+		}
+		return reflect.DeepEqual(keys, want)
+	}) {
+		t.Fatalf("expected services %v but got %v", want, d.GetServices())
+	}
+}
+
+func TestRefreshDeleted(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a", LastIndex: 3}, &store.KVPair{Key: "rpcx/A/b", LastIndex: 5})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the listing after b is deleted has a lower index than the watch
+	kv.mu.Lock()
+	kv.pairs = kv.pairs[:1]
+	kv.mu.Unlock()
+	if ps, err := d.GetServicesFresh(context.Background(), 0); err != nil || len(ps) != 1 || ps[0].Key != "a" {
+		t.Fatalf("unexpected services %v, error %v", ps, err)
+	}
+	kv.mu.Lock()
+	kv.pairs = nil
+	kv.mu.Unlock()
+	if ps, err := d.GetServicesFresh(context.Background(), 0); err != nil || len(ps) != 0 {
+		t.Fatalf("unexpected services %v, error %v", ps, err)
+	}
+}
+
+func TestRefreshShards(t *testing.T) {
+	kv := &dirStore{fakeStore: newFakeStore(), chs: map[string]chan []*store.KVPair{}}
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithWatchShards("tcp@10.0.", "tcp@10.1."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	kv.Put("rpcx/A/tcp@10.0.0.1:8972", nil, nil)
+	kv.Put("rpcx/A/tcp@10.1.0.1:8972", nil, nil)
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 2 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+
+	// the servers refreshed in the other shards are kept
+	kv.ch("rpcx/A/tcp@10.0.") <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.2:8972"}}
+	want := []string{"tcp@10.0.0.2:8972", "tcp@10.1.0.1:8972"}
+	if !waitFor(func() bool {
+		var keys []string
+		for _, p := range d.GetServices() {
+			keys = append(keys, p.Key)
+		}
+		return reflect.DeepEqual(keys, want)
+	}) {
+		t.Fatalf("expected services %v but got %v", want, d.GetServices())
+	}
+}
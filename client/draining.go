@@ -0,0 +1,79 @@
+package client
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// drainingServer is a server which is draining and when it started to.
+type drainingServer struct {
+	pair  *client.KVPair
+	since time.Time
+}
+
+// WithDrainingGrace removes the draining servers from the services, so that new selections avoid them,
+// but keeps them in Draining for grace since they started to drain, so that sticky sessions can finish.
+func WithDrainingGrace(grace time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.drainingGrace = grace
+	}
+}
+
+// Draining returns the servers which started to drain within the grace set by WithDrainingGrace.
+// They should only be used by the connections which are already established.
+func (d *ConsulDiscovery) Draining() []*client.KVPair {
+	d.drainingMu.Lock()
+	defer d.drainingMu.Unlock()
+
+	pairs := make([]*client.KVPair, 0, len(d.draining))
+	for _, s := range d.draining {
+		if time.Since(s.since) > d.drainingGrace {
+			continue
+		}
+		pairs = append(pairs, &client.KVPair{Key: s.pair.Key, Value: s.pair.Value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+// checkDraining reports whether to keep the server in the services, the draining servers are moved to Draining
+// and added to seen.
+func (d *ConsulDiscovery) checkDraining(pair *client.KVPair, seen map[string]bool) bool {
+	if d.drainingGrace <= 0 {
+		return true
+	}
+
+	d.drainingMu.Lock()
+	defer d.drainingMu.Unlock()
+
+	if meta.StateOf(pair.Value) != meta.StateDraining {
+		delete(d.draining, pair.Key)
+		return true
+	}
+	seen[pair.Key] = true
+	if d.draining == nil {
+		d.draining = make(map[string]*drainingServer)
+	}
+	if s, ok := d.draining[pair.Key]; ok {
+		s.pair = pair
+	} else {
+		d.draining[pair.Key] = &drainingServer{pair: pair, since: time.Now()}
+	}
+	return false
+}
+
+// pruneDraining forgets the draining servers which are not seen in the full list of servers any more.
+// The expired servers which are still draining are kept, so that their grace doesn't start again.
+func (d *ConsulDiscovery) pruneDraining(seen map[string]bool) {
+	d.drainingMu.Lock()
+	defer d.drainingMu.Unlock()
+
+	for key := range d.draining {
+		if !seen[key] {
+			delete(d.draining, key)
+		}
+	}
+}
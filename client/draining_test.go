@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestDraining(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/app/tcp@1:1", Value: []byte("state=active")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:2", Value: []byte("state=draining")},
+	)
+	d, err := NewConsulDiscoveryStore("rpcx/app", kv, WithDrainingGrace(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n := len(d.GetServices()); n != 1 {
+		t.Fatalf("got %d", n)
+	}
+	if ds := d.Draining(); len(ds) != 1 || ds[0].Key != "tcp@1:2" {
+		t.Fatalf("got %v", ds)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ds := d.Draining(); len(ds) != 0 {
+		t.Fatalf("got %v", ds)
+	}
+}
+
+func TestDrainingStillDraining(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/app/tcp@1:2", Value: []byte("state=draining")},
+	)
+	d, err := NewConsulDiscoveryStore("rpcx/app", kv, WithDrainingGrace(30*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	time.Sleep(40 * time.Millisecond)
+	kv.watchCh <- []*store.KVPair{{Key: "rpcx/app/tcp@1:2", Value: []byte("state=draining&x=1")}, {Key: "rpcx/app/tcp@1:3"}}
+	time.Sleep(20 * time.Millisecond)
+	if ds := d.Draining(); len(ds) != 0 {
+		t.Fatalf("got %v", ds)
+	}
+	kv.watchCh <- []*store.KVPair{{Key: "rpcx/app/tcp@1:3"}}
+	time.Sleep(20 * time.Millisecond)
+	d.drainingMu.Lock()
+	n := len(d.draining)
+	d.drainingMu.Unlock()
+	if n != 0 {
+		t.Fatal("not pruned")
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+// EventType is the type of a ServiceEvent.
+type EventType int
+
+const (
+	EventAdded EventType = iota
+	EventRemoved
+	EventUpdated
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventRemoved:
+		return "removed"
+	case EventUpdated:
+		return "updated"
+	default:
+		return "unknown"
+	}
+}
+
+// ServiceEvent is a change of a server delivered by WatchServiceEvents.
+type ServiceEvent struct {
+	Type EventType
+	// Pair is the server, with its last value if it is removed
+	Pair *client.KVPair
+}
+
+// diffEvents returns the events from the old servers to the new servers, sorted by the keys of the servers.
+func diffEvents(old map[string]string, pairs []*client.KVPair) []ServiceEvent {
+	var events []ServiceEvent
+	seen := make(map[string]bool, len(pairs))
+	for _, p := range pairs {
+		seen[p.Key] = true
+		v, ok := old[p.Key]
+		switch {
+		case !ok:
+			events = append(events, ServiceEvent{Type: EventAdded, Pair: p})
+		case v != p.Value:
+			events = append(events, ServiceEvent{Type: EventUpdated, Pair: p})
+		}
+	}
+	for k, v := range old {
+		if !seen[k] {
+			events = append(events, ServiceEvent{Type: EventRemoved, Pair: &client.KVPair{Key: k, Value: v}})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Pair.Key < events[j].Pair.Key })
+	return events
+}
+
+// pairsMap returns the values of the servers by their keys.
+func pairsMap(pairs []*client.KVPair) map[string]string {
+	m := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		m[p.Key] = p.Value
+	}
+	return m
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+// applyEvents applies the events to the servers received so far.
+func applyEvents(servers map[string]string, events []ServiceEvent) {
+	for _, e := range events {
+		if e.Type == EventRemoved {
+			delete(servers, e.Pair.Key)
+			continue
+		}
+		servers[e.Pair.Key] = e.Pair.Value
+	}
+}
+
+func TestEvents(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a", Value: []byte("x=1")})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ch := d.WatchServiceEvents(WithBuffer(1))
+	ev := <-ch
+	if len(ev) != 1 || ev[0].Type != EventAdded || ev[0].Pair.Key != "a" {
+		t.Fatalf("unexpected events %v", ev)
+	}
+	servers := pairsMap(nil)
+	applyEvents(servers, ev)
+
+	// the consumer is slow, the last change is still delivered without another change
+	d.setPairs([]*client.KVPair{{Key: "a", Value: "x=2"}, {Key: "b"}})
+	d.setPairs([]*client.KVPair{{Key: "b"}, {Key: "c"}})
+	want := map[string]string{"b": "", "c": ""}
+	for !reflect.DeepEqual(servers, want) {
+		select {
+		case ev := <-ch:
+			applyEvents(servers, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("expected servers %v but got %v", want, servers)
+		}
+	}
+
+	d.setPairs([]*client.KVPair{{Key: "b"}, {Key: "c"}})
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected events %v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	d.RemoveEventsWatcher(ch)
+	if len(d.Watchers()) != 0 {
+		t.Fatalf("unexpected watchers %v", d.Watchers())
+	}
+}
+
+func TestEventsSnapshot(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the changes racing with the watcher never leave it with an older snapshot
+	for i := 0; i < 20; i++ {
+		done := make(chan struct{})
+		go func() {
+			d.setPairs(kvs("b", "c"))
+			close(done)
+		}()
+		ch := d.WatchServiceEvents()
+		<-done
+
+		servers := pairsMap(nil)
+		want := pairsMap(kvs("b", "c"))
+		for !reflect.DeepEqual(servers, want) {
+			select {
+			case ev := <-ch:
+				applyEvents(servers, ev)
+			case <-time.After(time.Second):
+				t.Fatalf("expected servers %v but got %v", want, servers)
+			}
+		}
+		d.RemoveEventsWatcher(ch)
+		d.setPairs(kvs("a"))
+	}
+}
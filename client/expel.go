@@ -0,0 +1,107 @@
+package client
+
+import (
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/admin"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithExpelMarkers honors the instances of the service path expelled by admin.Expel:
+// they are removed from the servers at once, whatever their keys and states in consul.
+func WithExpelMarkers() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.honorExpel = true
+	}
+}
+
+// Expelled returns the instances removed by the expel markers.
+func (d *ConsulDiscovery) Expelled() map[string]admin.Expulsion {
+	d.expelledMu.RLock()
+	defer d.expelledMu.RUnlock()
+	return d.expelled
+}
+
+// setExpelled stores the expelled instances and reports whether they changed.
+func (d *ConsulDiscovery) setExpelled(expelled map[string]admin.Expulsion) bool {
+	d.expelledMu.Lock()
+	defer d.expelledMu.Unlock()
+
+	changed := len(expelled) != len(d.expelled)
+	for instance := range expelled {
+		if _, ok := d.expelled[instance]; !ok {
+			changed = true
+		}
+	}
+	d.expelled = expelled
+	return changed
+}
+
+// watchExpelled watches the expelled instances of the service path.
+func (d *ConsulDiscovery) watchExpelled() {
+	key := admin.ExpelKey(d.basePath)
+	for {
+		c, err := d.kv.Watch(key, d.stopCh)
+		if err == nil {
+			for p := range c {
+				expelled, err := admin.ParseExpelled(p.Value)
+				if err != nil {
+					log.Warnf("ignore malformed expelled instances of %s: %v", d.basePath, err)
+					continue
+				}
+				if d.setExpelled(expelled) {
+					log.Warnf("expelled instances of %s changed to %v", d.basePath, expelled)
+					d.refresh()
+				}
+			}
+		}
+
+		select {
+		case <-d.stopCh:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// expel returns the servers without the expelled instances.
+func (d *ConsulDiscovery) expel(pairs []*client.KVPair) []*client.KVPair {
+	d.expelledMu.RLock()
+	defer d.expelledMu.RUnlock()
+	if len(d.expelled) == 0 {
+		return pairs
+	}
+
+	kept := make([]*client.KVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		// the instances are expelled by the keys they are registered with
+		key := pair.Key
+		if registered, ok := d.registeredKeys[key]; ok {
+			key = registered
+		}
+		if _, ok := d.expelled[key]; ok {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return kept
+}
+
+// pruneRegisteredKeys forgets the registered keys of the rewritten servers which are not in pairs.
+func (d *ConsulDiscovery) pruneRegisteredKeys(pairs []*client.KVPair) {
+	d.expelledMu.Lock()
+	defer d.expelledMu.Unlock()
+	if len(d.registeredKeys) == 0 {
+		return
+	}
+	keys := make(map[string]bool, len(pairs))
+	for _, p := range pairs {
+		keys[p.Key] = true
+	}
+	for key := range d.registeredKeys {
+		if !keys[key] {
+			delete(d.registeredKeys, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/admin"
+)
+
+func TestExpelDiscovery(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/A/b"}, &store.KVPair{Key: "rpcx/A/c"},
+		&store.KVPair{Key: "_rpcx_admin/expel/rpcx/A", Value: []byte(`{"a":{"reason":"bad"}}`)})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithExpelMarkers(), WithFreezeFlag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 2 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	if d.Expelled()["a"].Reason != "bad" {
+		t.Fatalf("unexpected expelled servers %v", d.Expelled())
+	}
+
+	// expelled instances are removed even if the servers are frozen
+	d.setFrozen(true)
+	d.setExpelled(map[string]admin.Expulsion{"a": {}, "b": {}})
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "c" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	d.setExpelled(nil)
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 1 {
+		t.Fatal("frozen servers changed", ps)
+	}
+	d.setFrozen(false)
+	time.Sleep(10 * time.Millisecond)
+	if !waitFor(func() bool { return len(d.GetServices()) == 3 }) {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+}
+
+func TestExpelDialAddress(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/A/tcp@10.0.0.1:8972", Value: []byte("hostname=h1&ip=10.0.0.1")},
+		&store.KVPair{Key: "rpcx/A/tcp@10.0.0.2:8972", Value: []byte("hostname=h2&ip=10.0.0.2")},
+		&store.KVPair{Key: "_rpcx_admin/expel/rpcx/A", Value: []byte(`{"tcp@10.0.0.1:8972":{"reason":"bad"}}`)})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithExpelMarkers(), WithFreezeFlag(), WithDialAddress(DialHostname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@h2:8972" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+
+	// the frozen servers are expelled by their registered keys too
+	d.setExpelled(nil)
+	<-d.refresh()
+	d.setFrozen(true)
+	d.setExpelled(map[string]admin.Expulsion{"tcp@10.0.0.2:8972": {}})
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@h1:8972" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
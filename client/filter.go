@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// maxFilterGoroutines bounds the goroutines of the filter calls which haven't returned yet.
+const maxFilterGoroutines = 16
+
+// WithFilterTimeout limits how long the filter can take for a server, the server is kept if it takes longer.
+// Every call of the filter runs in its own goroutine if it is set. The filter can't be cancelled, so the goroutine
+// of a call which timed out keeps running until the filter returns. At most 16 of them run at once, and the
+// servers are kept without calling the filter while all of them are stuck.
+func WithFilterTimeout(timeout time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.filterTimeout = timeout
+		d.filterSlots = make(chan struct{}, maxFilterGoroutines)
+	}
+}
+
+// FilterPanics returns how many times the filter has panicked.
+func (d *ConsulDiscovery) FilterPanics() uint64 {
+	return atomic.LoadUint64(&d.filterPanics)
+}
+
+// FilterTimeouts returns how many times the filter has timed out.
+func (d *ConsulDiscovery) FilterTimeouts() uint64 {
+	return atomic.LoadUint64(&d.filterTimeouts)
+}
+
+// applyFilter reports whether the filter keeps the server.
+// A panicking filter keeps the server instead of killing the watch goroutine, the panic is reported with StrictErrors
+// and crashes the process with CrashOnPanic.
+func (d *ConsulDiscovery) applyFilter(pair *client.KVPair) bool {
+	if d.filterTimeout <= 0 {
+		return d.callFilter(pair)
+	}
+
+	select {
+	case d.filterSlots <- struct{}{}:
+	default:
+		atomic.AddUint64(&d.filterTimeouts, 1)
+		log.Warnf("%d calls of filter %s of %s haven't returned, keep server %s", maxFilterGoroutines, funcName(d.filter), d.basePath, pair.Key)
+		return true
+	}
+	result := make(chan bool, 1)
+	err := budget.Go("filter", func() {
+		defer func() { <-d.filterSlots }()
+		result <- d.callFilter(pair)
+	})
+	if err != nil {
+		<-d.filterSlots
+		log.Warnf("cannot call filter %s of %s on server %s, keep it: %v", funcName(d.filter), d.basePath, pair.Key, err)
+		d.reportError(err)
+		return true
+	}
+
+	timer := time.NewTimer(d.filterTimeout)
+	defer timer.Stop()
+	select {
+	case keep := <-result:
+		return keep
+	case <-timer.C:
+		atomic.AddUint64(&d.filterTimeouts, 1)
+		log.Warnf("filter %s of %s timed out on server %s after %v, keep it", funcName(d.filter), d.basePath, pair.Key, d.filterTimeout)
+		return true
+	}
+}
+
+func (d *ConsulDiscovery) callFilter(pair *client.KVPair) (keep bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&d.filterPanics, 1)
+			log.Errorf("filter %s of %s panicked on server %s (%s), keep it: %v", funcName(d.filter), d.basePath, pair.Key, d.redactor.Metadata(pair.Value), r)
+			d.reportError(fmt.Errorf("filter %s of %s on server %s %w: %v", funcName(d.filter), d.basePath, pair.Key, ErrPanicked, r))
+			d.repanic(r)
+			keep = true
+		}
+	}()
+	return d.filter(pair)
+}
+
+// funcName returns the name of the function f.
+func funcName(f interface{}) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return "unknown"
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestSafeFilter(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/A/b"}, &store.KVPair{Key: "rpcx/A/c"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithFilterTimeout(50*time.Millisecond))
+	defer d.Close()
+	d.SetFilter(func(p *client.KVPair) bool {
+		switch p.Key {
+		case "a":
+			panic("boom")
+		case "b":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return false
+	})
+	d.setPairs(d.parse(kv.pairs))
+	if ps := d.GetServices(); len(ps) != 2 || d.FilterPanics() != 1 || d.FilterTimeouts() != 1 {
+		t.Fatalf("unexpected services %v, panics %d, timeouts %d", ps, d.FilterPanics(), d.FilterTimeouts())
+	}
+}
+
+func TestStuckFilter(t *testing.T) {
+	kv := newFakeStore()
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithFilterTimeout(time.Millisecond))
+	defer d.Close()
+	var calls int32
+	release := make(chan struct{})
+	defer close(release)
+	d.SetFilter(func(p *client.KVPair) bool {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return false
+	})
+	for i := 0; i < 2*maxFilterGoroutines; i++ {
+		if !d.applyFilter(&client.KVPair{Key: "a"}) {
+			t.Fatal("server of a stuck filter is not kept")
+		}
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&calls) == maxFilterGoroutines }) {
+		t.Fatalf("expect %d stuck filter goroutines but got %d", maxFilterGoroutines, atomic.LoadInt32(&calls))
+	}
+	if d.FilterTimeouts() != 2*maxFilterGoroutines {
+		t.Fatalf("unexpected timeouts %d", d.FilterTimeouts())
+	}
+}
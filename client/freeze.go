@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/admin"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithFreezeFlag honors the freeze flag of the service path set by admin.Freeze:
+// while it is set, the discovery keeps its current servers and ignores all changes.
+func WithFreezeFlag() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.honorFreeze = true
+	}
+}
+
+// IsFrozen reports whether the servers are pinned by the freeze flag.
+func (d *ConsulDiscovery) IsFrozen() bool {
+	return atomic.LoadInt32(&d.frozen) == 1
+}
+
+func (d *ConsulDiscovery) setFrozen(frozen bool) {
+	var v int32
+	if frozen {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.frozen, v) == v {
+		return
+	}
+
+	if frozen {
+		log.Warnf("services of %s are frozen, changes are ignored until unfreeze", d.basePath)
+		return
+	}
+	log.Infof("services of %s are unfrozen", d.basePath)
+	d.refresh()
+}
+
+// watchFreeze watches the freeze flag of the service path.
+func (d *ConsulDiscovery) watchFreeze() {
+	key := admin.FreezeKey(d.basePath)
+	for {
+		c, err := d.kv.Watch(key, d.stopCh)
+		if err == nil {
+			for p := range c {
+				d.setFrozen(admin.IsTrue(p.Value))
+			}
+		}
+
+		select {
+		case <-d.stopCh:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
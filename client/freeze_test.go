@@ -0,0 +1,27 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestFreezeDiscovery(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "_rpcx_admin/freeze/rpcx/A", Value: []byte("true")})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithFreezeFlag())
+	defer d.Close()
+	if !d.IsFrozen() || len(d.GetServices()) != 1 {
+		t.Fatal("expect the frozen servers")
+	}
+	kv.watchCh <- []*store.KVPair{}
+	time.Sleep(50 * time.Millisecond)
+	if len(d.GetServices()) != 1 {
+		t.Fatal("changed while frozen")
+	}
+	kv.Put("rpcx/A/b", nil, nil)
+	d.setFrozen(false)
+	if !waitFor(func() bool { return len(d.GetServices()) == 2 }) {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+}
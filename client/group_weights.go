@@ -0,0 +1,118 @@
+package client
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/admin"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// groupWeightScale keeps the weights of the servers integers when the weight of a group is split among them.
+const groupWeightScale = 100
+
+// WithGroupWeights honors the group weights of the service path set by admin.SetGroupWeights:
+// the traffic is shifted between the groups of the servers (meta.Group) by rewriting their weights,
+// so that a weighted selector, e.g. client.WeightedRoundRobin, sends each group its share.
+// The servers of the groups without weights keep their own weights, the groups weighted 0 are removed.
+func WithGroupWeights() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.honorGroupWeights = true
+	}
+}
+
+// GroupWeights returns the group weights the servers are weighted by, nil if none are set.
+func (d *ConsulDiscovery) GroupWeights() map[string]int {
+	d.groupWeightsMu.RLock()
+	defer d.groupWeightsMu.RUnlock()
+	return d.groupWeights
+}
+
+// setGroupWeights stores the group weights and reports whether they changed.
+func (d *ConsulDiscovery) setGroupWeights(weights map[string]int) bool {
+	d.groupWeightsMu.Lock()
+	defer d.groupWeightsMu.Unlock()
+
+	changed := len(weights) != len(d.groupWeights)
+	for group, w := range weights {
+		if old, ok := d.groupWeights[group]; !ok || old != w {
+			changed = true
+		}
+	}
+	d.groupWeights = weights
+	return changed
+}
+
+// watchGroupWeights watches the group weights of the service path.
+func (d *ConsulDiscovery) watchGroupWeights() {
+	key := admin.GroupWeightsKey(d.basePath)
+	for {
+		c, err := d.kv.Watch(key, d.stopCh)
+		if err == nil {
+			for p := range c {
+				weights, err := admin.ParseGroupWeights(p.Value)
+				if err != nil {
+					log.Warnf("ignore malformed group weights of %s: %v", d.basePath, err)
+					continue
+				}
+				if d.setGroupWeights(weights) {
+					log.Infof("group weights of %s changed to %v", d.basePath, weights)
+					d.refresh()
+				}
+			}
+		}
+
+		select {
+		case <-d.stopCh:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// applyGroupWeights returns the servers weighted by the group weights. The weight of a group is split
+// among its servers by their own weights. All servers are kept if the group weights would remove all of them.
+func (d *ConsulDiscovery) applyGroupWeights(pairs []*client.KVPair) []*client.KVPair {
+	weights := d.GroupWeights()
+	if len(weights) == 0 {
+		return pairs
+	}
+
+	// the sum of the weights of the servers in each group
+	sums := make(map[string]int)
+	for _, pair := range pairs {
+		if group := meta.Parse(pair.Value).Get(meta.Group); weights[group] > 0 {
+			sums[group] += meta.HintsOf(pair.Value).Weight
+		}
+	}
+
+	weighted := make([]*client.KVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		v := meta.Parse(pair.Value)
+		gw, ok := weights[v.Get(meta.Group)]
+		if !ok {
+			weighted = append(weighted, pair)
+			continue
+		}
+		if gw == 0 {
+			continue
+		}
+
+		w := meta.HintsOf(pair.Value).Weight
+		if sum := sums[v.Get(meta.Group)]; w > 0 && sum > 0 {
+			w = gw * groupWeightScale * w / sum
+			if w < 1 {
+				w = 1
+			}
+		}
+		v.Set(meta.Weight, strconv.Itoa(w))
+		weighted = append(weighted, &client.KVPair{Key: pair.Key, Value: v.Encode()})
+	}
+	if len(weighted) == 0 && len(pairs) > 0 {
+		log.Warnf("group weights %v of %s remove all servers, ignore them", weights, d.basePath)
+		return pairs
+	}
+	return weighted
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+func TestGroupWeightsDiscovery(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/A/a", Value: []byte("group=v1")},
+		&store.KVPair{Key: "rpcx/A/b", Value: []byte("group=v1&weight=2")},
+		&store.KVPair{Key: "rpcx/A/c", Value: []byte("group=v2")},
+		&store.KVPair{Key: "rpcx/A/d", Value: []byte("group=v3")},
+		&store.KVPair{Key: "_rpcx_admin/group_weights/rpcx/A", Value: []byte(`{"v1":90,"v2":10}`)},
+	)
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithGroupWeights())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	got := map[string]int{}
+	for _, p := range d.GetServices() {
+		got[p.Key] = meta.HintsOf(p.Value).Weight
+	}
+	want := map[string]int{"a": 3000, "b": 6000, "c": 1000, "d": 1}
+	if len(got) != 4 {
+		t.Fatalf("unexpected %v", got)
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Fatalf("%s: %v", k, got)
+		}
+	}
+
+	d.setGroupWeights(map[string]int{"v1": 0, "v2": 100, "v3": 0})
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "c" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	d.setGroupWeights(map[string]int{"v1": 0, "v2": 0, "v3": 0})
+	<-d.refresh()
+	if ps := d.GetServices(); len(ps) != 4 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	if d.setGroupWeights(map[string]int{"v1": 0, "v2": 0, "v3": 0}) {
+		t.Fatal("unchanged")
+	}
+	if !d.setGroupWeights(nil) {
+		t.Fatal("changed")
+	}
+}
@@ -0,0 +1,100 @@
+// Package grpcresolver resolves the targets of grpc clients by the servers discovered in consul,
+// so that the grpc clients in the same binary as the rpcx clients reuse the discovery:
+//
+//	d, _ := client.NewConsulDiscoveryTemplate("rpcx", []string{"127.0.0.1:8500"}, nil)
+//	r := client.NewResolver(d)
+//	conn, _ := grpc.Dial("rpcx-consul:///Arith", grpc.WithResolvers(grpcresolver.NewBuilder(r)), ...)
+//
+// The path of the target is the service path relative to the discovery of the resolver.
+// It is in its own package so that only the applications using it depend on grpc.
+package grpcresolver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	consul "github.com/rpcxio/rpcx-consul/client"
+	"github.com/smallnest/rpcx/log"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the scheme of the targets resolved by the Builder.
+const Scheme = "rpcx-consul"
+
+// Builder builds the grpc resolvers of the targets like rpcx-consul:///Arith.
+type Builder struct {
+	r *consul.Resolver
+}
+
+// NewBuilder returns a Builder resolving the targets by r, which is closed by the application
+// after the grpc clients.
+func NewBuilder(r *consul.Resolver) *Builder {
+	return &Builder{r: r}
+}
+
+// Scheme returns Scheme.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build watches the servers of the service path of the target and pushes their addresses to cc.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	servicePath := target.URL.Path
+	if servicePath == "" {
+		servicePath = target.URL.Opaque
+	}
+	servicePath = strings.Trim(servicePath, "/")
+
+	updates, stop, err := b.r.Watch(servicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	err = budget.Go("grpc resolver watch", func() {
+		for {
+			select {
+			case <-done:
+				return
+			case addrs := <-updates:
+				update(cc, servicePath, addrs)
+			}
+		}
+	})
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &grpcResolver{stop: stop, done: done}, nil
+}
+
+// update pushes the addresses to cc, and reports an error if there is no server.
+func update(cc resolver.ClientConn, servicePath string, addrs []string) {
+	if len(addrs) == 0 {
+		cc.ReportError(&net.DNSError{Err: "no such service", Name: servicePath, IsNotFound: true})
+		return
+	}
+
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if err := cc.UpdateState(state); err != nil {
+		log.Warnf("cannot update the grpc servers of %s: %v", servicePath, err)
+	}
+}
+
+type grpcResolver struct {
+	stop func()
+	done chan struct{}
+}
+
+// ResolveNow does nothing, the changes of the servers are pushed once they are discovered.
+func (r *grpcResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close stops the watch of the servers.
+func (r *grpcResolver) Close() {
+	close(r.done)
+	r.stop()
+}
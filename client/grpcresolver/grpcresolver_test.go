@@ -0,0 +1,86 @@
+package grpcresolver
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/rpcxio/rpcx-consul/client"
+	"github.com/smallnest/rpcx/client"
+	"google.golang.org/grpc/resolver"
+)
+
+type clientConn struct {
+	resolver.ClientConn
+
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (c *clientConn) UpdateState(s resolver.State) error {
+	c.mu.Lock()
+	c.states = append(c.states, s)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, err)
+	c.mu.Unlock()
+}
+
+func (c *clientConn) updates() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.states), len(c.errs)
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestBuilder(t *testing.T) {
+	d, _ := client.NewMultipleServersDiscovery([]*client.KVPair{{Key: "tcp@10.0.0.1:8972"}})
+	r := consul.NewResolver(d)
+	defer r.Close()
+
+	b := NewBuilder(r)
+	if b.Scheme() != Scheme {
+		t.Fatalf("unexpected scheme %s", b.Scheme())
+	}
+	cc := &clientConn{}
+	gr, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { n, _ := cc.updates(); return n == 1 }) {
+		t.Fatal("the servers are not pushed")
+	}
+
+	d.Update([]*client.KVPair{{Key: "tcp@10.0.0.1:8972"}, {Key: "tcp@10.0.0.2:8972"}})
+	if !waitFor(func() bool { n, _ := cc.updates(); return n == 2 }) {
+		t.Fatal("the change is not pushed")
+	}
+	cc.mu.Lock()
+	got := cc.states[1].Addresses
+	cc.mu.Unlock()
+	if want := []resolver.Address{{Addr: "10.0.0.1:8972"}, {Addr: "10.0.0.2:8972"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v but got %v", want, got)
+	}
+
+	d.Update(nil)
+	if !waitFor(func() bool { _, n := cc.updates(); return n == 1 }) {
+		t.Fatal("no server is not reported")
+	}
+	gr.Close()
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// HashRingOf assembles the consistent-hash ring of the discovered servers from the tokens they publish,
+// see serverplugin.WithConsulHashRing.
+func HashRingOf(pairs []*client.KVPair) *meta.Ring {
+	return meta.NewRing(pairsMap(pairs))
+}
+
+// HashRingSelector is an rpcx Selector for stateful services: it sends the calls with the same key
+// to the server owning the key on the consistent-hash ring. Set it with XClient.SetSelector.
+type HashRingSelector struct {
+	key func(ctx context.Context, servicePath, serviceMethod string, args interface{}) string
+
+	mu   sync.RWMutex
+	ring *meta.Ring
+}
+
+var _ client.Selector = (*HashRingSelector)(nil)
+
+// NewHashRingSelector returns a HashRingSelector which routes the calls by the key returned by key,
+// e.g. the user ID in args.
+func NewHashRingSelector(key func(ctx context.Context, servicePath, serviceMethod string, args interface{}) string) *HashRingSelector {
+	return &HashRingSelector{key: key, ring: meta.NewRing(nil)}
+}
+
+// Select returns the owner of the key of the call, it returns an empty string if there is no healthy server.
+func (s *HashRingSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	s.mu.RLock()
+	ring := s.ring
+	s.mu.RUnlock()
+
+	owner, _ := ring.Get(s.key(ctx, servicePath, serviceMethod, args))
+	return owner
+}
+
+// UpdateServer assembles the ring of the servers.
+func (s *HashRingSelector) UpdateServer(servers map[string]string) {
+	ring := meta.NewRing(servers)
+
+	s.mu.Lock()
+	s.ring = ring
+	s.mu.Unlock()
+}
+
+// Ring returns the current ring, e.g. to find the replicas of a key.
+func (s *HashRingSelector) Ring() *meta.Ring {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring
+}
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestHashRingSelector(t *testing.T) {
+	s := NewHashRingSelector(func(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+		return args.(string)
+	})
+	if got := s.Select(context.Background(), "Arith", "Mul", "u1"); got != "" {
+		t.Fatalf("unexpected server %s", got)
+	}
+	pairs := []*client.KVPair{{Key: "tcp@a:1"}, {Key: "tcp@b:1"}}
+	s.UpdateServer(pairsMap(pairs))
+	want, _ := HashRingOf(pairs).Get("u1")
+	for i := 0; i < 10; i++ {
+		if got := s.Select(context.Background(), "Arith", "Mul", "u1"); got != want || got == "" {
+			t.Fatalf("expected %s but got %s", want, got)
+		}
+	}
+}
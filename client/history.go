@@ -0,0 +1,58 @@
+package client
+
+import "sync"
+
+// WithHistory keeps the last n membership changes in memory, they can be read by History.
+func WithHistory(n int) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		if n > 0 {
+			d.history = newChangeHistory(n)
+		}
+	}
+}
+
+// changeHistory is a ring buffer of changes.
+type changeHistory struct {
+	mu      sync.Mutex
+	changes []Change
+	next    int
+	full    bool
+}
+
+func newChangeHistory(n int) *changeHistory {
+	return &changeHistory{changes: make([]Change, n)}
+}
+
+func (h *changeHistory) add(c Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.changes[h.next] = c
+	h.next++
+	if h.next == len(h.changes) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// list returns the changes from the oldest to the latest.
+func (h *changeHistory) list() []Change {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		return append([]Change(nil), h.changes[:h.next]...)
+	}
+	changes := make([]Change, 0, len(h.changes))
+	changes = append(changes, h.changes[h.next:]...)
+	return append(changes, h.changes[:h.next]...)
+}
+
+// History returns the recent membership changes from the oldest to the latest.
+// It returns nil unless the discovery is created WithHistory.
+func (d *ConsulDiscovery) History() []Change {
+	if d.history == nil {
+		return nil
+	}
+	return d.history.list()
+}
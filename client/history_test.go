@@ -0,0 +1,17 @@
+package client
+
+import "testing"
+
+func TestChangeHistory(t *testing.T) {
+	h := newChangeHistory(2)
+	h.add(Change{Joined: []string{"a"}})
+	if l := h.list(); len(l) != 1 {
+		t.Fatalf("unexpected %v", l)
+	}
+	h.add(Change{Joined: []string{"b"}})
+	h.add(Change{Joined: []string{"c"}})
+	l := h.list()
+	if len(l) != 2 || l[0].Joined[0] != "b" || l[1].Joined[0] != "c" {
+		t.Fatalf("unexpected %v", l)
+	}
+}
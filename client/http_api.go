@@ -0,0 +1,155 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// DiscoveryHandler exposes a discovery over HTTP so that non-Go clients on the same host
+// can reuse its consul handling:
+//
+//	GET /services?path=Arith  returns the servers as a JSON array
+//	GET /watch?path=Arith     streams the current servers and every change, one JSON array per line
+//	GET /history?path=Arith   returns the recent membership changes if the discovery keeps them
+//	GET /watchers?path=Arith  returns the watchers of the discovery with their drop counts
+//
+// path is relative to the served discovery and can be omitted to use the discovery itself.
+// The discoveries of the requested paths are closed once they are idle, and at most 256 of them are open
+// at the same time: requests of more paths get 503 Service Unavailable.
+// The metadata of the servers is redacted by the Redactor of the discovery if it has one, see WithRedactor.
+type DiscoveryHandler struct {
+	clones *clones
+	mux    *http.ServeMux
+}
+
+// NewDiscoveryHandler returns a http.Handler which serves the servers of d.
+func NewDiscoveryHandler(d client.ServiceDiscovery) *DiscoveryHandler {
+	h := &DiscoveryHandler{clones: newClones(d), mux: http.NewServeMux()}
+	h.mux.HandleFunc("/services", h.services)
+	h.mux.HandleFunc("/watch", h.watch)
+	h.mux.HandleFunc("/history", h.history)
+	h.mux.HandleFunc("/watchers", h.watchers)
+	return h
+}
+
+func (h *DiscoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close closes the discoveries cloned for requested paths.
+func (h *DiscoveryHandler) Close() {
+	h.clones.close()
+}
+
+// discovery returns the discovery of the requested path, the caller must call release once it's done with it.
+func (h *DiscoveryHandler) discovery(w http.ResponseWriter, r *http.Request) (d client.ServiceDiscovery, release func(), ok bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+
+	servicePath := r.URL.Query().Get("path")
+	d, release, err := h.clones.get(servicePath)
+	if errors.Is(err, ErrTooManyClones) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Errorf("cannot discover %s for http client: %v", servicePath, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, nil, false
+	}
+	return d, release, true
+}
+
+func (h *DiscoveryHandler) services(w http.ResponseWriter, r *http.Request) {
+	d, release, ok := h.discovery(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(redactPairs(redactorOf(d), d.GetServices()))
+}
+
+func (h *DiscoveryHandler) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	d, release, ok := h.discovery(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ch := watchLatest(d, "http-api")
+	defer d.RemoveWatcher(ch)
+
+	redactor := redactorOf(d)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(redactPairs(redactor, d.GetServices())); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case pairs := <-ch:
+			if err := enc.Encode(redactPairs(redactor, pairs)); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// redactorOf returns the redactor of the discovery, nil if it has none.
+func redactorOf(d client.ServiceDiscovery) *meta.Redactor {
+	if rd, ok := d.(interface{ Redactor() *meta.Redactor }); ok {
+		return rd.Redactor()
+	}
+	return nil
+}
+
+func (h *DiscoveryHandler) history(w http.ResponseWriter, r *http.Request) {
+	d, release, ok := h.discovery(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	hd, ok := d.(interface{ History() []Change })
+	if !ok {
+		http.Error(w, "history is not supported", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hd.History())
+}
+
+func (h *DiscoveryHandler) watchers(w http.ResponseWriter, r *http.Request) {
+	d, release, ok := h.discovery(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	wd, ok := d.(interface{ Watchers() []WatcherInfo })
+	if !ok {
+		http.Error(w, "watchers are not supported", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(wd.Watchers())
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestDiscoveryHandler(t *testing.T) {
+	sd := &staticDiscovery{pairs: []*client.KVPair{{Key: "a"}}}
+	h := NewDiscoveryHandler(sd)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/services?path=Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps []*client.KVPair
+	json.NewDecoder(resp.Body).Decode(&ps)
+	resp.Body.Close()
+	if len(ps) != 1 || ps[0].Key != "Arith" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	resp, err = http.Get(srv.URL + "/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	l, _ := r.ReadString('\n')
+	t.Log(l)
+	sd.update([]*client.KVPair{{Key: "b"}})
+	l, _ = r.ReadString('\n')
+	if l != "[{\"Key\":\"b\",\"Value\":\"\"}]\n" {
+		t.Fatalf("unexpected %v", l)
+	}
+}
+
+func TestDiscoveryHandlerClones(t *testing.T) {
+	h := NewDiscoveryHandler(&staticDiscovery{})
+	h.clones.max = 1
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	defer h.Close()
+
+	watch, err := http.Get(srv.URL + "/watch?path=Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(watch.Body).ReadString('\n')
+	resp, err := http.Get(srv.URL + "/services?path=Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503 while Arith is watched but got %d", resp.StatusCode)
+	}
+
+	watch.Body.Close()
+	ok := waitFor(func() bool {
+		resp, err := http.Get(srv.URL + "/services?path=Echo")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	if !ok {
+		t.Fatal("expect Echo once Arith is released")
+	}
+	h.clones.mu.Lock()
+	defer h.clones.mu.Unlock()
+	if _, ok := h.clones.m["Arith"]; ok || len(h.clones.m) != 1 {
+		t.Fatalf("expect the idle clone to be evicted but got %v", h.clones.m)
+	}
+}
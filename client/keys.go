@@ -0,0 +1,57 @@
+package client
+
+import (
+	"path"
+	"strings"
+
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithExactDepth only takes the keys directly under the base path as servers and ignores deeper keys,
+// for example rpcx/Arith/tcp@127.0.0.1:8972 but not rpcx/Arith/schema/Arith.
+// Don't use it with servers whose addresses contain slashes like unix@/tmp/rpcx.sock.
+func WithExactDepth() ConsulDiscoveryOpt {
+	return WithKeyDepth(1)
+}
+
+// WithKeyDepth only takes the keys at most depth path segments below the base path as servers
+// and ignores deeper keys, so that unrelated nested data doesn't pollute the servers. Zero means unlimited.
+func WithKeyDepth(depth int) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.keyDepth = depth
+	}
+}
+
+// WithKeyPatterns only takes the keys (relative to the base path) matching one of the patterns as servers.
+// The patterns have the syntax of path.Match, where * doesn't match slashes,
+// e.g. "tcp@*" or "*/tcp@*" for servers registered one level deeper.
+func WithKeyPatterns(patterns ...string) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Errorf("ignore malformed key pattern %q: %v", pattern, err)
+				continue
+			}
+			d.keyPatterns = append(d.keyPatterns, pattern)
+		}
+	}
+}
+
+// matchKey reports whether the key relative to the base path is a server.
+func (d *ConsulDiscovery) matchKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	if d.keyDepth > 0 && strings.Count(key, "/") >= d.keyDepth {
+		return false
+	}
+	if len(d.keyPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range d.keyPatterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
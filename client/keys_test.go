@@ -0,0 +1,30 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestExactDepth(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/app/a"}, &store.KVPair{Key: "rpcx/app/x/y"}, &store.KVPair{Key: "rpcx/app2/b"}, &store.KVPair{Key: "rpcx/app/"})
+	d, _ := NewConsulDiscoveryStore("rpcx/app", kv)
+	if ps := d.GetServices(); len(ps) != 2 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	d.Close()
+	d, _ = NewConsulDiscoveryStore("rpcx/app", newFakeStore(kv.pairs...), WithExactDepth())
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "a" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
+
+func TestKeyDepthPatterns(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@a:1"}, &store.KVPair{Key: "rpcx/app/z1/tcp@b:1"}, &store.KVPair{Key: "rpcx/app/z1/x/y"}, &store.KVPair{Key: "rpcx/app/config"})
+	d, _ := NewConsulDiscoveryStore("rpcx/app", kv, WithKeyDepth(2), WithKeyPatterns("tcp@*", "*/tcp@*", "[bad"))
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 2 || ps[1].Key != "z1/tcp@b:1" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
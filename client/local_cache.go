@@ -0,0 +1,377 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// LocalCacheServer serves the servers discovered by one process to sibling processes
+// on the same host over a unix socket, so that only one process per host watches consul.
+//
+// Every connection starts with a line containing the service path (relative to the served discovery,
+// empty means the discovery itself), then the server writes the current servers and every change
+// as one JSON array per line. Only the latest servers are written while a client falls behind.
+// The discoveries of the requested paths are closed once they are idle, and at most 256 of them are open
+// at the same time: the connections requesting more paths are closed.
+type LocalCacheServer struct {
+	clones *clones
+	ln     net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewLocalCacheServer listens on the unix socket and serves the servers of d.
+// It returns an error if another LocalCacheServer is serving on the socket.
+func NewLocalCacheServer(d client.ServiceDiscovery, socketPath string) (*LocalCacheServer, error) {
+	if err := removeStaleSocket(socketPath); err != nil {
+		log.Errorf("cannot listen on %s: %v", socketPath, err)
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Errorf("cannot listen on %s: %v", socketPath, err)
+		return nil, err
+	}
+
+	s := &LocalCacheServer{
+		clones: newClones(d),
+		ln:     ln,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	if err := budget.Go("local cache server", s.serve); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// removeStaleSocket removes the socket left by a previous run, unless a server still accepts connections on it.
+func removeStaleSocket(socketPath string) error {
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("local cache is already served on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalCacheServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				log.Errorf("local cache server stopped: %v", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		if err := budget.Go("local cache conn", func() { s.handle(conn) }); err != nil {
+			log.Errorf("cannot serve local cache client: %v", err)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}
+	}
+}
+
+func (s *LocalCacheServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	servicePath, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	servicePath = strings.TrimSpace(servicePath)
+
+	d, release, err := s.clones.get(servicePath)
+	if err != nil {
+		log.Errorf("cannot discover %s for local cache client: %v", servicePath, err)
+		return
+	}
+	defer release()
+
+	ch := watchLatest(d, "local-cache")
+	defer d.RemoveWatcher(ch)
+
+	// the client never writes after the handshake, so a read returns only when it goes away
+	done := make(chan struct{})
+	err = budget.Go("local cache conn", func() {
+		_, _ = r.ReadByte()
+		close(done)
+	})
+	if err != nil {
+		log.Errorf("cannot serve %s for local cache client: %v", servicePath, err)
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(d.GetServices()); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case pairs := <-ch:
+			if err := enc.Encode(pairs); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close stops serving and closes all connections and cloned discoveries.
+func (s *LocalCacheServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.clones.close()
+	return err
+}
+
+// LocalCacheDiscovery is a service discovery which reads the servers from a LocalCacheServer
+// in a sibling process instead of watching consul itself.
+type LocalCacheDiscovery struct {
+	socketPath  string
+	servicePath string
+
+	pairsMu sync.RWMutex
+	pairs   []*client.KVPair
+	chans   []chan []*client.KVPair
+	mu      sync.Mutex
+
+	filter client.ServiceDiscoveryFilter
+
+	connMu sync.Mutex
+	conn   net.Conn
+	closed bool
+	stopCh chan struct{}
+}
+
+// errLocalCacheClosed is returned by the dials which finish after the discovery is closed.
+var errLocalCacheClosed = errors.New("local cache discovery is closed")
+
+// NewLocalCacheDiscovery connects to the LocalCacheServer listening on socketPath
+// and returns the servers of servicePath.
+func NewLocalCacheDiscovery(socketPath, servicePath string) (*LocalCacheDiscovery, error) {
+	d := &LocalCacheDiscovery{socketPath: socketPath, servicePath: servicePath}
+	d.stopCh = make(chan struct{})
+
+	conn, dec, err := d.dial()
+	if err != nil {
+		log.Infof("cannot connect to local cache %s: %v", socketPath, err)
+		return nil, err
+	}
+
+	var pairs []*client.KVPair
+	if err := dec.Decode(&pairs); err != nil {
+		conn.Close()
+		log.Infof("cannot read services from local cache %s: %v", socketPath, err)
+		return nil, err
+	}
+	d.setPairs(pairs)
+
+	if err := budget.Go("local cache watch", func() { d.read(conn, dec) }); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *LocalCacheDiscovery) dial() (net.Conn, *json.Decoder, error) {
+	conn, err := net.Dial("unix", d.socketPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write([]byte(d.servicePath + "\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	// Close may have run during the dial, the connection would never be closed then
+	if d.closed {
+		conn.Close()
+		return nil, nil, errLocalCacheClosed
+	}
+	d.conn = conn
+	return conn, json.NewDecoder(conn), nil
+}
+
+func (d *LocalCacheDiscovery) read(conn net.Conn, dec *json.Decoder) {
+	var tempDelay time.Duration
+	for {
+		for {
+			var pairs []*client.KVPair
+			if err := dec.Decode(&pairs); err != nil {
+				break
+			}
+			tempDelay = 0
+			d.setPairs(pairs)
+		}
+		conn.Close()
+
+		for {
+			select {
+			case <-d.stopCh:
+				return
+			default:
+			}
+
+			if tempDelay == 0 {
+				tempDelay = 100 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 5 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			log.Warnf("local cache %s is disconnected, reconnect after %v", d.socketPath, tempDelay)
+
+			select {
+			case <-d.stopCh:
+				return
+			case <-time.After(tempDelay):
+			}
+
+			var err error
+			conn, dec, err = d.dial()
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+func (d *LocalCacheDiscovery) setPairs(ps []*client.KVPair) {
+	var pairs []*client.KVPair
+	for _, p := range ps {
+		if d.filter != nil && !d.filter(p) {
+			continue
+		}
+		pairs = append(pairs, p)
+	}
+
+	d.pairsMu.Lock()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		select {
+		case ch <- pairs:
+		default:
+			log.Warn("chan is full and new change has been dropped")
+		}
+	}
+	d.mu.Unlock()
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+func (d *LocalCacheDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	if d.servicePath != "" {
+		servicePath = d.servicePath + "/" + servicePath
+	}
+	return NewLocalCacheDiscovery(d.socketPath, servicePath)
+}
+
+// SetFilter sets the filer.
+func (d *LocalCacheDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {
+	d.filter = filter
+}
+
+// GetServices returns the servers
+func (d *LocalCacheDiscovery) GetServices() []*client.KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive the changes of servers.
+func (d *LocalCacheDiscovery) WatchService() chan []*client.KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*client.KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *LocalCacheDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*client.KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+func (d *LocalCacheDiscovery) Close() {
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.closed = true
+	close(d.stopCh)
+	if d.conn != nil {
+		d.conn.Close()
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+type staticDiscovery struct {
+	mu    sync.Mutex
+	pairs []*client.KVPair
+	chans []chan []*client.KVPair
+}
+
+func (d *staticDiscovery) GetServices() []*client.KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pairs
+}
+
+func (d *staticDiscovery) WatchService() chan []*client.KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch := make(chan []*client.KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *staticDiscovery) RemoveWatcher(ch chan []*client.KVPair) {}
+
+func (d *staticDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	return &staticDiscovery{pairs: []*client.KVPair{{Key: servicePath}}}, nil
+}
+
+func (d *staticDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {}
+
+func (d *staticDiscovery) Close() {}
+
+func (d *staticDiscovery) update(pairs []*client.KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pairs = pairs
+	for _, ch := range d.chans {
+		ch <- pairs
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rpcx.sock")
+	sd := &staticDiscovery{pairs: []*client.KVPair{{Key: "tcp@127.0.0.1:8972"}}}
+
+	s, err := NewLocalCacheServer(sd, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d, err := NewLocalCacheDiscovery(socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@127.0.0.1:8972" {
+		t.Fatalf("unexpected services: %v", ps)
+	}
+
+	ch := d.WatchService()
+	for {
+		sd.mu.Lock()
+		watched := len(sd.chans) > 0
+		sd.mu.Unlock()
+		if watched {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sd.update([]*client.KVPair{{Key: "tcp@127.0.0.1:8972"}, {Key: "tcp@127.0.0.1:8973"}})
+	select {
+	case ps := <-ch:
+		if len(ps) != 2 {
+			t.Fatalf("expect 2 services but got %d", len(ps))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+
+	clone, err := d.Clone("Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if ps := clone.GetServices(); len(ps) != 1 || ps[0].Key != "Arith" {
+		t.Fatalf("unexpected services of clone: %v", ps)
+	}
+}
+
+func TestLocalCacheSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rpcx.sock")
+	sd := &staticDiscovery{pairs: []*client.KVPair{{Key: "tcp@127.0.0.1:8972"}}}
+
+	// the socket left by a crashed process is removed
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	s, err := NewLocalCacheServer(sd, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the socket of a live server is kept
+	if _, err := NewLocalCacheServer(sd, socketPath); err == nil {
+		t.Fatal("expect error of the socket which is served")
+	}
+	d, err := NewLocalCacheDiscovery(socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a reconnect finishing after Close doesn't leak the connection
+	d.Close()
+	d.Close()
+	if _, _, err := d.dial(); err != errLocalCacheClosed {
+		t.Fatalf("expect errLocalCacheClosed but got %v", err)
+	}
+}
+
+func TestLocalCacheClones(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rpcx.sock")
+	s, err := NewLocalCacheServer(&staticDiscovery{}, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.clones.max = 1
+
+	a, err := NewLocalCacheDiscovery(socketPath, "Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLocalCacheDiscovery(socketPath, "Echo"); err == nil {
+		t.Fatal("expect an error while Arith is served")
+	}
+
+	a.Close()
+	var b *LocalCacheDiscovery
+	if !waitFor(func() bool { b, err = NewLocalCacheDiscovery(socketPath, "Echo"); return err == nil }) {
+		t.Fatalf("expect Echo once Arith is released: %v", err)
+	}
+	defer b.Close()
+}
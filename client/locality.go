@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/cloudmeta"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// Locality is the zone and region of the client.
+type Locality struct {
+	Zone   string
+	Region string
+}
+
+// WithLocality prefers the servers in the zone of the client, then the servers in its region,
+// and falls back to all servers if none of them is local. The servers publish their zone and region
+// as meta.Zone and meta.Region, e.g. with serverplugin.WithConsulEnrichers.
+func WithLocality(locality Locality) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.locality = &locality
+	}
+}
+
+// WithPreferLocal is WithLocality with the zone and region of the client read by the enrichers,
+// cloudmeta.Default() if none is given. They are read once and shared by the clones.
+func WithPreferLocal(enrichers ...cloudmeta.Enricher) ConsulDiscoveryOpt {
+	if len(enrichers) == 0 {
+		enrichers = cloudmeta.Default()
+	}
+
+	var once sync.Once
+	var locality Locality
+	return func(d *ConsulDiscovery) {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cloudmeta.DefaultTimeout)
+			defer cancel()
+
+			fields, errs := cloudmeta.Enrich(ctx, enrichers...)
+			locality = Locality{Zone: fields[meta.Zone], Region: fields[meta.Region]}
+			if locality.Zone == "" && locality.Region == "" {
+				log.Warnf("cannot detect the zone of the client, prefer no servers: %v", errs)
+			}
+		})
+		l := locality
+		d.locality = &l
+	}
+}
+
+// Locality returns the zone and region of the client which the servers are preferred by.
+func (d *ConsulDiscovery) Locality() Locality {
+	if d.locality == nil {
+		return Locality{}
+	}
+	return *d.locality
+}
+
+// preferLocal returns the servers in the zone of the client if any, otherwise the servers in its region if any,
+// otherwise all servers.
+func (d *ConsulDiscovery) preferLocal(pairs []*client.KVPair) []*client.KVPair {
+	l := d.locality
+	if l == nil || (l.Zone == "" && l.Region == "") {
+		return pairs
+	}
+
+	var zone, region []*client.KVPair
+	for _, pair := range pairs {
+		v := meta.Parse(pair.Value)
+		if l.Zone != "" && v.Get(meta.Zone) == l.Zone {
+			zone = append(zone, pair)
+		}
+		if l.Region != "" && v.Get(meta.Region) == l.Region {
+			region = append(region, pair)
+		}
+	}
+
+	switch {
+	case len(zone) > 0:
+		return zone
+	case len(region) > 0:
+		return region
+	default:
+		return pairs
+	}
+}
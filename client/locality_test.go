@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/cloudmeta"
+)
+
+func TestLocality(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/app/tcp@1:1", Value: []byte("zone=a1&region=a")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:2", Value: []byte("zone=a2&region=a")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:3", Value: []byte("zone=b1&region=b")},
+	)
+	calls := 0
+	opt := WithPreferLocal(cloudmeta.EnricherFunc(func(context.Context) (map[string]string, error) {
+		calls++
+		return map[string]string{"zone": "a1", "region": "a"}, nil
+	}))
+	d, err := NewConsulDiscoveryStore("rpcx/app", kv, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@1:1" {
+		t.Fatalf("got %v", ps)
+	}
+
+	kv.watchCh <- []*store.KVPair{
+		{Key: "rpcx/app/tcp@1:2", Value: []byte("zone=a2&region=a")},
+		{Key: "rpcx/app/tcp@1:3", Value: []byte("zone=b1&region=b")},
+	}
+	if !waitFor(func() bool { ps := d.GetServices(); return len(ps) == 1 && ps[0].Key == "tcp@1:2" }) {
+		t.Fatalf("got %v", d.GetServices())
+	}
+	kv.watchCh <- []*store.KVPair{
+		{Key: "rpcx/app/tcp@1:3", Value: []byte("zone=b1&region=b")},
+		{Key: "rpcx/app/tcp@1:4", Value: []byte("")},
+	}
+	if !waitFor(func() bool { return len(d.GetServices()) == 2 }) {
+		t.Fatalf("got %v", d.GetServices())
+	}
+	c, _ := d.Clone("app")
+	if calls != 1 || c.(*ConsulDiscovery).Locality().Zone != "a1" {
+		t.Fatalf("calls %d", calls)
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// lookup returns the server with the key.
+func (d *ConsulDiscovery) lookup(key string) (*client.KVPair, bool) {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+
+	for _, p := range d.loadPairs() {
+		if p.Key == key {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Ownership returns the owner, team and oncall contact of the server with the key.
+func (d *ConsulDiscovery) Ownership(key string) (meta.Ownership, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return meta.Ownership{}, false
+	}
+	return meta.OwnershipOf(p.Value), true
+}
+
+// BuildInfo returns the build information of the binary of the server with the key.
+func (d *ConsulDiscovery) BuildInfo(key string) (meta.BuildInfo, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return meta.BuildInfo{}, false
+	}
+	return meta.BuildInfoOf(p.Value), true
+}
+
+// Uptime returns how long the server with the key has been running.
+func (d *ConsulDiscovery) Uptime(key string) (time.Duration, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	return meta.UptimeOf(p.Value)
+}
+
+// Capacity returns the max_qps and max_concurrency hints of the server with the key.
+func (d *ConsulDiscovery) Capacity(key string) (meta.Capacity, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return meta.Capacity{}, false
+	}
+	return meta.CapacityOf(p.Value), true
+}
+
+// Ports returns the rpc, metrics and pprof ports published by the server with the key.
+// Use meta.HostPort to get the endpoint of a port.
+func (d *ConsulDiscovery) Ports(key string) (meta.Ports, bool) {
+	p, ok := d.lookup(key)
+	if !ok {
+		return meta.Ports{}, false
+	}
+	return meta.PortsOf(p.Value), true
+}
+
+// SelectorHints returns the weight, zone, health and capacity of all servers by their keys.
+func (d *ConsulDiscovery) SelectorHints() meta.SelectorHints {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+
+	pairs := d.loadPairs()
+	hints := make(meta.SelectorHints, len(pairs))
+	for _, p := range pairs {
+		hints[p.Key] = meta.HintsOf(p.Value)
+	}
+	return hints
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// failoverCheckInterval is how often the datacenters are checked for reachability
+// besides the changes of their servers.
+var failoverCheckInterval = time.Second
+
+// multiDCRetryInterval is how long to wait before discovering again in a datacenter whose servers can't be listed,
+// it doubles on every failure up to 30 seconds.
+var multiDCRetryInterval = time.Second
+
+// MultiDCDiscovery discovers the servers in several consul datacenters.
+// It prefers the servers in the first (local) datacenter and fails over to the next datacenters in order
+// when the local servers become empty or the local consul is unreachable.
+// The datacenter of each server is set in its metadata as meta.Datacenter.
+// A datacenter whose servers can't be listed is disconnected until discovering in it succeeds.
+type MultiDCDiscovery struct {
+	basePath    string
+	datacenters []string
+	kvs         []store.Store
+	ownStores   bool
+	opts        []ConsulDiscoveryOpt
+
+	mu       sync.Mutex
+	ds       []*ConsulDiscovery // nil for the datacenters which are retried
+	closed   bool
+	pairs    []*client.KVPair
+	active   string
+	filter   client.ServiceDiscoveryFilter
+	watchers []chan []*client.KVPair
+
+	changed chan struct{}
+	stopCh  chan struct{}
+}
+
+// NewMultiDCDiscovery returns a new MultiDCDiscovery of the datacenters, the first one is the local datacenter.
+// All datacenters are queried through the consul agent at consulAddr. options and cfg are optional.
+func NewMultiDCDiscovery(basePath, servicePath string, consulAddr []string, options *store.Config, cfg *consulkv.Config, datacenters []string, opts ...ConsulDiscoveryOpt) (*MultiDCDiscovery, error) {
+	kvs := make([]store.Store, 0, len(datacenters))
+	closeAll := func() {
+		for _, kv := range kvs {
+			kv.Close()
+		}
+	}
+	for _, dc := range datacenters {
+		var c consulkv.Config
+		if cfg != nil {
+			c = *cfg
+		}
+		c.Datacenter = dc
+		kv, err := consulkv.New(consulAddr, options, &c)
+		if err != nil {
+			log.Infof("cannot create store of datacenter %s: %v", dc, err)
+			closeAll()
+			return nil, err
+		}
+		kvs = append(kvs, kv)
+	}
+
+	d, err := NewMultiDCDiscoveryStore(basePath+"/"+servicePath, datacenters, kvs, opts...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	d.ownStores = true
+	return d, nil
+}
+
+// NewMultiDCDiscoveryStore returns a new MultiDCDiscovery with the stores of the datacenters in the same order.
+// The stores are not closed with the discovery. It returns an error only if the servers of no datacenter can be listed.
+func NewMultiDCDiscoveryStore(basePath string, datacenters []string, kvs []store.Store, opts ...ConsulDiscoveryOpt) (*MultiDCDiscovery, error) {
+	if len(datacenters) == 0 {
+		return nil, errors.New("datacenters are not specified")
+	}
+	if len(datacenters) != len(kvs) {
+		return nil, fmt.Errorf("%d datacenters but %d stores", len(datacenters), len(kvs))
+	}
+
+	m := &MultiDCDiscovery{
+		basePath:    basePath,
+		datacenters: datacenters,
+		kvs:         kvs,
+		opts:        opts,
+		changed:     make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+	m.ds = make([]*ConsulDiscovery, len(kvs))
+	var lastErr error
+	connected := 0
+	for i, kv := range kvs {
+		d, err := NewConsulDiscoveryStore(basePath, kv, m.dcOpts()...)
+		if err != nil {
+			log.Warnf("cannot discover %s in datacenter %s: %v", basePath, datacenters[i], err)
+			lastErr = err
+			continue
+		}
+		m.ds[i] = d
+		connected++
+	}
+	if connected == 0 {
+		return nil, lastErr
+	}
+
+	m.update()
+	for i, d := range m.ds {
+		i, d := i, d
+		var err error
+		if d == nil {
+			err = budget.Go("multi-dc retry", func() { m.retry(i) })
+		} else {
+			err = budget.Go("multi-dc forward", func() { m.forward(d) })
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if err := budget.Go("multi-dc watch", m.watch); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// dcOpts returns the options of the discoveries of the datacenters, which share the stores with the clones.
+func (m *MultiDCDiscovery) dcOpts() []ConsulDiscoveryOpt {
+	return append(m.opts[:len(m.opts):len(m.opts)], withSharedStore())
+}
+
+// discoveries returns the discoveries of the datacenters, nil for the ones which are retried.
+func (m *MultiDCDiscovery) discoveries() []*ConsulDiscovery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*ConsulDiscovery(nil), m.ds...)
+}
+
+// retry discovers in the datacenter i until it succeeds or m is closed.
+func (m *MultiDCDiscovery) retry(i int) {
+	interval := multiDCRetryInterval
+	for {
+		t := time.NewTimer(interval)
+		select {
+		case <-m.stopCh:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		d, err := NewConsulDiscoveryStore(m.basePath, m.kvs[i], m.dcOpts()...)
+		if err != nil {
+			log.Warnf("cannot discover %s in datacenter %s: %v", m.basePath, m.datacenters[i], err)
+			if interval *= 2; interval > 30*time.Second {
+				interval = 30 * time.Second
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			d.Close()
+			return
+		}
+		m.ds[i] = d
+		m.mu.Unlock()
+		log.Infof("discovering %s in datacenter %s", m.basePath, m.datacenters[i])
+		if err := budget.Go("multi-dc forward", func() { m.forward(d) }); err != nil {
+			log.Errorf("cannot watch %s in datacenter %s: %v", m.basePath, m.datacenters[i], err)
+		}
+		m.notify()
+		return
+	}
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+func (m *MultiDCDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	return NewMultiDCDiscoveryStore(m.basePath+"/"+servicePath, m.datacenters, m.kvs, m.opts...)
+}
+
+// SetFilter sets the filer.
+func (m *MultiDCDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {
+	m.mu.Lock()
+	m.filter = filter
+	m.mu.Unlock()
+	m.update()
+}
+
+// GetServices returns the servers of the preferred datacenter.
+func (m *MultiDCDiscovery) GetServices() []*client.KVPair {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pairs
+}
+
+// Datacenter returns the datacenter whose servers are returned, empty if there are no servers.
+func (m *MultiDCDiscovery) Datacenter() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// WatchService returns a chan receiving the servers on every change.
+func (m *MultiDCDiscovery) WatchService() chan []*client.KVPair {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := make(chan []*client.KVPair, 10)
+	m.watchers = append(m.watchers, ch)
+	return ch
+}
+
+func (m *MultiDCDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var watchers []chan []*client.KVPair
+	for _, c := range m.watchers {
+		if c != ch {
+			watchers = append(watchers, c)
+		}
+	}
+	m.watchers = watchers
+}
+
+// Close closes the discoveries of all datacenters, and their stores if m created them.
+// It is safe to call Close more than once.
+func (m *MultiDCDiscovery) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	ds := m.ds
+	m.mu.Unlock()
+
+	close(m.stopCh)
+	for _, d := range ds {
+		if d != nil {
+			d.Close()
+		}
+	}
+	if m.ownStores {
+		for _, kv := range m.kvs {
+			kv.Close()
+		}
+	}
+}
+
+// forward signals the changes of the servers in a datacenter.
+func (m *MultiDCDiscovery) forward(d *ConsulDiscovery) {
+	ch := d.WatchServiceNamed("multi-dc")
+	defer d.RemoveWatcher(ch)
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ch:
+			m.notify()
+		}
+	}
+}
+
+// notify signals the watch to choose the datacenter again.
+func (m *MultiDCDiscovery) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// watch chooses the datacenter again on every change and periodically, as the reachability changes silently.
+func (m *MultiDCDiscovery) watch() {
+	ticker := time.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-m.changed:
+		case <-ticker.C:
+		}
+		m.update()
+	}
+}
+
+// update chooses the first reachable datacenter which has servers, and notifies the watchers if the servers change.
+func (m *MultiDCDiscovery) update() {
+	var dc string
+	var ps []*client.KVPair
+	for i, d := range m.discoveries() {
+		if d == nil || !d.Connected() {
+			continue
+		}
+		if ps = d.GetServices(); len(ps) > 0 {
+			dc = m.datacenters[i]
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pairs := make([]*client.KVPair, 0, len(ps))
+	for _, p := range ps {
+		v := meta.Parse(p.Value)
+		v.Set(meta.Datacenter, dc)
+		pair := &client.KVPair{Key: p.Key, Value: v.Encode()}
+		if m.filter != nil && !m.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if dc != m.active {
+		switch {
+		case dc != m.datacenters[0]:
+			log.Warnf("servers of %s fail over to datacenter %q from %q", m.basePath, dc, m.active)
+		case m.active != "":
+			log.Infof("servers of %s fail back to datacenter %q from %q", m.basePath, dc, m.active)
+		}
+		m.active = dc
+	}
+	if c := diffPairs(m.pairs, pairs); c.IsEmpty() {
+		return
+	}
+	m.pairs = pairs
+
+	for _, ch := range m.watchers {
+		select {
+		case ch <- pairs:
+		default:
+			log.Warnf("chan of watcher of %s is full and new change has been dropped", m.basePath)
+		}
+	}
+}
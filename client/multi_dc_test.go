@@ -0,0 +1,84 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+func TestMultiDC(t *testing.T) {
+	local := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@1:1", Value: []byte("a=1")})
+	remote := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@2:1"})
+	m, err := NewMultiDCDiscoveryStore("rpcx/app", []string{"dc1", "dc2"}, []store.Store{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ps := m.GetServices()
+	if len(ps) != 1 || meta.Parse(ps[0].Value).Get("dc") != "dc1" || m.Datacenter() != "dc1" {
+		t.Fatalf("got %v", ps)
+	}
+	ch := m.WatchService()
+	local.watchCh <- []*store.KVPair{}
+	select {
+	case ps := <-ch:
+		if len(ps) != 1 || ps[0].Key != "tcp@2:1" || m.Datacenter() != "dc2" {
+			t.Fatalf("got %v", ps)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no failover")
+	}
+	local.watchCh <- []*store.KVPair{{Key: "rpcx/app/tcp@1:2"}}
+	select {
+	case ps := <-ch:
+		if len(ps) != 1 || ps[0].Key != "tcp@1:2" {
+			t.Fatalf("got %v", ps)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no failback")
+	}
+	// the local consul becomes unreachable
+	m.ds[0].watchFailed(errors.New("down"))
+	m.update()
+	if m.Datacenter() != "dc2" {
+		t.Fatal("no failover on disconnect")
+	}
+}
+
+func TestMultiDCRetry(t *testing.T) {
+	defer func(d time.Duration) { multiDCRetryInterval = d }(multiDCRetryInterval)
+	multiDCRetryInterval = 10 * time.Millisecond
+
+	local := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@1:1"})
+	local.listErr = errors.New("down")
+	remote := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@2:1"})
+	m, err := NewMultiDCDiscoveryStore("rpcx/app", []string{"dc1", "dc2"}, []store.Store{local, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Datacenter() != "dc2" {
+		t.Fatalf("expect dc2 while dc1 is down but got %q", m.Datacenter())
+	}
+
+	local.mu.Lock()
+	local.listErr = nil
+	local.mu.Unlock()
+	if !waitFor(func() bool { return m.Datacenter() == "dc1" }) {
+		t.Fatal("no failback once dc1 can be listed")
+	}
+
+	m.Close()
+	m.Close()
+	if local.isClosed() || remote.isClosed() {
+		t.Fatal("expect the stores of the caller to be kept")
+	}
+
+	remote.listErr = errors.New("down")
+	local.listErr = errors.New("down")
+	if _, err := NewMultiDCDiscoveryStore("rpcx/app", []string{"dc1", "dc2"}, []store.Store{local, remote}); err == nil {
+		t.Fatal("expect an error if no datacenter can be listed")
+	}
+}
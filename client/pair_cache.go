@@ -0,0 +1,201 @@
+package client
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/smallnest/rpcx/client"
+)
+
+// pairOverhead approximates the bytes of a cached server besides its key and value.
+const pairOverhead = 64
+
+// PairCache stores the servers of the discoveries by their base paths. One cache may be shared by many
+// discoveries, e.g. a template and its clones, so it must be safe for concurrent use. A bounded cache may evict
+// the servers of a discovery, which are listed from consul again by the next GetServices.
+// Other backends, e.g. an off-heap cache such as ristretto, can be plugged in by implementing it.
+type PairCache interface {
+	Get(basePath string) ([]*client.KVPair, bool)
+	Set(basePath string, pairs []*client.KVPair)
+	Delete(basePath string)
+}
+
+// WithPairCache stores the servers in cache instead of the memory of the discovery.
+// The clones share the cache, the servers of a discovery are deleted from it when it is closed.
+func WithPairCache(cache PairCache) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.cache = cache
+	}
+}
+
+// pairSlot is the default cache of a discovery, it holds the servers of one base path and is guarded by pairsMu.
+type pairSlot struct {
+	pairs []*client.KVPair
+	set   bool
+}
+
+func (s *pairSlot) Get(basePath string) ([]*client.KVPair, bool) {
+	return s.pairs, s.set
+}
+
+func (s *pairSlot) Set(basePath string, pairs []*client.KVPair) {
+	s.pairs, s.set = pairs, true
+}
+
+func (s *pairSlot) Delete(basePath string) {
+	s.pairs, s.set = nil, false
+}
+
+// loadPairs returns the cached servers, the caller holds pairsMu.
+func (d *ConsulDiscovery) loadPairs() []*client.KVPair {
+	pairs, _ := d.cache.Get(d.basePath)
+	return pairs
+}
+
+// PairCacheStats is the usage of a ShardedPairCache.
+type PairCacheStats struct {
+	Services  int    `json:"services"`
+	Servers   int    `json:"servers"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ShardedPairCache is a PairCache sharded by base path, for processes watching hundreds of services.
+// If MaxBytes is positive, the least recently read services are evicted when the servers take more bytes.
+type ShardedPairCache struct {
+	// accessed atomically and kept first for alignment
+	bytes     int64
+	clock     uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	MaxBytes int64
+	shards   []*pairShard
+}
+
+type pairShard struct {
+	mu      sync.RWMutex
+	entries map[string]*pairEntry
+}
+
+type pairEntry struct {
+	// the clock of the last read, accessed atomically
+	used  uint64
+	pairs []*client.KVPair
+	size  int64
+}
+
+// NewShardedPairCache returns a ShardedPairCache of shards shards, 16 if shards is not positive,
+// which holds at most maxBytes of servers, zero means unbounded.
+func NewShardedPairCache(shards int, maxBytes int64) *ShardedPairCache {
+	if shards <= 0 {
+		shards = 16
+	}
+	c := &ShardedPairCache{MaxBytes: maxBytes, shards: make([]*pairShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &pairShard{entries: make(map[string]*pairEntry)}
+	}
+	return c
+}
+
+func (c *ShardedPairCache) shard(basePath string) *pairShard {
+	h := fnv.New32a()
+	h.Write([]byte(basePath))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Get returns the servers of basePath.
+func (c *ShardedPairCache) Get(basePath string) ([]*client.KVPair, bool) {
+	s := c.shard(basePath)
+	s.mu.RLock()
+	e, ok := s.entries[basePath]
+	s.mu.RUnlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	atomic.StoreUint64(&e.used, atomic.AddUint64(&c.clock, 1))
+	return e.pairs, true
+}
+
+// Set stores the servers of basePath and evicts other services if the cache exceeds MaxBytes.
+func (c *ShardedPairCache) Set(basePath string, pairs []*client.KVPair) {
+	e := &pairEntry{pairs: pairs, used: atomic.AddUint64(&c.clock, 1)}
+	for _, p := range pairs {
+		e.size += int64(len(p.Key) + len(p.Value) + pairOverhead)
+	}
+
+	s := c.shard(basePath)
+	s.mu.Lock()
+	delta := e.size
+	if old, ok := s.entries[basePath]; ok {
+		delta -= old.size
+	}
+	s.entries[basePath] = e
+	s.mu.Unlock()
+
+	if atomic.AddInt64(&c.bytes, delta) > c.MaxBytes && c.MaxBytes > 0 {
+		c.evict(basePath)
+	}
+}
+
+// Delete deletes the servers of basePath.
+func (c *ShardedPairCache) Delete(basePath string) {
+	s := c.shard(basePath)
+	s.mu.Lock()
+	e, ok := s.entries[basePath]
+	delete(s.entries, basePath)
+	s.mu.Unlock()
+	if ok {
+		atomic.AddInt64(&c.bytes, -e.size)
+	}
+}
+
+// evict deletes the least recently read services except keep until the cache fits in MaxBytes.
+func (c *ShardedPairCache) evict(keep string) {
+	for atomic.LoadInt64(&c.bytes) > c.MaxBytes {
+		var (
+			oldest     string
+			oldestUsed uint64
+			found      bool
+		)
+		for _, s := range c.shards {
+			s.mu.RLock()
+			for basePath, e := range s.entries {
+				if used := atomic.LoadUint64(&e.used); basePath != keep && (!found || used < oldestUsed) {
+					oldest, oldestUsed, found = basePath, used, true
+				}
+			}
+			s.mu.RUnlock()
+		}
+		if !found {
+			return
+		}
+		c.Delete(oldest)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// Stats returns the usage of the cache.
+func (c *ShardedPairCache) Stats() PairCacheStats {
+	stats := PairCacheStats{
+		Bytes:     atomic.LoadInt64(&c.bytes),
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for _, s := range c.shards {
+		s.mu.RLock()
+		stats.Services += len(s.entries)
+		for _, e := range s.entries {
+			stats.Servers += len(e.pairs)
+		}
+		s.mu.RUnlock()
+	}
+	return stats
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestShardedPairCache(t *testing.T) {
+	c := NewShardedPairCache(4, 3*(pairOverhead+2))
+	c.Set("a", []*client.KVPair{{Key: "1", Value: "x"}})
+	c.Set("b", []*client.KVPair{{Key: "1", Value: "x"}})
+	c.Get("a")
+	c.Set("c", []*client.KVPair{{Key: "1", Value: "x"}, {Key: "2", Value: "y"}})
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a should be kept")
+	}
+	st := c.Stats()
+	if st.Services != 2 || st.Servers != 3 || st.Evictions != 1 || st.Bytes != 3*(pairOverhead+2) || st.Misses != 1 {
+		t.Fatalf("%+v", st)
+	}
+	c.Delete("a")
+	if c.Stats().Bytes != 2*(pairOverhead+2) {
+		t.Fatalf("unexpected stats %+v", c.Stats())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Set(string(rune('a'+i)), []*client.KVPair{{Key: "k", Value: "v"}})
+				c.Get(string(rune('a' + (i+1)%8)))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPairCacheDiscovery(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/B/b"})
+	cache := NewShardedPairCache(0, 0)
+	d, err := NewConsulDiscoveryStore("rpcx", kv, WithPairCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.GetServices()) != 2 {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+	cache.Delete("rpcx")
+	if len(d.GetServices()) != 2 {
+		t.Fatal("evicted servers are not listed again")
+	}
+	if cache.Stats().Services != 1 {
+		t.Fatalf("unexpected stats %+v", cache.Stats())
+	}
+	d.Close()
+	if cache.Stats().Services != 0 {
+		t.Fatalf("unexpected stats %+v", cache.Stats())
+	}
+}
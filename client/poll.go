@@ -0,0 +1,76 @@
+package client
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/log"
+)
+
+// pollsBeforeRewatch is how many polls are done before trying to watch again.
+const pollsBeforeRewatch = 10
+
+// WithPollFallback degrades to listing the servers every interval after the watch fails the given times in a row,
+// for example when a proxy strips the long polls or consul is too old. The servers are only updated when
+// the checksum of the listing changes, and the watch is tried again every 10 polls.
+func WithPollFallback(failures int, interval time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.pollAfter = failures
+		d.pollInterval = interval
+	}
+}
+
+// pollTree lists the directory periodically and calls update with the latest servers when their checksum
+// differs from sum, which is the checksum of the last servers it updated.
+// It returns true to try to watch again, or false if the discovery is closed.
+func (d *ConsulDiscovery) pollTree(directory string, update func(ps []*store.KVPair), sum *string) bool {
+	log.Warnf("watch of %s keeps failing, degrade to list it every %v", directory, d.pollInterval)
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for i := 0; i < pollsBeforeRewatch; i++ {
+		ps, err := d.kv.List(directory)
+		if err == store.ErrKeyNotFound {
+			ps, err = nil, nil
+		}
+		if err != nil {
+			d.watchFailed(fmt.Errorf("cannot list %s: %w", directory, err))
+			log.Warnf("cannot list %s: %v", directory, err)
+		} else {
+			d.watchRecovered()
+			if s := checksum(ps); s != *sum {
+				*sum = s
+				update(ps)
+			}
+		}
+
+		select {
+		case <-d.stopCh:
+			log.Info("discovery has been closed")
+			return false
+		case <-ticker.C:
+		}
+	}
+
+	log.Infof("try to watch %s again", directory)
+	return true
+}
+
+// checksum returns the checksum of the keys and values of the pairs regardless of their order.
+func checksum(ps []*store.KVPair) string {
+	sorted := append([]*store.KVPair(nil), ps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	h := sha256.New()
+	for _, p := range sorted {
+		h.Write([]byte(p.Key))
+		h.Write([]byte{0})
+		h.Write(p.Value)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
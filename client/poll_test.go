@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+type noWatchStore struct{ *fakeStore }
+
+func (s noWatchStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return nil, errors.New("long poll stripped")
+}
+
+func TestPollFallback(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/app/tcp@1:1"})
+	d, err := NewConsulDiscoveryStore("rpcx/app", noWatchStore{kv}, WithPollFallback(2, 10*time.Millisecond), WithWatchBackoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ch := d.WatchService()
+	kv.Put("rpcx/app/tcp@1:2", nil, nil)
+	select {
+	case ps := <-ch:
+		if len(ps) != 2 {
+			t.Fatalf("got %v", ps)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not polled")
+	}
+	// unchanged listings don't notify
+	select {
+	case ps := <-ch:
+		t.Fatalf("unexpected change %v", ps)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	a := []*store.KVPair{{Key: "a", Value: []byte("1")}, {Key: "b"}}
+	b := []*store.KVPair{{Key: "b"}, {Key: "a", Value: []byte("1")}}
+	if checksum(a) != checksum(b) || checksum(a) == checksum(a[:1]) {
+		t.Fatal("bad checksum")
+	}
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// DefaultPreparedQueryInterval is how often the prepared query is executed by default.
+const DefaultPreparedQueryInterval = 10 * time.Second
+
+// ConsulPreparedQueryDiscovery is a consul service discovery based on prepared queries,
+// so that the failover, nearest-N and tag policies are defined in consul instead of in every client.
+// Prepared queries don't support blocking queries, so the query is executed periodically
+// and the watchers are notified when the servers change.
+// The servers are converted as ConsulCatalogDiscovery does, and the datacenter is set as meta.Datacenter.
+type ConsulPreparedQueryDiscovery struct {
+	consul   *api.Client
+	query    string
+	interval time.Duration
+
+	pairsMu sync.RWMutex
+	pairs   []*client.KVPair
+	chans   []chan []*client.KVPair
+	mu      sync.Mutex
+
+	filter client.ServiceDiscoveryFilter
+
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConsulPreparedQueryDiscovery returns a ConsulPreparedQueryDiscovery executing the prepared query,
+// which is its ID or name, every interval. cfg is optional.
+func NewConsulPreparedQueryDiscovery(query string, consulAddr []string, cfg *consulkv.Config, interval time.Duration) (*ConsulPreparedQueryDiscovery, error) {
+	s, err := consulkv.New(consulAddr, nil, cfg)
+	if err != nil {
+		log.Infof("cannot create consul client: %v", err)
+		return nil, err
+	}
+	return NewConsulPreparedQueryDiscoveryClient(query, s.Client(), interval)
+}
+
+// NewConsulPreparedQueryDiscoveryClient returns a ConsulPreparedQueryDiscovery with specified consul client.
+func NewConsulPreparedQueryDiscoveryClient(query string, consul *api.Client, interval time.Duration) (*ConsulPreparedQueryDiscovery, error) {
+	if interval <= 0 {
+		interval = DefaultPreparedQueryInterval
+	}
+	d := &ConsulPreparedQueryDiscovery{consul: consul, query: query, interval: interval, stopCh: make(chan struct{})}
+
+	if err := d.execute(); err != nil {
+		log.Infof("cannot execute prepared query %s: %v", query, err)
+		return nil, err
+	}
+
+	if err := budget.Go("prepared query watch", d.watch); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// watch executes the query every interval.
+func (d *ConsulPreparedQueryDiscovery) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.execute(); err != nil {
+			log.Warnf("cannot execute prepared query %s: %v", d.query, err)
+		}
+	}
+}
+
+// execute executes the query and updates the servers if they change.
+func (d *ConsulPreparedQueryDiscovery) execute() error {
+	resp, _, err := d.consul.PreparedQuery().Execute(d.query, nil)
+	if err != nil {
+		return err
+	}
+
+	pairs := make([]*client.KVPair, 0, len(resp.Nodes))
+	for i := range resp.Nodes {
+		pair := entryPair(&resp.Nodes[i])
+		if resp.Datacenter != "" {
+			v := meta.Parse(pair.Value)
+			v.Set(meta.Datacenter, resp.Datacenter)
+			pair.Value = v.Encode()
+		}
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	d.pairsMu.Lock()
+	old := d.pairs
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+	if old != nil && diffPairs(old, pairs).IsEmpty() {
+		return nil
+	}
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		select {
+		case ch <- pairs:
+		default:
+			log.Warn("chan is full and new change has been dropped")
+		}
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// Clone clones this ServiceDiscovery with new servicePath, which is the name of another prepared query,
+// e.g. a service name matched by a prepared query template.
+func (d *ConsulPreparedQueryDiscovery) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	return NewConsulPreparedQueryDiscoveryClient(servicePath, d.consul, d.interval)
+}
+
+// SetFilter sets the filer.
+func (d *ConsulPreparedQueryDiscovery) SetFilter(filter client.ServiceDiscoveryFilter) {
+	d.filter = filter
+}
+
+// GetServices returns the servers
+func (d *ConsulPreparedQueryDiscovery) GetServices() []*client.KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive the changes of servers.
+func (d *ConsulPreparedQueryDiscovery) WatchService() chan []*client.KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*client.KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *ConsulPreparedQueryDiscovery) RemoveWatcher(ch chan []*client.KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*client.KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+func (d *ConsulPreparedQueryDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stopCh)
+	})
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestPreparedQuery(t *testing.T) {
+	var mu sync.Mutex
+	port := 8972
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/query/arith-nearest/execute" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(api.PreparedQueryExecuteResponse{Datacenter: "dc2", Nodes: []api.ServiceEntry{{Node: &api.Node{Address: "10.0.0.9"}, Service: &api.AgentService{Port: port}}}})
+	}))
+	defer srv.Close()
+	d, err := NewConsulPreparedQueryDiscovery("arith-nearest", []string{strings.TrimPrefix(srv.URL, "http://")}, nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@10.0.0.9:8972" || ps[0].Value != "dc=dc2" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	ch := d.WatchService()
+	select {
+	case ps := <-ch:
+		t.Fatalf("unexpected %v", ps)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	port = 8973
+	mu.Unlock()
+	select {
+	case ps := <-ch:
+		if ps[0].Key != "tcp@10.0.0.9:8973" {
+			t.Fatalf("unexpected services %v", ps)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change")
+	}
+	if _, err := NewConsulPreparedQueryDiscovery("missing", []string{strings.TrimPrefix(srv.URL, "http://")}, nil, 0); err == nil {
+		t.Fatal("expect error")
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/profile"
+)
+
+// staleReader is implemented by the stores which can serve stale reads, such as consulkv.Store.
+type staleReader interface {
+	StaleReads() *consulkv.StaleStore
+}
+
+// WithProfile applies the watch backoff, buffer and stale read settings of the profile,
+// the options after it override them. The stale reads only apply to the queries of this discovery
+// and its clones, not to the other users of the store.
+func WithProfile(p profile.Profile) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		WithWatchBackoff(p.BackoffMin, p.BackoffMax)(d)
+		WithWatchBuffer(p.WatchBuffer)(d)
+		if p.StaleReads {
+			if s, ok := d.kv.(staleReader); ok {
+				d.kv = s.StaleReads()
+			}
+		}
+	}
+}
+
+// WithWatchBackoff sets the backoff of re-watching consul after a watch fails, 1s to 30s by default.
+func WithWatchBackoff(min, max time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		if min > 0 && max >= min {
+			d.backoffMin = min
+			d.backoffMax = max
+		}
+	}
+}
+
+// WithWatchBuffer sets the buffer size of the chans returned by WatchService, 10 by default.
+func WithWatchBuffer(size int) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		if size > 0 {
+			d.watchBuffer = size
+		}
+	}
+}
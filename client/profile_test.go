@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/profile"
+)
+
+func TestProfile(t *testing.T) {
+	d, _ := NewConsulDiscoveryStore("rpcx/A", newFakeStore(), WithProfile(profile.ProfileLargeFleet), WithWatchBuffer(5))
+	defer d.Close()
+	if d.backoffMax != profile.ProfileLargeFleet.BackoffMax || cap(d.WatchService()) != 5 {
+		t.Fatalf("unexpected backoff %v", d.backoffMax)
+	}
+}
+
+func TestProfileStaleReads(t *testing.T) {
+	var mu sync.Mutex
+	stale := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			// the blocking query of the watch
+			<-r.Context().Done()
+			return
+		}
+		_, ok := r.URL.Query()["stale"]
+		mu.Lock()
+		stale[r.URL.Path] = ok
+		mu.Unlock()
+		w.Header().Set("X-Consul-Index", "1")
+		_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: strings.TrimPrefix(r.URL.Path, "/v1/kv/") + "tcp@127.0.0.1:8972"}})
+	}))
+	defer srv.Close()
+
+	kv, err := consulkv.New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithProfile(profile.ProfileLargeFleet), withSharedStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := kv.List("rpcx/B/"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !stale["/v1/kv/rpcx/A/"] || stale["/v1/kv/rpcx/B/"] {
+		t.Fatalf("expect only the reads of the discovery to be stale but got %v", stale)
+	}
+}
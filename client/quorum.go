@@ -0,0 +1,199 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// VerifySource is an independent source of servers used to confirm removals.
+type VerifySource interface {
+	// Keys returns the keys of the servers under basePath, relative to basePath.
+	Keys(basePath string) (map[string]bool, error)
+}
+
+// StoreSource is a VerifySource backed by a store, for example the KV of another consul cluster.
+type StoreSource struct {
+	KV store.Store
+}
+
+// Keys lists the keys under basePath.
+func (s *StoreSource) Keys(basePath string) (map[string]bool, error) {
+	ps, err := s.KV.List(basePath + "/")
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+
+	keys := make(map[string]bool, len(ps))
+	prefix := basePath + "/"
+	for _, p := range ps {
+		if strings.HasPrefix(p.Key, prefix) {
+			keys[strings.TrimPrefix(p.Key, prefix)] = true
+		}
+	}
+	return keys, nil
+}
+
+// verifyTimeout bounds how long the verify source is queried.
+var verifyTimeout = 5 * time.Second
+
+// WithVerifySource only applies the removals of servers which are confirmed by source too.
+// Servers which are removed from consul but still exist in source are kept,
+// trading freshness for resilience against a single corrupted source.
+// The removals are verified in the background, so that a slow source doesn't hold up the watch,
+// and retried with the watch backoff until they are confirmed or the servers come back.
+func WithVerifySource(source VerifySource) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.verifySource = source
+	}
+}
+
+// holdRemovals keeps the servers of old which are removed in pairs until the verify source confirms their removals,
+// except the removals confirmed already. raw is the update of the servers, which is applied again once
+// the verify source confirms removals.
+func (d *ConsulDiscovery) holdRemovals(raw, old, pairs []*client.KVPair) []*client.KVPair {
+	c := diffPairs(old, pairs)
+
+	d.verifyMu.Lock()
+	d.unverified = raw
+	held := make(map[string]bool, len(c.Left))
+	for _, k := range c.Left {
+		if !d.confirmed[k] {
+			held[k] = true
+		}
+	}
+	d.confirmed = nil
+	d.held = held
+	start := len(held) > 0 && !d.verifying
+	if start {
+		d.verifying = true
+	}
+	d.verifyMu.Unlock()
+
+	if start {
+		if err := d.spawn("removal verification", d.verifyRemovals); err != nil {
+			d.stopVerifying()
+			log.Warnf("cannot verify removals of %s, keep removed servers: %v", d.basePath, err)
+		}
+	}
+	if len(held) == 0 {
+		return pairs
+	}
+
+	verified := append([]*client.KVPair(nil), pairs...)
+	for _, p := range old {
+		if held[p.Key] {
+			verified = append(verified, p)
+		}
+	}
+	return verified
+}
+
+// verifyRemovals verifies the held removals with the verify source until none is held or the discovery is closed,
+// and applies the confirmed ones.
+func (d *ConsulDiscovery) verifyRemovals() {
+	min, max := d.backoffMin, d.backoffMax
+	if min <= 0 || max < min {
+		min, max = time.Second, 30*time.Second
+	}
+	backoff := min
+	for {
+		d.verifyMu.Lock()
+		held := make([]string, 0, len(d.held))
+		for k := range d.held {
+			held = append(held, k)
+		}
+		if len(held) == 0 {
+			d.verifying = false
+		}
+		d.verifyMu.Unlock()
+		if len(held) == 0 {
+			return
+		}
+
+		confirmed := make(map[string]bool, len(held))
+		keys, err := d.sourceKeys()
+		select {
+		case <-d.stopCh:
+			d.stopVerifying()
+			return
+		default:
+		}
+		if err != nil {
+			log.Warnf("cannot verify removals of %s, keep removed servers %v: %v", d.basePath, held, err)
+		} else {
+			for _, k := range held {
+				if !keys[k] {
+					confirmed[k] = true
+				}
+			}
+			if len(confirmed) < len(held) {
+				log.Warnf("removals of %d servers from %s are not confirmed by the verify source", len(held)-len(confirmed), d.basePath)
+			}
+		}
+		if len(confirmed) > 0 {
+			d.applyConfirmed(confirmed)
+			backoff = min
+			continue
+		}
+
+		select {
+		case <-d.stopCh:
+			d.stopVerifying()
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+func (d *ConsulDiscovery) stopVerifying() {
+	d.verifyMu.Lock()
+	d.verifying = false
+	d.verifyMu.Unlock()
+}
+
+// sourceKeys returns the keys of the verify source, it gives up after verifyTimeout.
+func (d *ConsulDiscovery) sourceKeys() (map[string]bool, error) {
+	type result struct {
+		keys map[string]bool
+		err  error
+	}
+	ch := make(chan result, 1)
+	err := budget.Go("verify source", func() {
+		keys, err := d.verifySource.Keys(d.basePath)
+		ch <- result{keys, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.keys, r.err
+	case <-time.After(verifyTimeout):
+		return nil, fmt.Errorf("verify source timed out after %v", verifyTimeout)
+	case <-d.stopCh:
+		return nil, errors.New("discovery is closed")
+	}
+}
+
+// applyConfirmed applies the latest update again without the servers whose removals are confirmed.
+func (d *ConsulDiscovery) applyConfirmed(confirmed map[string]bool) {
+	d.updateMu.Lock()
+	defer d.updateMu.Unlock()
+
+	d.verifyMu.Lock()
+	d.confirmed = confirmed
+	raw := d.unverified
+	d.verifyMu.Unlock()
+	d.setPairs(raw)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestVerifyRemovals(t *testing.T) {
+	d := &ConsulDiscovery{basePath: "rpcx/A", cache: &pairSlot{}, stopCh: make(chan struct{})}
+	defer func() {
+		d.stop()
+		d.wg.Wait()
+	}()
+	WithVerifySource(&StoreSource{KV: newFakeStore(&store.KVPair{Key: "rpcx/A/b"})})(d)
+	d.setPairs([]*client.KVPair{{Key: "a"}, {Key: "b"}})
+	d.setPairs(nil)
+	if !waitFor(func() bool { ps := d.GetServices(); return len(ps) == 1 && ps[0].Key == "b" }) {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+}
+
+type slowSource struct {
+	release chan struct{}
+	keys    map[string]bool
+}
+
+func (s *slowSource) Keys(basePath string) (map[string]bool, error) {
+	<-s.release
+	return s.keys, nil
+}
+
+func TestVerifyRemovalsSlowSource(t *testing.T) {
+	timeout := verifyTimeout
+	verifyTimeout = 20 * time.Millisecond
+	defer func() { verifyTimeout = timeout }()
+
+	source := &slowSource{release: make(chan struct{})}
+	d := &ConsulDiscovery{basePath: "rpcx/A", cache: &pairSlot{}, stopCh: make(chan struct{})}
+	WithVerifySource(source)(d)
+	WithWatchBackoff(10*time.Millisecond, 10*time.Millisecond)(d)
+	defer func() {
+		d.stop()
+		d.wg.Wait()
+	}()
+
+	d.setPairs([]*client.KVPair{{Key: "a"}, {Key: "b"}})
+	done := make(chan struct{})
+	go func() {
+		d.setPairs([]*client.KVPair{{Key: "b"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the update waits for the verify source")
+	}
+	// the removal is held until the source confirms it
+	time.Sleep(50 * time.Millisecond)
+	if ps := d.GetServices(); len(ps) != 2 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+
+	close(source.release)
+	want := []*client.KVPair{{Key: "b"}}
+	if !waitFor(func() bool { return reflect.DeepEqual(d.GetServices(), want) }) {
+		t.Fatalf("expected services %v but got %v", want, d.GetServices())
+	}
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// WithRedactor hides the secrets in the metadata of servers in the logs of the discovery and in DiscoveryHandler,
+// e.g. meta.NewRedactor("(?i)token"). The servers returned by GetServices and WatchService are not redacted.
+func WithRedactor(r *meta.Redactor) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.redactor = r
+	}
+}
+
+// Redactor returns the redactor of the discovery, nil if the metadata is not redacted.
+func (d *ConsulDiscovery) Redactor() *meta.Redactor {
+	return d.redactor
+}
+
+// redactPairs returns copies of the servers with their metadata redacted.
+func redactPairs(r *meta.Redactor, pairs []*client.KVPair) []*client.KVPair {
+	if r == nil {
+		return pairs
+	}
+	redacted := make([]*client.KVPair, len(pairs))
+	for i, p := range pairs {
+		redacted[i] = &client.KVPair{Key: p.Key, Value: r.Metadata(p.Value)}
+	}
+	return redacted
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+func TestRedact(t *testing.T) {
+	r, _ := meta.NewRedactor()
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a", Value: []byte("group=x&token=abc")})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithRedactor(r))
+	defer d.Close()
+	if d.GetServices()[0].Value != "group=x&token=abc" {
+		t.Fatal("data must not be redacted")
+	}
+	srv := httptest.NewServer(NewDiscoveryHandler(d))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "abc") || !strings.Contains(string(body), "token=REDACTED") {
+		t.Fatalf("unexpected body %s", string(body))
+	}
+	if d.GetServices()[0].Value != "group=x&token=abc" {
+		t.Fatal("data must not be redacted")
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// Resolver resolves service paths to the addresses of their servers like net.Resolver resolves hosts,
+// so that clients of other protocols in the same binary can reuse the discovery.
+// Service paths are relative to the discovery and empty means the discovery itself.
+//
+// Watch pushes every change and is what a resolver of other RPC frameworks needs to wrap,
+// see the grpcresolver package for the resolver of grpc.
+type Resolver struct {
+	clones *clones
+}
+
+// NewResolver returns a Resolver of the servers discovered by d.
+func NewResolver(d client.ServiceDiscovery) *Resolver {
+	return &Resolver{clones: newClones(d)}
+}
+
+// Lookup returns the addresses (host:port) of the servers of servicePath.
+// It returns a *net.DNSError with IsNotFound set if there is no server.
+func (r *Resolver) Lookup(ctx context.Context, servicePath string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, release, err := r.clones.get(servicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	addrs := addresses(d.GetServices())
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such service", Name: servicePath, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// LookupHost returns the distinct hosts of the servers of servicePath.
+func (r *Resolver) LookupHost(ctx context.Context, servicePath string) ([]string, error) {
+	addrs, err := r.Lookup(ctx, servicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(addrs))
+	hosts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// Watch returns a chan which receives the current addresses of the servers of servicePath and every change.
+// Only the latest addresses are kept if the receiver falls behind. Call stop to release the watch.
+func (r *Resolver) Watch(servicePath string) (updates <-chan []string, stop func(), err error) {
+	d, release, err := r.clones.get(servicePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := d.WatchService()
+	out := make(chan []string, 1)
+	out <- addresses(d.GetServices())
+
+	done := make(chan struct{})
+	err = budget.Go("resolver watch", func() {
+		defer release()
+		defer d.RemoveWatcher(ch)
+		for {
+			select {
+			case <-done:
+				return
+			case pairs := <-ch:
+				addrs := addresses(pairs)
+				select { // replace the pending addresses which are not received yet
+				case <-out:
+				default:
+				}
+				out <- addrs
+			}
+		}
+	})
+	if err != nil {
+		d.RemoveWatcher(ch)
+		release()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return out, func() { once.Do(func() { close(done) }) }, nil
+}
+
+// Close closes the discoveries cloned for looked up service paths.
+func (r *Resolver) Close() {
+	r.clones.close()
+}
+
+// addresses returns the addresses of the servers without the network.
+func addresses(pairs []*client.KVPair) []string {
+	addrs := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		_, host, port, err := meta.SplitKey(p.Key)
+		if err != nil { // no port, e.g. unix sockets
+			addr := p.Key
+			if i := strings.Index(addr, "@"); i >= 0 {
+				addr = addr[i+1:]
+			}
+			addrs = append(addrs, addr)
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestResolver(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@10.0.0.1:8972"}, &store.KVPair{Key: "rpcx/A/tcp@10.0.0.1:8973"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv)
+	defer d.Close()
+	r := NewResolver(d)
+	addrs, err := r.Lookup(context.Background(), "")
+	if err != nil || len(addrs) != 2 || addrs[0] != "10.0.0.1:8972" {
+		t.Fatalf("unexpected addresses %v, error %v", addrs, err)
+	}
+	hosts, _ := r.LookupHost(context.Background(), "")
+	if len(hosts) != 1 {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	up, stop, _ := r.Watch("")
+	defer stop()
+	if a := <-up; len(a) != 2 {
+		t.Fatalf("unexpected addresses %v", a)
+	}
+	kv.watchCh <- []*store.KVPair{{Key: "rpcx/A/tcp@10.0.0.2:1"}}
+	if a := <-up; len(a) != 1 || a[0] != "10.0.0.2:1" {
+		t.Fatalf("unexpected addresses %v", a)
+	}
+	kv.watchCh <- []*store.KVPair{}
+	<-up
+	var dnsErr *net.DNSError
+	if _, err := r.Lookup(context.Background(), ""); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/schema"
+)
+
+// GetSchema returns the schema of the service published under basePath by the register plugin.
+func GetSchema(kv store.Store, basePath, service string) (*schema.Service, error) {
+	basePath = strings.TrimPrefix(basePath, "/")
+
+	p, err := kv.Get(schema.Key(basePath, service))
+	if err != nil {
+		return nil, err
+	}
+
+	var s schema.Service
+	if err := json.Unmarshal(p.Value, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSchemas returns the schemas of all services published under basePath by the register plugin.
+func ListSchemas(kv store.Store, basePath string) ([]*schema.Service, error) {
+	basePath = strings.TrimPrefix(basePath, "/")
+
+	dir := schema.Dir(basePath) + "/"
+	ps, err := kv.List(dir)
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make([]*schema.Service, 0, len(ps))
+	for _, p := range ps {
+		if !strings.HasPrefix(p.Key, dir) {
+			continue
+		}
+		var s schema.Service
+		if err := json.Unmarshal(p.Value, &s); err != nil {
+			continue
+		}
+		schemas = append(schemas, &s)
+	}
+	return schemas, nil
+}
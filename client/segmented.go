@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/log"
+)
+
+// ListProgress is the progress of the segmented initial listing, reported after every segment.
+type ListProgress struct {
+	BasePath string
+	// Segment is the key prefix (relative to BasePath) listed in this step
+	Segment string
+	// Done of Total segments are listed
+	Done  int
+	Total int
+	// Keys listed so far
+	Keys int
+	// Err is the error of the segment, the listing stops at the first error
+	Err error
+}
+
+// keyLister lists the keys without their values, e.g. consulkv.Store.
+type keyLister interface {
+	Keys(directory string) ([]string, error)
+}
+
+// segment is a key prefix listed at once, or a key which is also the prefix of other keys.
+type segment struct {
+	prefix string
+	exact  bool
+}
+
+// WithSegmentedListing lists the servers of huge registries in segments of at most size keys on startup,
+// instead of one response which may be too large for consul to return in time. The keys are listed first
+// without their values, then the values are listed by key prefixes. It requires a store which can list
+// the keys, e.g. consulkv.Store, other stores list all servers at once.
+func WithSegmentedListing(size int) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.segmentSize = size
+	}
+}
+
+// WithListProgress calls fn after every segment of the segmented initial listing.
+func WithListProgress(fn func(ListProgress)) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.listProgress = fn
+	}
+}
+
+// list lists the pairs under directory, in segments if WithSegmentedListing is set.
+func (d *ConsulDiscovery) list(ctx context.Context, kv store.Store, directory string) ([]*store.KVPair, error) {
+	lister, ok := kv.(keyLister)
+	if d.segmentSize <= 0 || !ok {
+		if d.segmentSize > 0 {
+			log.Warnf("store of %s can't list keys, list all servers at once", d.basePath)
+		}
+		return listContext(ctx, kv, directory)
+	}
+
+	keys, err := lister.Keys(directory)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, directory)
+	}
+	sort.Strings(keys)
+	segments := splitSegments(keys, "", d.segmentSize, nil)
+
+	var pairs []*store.KVPair
+	seen := make(map[string]bool, len(keys))
+	for i, seg := range segments {
+		var ps []*store.KVPair
+		if seg.exact {
+			var p *store.KVPair
+			if p, err = kv.Get(directory + seg.prefix); err == nil {
+				ps = []*store.KVPair{p}
+			}
+		} else {
+			ps, err = listContext(ctx, kv, directory+seg.prefix)
+		}
+		// the keys may be deleted since they are listed
+		if err == store.ErrKeyNotFound {
+			err = nil
+		}
+		for _, p := range ps {
+			if !seen[p.Key] {
+				seen[p.Key] = true
+				pairs = append(pairs, p)
+			}
+		}
+
+		if d.listProgress != nil {
+			d.listProgress(ListProgress{
+				BasePath: d.basePath,
+				Segment:  seg.prefix,
+				Done:     i + 1,
+				Total:    len(segments),
+				Keys:     len(pairs),
+				Err:      err,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pairs, nil
+}
+
+// splitSegments splits the sorted keys with prefix into segments of at most size keys by longer prefixes.
+func splitSegments(keys []string, prefix string, size int, segments []segment) []segment {
+	i := 0
+	// the key equal to the prefix is skipped by listing it as a directory and not matched by the longer prefixes
+	if prefix != "" && keys[0] == prefix {
+		segments = append(segments, segment{prefix: prefix, exact: true})
+		i++
+	}
+	if i == len(keys) {
+		return segments
+	}
+	if len(keys)-i <= size {
+		return append(segments, segment{prefix: prefix})
+	}
+
+	for i < len(keys) {
+		next := keys[i][:len(prefix)+1]
+		j := i + 1
+		for j < len(keys) && strings.HasPrefix(keys[j], next) {
+			j++
+		}
+		segments = splitSegments(keys[i:j], next, size, segments)
+		i = j
+	}
+	return segments
+}
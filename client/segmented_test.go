@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+type keysStore struct{ *fakeStore }
+
+func (s keysStore) Keys(dir string) ([]string, error) {
+	ps, err := s.fakeStore.List(dir)
+	var keys []string
+	for _, p := range ps {
+		keys = append(keys, p.Key)
+	}
+	return keys, err
+}
+
+// List like consul skips the directory itself
+func (s keysStore) List(dir string) ([]*store.KVPair, error) {
+	ps, err := s.fakeStore.List(dir)
+	var out []*store.KVPair
+	for _, p := range ps {
+		if p.Key != dir {
+			out = append(out, p)
+		}
+	}
+	if len(out) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return out, err
+}
+
+func TestSplitSegments(t *testing.T) {
+	segs := splitSegments([]string{"a", "ab", "ac", "b"}, "", 2, nil)
+	if got := fmt.Sprint(segs); got != "[{a true} {a false} {b true}]" {
+		t.Fatalf("unexpected %v", got)
+	}
+	segs = splitSegments([]string{"a", "ab", "ac", "ad", "b"}, "", 2, nil)
+	if got := fmt.Sprint(segs); got != "[{a true} {ab true} {ac true} {ad true} {b true}]" {
+		t.Fatalf("unexpected %v", got)
+	}
+	segs = splitSegments([]string{"x1", "x2", "y1"}, "", 5, nil)
+	if got := fmt.Sprint(segs); got != "[{ false}]" {
+		t.Fatalf("unexpected %v", got)
+	}
+}
+
+func TestSegmentedListing(t *testing.T) {
+	fs := newFakeStore()
+	for i := 0; i < 50; i++ {
+		fs.Put(fmt.Sprintf("rpcx/A/tcp@10.0.%d.%d:8972", i/10, i), []byte("v"), nil)
+	}
+	var progress []ListProgress
+	d, err := NewConsulDiscoveryStore("rpcx/A", keysStore{fs}, WithSegmentedListing(8), WithListProgress(func(p ListProgress) { progress = append(progress, p) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n := len(d.GetServices()); n != 50 {
+		t.Fatalf("unexpected number %d", n)
+	}
+	last := progress[len(progress)-1]
+	if len(progress) < 7 || last.Done != last.Total || last.Keys != 50 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	for _, p := range progress {
+		if !strings.HasPrefix(p.Segment, "tcp@10.0.") {
+			t.Fatalf("unexpected %v", p)
+		}
+	}
+
+	fs.listErr = fmt.Errorf("boom")
+	if _, err := NewConsulDiscoveryStore("rpcx/A", keysStore{fs}, WithSegmentedListing(8)); err == nil {
+		t.Fatal("expect error when the segments cannot be listed")
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// ZoneSelector is an example rpcx Selector built on meta.SelectorHints:
+// it picks a healthy server by weight, preferring the servers in the local zone.
+// Set it with XClient.SetSelector.
+type ZoneSelector struct {
+	zone string
+
+	mu     sync.RWMutex
+	local  []weighted
+	remote []weighted
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+type weighted struct {
+	key    string
+	weight int
+}
+
+var _ client.Selector = (*ZoneSelector)(nil)
+
+// NewZoneSelector returns a ZoneSelector which prefers the servers in zone.
+func NewZoneSelector(zone string) *ZoneSelector {
+	return &ZoneSelector{zone: zone, rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// Select picks a server, it returns an empty string if there is no healthy server.
+func (s *ZoneSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if key := s.pick(s.local); key != "" {
+		return key
+	}
+	return s.pick(s.remote)
+}
+
+// UpdateServer updates the servers to select from.
+func (s *ZoneSelector) UpdateServer(servers map[string]string) {
+	var local, remote []weighted
+	for key, h := range meta.SelectorHintsOf(servers) {
+		if !h.Healthy || h.Weight == 0 {
+			continue
+		}
+		w := weighted{key: key, weight: h.Weight}
+		if s.zone != "" && h.Zone == s.zone {
+			local = append(local, w)
+		} else {
+			remote = append(remote, w)
+		}
+	}
+
+	s.mu.Lock()
+	s.local, s.remote = local, remote
+	s.mu.Unlock()
+}
+
+func (s *ZoneSelector) pick(servers []weighted) string {
+	total := 0
+	for _, w := range servers {
+		total += w.weight
+	}
+	if total == 0 {
+		return ""
+	}
+
+	s.randMu.Lock()
+	n := s.rand.Intn(total)
+	s.randMu.Unlock()
+	for _, w := range servers {
+		if n < w.weight {
+			return w.key
+		}
+		n -= w.weight
+	}
+	return ""
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"context"
+	"testing"
+)
+
+func TestZoneSelector(t *testing.T) {
+	s := NewZoneSelector("a")
+	s.UpdateServer(map[string]string{"x": "zone=a", "y": "zone=b", "z": "zone=a&state=inactive"})
+	for i := 0; i < 50; i++ {
+		if k := s.Select(context.Background(), "", "", nil); k != "x" {
+			t.Fatalf("unexpected server %q", k)
+		}
+	}
+	s.UpdateServer(map[string]string{"y": "zone=b&weight=3"})
+	if k := s.Select(context.Background(), "", "", nil); k != "y" {
+		t.Fatalf("unexpected server %q", k)
+	}
+	s.UpdateServer(nil)
+	if k := s.Select(context.Background(), "", "", nil); k != "" {
+		t.Fatalf("unexpected server %q", k)
+	}
+}
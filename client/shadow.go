@@ -0,0 +1,195 @@
+package client
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// AlertShadowDivergence means the servers of a discovery have differed from its shadow for longer than the grace period.
+const AlertShadowDivergence AlertKind = "shadow_divergence"
+
+// shadowCheckInterval is how often the servers are compared with the shadow besides its changes,
+// so that the divergences are reported once they last for the grace period.
+const shadowCheckInterval = time.Second
+
+// Divergence is how the servers of a discovery differ from its shadow.
+type Divergence struct {
+	// Since is when the discoveries started to differ
+	Since time.Time
+	// keys of the servers which only the discovery or only the shadow has, or whose metadata differ
+	OnlyPrimary []string
+	OnlyShadow  []string
+	Mismatched  []string
+}
+
+// IsEmpty reports whether the discoveries agree.
+func (v Divergence) IsEmpty() bool {
+	return v.Count() == 0
+}
+
+// Count returns the number of servers which differ.
+func (v Divergence) Count() int {
+	return len(v.OnlyPrimary) + len(v.OnlyShadow) + len(v.Mismatched)
+}
+
+// WithShadow runs shadow alongside the discovery to verify a migration before cutting the traffic over,
+// e.g. a ConsulCatalogDiscovery of the same service while moving from KV to the catalog.
+// The discovery keeps serving its own servers, and compares them with the shadow every time it changes.
+// The divergences lasting longer than grace are logged, sent to the AlertSink and recorded by the EventHook
+// if it implements hook.ShadowHook. Only the fields routing the requests are compared, see shadowFields.
+// The shadow is not closed with the discovery, while the clones of the discovery compare with the clones
+// of the shadow of the same service paths, which are closed with them.
+func WithShadow(shadow client.ServiceDiscovery, grace time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.shadow = shadow
+		d.shadowGrace = grace
+		d.ownShadow = false
+	}
+}
+
+// withClonedShadow is WithShadow of a clone of the shadow, which is closed with the discovery.
+func withClonedShadow(shadow client.ServiceDiscovery, grace time.Duration) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.shadow = shadow
+		d.shadowGrace = grace
+		d.ownShadow = true
+	}
+}
+
+// ShadowDivergence returns how the servers differ from the shadow, false unless the divergence has lasted
+// for the grace period of WithShadow.
+func (d *ConsulDiscovery) ShadowDivergence() (Divergence, bool) {
+	d.shadowMu.Lock()
+	defer d.shadowMu.Unlock()
+	return d.divergence, !d.divergence.IsEmpty()
+}
+
+// watchShadow compares the servers with the shadow until the discovery is closed.
+func (d *ConsulDiscovery) watchShadow() {
+	ch := d.shadow.WatchService()
+	defer d.shadow.RemoveWatcher(ch)
+	ticker := time.NewTicker(shadowCheckInterval)
+	defer ticker.Stop()
+
+	d.compareShadow()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ch:
+		case <-ticker.C:
+		}
+		d.compareShadow()
+	}
+}
+
+// compareShadow compares the servers with the shadow and reports the lasting divergences.
+func (d *ConsulDiscovery) compareShadow() {
+	// the servers are not read by GetServices, which the access hook would count
+	d.pairsMu.RLock()
+	primary, ok := d.cache.Get(d.basePath)
+	d.pairsMu.RUnlock()
+	if !ok {
+		// evicted from the shared cache, compare after it is listed again
+		return
+	}
+	v := diffShadow(primary, d.shadow.GetServices())
+	now := time.Now()
+
+	d.shadowMu.Lock()
+	if v.IsEmpty() {
+		converged := !d.divergence.IsEmpty()
+		d.divergedSince = time.Time{}
+		d.divergence = Divergence{}
+		d.shadowMu.Unlock()
+
+		if converged {
+			log.Infof("servers of %s agree with the shadow again", d.basePath)
+		}
+		d.shadowCompared(0)
+		return
+	}
+
+	if d.divergedSince.IsZero() {
+		d.divergedSince = now
+	}
+	v.Since = d.divergedSince
+	if now.Sub(v.Since) < d.shadowGrace {
+		d.shadowMu.Unlock()
+		d.shadowCompared(0)
+		return
+	}
+	reported := !d.divergence.IsEmpty()
+	d.divergence = v
+	d.shadowMu.Unlock()
+
+	d.shadowCompared(v.Count())
+	if reported {
+		return
+	}
+	log.Warnf("servers of %s differ from the shadow since %s, only in the discovery: %v, only in the shadow: %v, mismatched: %v",
+		d.basePath, v.Since.Format(time.RFC3339), v.OnlyPrimary, v.OnlyShadow, v.Mismatched)
+	if d.alertSink != nil {
+		d.alert(AlertShadowDivergence, "%d servers of %s differ from the shadow since %s", v.Count(), d.basePath, v.Since.Format(time.RFC3339))
+	}
+}
+
+func (d *ConsulDiscovery) shadowCompared(divergent int) {
+	if h, ok := d.hook.(hook.ShadowHook); ok {
+		h.ShadowCompared(d.basePath, divergent)
+	}
+}
+
+// diffShadow returns how the servers of the primary discovery differ from the shadow.
+func diffShadow(primary, shadow []*client.KVPair) Divergence {
+	var v Divergence
+	values := make(map[string]string, len(shadow))
+	for _, p := range shadow {
+		values[p.Key] = p.Value
+	}
+	for _, p := range primary {
+		value, ok := values[p.Key]
+		if !ok {
+			v.OnlyPrimary = append(v.OnlyPrimary, p.Key)
+			continue
+		}
+		if !sameShadowMetadata(p.Value, value) {
+			v.Mismatched = append(v.Mismatched, p.Key)
+		}
+		delete(values, p.Key)
+	}
+	for key := range values {
+		v.OnlyShadow = append(v.OnlyShadow, key)
+	}
+
+	sort.Strings(v.OnlyPrimary)
+	sort.Strings(v.OnlyShadow)
+	sort.Strings(v.Mismatched)
+	return v
+}
+
+// shadowFields are the fields of the metadata compared with the shadow, the ones which route the requests.
+// The other fields, like the rates of the calls, the fields the catalog drops and the hints of the addresses,
+// vary between the registries without changing the routing. The weights are rewritten by the group weights.
+var shadowFields = []string{meta.Group, meta.State, meta.Zone, meta.Region, meta.Datacenter, meta.IngressHost, meta.IngressPath}
+
+// sameShadowMetadata reports whether the routing fields of the metadata are the same,
+// regardless of the order of the fields and of the tags.
+func sameShadowMetadata(a, b string) bool {
+	va, vb := meta.Parse(a), meta.Parse(b)
+	for _, field := range shadowFields {
+		if va.Get(field) != vb.Get(field) {
+			return false
+		}
+	}
+	ta, tb := meta.TagsOf(a), meta.TagsOf(b)
+	sort.Strings(ta)
+	sort.Strings(tb)
+	return reflect.DeepEqual(ta, tb)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/smallnest/rpcx/client"
+)
+
+type fakeShadow struct {
+	mu     sync.Mutex
+	path   string
+	pairs  []*client.KVPair
+	ch     chan []*client.KVPair
+	closed bool
+	clones []*fakeShadow
+}
+
+func (s *fakeShadow) GetServices() []*client.KVPair          { s.mu.Lock(); defer s.mu.Unlock(); return s.pairs }
+func (s *fakeShadow) WatchService() chan []*client.KVPair    { return s.ch }
+func (s *fakeShadow) RemoveWatcher(ch chan []*client.KVPair) {}
+func (s *fakeShadow) Clone(servicePath string) (client.ServiceDiscovery, error) {
+	c := &fakeShadow{path: servicePath, ch: make(chan []*client.KVPair, 1)}
+	s.mu.Lock()
+	s.clones = append(s.clones, c)
+	s.mu.Unlock()
+	return c, nil
+}
+func (s *fakeShadow) SetFilter(client.ServiceDiscoveryFilter) {}
+func (s *fakeShadow) Close()                                  { s.mu.Lock(); s.closed = true; s.mu.Unlock() }
+
+type shadowHook struct {
+	hook.NopHook
+	mu        sync.Mutex
+	divergent []int
+}
+
+func (h *shadowHook) ShadowCompared(path string, divergent int) {
+	h.mu.Lock()
+	h.divergent = append(h.divergent, divergent)
+	h.mu.Unlock()
+}
+
+func TestDiffShadow(t *testing.T) {
+	v := diffShadow(
+		[]*client.KVPair{{Key: "a", Value: "group=x&weight=2&tags=a,b&calls=10"}, {Key: "b"}, {Key: "d", Value: "group=x"}, {Key: "e", Value: "tags=a"}},
+		[]*client.KVPair{{Key: "a", Value: "weight=1&group=x&tags=b,a&calls=20&hostname=h"}, {Key: "c"}, {Key: "d", Value: "group=y"}, {Key: "e", Value: "tags=b"}},
+	)
+	if !reflect.DeepEqual(v.OnlyPrimary, []string{"b"}) || !reflect.DeepEqual(v.OnlyShadow, []string{"c"}) || !reflect.DeepEqual(v.Mismatched, []string{"d", "e"}) || v.Count() != 4 {
+		t.Fatalf("%+v", v)
+	}
+}
+
+func TestCompareShadow(t *testing.T) {
+	sink := &memSink{}
+	h := &shadowHook{}
+	shadow := &fakeShadow{pairs: []*client.KVPair{{Key: "a"}, {Key: "c"}}}
+	d := &ConsulDiscovery{basePath: "x", cache: &pairSlot{}, hook: h}
+	WithAlertSink(sink, 0)(d)
+	WithShadow(shadow, time.Hour)(d)
+	d.setPairs([]*client.KVPair{{Key: "a"}, {Key: "b"}})
+
+	d.compareShadow()
+	if _, ok := d.ShadowDivergence(); ok {
+		t.Fatal("reported within grace")
+	}
+	d.shadowGrace = 0
+	d.compareShadow()
+	d.compareShadow()
+	v, ok := d.ShadowDivergence()
+	if !ok || v.Count() != 2 || v.Since.IsZero() {
+		t.Fatalf("%+v", v)
+	}
+	if !waitFor(func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.alerts) == 1 && sink.alerts[0].Kind == AlertShadowDivergence
+	}) {
+		t.Fatalf("unexpected alerts %v", sink.alerts)
+	}
+
+	shadow.mu.Lock()
+	shadow.pairs = []*client.KVPair{{Key: "a"}, {Key: "b"}}
+	shadow.mu.Unlock()
+	d.compareShadow()
+	if _, ok := d.ShadowDivergence(); ok {
+		t.Fatal("still diverged")
+	}
+	time.Sleep(20 * time.Millisecond)
+	sink.mu.Lock()
+	n := len(sink.alerts)
+	sink.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("unexpected alerts %v", sink.alerts)
+	}
+	if !reflect.DeepEqual(h.divergent, []int{0, 2, 2, 0}) {
+		t.Fatalf("unexpected divergences %v", h.divergent)
+	}
+}
+
+func TestShadowClone(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@1.1.1.1:1", Value: []byte("")})
+	shadow := &fakeShadow{ch: make(chan []*client.KVPair, 1), pairs: []*client.KVPair{{Key: "tcp@1.1.1.1:1"}}}
+	d, err := NewConsulDiscoveryStore("rpcx", kv, WithShadow(shadow, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Clone("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow.mu.Lock()
+	clone := shadow.clones[0]
+	shadow.mu.Unlock()
+	if clone.path != "A" {
+		t.Fatalf("unexpected path of the shadow clone %s", clone.path)
+	}
+	clone.mu.Lock()
+	clone.pairs = []*client.KVPair{{Key: "tcp@2.2.2.2:1"}}
+	clone.mu.Unlock()
+	clone.ch <- nil
+	cd := c.(*ConsulDiscovery)
+	if !waitFor(func() bool { _, ok := cd.ShadowDivergence(); return ok }) {
+		t.Fatal("no divergence")
+	}
+	c.Close()
+	d.Close()
+	if !clone.closed || shadow.closed {
+		t.Fatalf("unexpected closed clone %v, shadow %v", clone.closed, shadow.closed)
+	}
+}
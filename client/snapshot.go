@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// snapshot is the last known servers of a discovery persisted in the cache dir.
+type snapshot struct {
+	BasePath  string           `json:"base_path"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Servers   []*client.KVPair `json:"servers"`
+}
+
+// WithCacheDir persists the servers in a snapshot file in dir on every change. If consul is unreachable
+// when the discovery is created, it serves the servers of the snapshot instead of failing, until the watch recovers.
+// Check UpdatedAt to decide whether to trust them.
+func WithCacheDir(dir string) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.cacheDir = dir
+	}
+}
+
+// UpdatedAt returns when the servers were received from consul last time,
+// or when the snapshot was taken if they are served from the snapshot.
+func (d *ConsulDiscovery) UpdatedAt() time.Time {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.updatedAt
+}
+
+// FromSnapshot reports whether the servers are served from the snapshot in the cache dir,
+// it is false once the servers are received from consul.
+func (d *ConsulDiscovery) FromSnapshot() bool {
+	return atomic.LoadInt32(&d.fromSnapshot) == 1
+}
+
+// snapshotFile returns the snapshot file of the discovery.
+func (d *ConsulDiscovery) snapshotFile() string {
+	return filepath.Join(d.cacheDir, url.PathEscape(d.basePath)+".json")
+}
+
+// saveSnapshot writes the servers to the snapshot file atomically.
+func (d *ConsulDiscovery) saveSnapshot(pairs []*client.KVPair, updatedAt time.Time) {
+	data, err := json.Marshal(snapshot{BasePath: d.basePath, UpdatedAt: updatedAt, Servers: pairs})
+	if err != nil {
+		log.Warnf("cannot encode snapshot of %s: %v", d.basePath, err)
+		return
+	}
+
+	file := d.snapshotFile()
+	if err := os.MkdirAll(d.cacheDir, 0o755); err != nil {
+		log.Warnf("cannot create cache dir %s: %v", d.cacheDir, err)
+		return
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Warnf("cannot write snapshot %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		log.Warnf("cannot write snapshot %s: %v", file, err)
+	}
+}
+
+// loadSnapshot reads the servers from the snapshot file.
+func (d *ConsulDiscovery) loadSnapshot() (*snapshot, error) {
+	data, err := os.ReadFile(d.snapshotFile())
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// serveSnapshot serves the servers of the snapshot if the initial listing failed with err.
+func (d *ConsulDiscovery) serveSnapshot(err error) bool {
+	if d.cacheDir == "" {
+		return false
+	}
+	s, serr := d.loadSnapshot()
+	if serr != nil {
+		log.Warnf("cannot read snapshot of %s: %v", d.basePath, serr)
+		return false
+	}
+
+	log.Warnf("cannot get services of %s from registry, serve %d servers of the snapshot taken at %s: %v",
+		d.basePath, len(s.Servers), s.UpdatedAt.Format(time.RFC3339), err)
+	d.pairsMu.Lock()
+	d.cache.Set(d.basePath, s.Servers)
+	d.updatedAt = s.UpdatedAt
+	d.pairsMu.Unlock()
+	atomic.StoreInt32(&d.fromSnapshot, 1)
+	atomic.StoreInt32(&d.disconnected, 1)
+	return true
+}
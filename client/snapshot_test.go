@@ -0,0 +1,47 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@1:1", Value: []byte("x=1")})
+	d, err := NewConsulDiscoveryStore("rpcx/A", kv, WithCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := d.UpdatedAt()
+	d.Close()
+
+	down := newFakeStore()
+	down.listErr = errors.New("down")
+	if _, err := NewConsulDiscoveryStore("rpcx/B", down, WithCacheDir(dir)); err == nil {
+		t.Fatal("expect error without snapshot")
+	}
+	d2, err := NewConsulDiscoveryStore("rpcx/A", down, WithCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if ps := d2.GetServices(); len(ps) != 1 || ps[0].Value != "x=1" || !d2.FromSnapshot() || d2.Connected() {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	if !d2.UpdatedAt().Equal(at) {
+		t.Fatalf("expected update time %[2]v but got %[1]v", d2.UpdatedAt(), at)
+	}
+
+	down.watchCh <- []*store.KVPair{{Key: "rpcx/A/tcp@1:2", Value: []byte("x=2")}}
+	if !waitFor(func() bool {
+		return !d2.FromSnapshot() && len(d2.GetServices()) == 1 && d2.GetServices()[0].Key == "tcp@1:2"
+	}) {
+		t.Fatalf("unexpected services %v", d2.GetServices())
+	}
+	s, err := d2.loadSnapshot()
+	if err != nil || len(s.Servers) != 1 || s.Servers[0].Key != "tcp@1:2" {
+		t.Fatalf("unexpected snapshot %+v, error %v", s, err)
+	}
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// StatePolicy is which servers to keep according to the state in their metadata, see meta.StateOf.
+type StatePolicy int
+
+const (
+	// KeepAllStates keeps the servers in any state and leaves them to the selector.
+	KeepAllStates StatePolicy = iota
+	// SkipPaused drops the paused and inactive servers but keeps the draining ones,
+	// so that the clients can finish their work with the servers which are going away.
+	SkipPaused
+	// SkipNotServing drops the servers which should not receive new traffic, see meta.Serving.
+	SkipNotServing
+)
+
+// WithStatePolicy sets which servers to keep according to their states.
+func WithStatePolicy(policy StatePolicy) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.statePolicy = policy
+	}
+}
+
+// checkState reports whether to keep the server according to the state policy.
+func (d *ConsulDiscovery) checkState(pair *client.KVPair) bool {
+	switch d.statePolicy {
+	case SkipPaused:
+		state := meta.StateOf(pair.Value)
+		return state != meta.StatePaused && state != meta.StateInactive
+	case SkipNotServing:
+		return meta.Serving(meta.StateOf(pair.Value))
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestStatePolicy(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/app/tcp@1:1", Value: []byte("state=active")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:2", Value: []byte("state=paused")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:3", Value: []byte("state=draining")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:4", Value: []byte("")},
+	)
+	for policy, want := range map[StatePolicy]int{KeepAllStates: 4, SkipPaused: 3, SkipNotServing: 2} {
+		d, err := NewConsulDiscoveryStore("rpcx/app", kv, WithStatePolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(d.GetServices()); n != want {
+			t.Errorf("policy %d: want %d got %d", policy, want, n)
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	pairs   []*store.KVPair
+	lists   int
+	watchCh chan []*store.KVPair
+	listErr error
+	closed  bool
+}
+
+func newFakeStore(pairs ...*store.KVPair) *fakeStore {
+	return &fakeStore{pairs: pairs, watchCh: make(chan []*store.KVPair, 10)}
+}
+func (s *fakeStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pairs {
+		if p.Key == key {
+			p.Value = value
+			return nil
+		}
+	}
+	s.pairs = append(s.pairs, &store.KVPair{Key: key, Value: value})
+	return nil
+}
+func (s *fakeStore) Get(key string) (*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pairs {
+		if p.Key == key {
+			return p, nil
+		}
+	}
+	return nil, store.ErrKeyNotFound
+}
+func (s *fakeStore) Delete(key string) error         { return nil }
+func (s *fakeStore) Exists(key string) (bool, error) { return false, nil }
+func (s *fakeStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+func (s *fakeStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchCh, nil
+}
+func (s *fakeStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+func (s *fakeStore) List(directory string) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	var ps []*store.KVPair
+	for _, p := range s.pairs {
+		if len(p.Key) >= len(directory) && p.Key[:len(directory)] == directory {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+func (s *fakeStore) DeleteTree(directory string) error { return nil }
+func (s *fakeStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	return false, nil, store.ErrCallNotSupported
+}
+func (s *fakeStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return false, store.ErrCallNotSupported
+}
+func (s *fakeStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func (s *fakeStore) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func kvs(keys ...string) []*client.KVPair {
+	var ps []*client.KVPair
+	for _, k := range keys {
+		ps = append(ps, &client.KVPair{Key: k, Value: "v=" + k})
+	}
+	return ps
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/smallnest/rpcx/log"
+)
+
+// errChanSize is the buffer size of the error chan, errors are dropped if it is full.
+const errChanSize = 16
+
+// ErrChangeDropped is reported when a change is dropped because the chan of a watcher is full.
+var ErrChangeDropped = errors.New("chan is full and new change has been dropped")
+
+// ErrPanicked is reported when a notification or a filter panics.
+var ErrPanicked = errors.New("panicked")
+
+// WithStrictErrors reports the failures instead of recovering silently: the panics in notification goroutines
+// and filters, the dropped changes and the watch failures are reported on the chan returned by Errors.
+// The panics are still recovered, so that they don't kill the watch goroutine, unless CrashOnPanic is set.
+func WithStrictErrors() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.strictErrors = true
+	}
+}
+
+// WithCrashOnPanic fails fast: the panics in notification goroutines and filters are reported
+// like with StrictErrors and then panic again, so that they crash the process instead of being recovered.
+func WithCrashOnPanic() ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.crashOnPanic = true
+	}
+}
+
+// Errors returns the chan of the errors reported with StrictErrors, it is nil otherwise.
+func (d *ConsulDiscovery) Errors() <-chan error {
+	return d.errCh
+}
+
+// recoverPanic recovers the panic of what, and reports it with StrictErrors.
+// It must be deferred directly.
+func (d *ConsulDiscovery) recoverPanic(what string) {
+	if r := recover(); r != nil {
+		d.reportError(fmt.Errorf("%s of %s %w: %v", what, d.basePath, ErrPanicked, r))
+		d.repanic(r)
+	}
+}
+
+// repanic panics again with the recovered r if CrashOnPanic is set.
+func (d *ConsulDiscovery) repanic(r interface{}) {
+	if d.crashOnPanic {
+		panic(r)
+	}
+}
+
+// reportError sends err to the error chan without blocking.
+func (d *ConsulDiscovery) reportError(err error) {
+	if d.errCh == nil {
+		return
+	}
+	select {
+	case d.errCh <- err:
+	default:
+		log.Warnf("error chan of %s is full and error has been dropped: %v", d.basePath, err)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/client"
+)
+
+func TestStrictErrors(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithStrictErrors())
+	defer d.Close()
+	d.WatchServiceNamed("slow")
+	for i := 0; i < 11; i++ {
+		d.setPairs(nil)
+	}
+	err := <-d.Errors()
+	if !errors.Is(err, ErrChangeDropped) {
+		t.Fatal(err)
+	}
+	d2, _ := NewConsulDiscoveryStore("rpcx/A", kv)
+	defer d2.Close()
+	if d2.Errors() != nil {
+		t.Fatal("expect no error channel without WithStrictErrors")
+	}
+}
+
+func TestStrictPanics(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithStrictErrors())
+	defer d.Close()
+	d.SetFilter(func(p *client.KVPair) bool {
+		panic("boom")
+	})
+	if ps := d.parse(kv.pairs); len(ps) != 1 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	if err := <-d.Errors(); !errors.Is(err, ErrPanicked) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the consumer closes the chan of its watcher
+	ch := d.WatchService()
+	close(ch)
+	d.setPairs(nil)
+	if err := <-d.Errors(); !errors.Is(err, ErrPanicked) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCrashOnPanic(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithStrictErrors(), WithCrashOnPanic())
+	defer d.Close()
+	d.SetFilter(func(p *client.KVPair) bool {
+		panic("boom")
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expect the panic of the filter but got %v", r)
+			}
+		}()
+		d.parse(kv.pairs)
+	}()
+	if err := <-d.Errors(); !errors.Is(err, ErrPanicked) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+)
+
+// TagFilter returns a filter keeping the servers which match all expressions.
+// An expression is either key=value matching a metadata field, or a tag in meta.Tags.
+func TagFilter(exprs ...string) (client.ServiceDiscoveryFilter, error) {
+	metas := make(map[string]string)
+	var tags []string
+	for _, expr := range exprs {
+		k, v, ok := strings.Cut(expr, "=")
+		if k == "" {
+			return nil, fmt.Errorf("invalid tag filter %q", expr)
+		}
+		if ok {
+			metas[k] = v
+		} else {
+			tags = append(tags, k)
+		}
+	}
+
+	return func(pair *client.KVPair) bool {
+		v := meta.Parse(pair.Value)
+		for k, value := range metas {
+			if v.Get(k) != value {
+				return false
+			}
+		}
+		for _, tag := range tags {
+			if !meta.HasTag(pair.Value, tag) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// SetTagFilter filters the servers by their tags and metadata before they reach the selector,
+// e.g. SetTagFilter("version=v2", "canary"), see TagFilter. It works alongside SetFilter,
+// and no expressions remove it. The servers are listed again to apply it.
+func (d *ConsulDiscovery) SetTagFilter(exprs ...string) error {
+	var filter client.ServiceDiscoveryFilter
+	if len(exprs) > 0 {
+		var err error
+		if filter, err = TagFilter(exprs...); err != nil {
+			return err
+		}
+	}
+
+	d.tagFilterMu.Lock()
+	d.tagFilter = filter
+	d.tagFilterMu.Unlock()
+
+	<-d.refresh()
+	return nil
+}
+
+// matchTags reports whether the server passes the tag filter.
+func (d *ConsulDiscovery) matchTags(pair *client.KVPair) bool {
+	d.tagFilterMu.RLock()
+	filter := d.tagFilter
+	d.tagFilterMu.RUnlock()
+	return filter == nil || filter(pair)
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestTagFilter(t *testing.T) {
+	kv := newFakeStore(
+		&store.KVPair{Key: "rpcx/app/tcp@1:1", Value: []byte("version=v1&tags=a")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:2", Value: []byte("version=v2&tags=a,canary")},
+		&store.KVPair{Key: "rpcx/app/tcp@1:3", Value: []byte("version=v2")},
+	)
+	d, err := NewConsulDiscoveryStore("rpcx/app", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.SetTagFilter("version=v2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.GetServices()); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+	d.SetTagFilter("version=v2", "canary")
+	if ps := d.GetServices(); len(ps) != 1 || ps[0].Key != "tcp@1:2" {
+		t.Fatalf("got %v", ps)
+	}
+	d.SetTagFilter()
+	if n := len(d.GetServices()); n != 3 {
+		t.Fatalf("got %d", n)
+	}
+	if err := d.SetTagFilter("=x"); err == nil {
+		t.Fatal("expect error")
+	}
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// defaultTombstoneTTL is how long a tombstone is honored if it doesn't publish its expiry.
+const defaultTombstoneTTL = time.Minute
+
+// tombstone is a server which is unregistered, see meta.Tombstone.
+type tombstone struct {
+	// modify index of the tombstone, zero if the store doesn't report it
+	index   uint64
+	expires time.Time
+}
+
+// checkTombstone reports whether to keep the server of key. The tombstones are always dropped and remembered
+// until they expire, so that an older value of the key, e.g. of a stale read, doesn't bring the server back.
+// A value written after the tombstone, e.g. by the server registering again, is kept.
+func (d *ConsulDiscovery) checkTombstone(key string, p *store.KVPair) bool {
+	d.tombstonesMu.Lock()
+	defer d.tombstonesMu.Unlock()
+
+	now := time.Now()
+	if expires, ok := meta.TombstoneOf(string(p.Value)); ok {
+		if expires.IsZero() {
+			expires = now.Add(defaultTombstoneTTL)
+		}
+		if d.tombstones == nil {
+			d.tombstones = make(map[string]tombstone)
+		}
+		for k, t := range d.tombstones { // forget the expired tombstones whose keys are gone
+			if now.After(t.expires) {
+				delete(d.tombstones, k)
+			}
+		}
+		d.tombstones[key] = tombstone{index: p.LastIndex, expires: expires}
+		return false
+	}
+
+	t, ok := d.tombstones[key]
+	if !ok {
+		return true
+	}
+	if now.After(t.expires) || t.index > 0 && p.LastIndex > t.index {
+		delete(d.tombstones, key)
+		return true
+	}
+	return false
+}
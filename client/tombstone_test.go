@@ -0,0 +1,34 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+func TestTombstone(t *testing.T) {
+	d := &ConsulDiscovery{basePath: "rpcx/A", cache: &pairSlot{}}
+	live := &store.KVPair{Key: "rpcx/A/a", Value: []byte("group=a"), LastIndex: 5}
+	if ps := d.parse([]*store.KVPair{live}); len(ps) != 1 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	tomb := &store.KVPair{Key: "rpcx/A/a", Value: []byte(meta.Tombstone(time.Now().Add(time.Minute))), LastIndex: 7}
+	if ps := d.parse([]*store.KVPair{tomb}); len(ps) != 0 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	if ps := d.parse([]*store.KVPair{live}); len(ps) != 0 {
+		t.Fatal("stale resurrected", ps)
+	}
+	again := &store.KVPair{Key: "rpcx/A/a", Value: []byte("group=a"), LastIndex: 9}
+	if ps := d.parse([]*store.KVPair{again}); len(ps) != 1 {
+		t.Fatal("re-registered hidden")
+	}
+
+	exp := &store.KVPair{Key: "rpcx/A/b", Value: []byte(meta.Tombstone(time.Now().Add(-time.Second)))}
+	d.parse([]*store.KVPair{exp})
+	if ps := d.parse([]*store.KVPair{{Key: "rpcx/A/b"}}); len(ps) != 1 {
+		t.Fatal("expired honored")
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// AddressValidator validates the key of a discovered server like tcp@10.0.0.1:8972,
+// the servers with an invalid key are dropped.
+type AddressValidator func(key string) error
+
+// WithAddressValidator drops the servers rejected by the validator, for example DefaultAddressValidator.
+func WithAddressValidator(validator AddressValidator) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.addressValidator = validator
+	}
+}
+
+// DefaultAddressValidator returns a validator which requires a non-empty host and a valid port.
+// Loopback hosts are rejected too if remote is true, i.e. the servers run on other hosts than the client,
+// where they can't be reached by loopback addresses. Servers on unix sockets are always accepted.
+func DefaultAddressValidator(remote bool) AddressValidator {
+	return func(key string) error {
+		network, host, port, err := meta.SplitKey(key)
+		if network == "unix" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			return errors.New("empty host")
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		if remote && isLoopback(host) {
+			return fmt.Errorf("loopback host %s of remote server", host)
+		}
+		return nil
+	}
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// RejectedAddresses returns how many servers have been rejected by the address validator.
+func (d *ConsulDiscovery) RejectedAddresses() uint64 {
+	return atomic.LoadUint64(&d.rejected)
+}
+
+// checkAddress reports whether the address of the server is accepted by the validator.
+func (d *ConsulDiscovery) checkAddress(pair *client.KVPair) bool {
+	if d.addressValidator == nil {
+		return true
+	}
+	err := d.addressValidator(pair.Key)
+	if err == nil {
+		return true
+	}
+
+	atomic.AddUint64(&d.rejected, 1)
+	log.Warnf("skip server %s of %s with invalid address: %v", pair.Key, d.basePath, err)
+	return false
+}
@@ -0,0 +1,22 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestAddressValidator(t *testing.T) {
+	v := DefaultAddressValidator(true)
+	for key, ok := range map[string]bool{"tcp@10.0.0.1:8972": true, "unix@/tmp/a.sock": true, "tcp@127.0.0.1:1": false, "tcp@localhost:1": false, "tcp@:1": false, "tcp@h:0": false, "tcp@h": false} {
+		if (v(key) == nil) != ok {
+			t.Fatalf("unexpected validation of %s: %v", key, v(key))
+		}
+	}
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/tcp@10.0.0.1:1"}, &store.KVPair{Key: "rpcx/A/tcp@bad"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithAddressValidator(DefaultAddressValidator(false)))
+	defer d.Close()
+	if len(d.GetServices()) != 1 || d.RejectedAddresses() != 1 {
+		t.Fatalf("unexpected services %v", d.GetServices())
+	}
+}
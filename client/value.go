@@ -0,0 +1,67 @@
+package client
+
+import (
+	"net/url"
+	"sync/atomic"
+
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// MalformedPolicy is how to handle the servers whose value can't be parsed as metadata.
+type MalformedPolicy int
+
+const (
+	// KeepMalformed keeps the server with its value unchanged.
+	KeepMalformed MalformedPolicy = iota
+	// SkipMalformed drops the server.
+	SkipMalformed
+	// EmptyMalformed keeps the server with an empty value.
+	EmptyMalformed
+)
+
+// MalformedHandler is called with the server whose value can't be parsed.
+// It can modify the pair and returns whether to keep it.
+type MalformedHandler func(pair *client.KVPair, err error) bool
+
+// WithMalformedPolicy sets how to handle the servers whose value can't be parsed as metadata.
+func WithMalformedPolicy(policy MalformedPolicy) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.malformedPolicy = policy
+	}
+}
+
+// WithMalformedHandler sets the handler of the servers whose value can't be parsed as metadata.
+// It takes precedence over the MalformedPolicy.
+func WithMalformedHandler(handler MalformedHandler) ConsulDiscoveryOpt {
+	return func(d *ConsulDiscovery) {
+		d.malformedHandler = handler
+	}
+}
+
+// MalformedValues returns how many malformed values have been seen.
+func (d *ConsulDiscovery) MalformedValues() uint64 {
+	return atomic.LoadUint64(&d.malformed)
+}
+
+// checkValue reports whether to keep the server according to the malformed policy.
+func (d *ConsulDiscovery) checkValue(pair *client.KVPair) bool {
+	_, err := url.ParseQuery(pair.Value)
+	if err == nil {
+		return true
+	}
+
+	atomic.AddUint64(&d.malformed, 1)
+	if d.malformedHandler != nil {
+		return d.malformedHandler(pair, err)
+	}
+
+	switch d.malformedPolicy {
+	case SkipMalformed:
+		log.Warnf("skip server %s of %s with malformed value: %v", pair.Key, d.basePath, err)
+		return false
+	case EmptyMalformed:
+		pair.Value = ""
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestMalformedPolicy(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a", Value: []byte("x=%zz")}, &store.KVPair{Key: "rpcx/A/b", Value: []byte("x=1")})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithMalformedPolicy(SkipMalformed))
+	defer d.Close()
+	if ps := d.GetServices(); len(ps) != 1 || d.MalformedValues() != 1 {
+		t.Fatalf("unexpected services %v", ps)
+	}
+	d2, _ := NewConsulDiscoveryStore("rpcx/A", kv, WithMalformedPolicy(EmptyMalformed))
+	defer d2.Close()
+	if ps := d2.GetServices(); len(ps) != 2 || ps[0].Value != "" {
+		t.Fatalf("unexpected services %v", ps)
+	}
+}
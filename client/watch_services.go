@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+)
+
+// ServiceUpdate is the servers of a service path received from WatchServices.
+type ServiceUpdate struct {
+	Path  string
+	Pairs []*client.KVPair
+}
+
+// WatchServices watches the servicePaths relative to this discovery through one chan,
+// which receives the current servers of every path first and then every change,
+// so that gateways don't manage a chan per upstream. Call stop to release the watches, which closes the chan.
+// Only the latest servers of a path are kept while the receiver falls behind, and a repeated path is watched once.
+// The watches are closed once ctx is done like WithContext, then stop still has to be called to close the chan.
+func (d *ConsulDiscovery) WatchServices(ctx context.Context, servicePaths []string) (updates <-chan ServiceUpdate, stop func(), err error) {
+	clones, err := d.CloneAll(ctx, servicePaths, 0)
+	if err != nil {
+		for _, c := range clones {
+			c.Close()
+		}
+		return nil, nil, err
+	}
+
+	// the current servers are queued before any watch goroutine sends, so that they fit in the buffer
+	out := make(chan ServiceUpdate, len(clones))
+	watches := make(map[string]chan []*client.KVPair, len(clones))
+	for path, c := range clones {
+		watches[path] = c.WatchServiceWith(WithName("watch-services"), WithPolicy(CoalesceLatest))
+		out <- ServiceUpdate{Path: path, Pairs: c.GetServices()}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			close(out)
+			for _, c := range clones {
+				c.Close()
+			}
+		})
+	}
+	for path, c := range clones {
+		path, c, ch := path, c, watches[path]
+		wg.Add(1)
+		err := budget.Go("services watch", func() {
+			defer wg.Done()
+			defer c.RemoveWatcher(ch)
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case pairs := <-ch:
+					select {
+					case out <- ServiceUpdate{Path: path, Pairs: pairs}:
+					case <-done:
+						return
+					}
+				}
+			}
+		})
+		if err != nil {
+			wg.Done()
+			c.RemoveWatcher(ch)
+			stop()
+			return nil, nil, err
+		}
+	}
+	return out, stop, nil
+}
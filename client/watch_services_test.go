@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+// dirStore returns a watch chan per directory.
+type dirStore struct {
+	*fakeStore
+	mu  sync.Mutex
+	chs map[string]chan []*store.KVPair
+}
+
+func (s *dirStore) ch(dir string) chan []*store.KVPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chs[dir] == nil {
+		s.chs[dir] = make(chan []*store.KVPair, 10)
+	}
+	return s.chs[dir]
+}
+func (s *dirStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.ch(directory), nil
+}
+
+func TestWatchServices(t *testing.T) {
+	kv := &dirStore{fakeStore: newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/B/b"}), chs: map[string]chan []*store.KVPair{}}
+	d, _ := NewConsulDiscoveryStore("rpcx", kv)
+	up, stop, err := d.WatchServices(context.Background(), []string{"A", "B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for i := 0; i < 2; i++ {
+		u := <-up
+		seen[u.Path] = len(u.Pairs)
+	}
+	if seen["A"] != 1 || seen["B"] != 1 {
+		t.Fatalf("unexpected updates %v", seen)
+	}
+	kv.ch("rpcx/A/") <- []*store.KVPair{{Key: "rpcx/A/x"}, {Key: "rpcx/A/y"}}
+	select {
+	case u := <-up:
+		if u.Path != "A" || len(u.Pairs) != 2 {
+			t.Fatalf("unexpected update %+v", u)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update")
+	}
+
+	stop()
+	for range up {
+	}
+	stop()
+}
+
+func TestWatchServicesRepeated(t *testing.T) {
+	kv := &dirStore{fakeStore: newFakeStore(&store.KVPair{Key: "rpcx/A/a"}, &store.KVPair{Key: "rpcx/B/b"}), chs: map[string]chan []*store.KVPair{}}
+	d, _ := NewConsulDiscoveryStore("rpcx", kv)
+	defer d.Close()
+	up, stop, err := d.WatchServices(context.Background(), []string{"A", "B", "A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if len(up) != 2 {
+		t.Fatalf("expect A and B to be watched once but got %d updates", len(up))
+	}
+}
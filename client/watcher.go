@@ -0,0 +1,397 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WatchPolicy is how the changes are delivered to a watcher whose consumer is slow.
+type WatchPolicy int
+
+const (
+	// DropNewest drops the new change if the chan is full, it is the default policy.
+	DropNewest WatchPolicy = iota
+	// DropOldest drops the oldest pending change to make room for the new change.
+	DropOldest
+	// Block waits until the consumer receives the change, which holds up the updates of the discovery,
+	// so it is only for the consumers which keep up.
+	Block
+	// CoalesceLatest keeps only the latest undelivered change, which is sent once the consumer is ready.
+	CoalesceLatest
+)
+
+func (p WatchPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case CoalesceLatest:
+		return "coalesce-latest"
+	default:
+		return "policy-" + strconv.Itoa(int(p))
+	}
+}
+
+// watcher is a chan returned by WatchService or WatchServiceEvents.
+type watcher struct {
+	// number of dropped changes, accessed atomically and kept first for alignment
+	drops uint64
+
+	// either ch or events is set
+	ch     chan []*client.KVPair
+	events chan []ServiceEvent
+	// servers already sent to events
+	sent map[string]string
+
+	name    string
+	created time.Time
+	buffer  int
+	policy  WatchPolicy
+
+	// serializes the sends
+	sendMu sync.Mutex
+	// the latest servers and the signal of them, for CoalesceLatest
+	latestMu  sync.Mutex
+	latest    []*client.KVPair
+	latestSet bool
+	notify    chan struct{}
+	// closed when the watcher is removed
+	removed chan struct{}
+}
+
+// WatcherInfo describes a watcher of the discovery.
+type WatcherInfo struct {
+	Name       string    `json:"name"`
+	Policy     string    `json:"policy"`
+	Events     bool      `json:"events,omitempty"`
+	BufferSize int       `json:"buffer_size"`
+	Pending    int       `json:"pending"`
+	Drops      uint64    `json:"drops"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WatchOpt configures a watcher created by WatchServiceWith or WatchServiceEvents.
+type WatchOpt func(*watcher)
+
+// WithName names the watcher to identify its consumer, for example "xclient-orders".
+// The watchers without a name are named by their order, e.g. watcher-1.
+func WithName(name string) WatchOpt {
+	return func(w *watcher) {
+		w.name = name
+	}
+}
+
+// WithBuffer sets the buffer size of the chan of the watcher, the buffer size of the discovery is used by default.
+func WithBuffer(size int) WatchOpt {
+	return func(w *watcher) {
+		w.buffer = size
+	}
+}
+
+// WithPolicy sets how the changes are delivered if the consumer is slow, DropNewest by default.
+func WithPolicy(policy WatchPolicy) WatchOpt {
+	return func(w *watcher) {
+		w.policy = policy
+	}
+}
+
+// watchLatest watches the servers of d with CoalesceLatest if it supports the watch options, e.g. ConsulDiscovery,
+// so that a slow consumer receives the latest servers instead of missing the changes dropped from its full chan.
+func watchLatest(d client.ServiceDiscovery, name string) chan []*client.KVPair {
+	if wd, ok := d.(interface {
+		WatchServiceWith(opts ...WatchOpt) chan []*client.KVPair
+	}); ok {
+		return wd.WatchServiceWith(WithName(name), WithPolicy(CoalesceLatest))
+	}
+	return d.WatchService()
+}
+
+// WatchServiceWith is WatchService with options.
+func (d *ConsulDiscovery) WatchServiceWith(opts ...WatchOpt) chan []*client.KVPair {
+	w := d.newWatcher(opts)
+	w.ch = make(chan []*client.KVPair, w.buffer)
+	d.addWatcher(w)
+	return w.ch
+}
+
+// WatchServiceEvents returns a chan to receive the added, removed and updated servers instead of all servers on every change.
+// The current servers are sent as added first. The events are never lost: the changes which can't be delivered
+// are merged and sent by a goroutine of the watcher once the consumer is ready, like CoalesceLatest,
+// so the policy of the watcher is ignored. The buffer size is at least 1.
+func (d *ConsulDiscovery) WatchServiceEvents(opts ...WatchOpt) chan []ServiceEvent {
+	w := d.newWatcher(opts)
+	if w.buffer < 1 {
+		w.buffer = 1
+	}
+	w.policy = CoalesceLatest
+	w.events = make(chan []ServiceEvent, w.buffer)
+	w.sent = make(map[string]string)
+
+	// the watcher is added before the current servers are read, so that no change is missed
+	d.addWatcher(w)
+	pairs := d.GetServices()
+	if w.policy != CoalesceLatest {
+		// no goroutine for the watcher, the chan is still empty
+		w.trySend(pairs)
+		return w.events
+	}
+	w.latestMu.Lock()
+	// the servers received since the watcher was added are not older than the current ones
+	if !w.latestSet {
+		w.latest, w.latestSet = pairs, true
+	}
+	w.latestMu.Unlock()
+	w.signal()
+	return w.events
+}
+
+// RemoveEventsWatcher removes the chan returned by WatchServiceEvents.
+func (d *ConsulDiscovery) RemoveEventsWatcher(ch chan []ServiceEvent) {
+	d.removeWatchers(func(w *watcher) bool { return w.events == ch })
+}
+
+func (d *ConsulDiscovery) newWatcher(opts []WatchOpt) *watcher {
+	w := &watcher{created: time.Now(), buffer: d.watchBuffer, removed: make(chan struct{})}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.buffer < 0 {
+		w.buffer = 0
+	}
+	return w
+}
+
+func (d *ConsulDiscovery) addWatcher(w *watcher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.watcherSeq++
+	if w.name == "" {
+		w.name = "watcher-" + strconv.Itoa(d.watcherSeq)
+	}
+	d.watchers = append(d.watchers, w)
+
+	if w.policy == CoalesceLatest {
+		w.notify = make(chan struct{}, 1)
+		if err := budget.Go("notifier", func() { d.coalesce(w) }); err != nil {
+			// the latest servers are still delivered if the consumer catches up
+			log.Errorf("watcher %s of %s falls back to DropOldest: %v", w.name, d.basePath, err)
+			d.reportError(err)
+			w.policy = DropOldest
+		}
+	}
+}
+
+// removeWatchers removes the watchers matching remove.
+func (d *ConsulDiscovery) removeWatchers(remove func(w *watcher) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var watchers []*watcher
+	for _, w := range d.watchers {
+		if remove(w) {
+			close(w.removed)
+			continue
+		}
+
+		watchers = append(watchers, w)
+	}
+
+	d.watchers = watchers
+}
+
+// notifyWatchers delivers the servers to all watchers by their policies.
+func (d *ConsulDiscovery) notifyWatchers(pairs []*client.KVPair) {
+	d.mu.Lock()
+	watchers := append([]*watcher(nil), d.watchers...)
+	d.mu.Unlock()
+
+	for _, w := range watchers {
+		d.deliver(w, pairs)
+	}
+}
+
+// deliver delivers the servers to the watcher by its policy.
+func (d *ConsulDiscovery) deliver(w *watcher, pairs []*client.KVPair) {
+	// the consumer may close the chan
+	defer d.recoverPanic("watcher " + w.name)
+
+	switch w.policy {
+	case CoalesceLatest:
+		w.latestMu.Lock()
+		w.latest, w.latestSet = pairs, true
+		w.latestMu.Unlock()
+		w.signal()
+		return
+	case Block:
+		w.sendBlocking(pairs, d.stopCh)
+		return
+	}
+
+	if w.trySend(pairs) {
+		return
+	}
+	if w.policy == DropOldest && w.ch != nil {
+		select {
+		case <-w.ch:
+		default:
+		}
+		atomic.AddUint64(&w.drops, 1)
+		if d.hook != nil {
+			d.hook.NotificationDropped(d.basePath, w.name)
+		}
+		if w.trySend(pairs) {
+			return
+		}
+	}
+
+	atomic.AddUint64(&w.drops, 1)
+	if d.hook != nil {
+		d.hook.NotificationDropped(d.basePath, w.name)
+	}
+	if w.events != nil {
+		log.Warnf("events chan of watcher %s of %s is full, the change is merged into the next events", w.name, d.basePath)
+		return
+	}
+	log.Warnf("chan of watcher %s of %s is full and new change has been dropped", w.name, d.basePath)
+	d.reportError(fmt.Errorf("watcher %s of %s: %w", w.name, d.basePath, ErrChangeDropped))
+}
+
+// signal wakes up the goroutine of the watcher to send the latest servers.
+func (w *watcher) signal() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce sends the latest servers to the watcher until it is removed or the discovery is closed.
+func (d *ConsulDiscovery) coalesce(w *watcher) {
+	for {
+		select {
+		case <-w.notify:
+		case <-w.removed:
+			return
+		case <-d.stopCh:
+			return
+		}
+
+		w.latestMu.Lock()
+		pairs := w.latest
+		w.latestMu.Unlock()
+		func() {
+			defer d.recoverPanic("watcher " + w.name)
+			w.sendBlocking(pairs, d.stopCh)
+		}()
+	}
+}
+
+// trySend sends the servers, or the events since the last sent servers, without blocking.
+func (w *watcher) trySend(pairs []*client.KVPair) bool {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	if w.events == nil {
+		select {
+		case w.ch <- pairs:
+			return true
+		default:
+			return false
+		}
+	}
+
+	events := diffEvents(w.sent, pairs)
+	if len(events) == 0 {
+		return true
+	}
+	select {
+	case w.events <- events:
+		w.sent = pairsMap(pairs)
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBlocking sends the servers, or the events since the last sent servers,
+// until the watcher is removed or stop is closed.
+func (w *watcher) sendBlocking(pairs []*client.KVPair, stop <-chan struct{}) {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	if w.events == nil {
+		select {
+		case w.ch <- pairs:
+		case <-w.removed:
+		case <-stop:
+		}
+		return
+	}
+
+	events := diffEvents(w.sent, pairs)
+	if len(events) == 0 {
+		return
+	}
+	select {
+	case w.events <- events:
+		w.sent = pairsMap(pairs)
+	case <-w.removed:
+	case <-stop:
+	}
+}
+
+func (w *watcher) info() WatcherInfo {
+	info := WatcherInfo{
+		Name:      w.name,
+		Policy:    w.policy.String(),
+		Events:    w.events != nil,
+		Drops:     atomic.LoadUint64(&w.drops),
+		CreatedAt: w.created,
+	}
+	if w.events != nil {
+		info.BufferSize, info.Pending = cap(w.events), len(w.events)
+	} else {
+		info.BufferSize, info.Pending = cap(w.ch), len(w.ch)
+	}
+	return info
+}
+
+// WatchServiceNamed is WatchService with a name identifying the consumer of the chan,
+// which is reported with the changes dropped because the consumer is too slow.
+func (d *ConsulDiscovery) WatchServiceNamed(name string) chan []*client.KVPair {
+	return d.WatchServiceWith(WithName(name))
+}
+
+// Watchers returns the current watchers.
+func (d *ConsulDiscovery) Watchers() []WatcherInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	infos := make([]WatcherInfo, 0, len(d.watchers))
+	for _, w := range d.watchers {
+		infos = append(infos, w.info())
+	}
+	return infos
+}
+
+// DroppedChanges returns how many changes have been dropped by the name of every current watcher.
+func (d *ConsulDiscovery) DroppedChanges() map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	drops := make(map[string]uint64, len(d.watchers))
+	for _, w := range d.watchers {
+		drops[w.name] += atomic.LoadUint64(&w.drops)
+	}
+	return drops
+}
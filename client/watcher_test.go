@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestWatcherDrops(t *testing.T) {
+	kv := newFakeStore(&store.KVPair{Key: "rpcx/A/a"})
+	d, _ := NewConsulDiscoveryStore("rpcx/A", kv)
+	defer d.Close()
+	d.WatchServiceNamed("slow")
+	fast := d.WatchService()
+	for i := 0; i < 15; i++ {
+		d.setPairs(nil)
+		select {
+		case <-fast:
+		default:
+		}
+	}
+	if !waitFor(func() bool { return d.DroppedChanges()["slow"] == 5 }) {
+		t.Fatalf("unexpected dropped changes %v", d.DroppedChanges())
+	}
+	if _, ok := d.DroppedChanges()["watcher-2"]; !ok {
+		t.Fatalf("unexpected dropped changes %v", d.DroppedChanges())
+	}
+}
+
+func TestWatchersHandler(t *testing.T) {
+	d, _ := NewConsulDiscoveryStore("rpcx/A", newFakeStore())
+	defer d.Close()
+	d.WatchServiceWith(WithName("xclient-orders"))
+	srv := httptest.NewServer(NewDiscoveryHandler(d))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/watchers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var infos []WatcherInfo
+	json.NewDecoder(resp.Body).Decode(&infos)
+	if len(infos) != 1 || infos[0].Name != "xclient-orders" || infos[0].BufferSize != 10 {
+		t.Fatalf("unexpected watchers %v", infos)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	d, _ := NewConsulDiscoveryStore("rpcx/A", newFakeStore())
+	defer d.Close()
+	oldest := d.WatchServiceWith(WithBuffer(2), WithPolicy(DropOldest), WithName("oldest"))
+	coalesce := d.WatchServiceWith(WithBuffer(0), WithPolicy(CoalesceLatest))
+	g := runtime.NumGoroutine()
+	d.setPairs(kvs("a"))
+	d.setPairs(kvs("b"))
+	d.setPairs(kvs("c"))
+	if runtime.NumGoroutine() > g+1 {
+		t.Fatal("goroutines", runtime.NumGoroutine(), g)
+	}
+	if p := <-oldest; p[0].Key != "b" {
+		t.Fatalf("unexpected server %s", p[0].Key)
+	}
+	if p := <-oldest; p[0].Key != "c" {
+		t.Fatalf("unexpected server %s", p[0].Key)
+	}
+	if d.DroppedChanges()["oldest"] != 1 {
+		t.Fatalf("unexpected dropped changes %v", d.DroppedChanges())
+	}
+	// first coalesced delivery may be a or later, last one must be c
+	var last string
+	for done := false; !done; {
+		select {
+		case p := <-coalesce:
+			last = p[0].Key
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if last != "c" {
+		t.Fatalf("unexpected last change %s", last)
+	}
+
+	blocked := d.WatchServiceWith(WithBuffer(0), WithPolicy(Block))
+	done := make(chan struct{})
+	go func() { d.setPairs(kvs("d")); close(done) }()
+	select {
+	case <-done:
+		t.Fatal("expect blocking")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if p := <-blocked; p[0].Key != "d" {
+		t.Fatalf("unexpected %v", p)
+	}
+	<-done
+	go func() { d.setPairs(kvs("e")); close(done) }()
+	done = make(chan struct{})
+	time.Sleep(50 * time.Millisecond)
+	d.RemoveWatcher(blocked)
+	infos := d.Watchers()
+	if len(infos) != 2 || infos[0].Policy != "drop-oldest" {
+		t.Fatalf("unexpected watchers %v", infos)
+	}
+}
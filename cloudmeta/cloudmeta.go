@@ -0,0 +1,265 @@
+// Package cloudmeta reads the metadata of the instance a server runs on from cloud providers,
+// such as its zone, so that the register plugin publishes it with all services
+// (see serverplugin.WithConsulEnrichers) and the clients can filter servers by zone.
+package cloudmeta
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// DefaultTimeout bounds the requests to the metadata services, they are only reachable on their cloud.
+const DefaultTimeout = 2 * time.Second
+
+// ErrNotAvailable is returned if the metadata service of the provider is not reachable.
+var ErrNotAvailable = errors.New("instance metadata is not available")
+
+// Enricher returns the metadata of the instance, keyed by the fields of package meta.
+type Enricher interface {
+	Enrich(ctx context.Context) (map[string]string, error)
+}
+
+// EnricherFunc is an adapter to use a function as an Enricher.
+type EnricherFunc func(ctx context.Context) (map[string]string, error)
+
+// Enrich calls f(ctx).
+func (f EnricherFunc) Enrich(ctx context.Context) (map[string]string, error) {
+	return f(ctx)
+}
+
+// Enrich merges the metadata of the enrichers, the earlier enrichers take precedence.
+// The enrichers which fail are skipped, their errors are returned together with the merged metadata.
+func Enrich(ctx context.Context, enrichers ...Enricher) (map[string]string, []error) {
+	fields := make(map[string]string)
+	var errs []error
+	for _, e := range enrichers {
+		m, err := e.Enrich(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for k, v := range m {
+			if _, ok := fields[k]; !ok && v != "" {
+				fields[k] = v
+			}
+		}
+	}
+	return fields, errs
+}
+
+// AWS reads the availability zone, region and instance id from the EC2 instance metadata service (IMDSv2).
+type AWS struct {
+	// Endpoint of the metadata service, http://169.254.169.254 if empty
+	Endpoint string
+	Client   *http.Client
+}
+
+// Enrich implements Enricher.
+func (a *AWS) Enrich(ctx context.Context) (map[string]string, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := do(a.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("aws: %w", err)
+	}
+
+	fields := make(map[string]string)
+	for field, path := range map[string]string{
+		meta.Zone:       "/latest/meta-data/placement/availability-zone",
+		meta.Region:     "/latest/meta-data/placement/region",
+		meta.InstanceID: "/latest/meta-data/instance-id",
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		v, err := do(a.Client, req)
+		if err != nil {
+			return nil, fmt.Errorf("aws: %w", err)
+		}
+		fields[field] = v
+	}
+	return fields, nil
+}
+
+// GCP reads the zone, region and instance id from the Compute Engine metadata server.
+type GCP struct {
+	// Endpoint of the metadata server, http://metadata.google.internal if empty
+	Endpoint string
+	Client   *http.Client
+}
+
+// Enrich implements Enricher.
+func (g *GCP) Enrich(ctx context.Context) (map[string]string, error) {
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = "http://metadata.google.internal"
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/computeMetadata/v1/instance/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		v, err := do(g.Client, req)
+		if err != nil {
+			return "", fmt.Errorf("gcp: %w", err)
+		}
+		return v, nil
+	}
+
+	// the zone is like projects/123456/zones/us-central1-a
+	zone, err := get("zone")
+	if err != nil {
+		return nil, err
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	id, err := get("id")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{meta.Zone: zone, meta.InstanceID: id}
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		fields[meta.Region] = zone[:i]
+	}
+	return fields, nil
+}
+
+// Kubernetes reads the node and the pod from the environment and the labels of the pod
+// from a downward API volume. The well-known zone and region labels of the pod are published as meta.Zone and meta.Region.
+//
+// The environment is set in the pod spec like:
+//
+//	env:
+//	- name: NODE_NAME
+//	  valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//	- name: POD_NAME
+//	  valueFrom: {fieldRef: {fieldPath: metadata.name}}
+type Kubernetes struct {
+	// LabelsFile is the downward API file of metadata.labels, /etc/podinfo/labels if empty
+	LabelsFile string
+	// Labels selects the labels to publish, all labels are published if empty
+	Labels []string
+}
+
+// Enrich implements Enricher.
+func (k *Kubernetes) Enrich(ctx context.Context) (map[string]string, error) {
+	fields := make(map[string]string)
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		fields[meta.Node] = node
+	}
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		fields[meta.Pod] = pod
+	}
+
+	file := k.LabelsFile
+	if file == "" {
+		file = "/etc/podinfo/labels"
+	}
+	labels, err := readLabels(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	if len(fields) == 0 && labels == nil {
+		return nil, fmt.Errorf("kubernetes: %w", ErrNotAvailable)
+	}
+
+	for name, value := range labels {
+		switch name {
+		case "topology.kubernetes.io/zone":
+			fields[meta.Zone] = value
+		case "topology.kubernetes.io/region":
+			fields[meta.Region] = value
+		}
+		if k.selected(name) {
+			fields[meta.LabelPrefix+name] = value
+		}
+	}
+	return fields, nil
+}
+
+func (k *Kubernetes) selected(label string) bool {
+	if len(k.Labels) == 0 {
+		return true
+	}
+	for _, l := range k.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// readLabels reads the labels in the downward API format, one key="value" per line.
+func readLabels(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q in %s", line, file)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		labels[name] = value
+	}
+	return labels, scanner.Err()
+}
+
+// do sends the request and returns the body, which must be returned with 200 OK.
+func do(c *http.Client, req *http.Request) (string, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNotAvailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Default returns the enrichers of all supported providers, the kubernetes metadata takes precedence.
+func Default() []Enricher {
+	return []Enricher{&Kubernetes{}, &AWS{}, &GCP{}}
+}
@@ -0,0 +1,122 @@
+package cloudmeta
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAWS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/placement/availability-zone":
+			w.Write([]byte("us-east-1a"))
+		case "/latest/meta-data/placement/region":
+			w.Write([]byte("us-east-1"))
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-0123456789"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	fields, err := (&AWS{Endpoint: ts.URL}).Enrich(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"zone": "us-east-1a", "region": "us-east-1", "instance_id": "i-0123456789"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("expect %v but got %v", want, fields)
+	}
+}
+
+func TestGCP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/zone":
+			w.Write([]byte("projects/123456/zones/us-central1-a"))
+		case "/computeMetadata/v1/instance/id":
+			w.Write([]byte("42"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	fields, err := (&GCP{Endpoint: ts.URL}).Enrich(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"zone": "us-central1-a", "region": "us-central1", "instance_id": "42"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("expect %v but got %v", want, fields)
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "labels")
+	labels := "app=\"payments\"\ntopology.kubernetes.io/zone=\"eu-west-1b\"\ntier=\"backend\"\n"
+	if err := os.WriteFile(file, []byte(labels), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("POD_NAME", "payments-7d9f")
+
+	fields, err := (&Kubernetes{LabelsFile: file, Labels: []string{"app"}}).Enrich(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"node": "node-1", "pod": "payments-7d9f", "zone": "eu-west-1b", "label_app": "payments"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("expect %v but got %v", want, fields)
+	}
+
+	t.Setenv("NODE_NAME", "")
+	t.Setenv("POD_NAME", "")
+	_, err = (&Kubernetes{LabelsFile: filepath.Join(t.TempDir(), "labels")}).Enrich(context.Background())
+	if !errors.Is(err, ErrNotAvailable) {
+		t.Fatalf("expect ErrNotAvailable but got %v", err)
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	failed := errors.New("failed")
+	fields, errs := Enrich(context.Background(),
+		EnricherFunc(func(context.Context) (map[string]string, error) { return nil, failed }),
+		EnricherFunc(func(context.Context) (map[string]string, error) {
+			return map[string]string{"zone": "a", "node": ""}, nil
+		}),
+		EnricherFunc(func(context.Context) (map[string]string, error) {
+			return map[string]string{"zone": "b", "node": "n"}, nil
+		}),
+	)
+	if len(errs) != 1 || errs[0] != failed {
+		t.Fatalf("expect the error of the first enricher but got %v", errs)
+	}
+	want := map[string]string{"zone": "a", "node": "n"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("expect %v but got %v", want, fields)
+	}
+}
@@ -0,0 +1,107 @@
+// Command rpcx-consul runs administrative operations on the rpcx services registered in consul.
+//
+//	rpcx-consul -consul 127.0.0.1:8500 freeze rpcx/Arith
+//	rpcx-consul -consul 127.0.0.1:8500 unfreeze rpcx/Arith
+//	rpcx-consul -consul 127.0.0.1:8500 weights rpcx/Arith v1=90,v2=10
+//	rpcx-consul -consul 127.0.0.1:8500 expel rpcx/Arith tcp@10.0.0.1:8972 bad disk
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rpcxio/libkv"
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/libkv/store/consul"
+	"github.com/rpcxio/rpcx-consul/admin"
+)
+
+var consulAddr = flag.String("consul", "127.0.0.1:8500", "consul address")
+
+func init() {
+	consul.Register()
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <verb> <args>\n\nverbs:\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "  freeze <servicePath>    pin the servers of the service in all discoveries")
+	fmt.Fprintln(flag.CommandLine.Output(), "  unfreeze <servicePath>  unpin the servers of the service")
+	fmt.Fprintln(flag.CommandLine.Output(), "  weights <servicePath> [group=weight,...]")
+	fmt.Fprintln(flag.CommandLine.Output(), "                          shift the traffic between the groups, no weights clear them")
+	fmt.Fprintln(flag.CommandLine.Output(), "  expel <servicePath> <instance> [reason]")
+	fmt.Fprintln(flag.CommandLine.Output(), "                          remove the instance from all discoveries at once")
+	fmt.Fprintln(flag.CommandLine.Output(), "  unexpel <servicePath> <instance>")
+	fmt.Fprintln(flag.CommandLine.Output(), "                          let the discoveries use the instance again")
+	fmt.Fprintln(flag.CommandLine.Output(), "\nflags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	kv, err := libkv.NewStore(store.CONSUL, []string{*consulAddr}, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot connect to consul: %v\n", err)
+		os.Exit(1)
+	}
+	defer kv.Close()
+
+	verb, args := flag.Arg(0), flag.Args()[1:]
+	switch verb {
+	case "freeze":
+		err = admin.Freeze(kv, args[0])
+	case "unfreeze":
+		err = admin.Unfreeze(kv, args[0])
+	case "weights":
+		if len(args) < 2 {
+			err = admin.ClearGroupWeights(kv, args[0])
+			break
+		}
+		var weights map[string]int
+		if weights, err = parseWeights(args[1]); err == nil {
+			err = admin.SetGroupWeights(kv, args[0], weights)
+		}
+	case "expel", "unexpel":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		if verb == "unexpel" {
+			err = admin.Unexpel(kv, args[0], args[1])
+			break
+		}
+		err = admin.Expel(kv, args[0], args[1], strings.Join(args[2:], " "))
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v: %v\n", verb, args, err)
+		os.Exit(1)
+	}
+}
+
+// parseWeights parses the group weights like v1=90,v2=10.
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, field := range strings.Split(s, ",") {
+		group, weight, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed group weight %q", field)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, fmt.Errorf("malformed weight of group %s: %w", group, err)
+		}
+		weights[group] = w
+	}
+	return weights, nil
+}
@@ -0,0 +1,55 @@
+// Command rpcx-gateway is an example HTTP gateway to the rpcx services registered in consul.
+// It watches all services under the base path, routes the requests by their ingress hints
+// to the healthy servers and logs the metrics of the gateway.
+//
+//	rpcx-gateway -consul 127.0.0.1:8500 -base rpcx -addr :8080
+//	curl -X POST -d '{"A":2,"B":3}' http://127.0.0.1:8080/Arith/Mul
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/rpcxio/rpcx-consul/client"
+	"github.com/rpcxio/rpcx-consul/gateway"
+)
+
+var (
+	consulAddr      = flag.String("consul", "127.0.0.1:8500", "consul address")
+	basePath        = flag.String("base", "rpcx", "base path of the services")
+	addr            = flag.String("addr", ":8080", "listen address")
+	metricsInterval = flag.Duration("metrics", time.Minute, "interval of logging the metrics, zero disables it")
+	timeout         = flag.Duration("timeout", 30*time.Second, "timeout of reading a request and writing its response")
+)
+
+func main() {
+	flag.Parse()
+
+	d, err := client.NewConsulDiscoveryTemplate(*basePath, []string{*consulAddr}, nil)
+	if err != nil {
+		log.Fatalf("cannot watch the services under %s: %v", *basePath, err)
+	}
+	defer d.Close()
+
+	g := gateway.New()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go g.Watch(d, stopCh)
+
+	if *metricsInterval > 0 {
+		go metrics.Log(metrics.DefaultRegistry, *metricsInterval, log.New(os.Stderr, "metrics: ", log.LstdFlags))
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           g,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *timeout,
+		WriteTimeout:      *timeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Fatal(server.ListenAndServe())
+}
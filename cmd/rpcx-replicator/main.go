@@ -0,0 +1,50 @@
+// Command rpcx-replicator mirrors the rpcx services registered in one consul datacenter into another one.
+//
+//	rpcx-replicator -source 10.0.0.10:8500 -source-dc dc1 -target 10.1.0.10:8500 -target-dc dc2 -base rpcx
+//
+// Run one in the opposite direction as well to replicate both ways.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/replicator"
+)
+
+var (
+	sourceAddr = flag.String("source", "127.0.0.1:8500", "consul address of the source datacenter")
+	sourceDC   = flag.String("source-dc", "", "source datacenter")
+	targetAddr = flag.String("target", "127.0.0.1:8500", "consul address of the target datacenter")
+	targetDC   = flag.String("target-dc", "", "target datacenter")
+	basePath   = flag.String("base", "rpcx", "base path of the services")
+)
+
+func main() {
+	flag.Parse()
+
+	source, err := consulkv.New([]string{*sourceAddr}, nil, &consulkv.Config{Datacenter: *sourceDC})
+	if err != nil {
+		log.Fatalf("cannot connect to consul of %s: %v", *sourceDC, err)
+	}
+	defer source.Close()
+	target, err := consulkv.New([]string{*targetAddr}, nil, &consulkv.Config{Datacenter: *targetDC})
+	if err != nil {
+		log.Fatalf("cannot connect to consul of %s: %v", *targetDC, err)
+	}
+	defer target.Close()
+
+	r, err := replicator.New(source, *sourceDC, target, *targetDC, *basePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r.Run(ctx)
+}
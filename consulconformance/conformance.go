@@ -0,0 +1,250 @@
+// Package consulconformance is a test suite to run against your own consul cluster, to verify that
+// the ACLs, TLS and watches work with this library before going to production:
+//
+//	func TestConsul(t *testing.T) {
+//		consulconformance.Run(t, consulconformance.Config{
+//			Addr:     "consul.example.com:8501",
+//			Consul:   &consulkv.Config{TokenFile: "/etc/consul/token", CAFile: "/etc/consul/ca.pem"},
+//			BasePath: "rpcx_conformance",
+//		})
+//	}
+//
+// The suite writes and deletes keys under BasePath only, besides trying to write DeniedKey if it is set.
+package consulconformance
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/serverplugin"
+)
+
+// DefaultBasePath is the base path of the keys written by the suite if Config.BasePath is empty.
+const DefaultBasePath = "rpcx_conformance"
+
+// Config is the consul cluster to verify.
+type Config struct {
+	// Addr is the address of the consul agent or server, e.g. 127.0.0.1:8500
+	Addr string
+	// Consul is the settings of the client, such as the ACL token and the TLS files
+	Consul *consulkv.Config
+	// BasePath is where the keys are written, the token must be allowed to write it
+	BasePath string
+	// DeniedKey is a key the token must not be allowed to write, to verify the ACLs are enforced
+	DeniedKey string
+	// RequireTLS fails the suite if the connections to consul are not encrypted
+	RequireTLS bool
+	// Timeout is how long the watches wait for changes, 30s by default
+	Timeout time.Duration
+}
+
+// Run runs all tests of the suite as subtests of t.
+func Run(t *testing.T, cfg Config) {
+	if cfg.BasePath == "" {
+		cfg.BasePath = DefaultBasePath
+	}
+	cfg.BasePath = strings.Trim(cfg.BasePath, "/")
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	s, err := consulkv.New([]string{cfg.Addr}, nil, cfg.Consul)
+	if err != nil {
+		t.Fatalf("cannot create consul client: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Client().Status().Leader(); err != nil {
+		t.Fatalf("cannot reach consul at %s: %v", cfg.Addr, err)
+	}
+
+	t.Run("TLS", func(t *testing.T) { testTLS(t, cfg, s) })
+	t.Run("KV", func(t *testing.T) { testKV(t, cfg, s) })
+	t.Run("TTL", func(t *testing.T) { testTTL(t, cfg, s) })
+	t.Run("ACL", func(t *testing.T) { testACL(t, cfg, s) })
+	t.Run("Watch", func(t *testing.T) { testWatch(t, cfg, s) })
+	t.Run("Register", func(t *testing.T) { testRegister(t, cfg, s) })
+}
+
+// key returns a key under the base path unique to the test.
+func key(t *testing.T, cfg Config, name string) string {
+	return fmt.Sprintf("%s/%s-%d/%s", cfg.BasePath, strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano(), name)
+}
+
+func testTLS(t *testing.T, cfg Config, s *consulkv.Store) {
+	encrypted := strings.HasPrefix(cfg.Addr, "https://") || (cfg.Consul != nil && (cfg.Consul.CertFile != "" || cfg.Consul.CAFile != ""))
+	if !encrypted {
+		if cfg.RequireTLS {
+			t.Fatal("TLS is required but neither CAFile nor CertFile is configured")
+		}
+		t.Skip("TLS is not configured")
+	}
+	// the connection is verified by Run, so the certificates are accepted by both sides
+	if _, err := s.Client().Agent().Self(); err != nil {
+		t.Fatalf("cannot read the agent over TLS: %v", err)
+	}
+}
+
+func testKV(t *testing.T, cfg Config, s *consulkv.Store) {
+	k := key(t, cfg, "tcp@127.0.0.1:8972")
+	if err := s.Put(k, []byte("group=a"), nil); err != nil {
+		t.Fatalf("cannot put %s: %v", k, err)
+	}
+	defer s.Delete(k)
+
+	p, err := s.Get(k)
+	if err != nil {
+		t.Fatalf("cannot get %s: %v", k, err)
+	}
+	if string(p.Value) != "group=a" {
+		t.Fatalf("expect value group=a but got %s", p.Value)
+	}
+
+	dir := k[:strings.LastIndex(k, "/")]
+	pairs, err := s.List(dir + "/")
+	if err != nil {
+		t.Fatalf("cannot list %s: %v", dir, err)
+	}
+	if len(pairs) != 1 || pairs[0].Key != k {
+		t.Fatalf("expect only %s listed but got %d keys", k, len(pairs))
+	}
+
+	if err := s.Delete(k); err != nil {
+		t.Fatalf("cannot delete %s: %v", k, err)
+	}
+	if _, err := s.Get(k); err != store.ErrKeyNotFound {
+		t.Fatalf("expect %s deleted but got %v", k, err)
+	}
+}
+
+func testTTL(t *testing.T, cfg Config, s *consulkv.Store) {
+	k := key(t, cfg, "tcp@127.0.0.1:8972")
+	if err := s.Put(k, []byte("group=a"), &store.WriteOptions{TTL: 20 * time.Second}); err != nil {
+		t.Fatalf("cannot put %s with TTL, the token needs session write: %v", k, err)
+	}
+	defer s.Delete(k)
+
+	se, err := s.NewSession(10 * time.Second)
+	if err != nil {
+		t.Fatalf("cannot create session: %v", err)
+	}
+	k2 := key(t, cfg, "tcp@127.0.0.1:8973")
+	if err := se.Put(k2, []byte("group=a")); err != nil {
+		se.Destroy()
+		t.Fatalf("cannot put %s with session: %v", k2, err)
+	}
+	se.Destroy()
+
+	// consul deletes the keys of a destroyed session asynchronously
+	deadline := time.Now().Add(cfg.Timeout)
+	for {
+		_, err := s.Get(k2)
+		if err == store.ErrKeyNotFound {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %s deleted with its session but got %v", k2, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func testACL(t *testing.T, cfg Config, s *consulkv.Store) {
+	if cfg.Consul == nil || (cfg.Consul.Token == "" && cfg.Consul.TokenFile == "") {
+		t.Skip("no ACL token is configured")
+	}
+
+	problems, err := s.VerifyTokenScope(cfg.BasePath)
+	if err != nil {
+		t.Fatalf("cannot verify the scope of the token: %v", err)
+	}
+	for _, problem := range problems {
+		t.Errorf("token is overly broad for %s: %s", cfg.BasePath, problem)
+	}
+
+	if cfg.DeniedKey != "" {
+		if err := s.Put(cfg.DeniedKey, []byte("conformance"), nil); err == nil {
+			_ = s.Delete(cfg.DeniedKey)
+			t.Errorf("expect writing %s denied by the ACLs", cfg.DeniedKey)
+		}
+	}
+}
+
+func testWatch(t *testing.T, cfg Config, s *consulkv.Store) {
+	k := key(t, cfg, "tcp@127.0.0.1:8972")
+	dir := k[:strings.LastIndex(k, "/")]
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch, err := s.WatchTree(dir, stopCh)
+	if err != nil {
+		t.Fatalf("cannot watch %s: %v", dir, err)
+	}
+
+	wait := func(what string, ok func(pairs []*store.KVPair) bool) {
+		timer := time.NewTimer(cfg.Timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case pairs, open := <-ch:
+				if !open {
+					t.Fatalf("watch of %s is closed before %s", dir, what)
+				}
+				if ok(pairs) {
+					return
+				}
+			case <-timer.C:
+				t.Fatalf("watch of %s didn't see %s in %v", dir, what, cfg.Timeout)
+			}
+		}
+	}
+
+	if err := s.Put(k, []byte("group=a"), nil); err != nil {
+		t.Fatalf("cannot put %s: %v", k, err)
+	}
+	defer s.Delete(k)
+	wait("the key added", func(pairs []*store.KVPair) bool { return len(pairs) == 1 && string(pairs[0].Value) == "group=a" })
+
+	if err := s.Put(k, []byte("group=b"), nil); err != nil {
+		t.Fatalf("cannot put %s: %v", k, err)
+	}
+	wait("the key updated", func(pairs []*store.KVPair) bool { return len(pairs) == 1 && string(pairs[0].Value) == "group=b" })
+
+	if err := s.Delete(k); err != nil {
+		t.Fatalf("cannot delete %s: %v", k, err)
+	}
+	wait("the key deleted", func(pairs []*store.KVPair) bool { return len(pairs) == 0 })
+}
+
+func testRegister(t *testing.T, cfg Config, s *consulkv.Store) {
+	basePath := key(t, cfg, "rpcx")
+	p := serverplugin.NewConsulRegisterPlugin(
+		serverplugin.WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		serverplugin.WithConsulServers([]string{cfg.Addr}),
+		serverplugin.WithConsulBasePath(basePath),
+		serverplugin.WithConsulConfig(cfg.Consul),
+		serverplugin.WithConsulUpdateInterval(10*time.Second),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatalf("cannot start the register plugin: %v", err)
+	}
+	defer s.DeleteTree(basePath)
+
+	if err := p.Register("Conformance", nil, "group=a"); err != nil {
+		t.Fatalf("cannot register: %v", err)
+	}
+	k := basePath + "/Conformance/tcp@127.0.0.1:8972"
+	if p, err := s.Get(k); err != nil || string(p.Value) != "group=a" {
+		t.Fatalf("expect %s registered but got %v", k, err)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatalf("cannot stop the register plugin: %v", err)
+	}
+	if _, err := s.Get(k); err != store.ErrKeyNotFound {
+		t.Fatalf("expect %s unregistered but got %v", k, err)
+	}
+}
@@ -0,0 +1,20 @@
+package consulconformance
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rpcxio/rpcx-consul/consulkv"
+)
+
+// TestRun runs the suite against the consul at $CONSUL_HTTP_ADDR, with the token in $CONSUL_HTTP_TOKEN.
+func TestRun(t *testing.T) {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		t.Skip("CONSUL_HTTP_ADDR is not set")
+	}
+	Run(t, Config{
+		Addr:   addr,
+		Consul: &consulkv.Config{Token: os.Getenv("CONSUL_HTTP_TOKEN")},
+	})
+}
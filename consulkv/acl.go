@@ -0,0 +1,289 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/schema"
+)
+
+// globalManagementPolicyID is the ID of the builtin policy granting everything.
+const globalManagementPolicyID = "00000000-0000-0000-0000-000000000001"
+
+// VerifyTokenScope introspects the policies of the ACL token and returns the problems
+// if the token can write anything beyond basePath and the schemas of its services, e.g. other KV paths or the ACLs.
+// The policies which the token is not allowed to read, or whose rules can't be parsed, are reported as problems too.
+func (s *Store) VerifyTokenScope(basePath string) ([]string, error) {
+	basePath = strings.Trim(basePath, "/")
+
+	token, _, err := s.client.ACL().TokenReadSelf(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the ACL token: %w", err)
+	}
+
+	var problems []string
+	for _, link := range token.Policies {
+		if link.ID == globalManagementPolicyID {
+			problems = append(problems, fmt.Sprintf("policy %s grants global management", link.Name))
+			continue
+		}
+
+		policy, _, err := s.client.ACL().PolicyRead(link.ID, nil)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot verify policy %s: %v", link.Name, err))
+			continue
+		}
+		for _, problem := range ruleProblems(policy.Rules, basePath) {
+			problems = append(problems, fmt.Sprintf("policy %s %s", link.Name, problem))
+		}
+	}
+	if len(token.Roles) > 0 {
+		problems = append(problems, fmt.Sprintf("cannot verify the %d roles of the token", len(token.Roles)))
+	}
+	return problems, nil
+}
+
+// ruleProblems returns the rules which grant to write beyond basePath, and the rules which can't be verified.
+func ruleProblems(rules, basePath string) []string {
+	parsed, err := parseRules(rules)
+	if err != nil {
+		return []string{fmt.Sprintf("has rules which can't be verified: %v", err)}
+	}
+
+	var problems []string
+	for _, r := range parsed {
+		switch r.kind {
+		case "key", "key_prefix":
+			if !r.block {
+				problems = append(problems, fmt.Sprintf("has a %s rule without a path which can't be verified", r.kind))
+				continue
+			}
+			for _, name := range r.attrNames() {
+				if name != "policy" {
+					problems = append(problems, fmt.Sprintf("has %s %q with %s which can't be verified", r.kind, r.label, name))
+				}
+			}
+			if r.attrs["policy"] == "write" && !withinPath(r.kind, r.label, basePath) {
+				problems = append(problems, fmt.Sprintf("grants to write %s %q beyond %s", r.kind, r.label, basePath))
+			}
+		case "acl", "operator":
+			if r.block {
+				problems = append(problems, fmt.Sprintf("has a %s block which can't be verified", r.kind))
+				continue
+			}
+			if r.value == "write" {
+				problems = append(problems, fmt.Sprintf("grants to write %s", r.kind))
+			}
+		}
+	}
+	return problems
+}
+
+// aclRule is a rule of an ACL policy, a block like key_prefix "rpcx/" { policy = "write" }
+// or an attribute like operator = "write".
+type aclRule struct {
+	kind  string
+	block bool
+	// label and attrs of a block
+	label string
+	attrs map[string]string
+	// value of an attribute
+	value string
+}
+
+func (r aclRule) attrNames() []string {
+	names := make([]string, 0, len(r.attrs))
+	for name := range r.attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseRules parses the rules of an ACL policy in HCL or JSON. Only the flat rules of the policies are supported,
+// the blocks with a label and string attributes and the string attributes, anything else is an error.
+func parseRules(rules string) ([]aclRule, error) {
+	if strings.HasPrefix(strings.TrimSpace(rules), "{") {
+		return parseJSONRules(rules)
+	}
+
+	tokens, err := scanRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	var parsed []aclRule
+	for len(tokens) > 0 {
+		if tokens[0].kind != tokenIdent {
+			return nil, fmt.Errorf("unexpected %s", tokens[0])
+		}
+		r := aclRule{kind: tokens[0].text}
+		switch {
+		case len(tokens) >= 3 && tokens[1].is("=") && tokens[2].kind == tokenString:
+			r.value = tokens[2].text
+			tokens = tokens[3:]
+		case len(tokens) >= 3 && tokens[1].kind == tokenString && tokens[2].is("{"):
+			r.block, r.label, r.attrs = true, tokens[1].text, make(map[string]string)
+			tokens = tokens[3:]
+			for len(tokens) > 0 && !tokens[0].is("}") {
+				if len(tokens) < 3 || tokens[0].kind != tokenIdent || !tokens[1].is("=") || tokens[2].kind != tokenString {
+					return nil, fmt.Errorf("unexpected %s in %s %q", tokens[0], r.kind, r.label)
+				}
+				r.attrs[tokens[0].text] = tokens[2].text
+				tokens = tokens[3:]
+			}
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("unterminated %s %q", r.kind, r.label)
+			}
+			tokens = tokens[1:]
+		default:
+			return nil, fmt.Errorf("unexpected rule %s", r.kind)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// parseJSONRules parses the rules in JSON like {"key_prefix": {"rpcx/": {"policy": "write"}}, "operator": "write"}.
+func parseJSONRules(rules string) ([]aclRule, error) {
+	var top map[string]interface{}
+	if err := json.Unmarshal([]byte(rules), &top); err != nil {
+		return nil, err
+	}
+
+	var parsed []aclRule
+	for _, kind := range sortedKeys(top) {
+		var blocks []interface{}
+		switch v := top[kind].(type) {
+		case string:
+			parsed = append(parsed, aclRule{kind: kind, value: v})
+			continue
+		case map[string]interface{}:
+			blocks = []interface{}{v}
+		case []interface{}:
+			blocks = v
+		default:
+			return nil, fmt.Errorf("unexpected rule %s", kind)
+		}
+
+		for _, b := range blocks {
+			labels, ok := b.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unexpected rule %s", kind)
+			}
+			for _, label := range sortedKeys(labels) {
+				attrs, ok := labels[label].(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("unexpected %s %q", kind, label)
+				}
+				r := aclRule{kind: kind, block: true, label: label, attrs: make(map[string]string, len(attrs))}
+				for name, value := range attrs {
+					s, ok := value.(string)
+					if !ok {
+						return nil, fmt.Errorf("unexpected %s in %s %q", name, kind, label)
+					}
+					r.attrs[name] = s
+				}
+				parsed = append(parsed, r)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const (
+	tokenIdent = iota
+	tokenString
+	tokenSymbol
+)
+
+type ruleToken struct {
+	kind int
+	text string
+}
+
+func (t ruleToken) is(symbol string) bool {
+	return t.kind == tokenSymbol && t.text == symbol
+}
+
+func (t ruleToken) String() string {
+	if t.kind == tokenString {
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+// scanRules splits the rules in HCL into identifiers, strings and the symbols = { }, skipping the comments.
+func scanRules(rules string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(rules); {
+		c := rules[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ',':
+			i++
+		case c == '#' || strings.HasPrefix(rules[i:], "//"):
+			if n := strings.IndexByte(rules[i:], '\n'); n >= 0 {
+				i += n + 1
+			} else {
+				i = len(rules)
+			}
+		case strings.HasPrefix(rules[i:], "/*"):
+			n := strings.Index(rules[i+2:], "*/")
+			if n < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += n + 4
+		case c == '=' || c == '{' || c == '}':
+			tokens = append(tokens, ruleToken{kind: tokenSymbol, text: string(c)})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(rules) && rules[j] != '"' {
+				if rules[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rules) {
+				return nil, errors.New("unterminated string")
+			}
+			s, err := strconv.Unquote(rules[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed string %s: %w", rules[i:j+1], err)
+			}
+			tokens = append(tokens, ruleToken{kind: tokenString, text: s})
+			i = j + 1
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(rules) && (rules[j] == '_' || rules[j] == '-' || rules[j] >= 'a' && rules[j] <= 'z' || rules[j] >= 'A' && rules[j] <= 'Z' || rules[j] >= '0' && rules[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{kind: tokenIdent, text: rules[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// withinPath reports whether the rule only matches the keys under basePath or the schemas of its services.
+// A key_prefix "rpcx" rule matches "rpcx2/..." too, so only "rpcx/..." is within "rpcx".
+func withinPath(kind, path, basePath string) bool {
+	if kind == "key" && path == basePath {
+		return true
+	}
+	return strings.HasPrefix(path, basePath+"/") || strings.HasPrefix(path, schema.Dir(basePath)+"/")
+}
@@ -0,0 +1,38 @@
+package consulkv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleProblems(t *testing.T) {
+	cases := []struct {
+		rules    string
+		problems []string
+	}{
+		{`key_prefix "rpcx/" { policy = "write" }`, nil},
+		{`key_prefix "_rpcx_admin/schema/rpcx/" { policy = "write" }`, nil},
+		{`key_prefix "_rpcx_admin/" { policy = "write" }`, []string{`grants to write key_prefix "_rpcx_admin/" beyond rpcx`}},
+		{`# the services
+key "rpcx" {
+  policy = "write"
+}
+key_prefix "" { policy = "read" } /* everything */
+service_prefix "" { policy = "write" }
+acl = "read"`, nil},
+		{`key_prefix "rpcx" { policy = "write" }
+operator = "write"`, []string{`grants to write key_prefix "rpcx" beyond rpcx`, "grants to write operator"}},
+		{`{"key_prefix": {"rpcx/": {"policy": "write"}, "other/": {"policy": "write"}}, "acl": "write"}`,
+			[]string{"grants to write acl", `grants to write key_prefix "other/" beyond rpcx`}},
+		{`key_prefix "rpcx/" { policy = "read" intentions = "write" }`, []string{`has key_prefix "rpcx/" with intentions which can't be verified`}},
+		{`key_prefix "rpcx/" { policy = "write" nested { policy = "write" } }`, []string{`has rules which can't be verified: unexpected nested in key_prefix "rpcx/"`}},
+		{`key_prefix "rpcx/" { policy = "write"`, []string{`has rules which can't be verified: unterminated key_prefix "rpcx/"`}},
+		{`{"key_prefix": {"rpcx/": {"policy": ["write"]}}}`, []string{`has rules which can't be verified: unexpected policy in key_prefix "rpcx/"`}},
+		{`key_prefix = "write"`, []string{"has a key_prefix rule without a path which can't be verified"}},
+	}
+	for _, c := range cases {
+		if problems := ruleProblems(c.rules, "rpcx"); !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("rules %s: expected problems %q but got %q", c.rules, c.problems, problems)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package consulkv
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/budget"
+)
+
+// blockingOptions returns the options of a blocking query which returns once the index changes after index.
+// The wait time is jittered, so that the queries of many clients which started together don't expire together.
+func (s *Store) blockingOptions(index uint64, stale bool) *api.QueryOptions {
+	wait := s.cfg.WatchWaitTime
+	if wait <= 0 {
+		wait = DefaultWatchWaitTime
+	}
+	if jitter := int64(wait / 16); jitter > 0 {
+		wait += time.Duration(rand.Int63n(jitter))
+	}
+
+	opts := s.queryOptions(stale)
+	opts.WaitIndex = index
+	opts.WaitTime = wait
+	return opts
+}
+
+// nextIndex returns the index of the next blocking query after a query waiting for index returns current,
+// and whether the result may have changed.
+// The index is never 0 which doesn't block, and it may go backwards, e.g. after a snapshot is restored.
+func nextIndex(index, current uint64) (uint64, bool) {
+	if current == index {
+		return index, false
+	}
+	if current == 0 {
+		return 1, true
+	}
+	return current, true
+}
+
+// stopContext returns a context which is canceled when stopCh or the store is closed,
+// so that the running blocking query returns immediately instead of after its wait time.
+// It returns a budget.ExceededError if the goroutine budget is used up.
+func (s *Store) stopContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := budget.Go("kv watch context", func() {
+		select {
+		case <-stopCh:
+		case <-s.stopCh:
+		case <-ctx.Done():
+		}
+		cancel()
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, cancel, nil
+}
@@ -0,0 +1,93 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestWatchTreeBlocking(t *testing.T) {
+	var mu sync.Mutex
+	var indexes []string
+	// the index goes backwards at the 4th query
+	lastIndex := []int{5, 5, 7, 3, 3}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := len(indexes)
+		indexes = append(indexes, r.URL.Query().Get("index"))
+		mu.Unlock()
+		if _, ok := r.URL.Query()["stale"]; !ok {
+			t.Errorf("expect a stale read")
+		}
+		if n >= len(lastIndex) {
+			time.Sleep(10 * time.Millisecond)
+			n = len(lastIndex) - 1
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(lastIndex[n]))
+		_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: "rpcx/app/tcp@127.0.0.1:8972"}})
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{AllowStale: true, WatchWaitTime: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch, err := s.WatchTree("rpcx/app/", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ { // index 5, 7 and 3
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("expect change %d", i)
+		}
+	}
+
+	want := []string{"", "5", "5", "7", "3"}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(indexes)
+		mu.Unlock()
+		if n >= len(want) || time.Now().After(deadline) {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(indexes) < len(want) {
+		t.Fatalf("expect %d queries but got %v", len(want), indexes)
+	}
+	for i, index := range want {
+		if indexes[i] != index {
+			t.Fatalf("expect the queries wait for %v but got %v", want, indexes)
+		}
+	}
+}
+
+func TestNextIndex(t *testing.T) {
+	for _, c := range []struct {
+		index, current, next uint64
+		changed              bool
+	}{
+		{0, 5, 5, true},
+		{5, 5, 5, false},
+		{5, 3, 3, true},
+		{5, 0, 1, true},
+	} {
+		if next, changed := nextIndex(c.index, c.current); next != c.next || changed != c.changed {
+			t.Errorf("nextIndex(%d, %d) = %d, %v", c.index, c.current, next, changed)
+		}
+	}
+}
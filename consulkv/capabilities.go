@@ -0,0 +1,110 @@
+package consulkv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Capabilities are the features of the consul agent which depend on its version and edition.
+type Capabilities struct {
+	// Version of the agent, e.g. 1.15.2 or 1.15.2+ent
+	Version    string
+	Enterprise bool
+
+	// Namespaces require Consul Enterprise 1.7+
+	Namespaces bool
+	// Partitions require Consul Enterprise 1.11+
+	Partitions bool
+	// Streaming of the blocking queries requires Consul 1.10+
+	Streaming bool
+
+	// TxnMaxReqLen is the maximum bytes of a transaction and KVMaxValueSize the maximum bytes of a value,
+	// zero if the ACL token is not allowed to read the agent configuration
+	TxnMaxReqLen   int
+	KVMaxValueSize int
+}
+
+// Capabilities queries the version and the features of the consul agent, the result is cached.
+func (s *Store) Capabilities() (*Capabilities, error) {
+	s.capsMu.Lock()
+	defer s.capsMu.Unlock()
+	if s.caps != nil {
+		return s.caps, nil
+	}
+
+	self, err := s.client.Agent().Self()
+	if err != nil {
+		return nil, fmt.Errorf("cannot query the consul agent: %w", err)
+	}
+	version, _ := self["Config"]["Version"].(string)
+	if version == "" {
+		return nil, fmt.Errorf("consul agent doesn't report its version")
+	}
+
+	caps := &Capabilities{
+		Version:    version,
+		Enterprise: strings.Contains(version, "+ent"),
+	}
+	caps.Namespaces = caps.Enterprise && versionAtLeast(version, 1, 7)
+	caps.Partitions = caps.Enterprise && versionAtLeast(version, 1, 11)
+	caps.Streaming = versionAtLeast(version, 1, 10)
+	if n, ok := self["DebugConfig"]["TxnMaxReqLen"].(float64); ok {
+		caps.TxnMaxReqLen = int(n)
+	}
+	if n, ok := self["DebugConfig"]["KVMaxValueSize"].(float64); ok {
+		caps.KVMaxValueSize = int(n)
+	}
+
+	s.caps = caps
+	return caps, nil
+}
+
+// cachedCapabilities returns the capabilities if they are queried, or nil.
+func (s *Store) cachedCapabilities() *Capabilities {
+	s.capsMu.Lock()
+	defer s.capsMu.Unlock()
+	return s.caps
+}
+
+// checkCapabilities returns an error if the agent doesn't support the settings of the config.
+func (s *Store) checkCapabilities() error {
+	caps, err := s.Capabilities()
+	if err != nil {
+		return err
+	}
+	if s.cfg.Namespace != "" && !caps.Namespaces {
+		return fmt.Errorf("namespaces require Consul Enterprise 1.7+, the agent runs %s", caps.Version)
+	}
+	if s.cfg.Partition != "" && !caps.Partitions {
+		return fmt.Errorf("admin partitions require Consul Enterprise 1.11+, the agent runs %s", caps.Version)
+	}
+	return nil
+}
+
+// checkValueSize returns an error if the value of key is larger than the agent accepts.
+func (s *Store) checkValueSize(key string, value []byte) error {
+	caps := s.cachedCapabilities()
+	if caps == nil || caps.KVMaxValueSize <= 0 || len(value) <= caps.KVMaxValueSize {
+		return nil
+	}
+	return fmt.Errorf("value of %s is %d bytes, consul accepts at most %d bytes", key, len(value), caps.KVMaxValueSize)
+}
+
+// versionAtLeast reports whether version, e.g. 1.15.2+ent, is at least major.minor.
+func versionAtLeast(version string, major, minor int) bool {
+	version = strings.TrimPrefix(version, "v")
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	mnr, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return maj > major || maj == major && mnr >= minor
+}
@@ -0,0 +1,113 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+)
+
+func newAgentServer(version string, debug map[string]interface{}, txns *[]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			_ = json.NewEncoder(w).Encode(map[string]map[string]interface{}{
+				"Config":      {"Version": version},
+				"DebugConfig": debug,
+			})
+		case "/v1/txn":
+			var ops api.TxnOps
+			_ = json.NewDecoder(r.Body).Decode(&ops)
+			*txns = append(*txns, len(ops))
+			_ = json.NewEncoder(w).Encode(api.TxnResponse{})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestCheckVersion(t *testing.T) {
+	srv := newAgentServer("1.15.2", nil, nil)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := New([]string{addr}, nil, &Config{Namespace: "team-a", CheckVersion: true})
+	if err == nil || !strings.Contains(err.Error(), "namespaces require Consul Enterprise 1.7+") {
+		t.Fatalf("expect the namespaces error but got %v", err)
+	}
+
+	s, err := New([]string{addr}, nil, &Config{CheckVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	caps, err := s.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Enterprise || caps.Namespaces || !caps.Streaming {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+
+	ent := newAgentServer("1.10.3+ent", nil, nil)
+	defer ent.Close()
+	addr = strings.TrimPrefix(ent.URL, "http://")
+	if _, err := New([]string{addr}, nil, &Config{Namespace: "team-a", CheckVersion: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New([]string{addr}, nil, &Config{Partition: "eu", CheckVersion: true})
+	if err == nil || !strings.Contains(err.Error(), "admin partitions require Consul Enterprise 1.11+") {
+		t.Fatalf("expect the partitions error but got %v", err)
+	}
+}
+
+func TestTxnSizeLimit(t *testing.T) {
+	var txns []int
+	srv := newAgentServer("1.15.2", map[string]interface{}{"TxnMaxReqLen": 1024, "KVMaxValueSize": 512}, &txns)
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{CheckVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pairs := []*store.KVPair{
+		{Key: "rpcx/Arith/a", Value: make([]byte, 300)},
+		{Key: "rpcx/Arith/b", Value: make([]byte, 300)},
+		{Key: "rpcx/Arith/c", Value: make([]byte, 300)},
+	}
+	if err := s.PutAll(pairs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 3 {
+		t.Fatalf("expect 3 transactions but got %v", txns)
+	}
+
+	if err := s.Put("rpcx/Arith/d", make([]byte, 600), nil); err == nil {
+		t.Fatal("expect the value too large")
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version string
+		want    bool
+	}{
+		{"1.7.0", true},
+		{"1.6.10", false},
+		{"1.11.0-rc1+ent", true},
+		{"v2.0.0", true},
+		{"0.9.3", false},
+		{"dev", false},
+	}
+	for _, c := range cases {
+		if got := versionAtLeast(c.version, 1, 7); got != c.want {
+			t.Errorf("versionAtLeast(%s) = %v, want %v", c.version, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package consulkv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// ConnectTLS provides the leaf certificate of a service and the CA roots of consul Connect,
+// so that rpcx servers and clients can talk with mTLS inside the service mesh.
+// The certificate and the roots are fetched again when the certificate is past half of its validity.
+type ConnectTLS struct {
+	consul  *api.Client
+	service string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	refreshAt time.Time
+}
+
+// NewConnectTLS fetches the leaf certificate of the service, which is the service ID for the agent API.
+func NewConnectTLS(consul *api.Client, service string) (*ConnectTLS, error) {
+	c := &ConnectTLS{consul: consul, service: service}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ClientConfig returns the tls.Config of clients dialing Connect services.
+// The servers are verified against the CA roots instead of their host names, as Connect identifies services by URIs.
+func (c *ConnectTLS) ClientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		InsecureSkipVerify:    true, // verified by VerifyPeerCertificate
+		VerifyPeerCertificate: c.verify,
+	}
+}
+
+// ServerConfig returns the tls.Config of Connect native servers, which require the client certificates issued by Connect.
+func (c *ConnectTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: c.verify,
+	}
+}
+
+// certificate returns the leaf certificate, it is fetched again if it is past half of its validity.
+func (c *ConnectTLS) certificate() (*tls.Certificate, error) {
+	c.mu.Lock()
+	stale := time.Now().After(c.refreshAt)
+	cert := c.cert
+	c.mu.Unlock()
+	if !stale {
+		return cert, nil
+	}
+
+	if err := c.refresh(); err != nil {
+		if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+			return cert, nil // keep using the valid certificate
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// verify verifies the certificate chain of the peer against the CA roots.
+func (c *ConnectTLS) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented by the peer")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid certificate of the peer: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	c.mu.Lock()
+	roots := c.roots
+	c.mu.Unlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// refresh fetches the leaf certificate and the CA roots.
+func (c *ConnectTLS) refresh() error {
+	rootList, _, err := c.consul.Agent().ConnectCARoots(nil)
+	if err != nil {
+		return fmt.Errorf("cannot get connect CA roots: %w", err)
+	}
+	roots := x509.NewCertPool()
+	for _, root := range rootList.Roots {
+		roots.AppendCertsFromPEM([]byte(root.RootCertPEM))
+	}
+
+	leaf, _, err := c.consul.Agent().ConnectCALeaf(c.service, nil)
+	if err != nil {
+		return fmt.Errorf("cannot get connect leaf certificate of %s: %w", c.service, err)
+	}
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return fmt.Errorf("invalid connect leaf certificate of %s: %w", c.service, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("invalid connect leaf certificate of %s: %w", c.service, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.roots = roots
+	c.refreshAt = leaf.ValidAfter.Add(leaf.ValidBefore.Sub(leaf.ValidAfter) / 2)
+	c.mu.Unlock()
+	return nil
+}
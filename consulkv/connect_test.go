@@ -0,0 +1,111 @@
+package consulkv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// issue returns a certificate signed by parent, or a self-signed CA if parent is nil, in PEM.
+func issue(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestConnectTLS(t *testing.T) {
+	ca, caKey, caPEM, _ := issue(t, "connect ca", nil, nil)
+	_, _, otherCAPEM, _ := issue(t, "other ca", nil, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/agent/connect/ca/roots":
+			_ = json.NewEncoder(w).Encode(api.CARootList{Roots: []*api.CARoot{{RootCertPEM: caPEM, Active: true}}})
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/connect/ca/leaf/"):
+			service := strings.TrimPrefix(r.URL.Path, "/v1/agent/connect/ca/leaf/")
+			cert, _, certPEM, keyPEM := issue(t, service, ca, caKey)
+			_ = json.NewEncoder(w).Encode(api.LeafCert{CertPEM: certPEM, PrivateKeyPEM: keyPEM, Service: service,
+				ValidAfter: cert.NotBefore, ValidBefore: cert.NotAfter})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	server, err := NewConnectTLS(s.Client(), "Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewConnectTLS(s.Client(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(server.ServerConfig(), client.ClientConfig()); err != nil {
+		t.Fatalf("expect the handshake within the mesh but got %v", err)
+	}
+
+	// a certificate which is not issued by connect is rejected
+	client.roots = x509.NewCertPool()
+	client.roots.AppendCertsFromPEM([]byte(otherCAPEM))
+	if err := handshake(server.ServerConfig(), client.ClientConfig()); err == nil {
+		t.Fatal("expect the server is not trusted")
+	}
+}
+
+func handshake(serverConfig, clientConfig *tls.Config) error {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tls.Server(c1, serverConfig).Handshake()
+		c1.Close()
+	}()
+	err := tls.Client(c2, clientConfig).Handshake()
+	c2.Close()
+	if serverErr := <-errCh; err == nil {
+		err = serverErr
+	}
+	return err
+}
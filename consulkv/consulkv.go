@@ -0,0 +1,628 @@
+// Package consulkv implements the libkv store on top of the consul api client,
+// so that the consul settings which store.Config can't express are supported.
+package consulkv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/log"
+)
+
+const (
+	// DefaultWatchWaitTime is how long we block for at a time to check if the watched key has changed.
+	DefaultWatchWaitTime = 15 * time.Second
+
+	// renewSessionRetryMax is the number of times to try to renew the session before giving up.
+	renewSessionRetryMax = 5
+
+	// defaultLockTTL is the default ttl for the consul lock.
+	defaultLockTTL = 20 * time.Second
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is returned when there are multiple endpoints specified for consul.
+	ErrMultipleEndpointsUnsupported = errors.New("consul does not support multiple endpoints")
+
+	// ErrSessionRenew is returned when the session can't be renewed.
+	ErrSessionRenew = errors.New("cannot set or renew session for ttl, unable to operate on sessions")
+)
+
+// Config contains the consul client settings which can't be expressed by store.Config.
+type Config struct {
+	// Datacenter to query and register in, the datacenter of the agent is used if it is empty
+	Datacenter string
+	// Namespace and Partition of Consul Enterprise for all reads, writes and watches,
+	// the defaults of the ACL token are used if they are empty
+	Namespace string
+	Partition string
+
+	// ACL token
+	Token string
+	// TokenFile is a file containing the ACL token, for example delivered by vault agent or
+	// kubernetes projected tokens. It takes precedence over Token and is reloaded when it changes.
+	TokenFile string
+
+	// client certificate and key files for mTLS, they are reloaded when they are rotated
+	CertFile string
+	KeyFile  string
+	// CA certificate file to verify consul servers, the system roots are used if it is empty
+	CAFile string
+
+	// User-Agent and extra headers sent with every request, for example for auth proxies in front of consul
+	UserAgent string
+	Headers   http.Header
+
+	// DialContext dials the connections to consul, so that they can be tunneled,
+	// for example through a SSH bastion. net.Dialer is used if it is nil.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// how often TokenFile, CertFile and KeyFile are checked for changes, 10s by default
+	ReloadInterval time.Duration
+
+	// AllowStale serves List, Watch and WatchTree by any consul server instead of the leader,
+	// which scales reads at the cost of slightly stale results.
+	AllowStale bool
+
+	// WatchWaitTime is how long the blocking queries of Watch and WatchTree wait for changes,
+	// DefaultWatchWaitTime by default. Longer waits cut the load of idle watches on consul servers.
+	WatchWaitTime time.Duration
+
+	// ResolveInterval is how often the endpoint is re-resolved if it is a DNS name, for example of a load balancer.
+	// The connections to the IPs it no longer resolves to are closed. Zero disables re-resolution.
+	ResolveInterval time.Duration
+
+	// CheckVersion queries the version and the features of the agent in New, which fails if the agent doesn't
+	// support the settings, e.g. Namespace. The transactions of PutAll are split by the size limit of the agent.
+	CheckVersion bool
+}
+
+// Store is a store.Store backed by the consul api client.
+type Store struct {
+	config *api.Config
+	client *api.Client
+	cfg    Config
+
+	tokenMu sync.Mutex
+	token   string
+
+	certMu      sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	transport   *http.Transport
+
+	conns *trackedConns
+
+	// 1 if stale reads are allowed, accessed atomically
+	allowStale int32
+
+	capsMu sync.Mutex
+	caps   *Capabilities
+
+	// the session holding the keys put by PutAll with a TTL
+	batchMu      sync.Mutex
+	batchSession string
+	batchTTL     time.Duration
+
+	closeOnce sync.Once
+	stopCh    chan struct{}
+}
+
+// New creates a consul store for the endpoint. options and cfg are optional.
+func New(endpoints []string, options *store.Config, cfg *Config) (*Store, error) {
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("consul endpoint is not specified")
+	}
+
+	s := &Store{stopCh: make(chan struct{})}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	s.SetAllowStale(s.cfg.AllowStale)
+
+	config := api.DefaultConfig()
+	config.HttpClient = &http.Client{}
+	config.Address = endpoints[0]
+	config.Scheme = "http"
+	config.Datacenter = s.cfg.Datacenter
+	config.Namespace = s.cfg.Namespace
+	config.Partition = s.cfg.Partition
+	s.config = config
+
+	var tlsConfig *tls.Config
+	if options != nil {
+		tlsConfig = options.TLS
+		if options.ConnectionTimeout != 0 {
+			config.WaitTime = options.ConnectionTimeout
+		}
+	}
+	if tlsConfig != nil || s.cfg.CertFile != "" || s.cfg.CAFile != "" {
+		if err := s.setTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	if s.cfg.DialContext != nil {
+		s.setDialer()
+	}
+	host, isName := endpointHost(config.Address)
+	resolve := s.cfg.ResolveInterval > 0 && isName
+	if resolve {
+		s.setResolver()
+	}
+
+	if s.cfg.TokenFile != "" {
+		if _, err := s.reloadToken(); err != nil {
+			return nil, err
+		}
+	} else {
+		s.setToken(s.cfg.Token)
+	}
+	base := config.HttpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	config.HttpClient.Transport = &headerTransport{base: base, s: s}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+
+	if s.cfg.CheckVersion {
+		if err := s.checkCapabilities(); err != nil {
+			return nil, err
+		}
+	}
+	if s.cfg.TokenFile != "" || s.cfg.CertFile != "" {
+		if err := budget.Go("consul file watch", s.watchFiles); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if resolve {
+		if err := budget.Go("consul endpoint watch", func() { s.watchEndpoint(host, lookupHost) }); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Client returns the underlying consul api client.
+func (s *Store) Client() *api.Client {
+	return s.client
+}
+
+// normalize the key for usage in consul.
+func (s *Store) normalize(key string) string {
+	key = store.Normalize(key)
+	return strings.TrimPrefix(key, "/")
+}
+
+func (s *Store) renewSession(pair *api.KVPair, ttl time.Duration) error {
+	// check if there is any previous session with an active TTL
+	session, err := s.getActiveSession(pair.Key)
+	if err != nil {
+		return err
+	}
+
+	if session == "" {
+		entry := &api.SessionEntry{
+			Behavior:  api.SessionBehaviorDelete, // delete the key when the session expires
+			TTL:       (ttl / 2).String(),        // consul multiplies the TTL by 2x
+			LockDelay: 1 * time.Millisecond,      // virtually disable lock delay
+		}
+
+		session, _, err = s.client.Session().Create(entry, nil)
+		if err != nil {
+			return err
+		}
+
+		// lock and ignore if lock is held, it's just a placeholder for the ephemeral behavior
+		lock, _ := s.client.LockOpts(&api.LockOptions{Key: pair.Key, Session: session})
+		if lock != nil {
+			_, _ = lock.Lock(nil)
+		}
+	}
+
+	_, _, err = s.client.Session().Renew(session, nil)
+	return err
+}
+
+// getActiveSession checks if the key already has a session attached.
+func (s *Store) getActiveSession(key string) (string, error) {
+	pair, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return "", err
+	}
+	if pair != nil && pair.Session != "" {
+		return pair.Session, nil
+	}
+	return "", nil
+}
+
+// SetAllowStale sets whether List, Watch and WatchTree can be served by any consul server.
+func (s *Store) SetAllowStale(allow bool) {
+	var v int32
+	if allow {
+		v = 1
+	}
+	atomic.StoreInt32(&s.allowStale, v)
+}
+
+// queryOptions returns the options of the reads which can be stale, they are stale regardless of SetAllowStale
+// if stale is set.
+func (s *Store) queryOptions(stale bool) *api.QueryOptions {
+	return &api.QueryOptions{AllowStale: stale || atomic.LoadInt32(&s.allowStale) == 1}
+}
+
+// Get the value at key.
+func (s *Store) Get(key string) (*store.KVPair, error) {
+	options := &api.QueryOptions{RequireConsistent: true}
+
+	pair, meta, err := s.client.KV().Get(s.normalize(key), options)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, store.ErrKeyNotFound
+	}
+
+	return &store.KVPair{Key: pair.Key, Value: pair.Value, LastIndex: meta.LastIndex}, nil
+}
+
+// Put a value at key.
+func (s *Store) Put(key string, value []byte, opts *store.WriteOptions) error {
+	if err := s.checkValueSize(key, value); err != nil {
+		return err
+	}
+	p := &api.KVPair{
+		Key:   s.normalize(key),
+		Value: value,
+		Flags: api.LockFlagValue,
+	}
+
+	if opts != nil && opts.TTL > 0 {
+		// create or renew a session holding a TTL, which can fail transiently
+		for retry := 1; retry <= renewSessionRetryMax; retry++ {
+			err := s.renewSession(p, opts.TTL)
+			if err == nil {
+				break
+			}
+			if retry == renewSessionRetryMax {
+				return ErrSessionRenew
+			}
+		}
+	}
+
+	_, err := s.client.KV().Put(p, nil)
+	return err
+}
+
+// Delete the value at key.
+func (s *Store) Delete(key string) error {
+	if _, err := s.Get(key); err != nil {
+		return err
+	}
+	_, err := s.client.KV().Delete(s.normalize(key), nil)
+	return err
+}
+
+// Exists checks that the key exists.
+func (s *Store) Exists(key string) (bool, error) {
+	_, err := s.Get(key)
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// List the children of the directory.
+// A directory with a trailing slash only matches the keys under it, otherwise it is a key prefix as in consul.
+func (s *Store) List(directory string) ([]*store.KVPair, error) {
+	return s.list(directory, false)
+}
+
+func (s *Store) list(directory string, stale bool) ([]*store.KVPair, error) {
+	dir := s.normalize(directory)
+	pairs, _, err := s.client.KV().List(dir, s.queryOptions(stale))
+	if err != nil {
+		return nil, err
+	}
+	kv := convertPairs(dir, pairs)
+	if len(kv) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+
+	return kv, nil
+}
+
+// Keys lists the keys under the directory without their values, which is much smaller than List
+// for huge directories. The directory itself is skipped like List does.
+func (s *Store) Keys(directory string) ([]string, error) {
+	return s.keys(directory, false)
+}
+
+func (s *Store) keys(directory string, stale bool) ([]string, error) {
+	dir := s.normalize(directory)
+	keys, _, err := s.client.KV().Keys(dir, "", s.queryOptions(stale))
+	if err != nil {
+		return nil, err
+	}
+	children := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key == dir || key+"/" == dir {
+			continue
+		}
+		children = append(children, key)
+	}
+	if len(children) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return children, nil
+}
+
+// convertPairs converts the pairs listed in dir, skipping dir itself.
+func convertPairs(dir string, pairs api.KVPairs) []*store.KVPair {
+	kv := make([]*store.KVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Key == dir || pair.Key+"/" == dir {
+			continue
+		}
+		kv = append(kv, &store.KVPair{
+			Key:       pair.Key,
+			Value:     pair.Value,
+			LastIndex: pair.ModifyIndex,
+		})
+	}
+	return kv
+}
+
+// DeleteTree deletes the keys under the directory.
+func (s *Store) DeleteTree(directory string) error {
+	if _, err := s.List(directory); err != nil {
+		return err
+	}
+	_, err := s.client.KV().DeleteTree(s.normalize(directory), nil)
+	return err
+}
+
+// Watch for changes on key.
+// The current value is sent first, the chan is closed on errors or when stopCh is closed.
+func (s *Store) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return s.watch(key, stopCh, false)
+}
+
+func (s *Store) watch(key string, stopCh <-chan struct{}, stale bool) (<-chan *store.KVPair, error) {
+	watchCh := make(chan *store.KVPair)
+
+	err := budget.Go("kv watch", func() {
+		defer close(watchCh)
+		ctx, cancel, err := s.stopContext(stopCh)
+		if err != nil {
+			log.Warnf("cannot watch %s: %v", key, err)
+			return
+		}
+		defer cancel()
+
+		var index uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			pair, meta, err := s.client.KV().Get(s.normalize(key), s.blockingOptions(index, stale).WithContext(ctx))
+			if err != nil {
+				return
+			}
+			var changed bool
+			// the index didn't change, so Get returned because of the WaitTime
+			if index, changed = nextIndex(index, meta.LastIndex); !changed {
+				continue
+			}
+
+			if pair != nil {
+				select {
+				case watchCh <- &store.KVPair{Key: pair.Key, Value: pair.Value, LastIndex: pair.ModifyIndex}:
+				case <-stopCh:
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on the children of the directory with blocking queries,
+// so the tree is only listed again when its index changes instead of polling it.
+// The current children are sent first, the chan is closed on errors or when stopCh is closed.
+func (s *Store) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchTree(directory, stopCh, false)
+}
+
+func (s *Store) watchTree(directory string, stopCh <-chan struct{}, stale bool) (<-chan []*store.KVPair, error) {
+	watchCh := make(chan []*store.KVPair)
+
+	err := budget.Go("kv tree watch", func() {
+		defer close(watchCh)
+		ctx, cancel, err := s.stopContext(stopCh)
+		if err != nil {
+			log.Warnf("cannot watch %s: %v", directory, err)
+			return
+		}
+		defer cancel()
+
+		dir := s.normalize(directory)
+		var index uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			pairs, meta, err := s.client.KV().List(dir, s.blockingOptions(index, stale).WithContext(ctx))
+			if err != nil {
+				return
+			}
+			var changed bool
+			// the index didn't change, so List returned because of the WaitTime
+			if index, changed = nextIndex(index, meta.LastIndex); !changed {
+				continue
+			}
+
+			select {
+			case watchCh <- convertPairs(dir, pairs):
+			case <-stopCh:
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watchCh, nil
+}
+
+// NewLock returns a lock for the key.
+func (s *Store) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	lockOpts := &api.LockOptions{Key: s.normalize(key)}
+
+	ttl := defaultLockTTL
+	var renewCh chan struct{}
+	if options != nil {
+		if options.TTL != 0 {
+			ttl = options.TTL
+		}
+		if options.Value != nil {
+			lockOpts.Value = options.Value
+		}
+		renewCh = options.RenewLock
+	}
+
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorRelease, // release the lock when the session expires
+		TTL:       (ttl / 2).String(),         // consul multiplies the TTL by 2x
+		LockDelay: 1 * time.Millisecond,       // virtually disable lock delay
+	}
+	session, _, err := s.client.Session().Create(entry, nil)
+	if err != nil {
+		return nil, err
+	}
+	lockOpts.Session = session
+
+	l, err := s.client.LockOpts(lockOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if renewCh != nil {
+		err := budget.Go("lock session renew", func() {
+			_ = s.client.Session().RenewPeriodic(entry.TTL, session, nil, renewCh)
+		})
+		if err != nil {
+			_, _ = s.client.Session().Destroy(session, nil)
+			return nil, err
+		}
+	}
+
+	return &lock{lock: l, renewCh: renewCh}, nil
+}
+
+type lock struct {
+	lock    *api.Lock
+	renewCh chan struct{}
+}
+
+// Lock attempts to acquire the lock and blocks while doing so.
+func (l *lock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	return l.lock.Lock(stopChan)
+}
+
+// Unlock the lock.
+func (l *lock) Unlock() error {
+	if l.renewCh != nil {
+		close(l.renewCh)
+	}
+	return l.lock.Unlock()
+}
+
+// AtomicPut puts a value at key if the key has not been modified since previous.
+// With a TTL, the key is attached to a session which deletes it when it expires, as Put does.
+func (s *Store) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if options != nil && options.TTL > 0 {
+		return s.atomicPutTTL(key, value, previous, options.TTL)
+	}
+
+	p := &api.KVPair{Key: s.normalize(key), Value: value, Flags: api.LockFlagValue}
+	if previous != nil {
+		p.ModifyIndex = previous.LastIndex
+	}
+
+	ok, _, err := s.client.KV().CAS(p, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		if previous == nil {
+			return false, nil, store.ErrKeyExists
+		}
+		return false, nil, store.ErrKeyModified
+	}
+
+	pair, err := s.Get(key)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, pair, nil
+}
+
+// AtomicDelete deletes the value at key if the key has not been modified since previous.
+func (s *Store) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	if _, err := s.Get(key); err == store.ErrKeyNotFound {
+		return false, err
+	}
+
+	p := &api.KVPair{Key: s.normalize(key), ModifyIndex: previous.LastIndex, Flags: api.LockFlagValue}
+	ok, _, err := s.client.KV().DeleteCAS(p, nil)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, store.ErrKeyModified
+	}
+	return true, nil
+}
+
+// Close stops the background goroutines of the store.
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
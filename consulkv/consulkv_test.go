@@ -0,0 +1,143 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestListBoundary(t *testing.T) {
+	keys := []string{"rpcx/app", "rpcx/app/tcp@127.0.0.1:8972", "rpcx/app2/tcp@127.0.0.1:8973"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		var pairs api.KVPairs
+		var matched []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				pairs = append(pairs, &api.KVPair{Key: k})
+				matched = append(matched, k)
+			}
+		}
+		if _, ok := r.URL.Query()["keys"]; ok {
+			_ = json.NewEncoder(w).Encode(matched)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(pairs)
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ps, err := s.List("rpcx/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Key != "rpcx/app/tcp@127.0.0.1:8972" {
+		t.Fatalf("unexpected pairs: %v", ps)
+	}
+
+	// without the trailing slash the directory is a key prefix as in consul
+	if ps, _ := s.List("rpcx/app"); len(ps) != 2 {
+		t.Fatalf("expect 2 pairs but got %d", len(ps))
+	}
+
+	if keys, err := s.Keys("rpcx/app/"); err != nil || len(keys) != 1 || keys[0] != "rpcx/app/tcp@127.0.0.1:8972" {
+		t.Fatalf("unexpected keys: %v, %v", keys, err)
+	}
+}
+
+func TestAllowStale(t *testing.T) {
+	var stale bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, stale = r.URL.Query()["stale"]
+		_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: "rpcx/app/tcp@127.0.0.1:8972"}})
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{AllowStale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.List("rpcx/app/"); err != nil || !stale {
+		t.Fatalf("expect a stale read but got %v, %v", stale, err)
+	}
+	s.SetAllowStale(false)
+	if _, err := s.List("rpcx/app/"); err != nil || stale {
+		t.Fatalf("expect no stale read but got %v, %v", stale, err)
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	var dc, ns, partition string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc, ns, partition = r.URL.Query().Get("dc"), r.URL.Query().Get("ns"), r.URL.Query().Get("partition")
+		_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: "rpcx/app/tcp@127.0.0.1:8972"}})
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{Datacenter: "dc2", Namespace: "team-a", Partition: "tenant-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.List("rpcx/app/"); err != nil || dc != "dc2" || ns != "team-a" || partition != "tenant-1" {
+		t.Fatalf("expect to query dc2/team-a/tenant-1 but got %q/%q/%q, %v", dc, ns, partition, err)
+	}
+}
+
+func TestVerifyTokenScope(t *testing.T) {
+	rules := map[string]string{
+		"p1": `key_prefix "rpcx/" { policy = "write" }`,
+		"p2": `key_prefix "" { policy = "read" }
+key_prefix "rpcx" { policy = "write" }
+acl = "write"`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/acl/token/self":
+			_ = json.NewEncoder(w).Encode(api.ACLToken{Policies: []*api.ACLTokenPolicyLink{
+				{ID: "p1", Name: "rpcx"}, {ID: "p2", Name: "broad"}, {ID: "p3", Name: "hidden"},
+			}})
+		case strings.HasPrefix(r.URL.Path, "/v1/acl/policy/"):
+			id := strings.TrimPrefix(r.URL.Path, "/v1/acl/policy/")
+			if _, ok := rules[id]; !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(api.ACLPolicy{ID: id, Rules: rules[id]})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	problems, err := s.VerifyTokenScope("/rpcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems but got %q", problems)
+	}
+	for i, want := range []string{`policy broad grants to write key_prefix "rpcx"`, "policy broad grants to write acl", "cannot verify policy hidden"} {
+		if !strings.HasPrefix(problems[i], want) {
+			t.Errorf("expected problem %q but got %q", want, problems[i])
+		}
+	}
+}
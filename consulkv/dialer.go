@@ -0,0 +1,13 @@
+package consulkv
+
+import "net/http"
+
+// setDialer dials the connections of the transport with DialContext.
+func (s *Store) setDialer() {
+	transport, ok := s.config.HttpClient.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.DialContext = s.cfg.DialContext
+	s.config.HttpClient.Transport = transport
+}
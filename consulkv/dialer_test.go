@@ -0,0 +1,35 @@
+package consulkv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var dialed string
+	s, err := New([]string{"consul.internal:8500"}, nil, &Config{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			var d net.Dialer
+			return d.DialContext(ctx, network, strings.TrimPrefix(srv.URL, "http://"))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if ok, err := s.Exists("rpcx/key"); err != nil || ok {
+		t.Fatalf("expect not exist but got %v, %v", ok, err)
+	}
+	if dialed != "consul.internal:8500" {
+		t.Fatalf("unexpected dialed address: %s", dialed)
+	}
+}
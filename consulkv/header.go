@@ -0,0 +1,35 @@
+package consulkv
+
+import "net/http"
+
+// headerTransport sets the ACL token, User-Agent and extra headers on every request.
+type headerTransport struct {
+	base http.RoundTripper
+	s    *Store
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.s.tokenMu.Lock()
+	token := t.s.token
+	t.s.tokenMu.Unlock()
+
+	cfg := &t.s.cfg
+	if token == "" && cfg.UserAgent == "" && len(cfg.Headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for k, vs := range cfg.Headers {
+		req.Header.Del(k)
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,33 @@
+package consulkv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{
+		Token:     "token",
+		UserAgent: "rpcx-test",
+		Headers:   http.Header{"X-Proxy-Auth": []string{"secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, _ = s.Exists("rpcx/key")
+
+	if header.Get("User-Agent") != "rpcx-test" || header.Get("X-Proxy-Auth") != "secret" || header.Get("X-Consul-Token") != "token" {
+		t.Fatalf("unexpected headers: %v", header)
+	}
+}
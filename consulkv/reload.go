@@ -0,0 +1,45 @@
+package consulkv
+
+import (
+	"time"
+
+	"github.com/smallnest/rpcx/log"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// watchFiles reloads the token and the client certificate when their files change.
+func (s *Store) watchFiles() {
+	interval := s.cfg.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if s.cfg.TokenFile != "" {
+			changed, err := s.reloadToken()
+			if err != nil {
+				log.Warnf("cannot reload consul token, keep the current one: %v", err)
+			} else if changed {
+				log.Infof("consul token is reloaded from %s", s.cfg.TokenFile)
+			}
+		}
+
+		if s.cfg.CertFile != "" {
+			changed, err := s.reloadCert()
+			if err != nil {
+				log.Warnf("cannot reload consul client certificate, keep the current one: %v", err)
+			} else if changed {
+				log.Infof("consul client certificate is reloaded from %s", s.cfg.CertFile)
+			}
+		}
+	}
+}
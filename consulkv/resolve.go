@@ -0,0 +1,136 @@
+package consulkv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallnest/rpcx/log"
+)
+
+// lookupHost resolves the endpoint, replaced in tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// trackedConns are the connections to consul by their remote IPs.
+type trackedConns struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]string
+}
+
+type trackedConn struct {
+	net.Conn
+	t    *trackedConns
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, c)
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// closeExcept closes the connections to the IPs which are not in ips.
+func (t *trackedConns) closeExcept(ips map[string]bool) int {
+	t.mu.Lock()
+	var stale []*trackedConn
+	for c, ip := range t.conns {
+		if !ips[ip] {
+			stale = append(stale, c)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range stale {
+		c.Close()
+	}
+	return len(stale)
+}
+
+// endpointHost returns the host of the endpoint if it is a DNS name.
+func endpointHost(address string) (string, bool) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		if address[:i] == "unix" {
+			return "", false
+		}
+		address = address[i+3:]
+	}
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	return host, host != "" && net.ParseIP(host) == nil
+}
+
+// setResolver tracks the connections of the transport by their remote IPs,
+// so that the connections to the IPs the endpoint no longer resolves to can be closed.
+func (s *Store) setResolver() {
+	transport, ok := s.config.HttpClient.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	s.conns = &trackedConns{conns: make(map[*trackedConn]string)}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var ip string
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP.String()
+		}
+		c := &trackedConn{Conn: conn, t: s.conns}
+		s.conns.mu.Lock()
+		s.conns.conns[c] = ip
+		s.conns.mu.Unlock()
+		return c, nil
+	}
+	s.transport = transport
+	s.config.HttpClient.Transport = transport
+}
+
+// watchEndpoint re-resolves the endpoint every ResolveInterval and reconnects if its IPs change.
+func (s *Store) watchEndpoint(host string, lookup func(ctx context.Context, host string) ([]string, error)) {
+	ticker := time.NewTicker(s.cfg.ResolveInterval)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ResolveInterval)
+		addrs, err := lookup(ctx, host)
+		cancel()
+		if err != nil {
+			log.Warnf("cannot resolve consul endpoint %s, keep the current connections: %v", host, err)
+		} else {
+			sort.Strings(addrs)
+			current := strings.Join(addrs, ",")
+			if last != "" && current != last {
+				ips := make(map[string]bool, len(addrs))
+				for _, addr := range addrs {
+					ips[addr] = true
+				}
+				n := s.conns.closeExcept(ips)
+				s.transport.CloseIdleConnections()
+				log.Infof("consul endpoint %s is resolved to %s instead of %s, closed %d stale connections", host, current, last, n)
+			}
+			last = current
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package consulkv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var mu sync.Mutex
+	ips := []string{"127.0.0.1"}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips, nil
+	}
+	defer func() { lookupHost = net.DefaultResolver.LookupHost }()
+
+	s, err := New([]string{"consul.internal:8500"}, nil, &Config{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, strings.TrimPrefix(srv.URL, "http://"))
+		},
+		ResolveInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Exists("rpcx/key"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connCount(); n != 1 {
+		t.Fatalf("expect 1 connection but got %d", n)
+	}
+
+	time.Sleep(50 * time.Millisecond) // let the first resolution finish
+	mu.Lock()
+	ips = []string{"10.0.0.1"}
+	mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for s.connCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for addr, want := range map[string]bool{"consul.internal:8500": true, "10.0.0.1:8500": false, "https://consul:8501": true, "unix:///tmp/consul.sock": false} {
+		if _, ok := endpointHost(addr); ok != want {
+			t.Errorf("endpointHost(%s) = %v, want %v", addr, ok, want)
+		}
+	}
+}
+
+func (s *Store) connCount() int {
+	s.conns.mu.Lock()
+	defer s.conns.mu.Unlock()
+	return len(s.conns.conns)
+}
@@ -0,0 +1,86 @@
+package consulkv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/smallnest/rpcx/log"
+)
+
+// Session is a consul session with the delete behavior: the keys put with it are deleted by consul
+// when the session is destroyed or expires, e.g. because the process died.
+// It is renewed in the background until it is destroyed or lost.
+type Session struct {
+	s  *Store
+	ID string
+
+	stopCh    chan struct{}
+	lost      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession creates a session with the TTL, consul requires it to be between 10s and 24h.
+// Consul may keep an expired session for up to twice the TTL before it deletes the keys.
+func (s *Store) NewSession(ttl time.Duration) (*Session, error) {
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorDelete,
+		TTL:       ttl.String(),
+		LockDelay: 1 * time.Millisecond, // virtually disable lock delay, so a restarted process can put the keys at once
+	}
+	id, _, err := s.client.Session().Create(entry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	se := &Session{s: s, ID: id, stopCh: make(chan struct{}), lost: make(chan struct{})}
+	err = budget.Go("session renew", func() {
+		defer close(se.lost)
+		// it returns after the session is destroyed or can't be renewed
+		err := s.client.Session().RenewPeriodic(entry.TTL, id, nil, se.stopCh)
+		if err != nil {
+			log.Warnf("consul session %s is lost: %v", id, err)
+		}
+	})
+	if err != nil {
+		_, _ = s.client.Session().Destroy(id, nil)
+		return nil, err
+	}
+	return se, nil
+}
+
+// Put puts a value at key which is deleted with the session.
+func (se *Session) Put(key string, value []byte) error {
+	p := &api.KVPair{Key: se.s.normalize(key), Value: value, Session: se.ID}
+	ok, _, err := se.s.client.KV().Acquire(p, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("cannot put %s with session %s, it is held by another session or the session is invalid", p.Key, se.ID)
+	}
+	return nil
+}
+
+// PutAll puts the pairs which are deleted with the session in transactions of at most chunk operations,
+// 64 if chunk is not positive or larger, so that the keys of a transaction are written atomically.
+func (se *Session) PutAll(pairs []*store.KVPair, chunk int) error {
+	return se.s.putTxns(pairs, se.ID, nil, chunk)
+}
+
+// Lost returns a chan which is closed after the session is destroyed or lost,
+// then the keys put with it are deleted and a new session is required.
+func (se *Session) Lost() <-chan struct{} {
+	return se.lost
+}
+
+// Destroy destroys the session, consul deletes the keys put with it.
+func (se *Session) Destroy() {
+	se.closeOnce.Do(func() {
+		close(se.stopCh)
+	})
+	<-se.lost
+}
@@ -0,0 +1,154 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+)
+
+// sessionServer is a fake consul which expires the session on the first renewal if expire is set.
+type sessionServer struct {
+	mu        sync.Mutex
+	acquired  map[string]string
+	destroyed bool
+	expire    bool
+	txns      []int
+}
+
+func (f *sessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		w.Write([]byte(`{"ID":"s1"}`))
+	case r.URL.Path == "/v1/session/renew/s1":
+		if f.expire {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[{"ID":"s1","TTL":"1s"}]`))
+	case r.URL.Path == "/v1/session/destroy/s1":
+		f.destroyed = true
+		w.Write([]byte(`true`))
+	case r.URL.Path == "/v1/txn":
+		var ops api.TxnOps
+		_ = json.NewDecoder(r.Body).Decode(&ops)
+		for _, op := range ops {
+			f.acquired[op.KV.Key] = op.KV.Session
+		}
+		f.txns = append(f.txns, len(ops))
+		w.Write([]byte(`{}`))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		if holder, ok := f.acquired[key]; ok && holder != r.URL.Query().Get("acquire") {
+			w.Write([]byte(`false`))
+			return
+		}
+		f.acquired[key] = r.URL.Query().Get("acquire")
+		w.Write([]byte(`true`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSession(t *testing.T) {
+	fake := &sessionServer{acquired: map[string]string{"rpcx/Echo/tcp@127.0.0.1:8972": "s0"}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	se, err := s.NewSession(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := se.Put("rpcx/Arith/tcp@127.0.0.1:8972", []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.Put("rpcx/Echo/tcp@127.0.0.1:8972", []byte("")); err == nil {
+		t.Fatal("expect an error of the key held by another session")
+	}
+
+	fake.mu.Lock()
+	holder := fake.acquired["rpcx/Arith/tcp@127.0.0.1:8972"]
+	fake.mu.Unlock()
+	if holder != "s1" {
+		t.Fatalf("expect the key acquired by s1 but got %q", holder)
+	}
+
+	se.Destroy()
+	fake.mu.Lock()
+	destroyed := fake.destroyed
+	fake.mu.Unlock()
+	if !destroyed {
+		t.Fatal("expect the session destroyed")
+	}
+}
+
+func TestSessionLost(t *testing.T) {
+	srv := httptest.NewServer(&sessionServer{acquired: map[string]string{}, expire: true})
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	se, err := s.NewSession(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-se.Lost():
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect the session lost after it can't be renewed")
+	}
+}
+
+func TestSessionPutAll(t *testing.T) {
+	fake := &sessionServer{acquired: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	se, err := s.NewSession(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Destroy()
+
+	var pairs []*store.KVPair
+	for i := 0; i < 25; i++ {
+		pairs = append(pairs, &store.KVPair{Key: fmt.Sprintf("rpcx/S%d/tcp@127.0.0.1:8972", i)})
+	}
+	if err := se.PutAll(pairs, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.txns) != 3 || fake.txns[0] != 10 || fake.txns[2] != 5 {
+		t.Fatalf("unexpected transactions: %v", fake.txns)
+	}
+	if fake.acquired["rpcx/S24/tcp@127.0.0.1:8972"] != "s1" {
+		t.Fatal("keys are not locked by the session")
+	}
+}
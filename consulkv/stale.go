@@ -0,0 +1,36 @@
+package consulkv
+
+import "github.com/rpcxio/libkv/store"
+
+// StaleStore is a view of a Store whose List, Keys, Watch and WatchTree can be served by any consul server
+// regardless of SetAllowStale, so that one user of a shared store reads stale without changing the reads of the others.
+// The other methods, including Close, are the ones of the store.
+type StaleStore struct {
+	*Store
+}
+
+// StaleReads returns a view of the store whose reads can be stale.
+func (s *Store) StaleReads() *StaleStore {
+	return &StaleStore{s}
+}
+
+// List the children of the directory, it can be served by any consul server.
+func (s *StaleStore) List(directory string) ([]*store.KVPair, error) {
+	return s.list(directory, true)
+}
+
+// Keys lists the keys under the directory, it can be served by any consul server.
+func (s *StaleStore) Keys(directory string) ([]string, error) {
+	return s.keys(directory, true)
+}
+
+// Watch for changes on key with blocking queries which can be served by any consul server.
+func (s *StaleStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return s.watch(key, stopCh, true)
+}
+
+// WatchTree watches for changes on the children of the directory with blocking queries
+// which can be served by any consul server.
+func (s *StaleStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchTree(directory, stopCh, true)
+}
@@ -0,0 +1,45 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+func TestStaleReads(t *testing.T) {
+	var mu sync.Mutex
+	var stale []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.URL.Query()["stale"]
+		mu.Lock()
+		stale = append(stale, ok)
+		mu.Unlock()
+		w.Header().Set("X-Consul-Index", "1")
+		_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: "rpcx/app/tcp@127.0.0.1:8972"}})
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.StaleReads().List("rpcx/app/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List("rpcx/app/"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stale) != 2 || !stale[0] || stale[1] {
+		t.Fatalf("expect only the read of the view to be stale but got %v", stale)
+	}
+}
@@ -0,0 +1,97 @@
+package consulkv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// setTLS uses https and a transport with the TLS config base, which may be nil, the CA certificate of CAFile
+// and the client certificate loaded from CertFile and KeyFile if they are set.
+func (s *Store) setTLS(base *tls.Config) error {
+	var tlsConfig *tls.Config
+	if base != nil {
+		tlsConfig = base.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	if s.cfg.CertFile != "" {
+		if _, err := s.reloadCert(); err != nil {
+			return err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			s.certMu.Lock()
+			defer s.certMu.Unlock()
+			return s.cert, nil
+		}
+	}
+
+	if s.cfg.CAFile != "" {
+		data, err := os.ReadFile(s.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("cannot read CA file %s: %w", s.cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in CA file %s", s.cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	s.transport = transport
+	s.config.HttpClient.Transport = transport
+	s.config.Scheme = "https"
+	return nil
+}
+
+// reloadCert loads the client certificate if the files are modified and reports whether it is reloaded.
+func (s *Store) reloadCert() (bool, error) {
+	modTime, err := latestModTime(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	s.certMu.Lock()
+	unchanged := s.cert != nil && modTime.Equal(s.certModTime)
+	s.certMu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load client certificate %s: %w", s.cfg.CertFile, err)
+	}
+
+	s.certMu.Lock()
+	reloaded := s.cert != nil
+	s.cert = &cert
+	s.certModTime = modTime
+	s.certMu.Unlock()
+
+	// connections presenting the old certificate are not reused
+	if reloaded && s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+	return reloaded, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,101 @@
+package consulkv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientCertRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeCert(t, certFile, keyFile, "client1", time.Now().Add(-time.Minute))
+
+	s, err := New([]string{"127.0.0.1:8500"}, nil, &Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.config.Scheme != "https" {
+		t.Fatalf("expect https but got %s", s.config.Scheme)
+	}
+	old := s.cert
+
+	if reloaded, err := s.reloadCert(); err != nil || reloaded {
+		t.Fatalf("expect no reload but got %v, %v", reloaded, err)
+	}
+
+	writeCert(t, certFile, keyFile, "client2", time.Now())
+	if reloaded, err := s.reloadCert(); err != nil || !reloaded {
+		t.Fatalf("expect reload but got %v, %v", reloaded, err)
+	}
+	if s.cert == old {
+		t.Fatal("certificate is not rotated")
+	}
+}
+
+func TestCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// no client certificate
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "https://")}, nil, &Config{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if leader, err := s.Client().Status().Leader(); err != nil || leader != "127.0.0.1:8300" {
+		t.Fatalf("cannot query consul over https: %v", err)
+	}
+}
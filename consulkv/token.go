@@ -0,0 +1,58 @@
+package consulkv
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// String describes the config with the token and the values of the headers redacted, so that it can be logged.
+func (c Config) String() string {
+	token := c.Token
+	if token != "" {
+		token = meta.Redacted
+	}
+	headers := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		headers = append(headers, name+":"+meta.Redacted)
+	}
+	sort.Strings(headers)
+
+	return fmt.Sprintf("{Datacenter:%s Namespace:%s Partition:%s Token:%s TokenFile:%s CertFile:%s KeyFile:%s CAFile:%s UserAgent:%s Headers:[%s] AllowStale:%v}",
+		c.Datacenter, c.Namespace, c.Partition, token, c.TokenFile, c.CertFile, c.KeyFile, c.CAFile, c.UserAgent, strings.Join(headers, " "), c.AllowStale)
+}
+
+// setToken sets the ACL token used by all following requests.
+func (s *Store) setToken(token string) {
+	s.tokenMu.Lock()
+	s.token = token
+	s.tokenMu.Unlock()
+}
+
+// reloadToken reads the token file and reports whether the token is changed.
+func (s *Store) reloadToken() (bool, error) {
+	data, err := os.ReadFile(s.cfg.TokenFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot read token file %s: %w", s.cfg.TokenFile, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return false, fmt.Errorf("token file %s is empty", s.cfg.TokenFile)
+	}
+
+	s.tokenMu.Lock()
+	changed := token != s.token
+	s.tokenMu.Unlock()
+	if changed {
+		s.setToken(token)
+	}
+	return changed, nil
+}
+
+// SetToken replaces the ACL token used by all following requests.
+func (s *Store) SetToken(token string) {
+	s.setToken(token)
+}
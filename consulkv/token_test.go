@@ -0,0 +1,73 @@
+package consulkv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestTokenFileReload(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, &Config{
+		TokenFile:      tokenFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Get("rpcx/key"); err != store.ErrKeyNotFound {
+		t.Fatalf("expect ErrKeyNotFound but got %v", err)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("token2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := s.Get("rpcx/key"); err != store.ErrKeyNotFound {
+		t.Fatalf("expect ErrKeyNotFound but got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != 2 || tokens[0] != "token1" || tokens[1] != "token2" {
+		t.Fatalf("unexpected tokens: %v", tokens)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	cfg := &Config{Datacenter: "dc1", Token: "s3cr3t", Headers: http.Header{"Authorization": {"Bearer s3cr3t"}}}
+	s := fmt.Sprintf("%v %+v", cfg, *cfg)
+	if strings.Contains(s, "s3cr3t") {
+		t.Fatalf("expect the token redacted: %s", s)
+	}
+	if !strings.Contains(s, "Datacenter:dc1") || !strings.Contains(s, "Authorization:REDACTED") {
+		t.Fatalf("unexpected config: %s", s)
+	}
+}
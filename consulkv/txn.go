@@ -0,0 +1,229 @@
+package consulkv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+)
+
+// maxTxnOps is the maximum number of operations consul accepts in one transaction.
+const maxTxnOps = 64
+
+// txnOpOverhead approximates the bytes of the JSON of an operation besides its key and value.
+const txnOpOverhead = 128
+
+// PutAll puts the pairs in transactions of at most 64 operations.
+// With a TTL, the keys held by a live session, e.g. put with a TTL by Put, are kept attached to it and it is renewed,
+// the other keys are attached to one session of the store which deletes them when it expires.
+// The session of the store is created once and renewed by the next calls with the same TTL.
+// If the capabilities of the agent are queried, the transactions are also split by its size limit.
+func (s *Store) PutAll(pairs []*store.KVPair, opts *store.WriteOptions) error {
+	if opts == nil || opts.TTL <= 0 {
+		return s.putTxns(pairs, "", nil, maxTxnOps)
+	}
+
+	holders, err := s.holders(pairs)
+	if err != nil {
+		return err
+	}
+	session, err := s.renewBatchSession(opts.TTL)
+	if err != nil {
+		return err
+	}
+	alive := map[string]bool{session: true}
+	for key, holder := range holders {
+		ok, seen := alive[holder]
+		if !seen {
+			entry, _, err := s.client.Session().Renew(holder, nil)
+			if err != nil {
+				return err
+			}
+			ok = entry != nil
+			alive[holder] = ok
+		}
+		// the key is deleted with its expired session, so it is attached to the session of the store
+		if !ok {
+			delete(holders, key)
+		}
+	}
+	return s.putTxns(pairs, session, holders, maxTxnOps)
+}
+
+// renewBatchSession renews the session of the keys put by PutAll with the TTL,
+// a new session is created if it expired or it has another TTL.
+func (s *Store) renewBatchSession(ttl time.Duration) (string, error) {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+
+	if s.batchSession != "" && s.batchTTL == ttl {
+		entry, _, err := s.client.Session().Renew(s.batchSession, nil)
+		if err != nil {
+			return "", err
+		}
+		if entry != nil {
+			return s.batchSession, nil
+		}
+	}
+
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorDelete, // delete the keys when the session expires
+		TTL:       (ttl / 2).String(),        // consul multiplies the TTL by 2x
+		LockDelay: 1 * time.Millisecond,      // virtually disable lock delay
+	}
+	session, _, err := s.client.Session().Create(entry, nil)
+	if err != nil {
+		return "", err
+	}
+	s.batchSession, s.batchTTL = session, ttl
+	return session, nil
+}
+
+// holders returns the sessions holding the keys of the pairs by their normalized keys, read in transactions.
+func (s *Store) holders(pairs []*store.KVPair) (map[string]string, error) {
+	holders := make(map[string]string)
+	for start := 0; start < len(pairs); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+
+		// get fails the transaction if the key doesn't exist, get-tree doesn't
+		ops := make(api.TxnOps, 0, end-start)
+		keys := make(map[string]bool, end-start)
+		for _, p := range pairs[start:end] {
+			k := s.normalize(p.Key)
+			keys[k] = true
+			ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVGetTree, Key: k}})
+		}
+		ok, resp, _, err := s.client.Txn().Txn(ops, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, txnError(resp)
+		}
+		for _, r := range resp.Results {
+			if r.KV != nil && keys[r.KV.Key] && r.KV.Session != "" {
+				holders[r.KV.Key] = r.KV.Session
+			}
+		}
+	}
+	return holders, nil
+}
+
+// putTxns puts the pairs in transactions of at most chunk operations, locked by session if it is not empty.
+// The keys held by other sessions in holders are set without changing their sessions.
+func (s *Store) putTxns(pairs []*store.KVPair, session string, holders map[string]string, chunk int) error {
+	if chunk <= 0 || chunk > maxTxnOps {
+		chunk = maxTxnOps
+	}
+	for _, p := range pairs {
+		if err := s.checkValueSize(p.Key, p.Value); err != nil {
+			return err
+		}
+	}
+	var maxLen int
+	if caps := s.cachedCapabilities(); caps != nil {
+		maxLen = caps.TxnMaxReqLen
+	}
+
+	for start := 0; start < len(pairs); {
+		end, size := start, 0
+		for end < len(pairs) && end-start < chunk {
+			n := len(pairs[end].Key) + base64.StdEncoding.EncodedLen(len(pairs[end].Value)) + txnOpOverhead
+			if maxLen > 0 && end > start && size+n > maxLen {
+				break
+			}
+			size += n
+			end++
+		}
+
+		ops := make(api.TxnOps, 0, end-start)
+		for _, p := range pairs[start:end] {
+			op := &api.KVTxnOp{Verb: api.KVSet, Key: s.normalize(p.Key), Value: p.Value, Flags: api.LockFlagValue}
+			// the keys held by other sessions are set, which keeps their sessions
+			if holder := holders[op.Key]; session != "" && (holder == "" || holder == session) {
+				op.Verb = api.KVLock
+				op.Session = session
+			}
+			ops = append(ops, &api.TxnOp{KV: op})
+		}
+
+		ok, resp, _, err := s.client.Txn().Txn(ops, nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return txnError(resp)
+		}
+		start = end
+	}
+	return nil
+}
+
+func txnError(resp *api.TxnResponse) error {
+	if resp == nil || len(resp.Errors) == 0 {
+		return fmt.Errorf("consul transaction is rolled back")
+	}
+
+	msgs := make([]string, 0, len(resp.Errors))
+	for _, e := range resp.Errors {
+		msgs = append(msgs, fmt.Sprintf("op %d: %s", e.OpIndex, e.What))
+	}
+	return fmt.Errorf("consul transaction is rolled back: %s", strings.Join(msgs, "; "))
+}
+
+// atomicPutTTL puts the value if the key is not modified since previous, or doesn't exist if previous is nil,
+// and attaches the key to a session holding the TTL, in one transaction.
+func (s *Store) atomicPutTTL(key string, value []byte, previous *store.KVPair, ttl time.Duration) (bool, *store.KVPair, error) {
+	k := s.normalize(key)
+	session, err := s.getActiveSession(k)
+	if err != nil {
+		return false, nil, err
+	}
+	if session == "" {
+		entry := &api.SessionEntry{
+			Behavior:  api.SessionBehaviorDelete, // delete the key when the session expires
+			TTL:       (ttl / 2).String(),        // consul multiplies the TTL by 2x
+			LockDelay: 1 * time.Millisecond,      // virtually disable lock delay
+		}
+		if session, _, err = s.client.Session().Create(entry, nil); err != nil {
+			return false, nil, err
+		}
+	}
+
+	check := &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: k}
+	if previous != nil {
+		check = &api.KVTxnOp{Verb: api.KVCheckIndex, Key: k, Index: previous.LastIndex}
+	}
+	ops := api.TxnOps{
+		{KV: check},
+		{KV: &api.KVTxnOp{Verb: api.KVLock, Key: k, Value: value, Flags: api.LockFlagValue, Session: session}},
+	}
+	ok, resp, _, err := s.client.Txn().Txn(ops, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		if resp != nil && len(resp.Errors) > 0 && resp.Errors[0].OpIndex == 0 {
+			if previous == nil {
+				return false, nil, store.ErrKeyExists
+			}
+			return false, nil, store.ErrKeyModified
+		}
+		return false, nil, txnError(resp)
+	}
+
+	if _, _, err := s.client.Session().Renew(session, nil); err != nil {
+		return false, nil, err
+	}
+	pair, err := s.Get(key)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, pair, nil
+}
@@ -0,0 +1,167 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+)
+
+func TestPutAll(t *testing.T) {
+	var txns []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/txn" {
+			http.NotFound(w, r)
+			return
+		}
+		var ops api.TxnOps
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		txns = append(txns, len(ops))
+		_ = json.NewEncoder(w).Encode(api.TxnResponse{})
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var pairs []*store.KVPair
+	for i := 0; i < 70; i++ {
+		pairs = append(pairs, &store.KVPair{Key: fmt.Sprintf("rpcx/Arith/tcp@127.0.0.1:%d", 8000+i)})
+	}
+	if err := s.PutAll(pairs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 || txns[0] != 64 || txns[1] != 6 {
+		t.Fatalf("unexpected transactions: %v", txns)
+	}
+}
+
+func TestAtomicPutTTL(t *testing.T) {
+	var (
+		index    uint64 = 7
+		value    []byte
+		renewals int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/kv/rpcx/Arith/a":
+			if value == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+			_ = json.NewEncoder(w).Encode(api.KVPairs{{Key: "rpcx/Arith/a", Value: value, ModifyIndex: index, Session: "s1"}})
+		case r.URL.Path == "/v1/session/create":
+			_ = json.NewEncoder(w).Encode(api.SessionEntry{ID: "s1"})
+		case r.URL.Path == "/v1/session/renew/s1":
+			renewals++
+			_ = json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: "s1"}})
+		case r.URL.Path == "/v1/txn":
+			var ops api.TxnOps
+			_ = json.NewDecoder(r.Body).Decode(&ops)
+			check := ops[0].KV
+			if check.Verb == api.KVCheckIndex && check.Index != index || check.Verb == api.KVCheckNotExists && value != nil {
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(api.TxnResponse{Errors: api.TxnErrors{{OpIndex: 0, What: "failed"}}})
+				return
+			}
+			value, index = ops[1].KV.Value, index+1
+			_ = json.NewEncoder(w).Encode(api.TxnResponse{})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	opts := &store.WriteOptions{TTL: 10 * time.Second}
+	ok, pair, err := s.AtomicPut("rpcx/Arith/a", []byte("v1"), nil, opts)
+	if err != nil || !ok || string(pair.Value) != "v1" {
+		t.Fatalf("cannot put: %v", err)
+	}
+	if _, _, err := s.AtomicPut("rpcx/Arith/a", []byte("v2"), &store.KVPair{LastIndex: 1}, opts); err != store.ErrKeyModified {
+		t.Fatalf("expect ErrKeyModified but got %v", err)
+	}
+	if _, _, err := s.AtomicPut("rpcx/Arith/a", []byte("v2"), pair, opts); err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "v2" || renewals != 2 {
+		t.Fatalf("unexpected value %s and renewals %d", value, renewals)
+	}
+}
+
+func TestPutAllTTL(t *testing.T) {
+	var (
+		creates int
+		sets    = make(map[string]string) // key -> verb and session
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/session/create":
+			creates++
+			_ = json.NewEncoder(w).Encode(api.SessionEntry{ID: "batch"})
+		case "/v1/session/renew/batch", "/v1/session/renew/s0":
+			_ = json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")}})
+		case "/v1/txn":
+			var ops api.TxnOps
+			_ = json.NewDecoder(r.Body).Decode(&ops)
+			var resp api.TxnResponse
+			for _, op := range ops {
+				switch op.KV.Verb {
+				case api.KVGetTree:
+					holder := map[string]string{"rpcx/A/a": "s0", "rpcx/A/b": "gone"}[op.KV.Key]
+					if holder != "" {
+						resp.Results = append(resp.Results, &api.TxnResult{KV: &api.KVPair{Key: op.KV.Key, Session: holder}})
+					}
+				default:
+					sets[op.KV.Key] = strings.TrimSpace(string(op.KV.Verb) + " " + op.KV.Session)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pairs := []*store.KVPair{{Key: "rpcx/A/a"}, {Key: "rpcx/A/b"}, {Key: "rpcx/A/c"}}
+	opts := &store.WriteOptions{TTL: 20 * time.Second}
+	for i := 0; i < 2; i++ {
+		if err := s.PutAll(pairs, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if creates != 1 {
+		t.Fatalf("expect the session to be reused but created %d", creates)
+	}
+	want := map[string]string{"rpcx/A/a": "set", "rpcx/A/b": "lock batch", "rpcx/A/c": "lock batch"}
+	for k, v := range want {
+		if sets[k] != v {
+			t.Fatalf("unexpected ops %v", sets)
+		}
+	}
+}
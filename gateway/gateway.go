@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	consul "github.com/rpcxio/rpcx-consul/client"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/log"
+)
+
+// Headers of the HTTP gateway of rpcx servers.
+const (
+	XServicePath   = "X-RPCX-ServicePath"
+	XServiceMethod = "X-RPCX-ServiceMethod"
+	XSerializeType = "X-RPCX-SerializeType"
+)
+
+// serializeJSON is the rpcx serialize type of JSON, used if the request doesn't set one.
+const serializeJSON = "1"
+
+// Forwarder forwards a request to a server of the route, method is the rpcx method parsed from the path.
+type Forwarder interface {
+	Forward(w http.ResponseWriter, r *http.Request, route Route, server Server, method string)
+}
+
+// ForwarderFunc is an adapter to use a function as a Forwarder.
+type ForwarderFunc func(w http.ResponseWriter, r *http.Request, route Route, server Server, method string)
+
+// Forward calls f.
+func (f ForwarderFunc) Forward(w http.ResponseWriter, r *http.Request, route Route, server Server, method string) {
+	f(w, r, route, server, method)
+}
+
+// Gateway is an http.Handler which routes the requests like POST /arith/Mul by the routing table
+// to the HTTP gateway of the rpcx servers. Call Update with the servers every time they change.
+type Gateway struct {
+	// Forwarder forwards the requests, the HTTP gateway of the rpcx servers if nil
+	Forwarder Forwarder
+	// Metrics records the requests, metrics.DefaultRegistry if nil:
+	//
+	//	rpcx_consul.gateway.routes                 gauge of the routes
+	//	rpcx_consul.gateway.no_route               counter of the requests without a route
+	//	rpcx_consul.gateway.<service>.servers      gauge of the healthy servers
+	//	rpcx_consul.gateway.<service>.requests     timer of the forwarded requests
+	//	rpcx_consul.gateway.<service>.no_server    counter of the requests without a healthy server
+	Metrics metrics.Registry
+
+	table atomic.Value // *Table
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// Option configures a Gateway.
+type Option func(*Gateway)
+
+// WithForwarder forwards the requests by f instead of the HTTP gateway of the rpcx servers.
+func WithForwarder(f Forwarder) Option {
+	return func(g *Gateway) {
+		g.Forwarder = f
+	}
+}
+
+// WithMetrics records the requests in r.
+func WithMetrics(r metrics.Registry) Option {
+	return func(g *Gateway) {
+		g.Metrics = r
+	}
+}
+
+// New returns a Gateway without routes.
+func New(opts ...Option) *Gateway {
+	g := &Gateway{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.Metrics == nil {
+		g.Metrics = metrics.DefaultRegistry
+	}
+	if g.Forwarder == nil {
+		g.Forwarder = ForwarderFunc(forwardRPCX)
+	}
+	g.table.Store(&Table{})
+	return g
+}
+
+// Update replaces the routing table with the table built from the servers, see BuildTable.
+func (g *Gateway) Update(servers map[string]string) {
+	t := BuildTable(servers)
+	g.table.Store(t)
+
+	metrics.GetOrRegisterGauge("rpcx_consul.gateway.routes", g.Metrics).Update(int64(len(t.routes)))
+	for _, r := range t.routes {
+		metrics.GetOrRegisterGauge("rpcx_consul.gateway."+r.Service+".servers", g.Metrics).Update(int64(len(r.Servers)))
+	}
+}
+
+// Watch follows the servers of d, a discovery of the base path of all services like the ones returned by
+// consul.NewConsulDiscoveryTemplate, until stopCh is closed or d is closed, and updates the routing table every time
+// they change. The discovery retries its watch after failures and honors its options like the address validator,
+// tombstones and draining. Only the latest servers are kept while the routing table falls behind.
+func (g *Gateway) Watch(d *consul.ConsulDiscovery, stopCh <-chan struct{}) {
+	ch := d.WatchServiceWith(consul.WithName("gateway"), consul.WithPolicy(consul.CoalesceLatest))
+	defer d.RemoveWatcher(ch)
+
+	g.Update(serversOf(d.GetServices()))
+	for {
+		select {
+		case <-stopCh:
+			return
+		case pairs, ok := <-ch:
+			if !ok {
+				return
+			}
+			g.Update(serversOf(pairs))
+		}
+	}
+}
+
+// serversOf returns the metadata of the servers keyed like Arith/tcp@10.0.0.1:8972.
+func serversOf(pairs []*client.KVPair) map[string]string {
+	servers := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		servers[p.Key] = p.Value
+	}
+	return servers
+}
+
+// Table returns the current routing table.
+func (g *Gateway) Table() *Table {
+	return g.table.Load().(*Table)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	route, ok := g.Table().Match(host, r.URL.Path)
+	if !ok {
+		metrics.GetOrRegisterCounter("rpcx_consul.gateway.no_route", g.Metrics).Inc(1)
+		http.Error(w, "no route", http.StatusNotFound)
+		return
+	}
+
+	// the method is the first segment after the path prefix
+	method := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, route.Ingress.PathPrefix), "/")
+	if i := strings.Index(method, "/"); i >= 0 {
+		method = method[:i]
+	}
+	if method == "" {
+		http.Error(w, "no method of service "+route.Service, http.StatusNotFound)
+		return
+	}
+
+	server, ok := g.pick(route.Servers)
+	if !ok {
+		metrics.GetOrRegisterCounter("rpcx_consul.gateway."+route.Service+".no_server", g.Metrics).Inc(1)
+		http.Error(w, "no healthy server of service "+route.Service, http.StatusServiceUnavailable)
+		return
+	}
+
+	start := time.Now()
+	g.Forwarder.Forward(w, r, route, server, method)
+	metrics.GetOrRegisterTimer("rpcx_consul.gateway."+route.Service+".requests", g.Metrics).UpdateSince(start)
+}
+
+// pick picks a server randomly by the weights.
+func (g *Gateway) pick(servers []Server) (Server, bool) {
+	total := 0
+	for _, s := range servers {
+		total += s.Weight
+	}
+	if total <= 0 {
+		return Server{}, false
+	}
+
+	g.randMu.Lock()
+	n := g.rand.Intn(total)
+	g.randMu.Unlock()
+	for _, s := range servers {
+		if n -= s.Weight; n < 0 {
+			return s, true
+		}
+	}
+	return servers[len(servers)-1], true
+}
+
+// forwardRPCX forwards the request to the HTTP gateway of the rpcx server, which listens on the same port.
+func forwardRPCX(w http.ResponseWriter, r *http.Request, route Route, server Server, method string) {
+	_, host, port, err := meta.SplitKey(server.Key)
+	if err != nil {
+		http.Error(w, "malformed server "+server.Key, http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = net.JoinHostPort(host, port)
+			req.URL.Path = "/"
+			req.Header.Set(XServicePath, route.Service)
+			req.Header.Set(XServiceMethod, method)
+			if req.Header.Get(XSerializeType) == "" {
+				req.Header.Set(XSerializeType, serializeJSON)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Warnf("cannot forward %s to %s: %v", r.URL.Path, server.Key, err)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
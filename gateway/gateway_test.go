@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/rpcxio/libkv/store"
+	consul "github.com/rpcxio/rpcx-consul/client"
+)
+
+func TestBuildTable(t *testing.T) {
+	table := BuildTable(map[string]string{
+		"Arith/tcp@10.0.0.1:8972": "weight=2",
+		"Arith/tcp@10.0.0.2:8972": "state=paused",
+		"Arith/tcp@10.0.0.3:8972": "weight=0",
+		"Echo/tcp@10.0.0.4:8972":  "ingress_path=/e/",
+		"Admin/tcp@10.0.0.5:8972": "ingress_host=admin.example.com",
+		"Arith":                   "",
+		"schema/Arith":            `{"name":"Arith"}`,
+	})
+
+	var services []string
+	for _, r := range table.Routes() {
+		services = append(services, r.Service)
+	}
+	if got := strings.Join(services, ","); got != "Admin,Arith,Echo" {
+		t.Fatalf("unexpected routes %s", got)
+	}
+
+	r, ok := table.Match("api.example.com", "/Arith/Mul")
+	if !ok || r.Service != "Arith" {
+		t.Fatalf("unexpected route %+v, %v", r, ok)
+	}
+	if len(r.Servers) != 1 || r.Servers[0] != (Server{Key: "tcp@10.0.0.1:8972", Weight: 2}) {
+		t.Fatalf("unexpected servers %+v", r.Servers)
+	}
+	if r, _ := table.Match("admin.example.com", "/Arith/Mul"); r.Service != "Admin" {
+		t.Fatalf("expected the route of the host but got %s", r.Service)
+	}
+	if r, _ := table.Match("", "/e/Echo"); r.Service != "Echo" {
+		t.Fatalf("expected the route of the ingress path but got %s", r.Service)
+	}
+	if _, ok := table.Match("", "/Echo/Echo"); ok {
+		t.Fatal("the service with an ingress path is routed at the default path")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	var method string
+	g := New(WithMetrics(metrics.NewRegistry()), WithForwarder(ForwarderFunc(
+		func(w http.ResponseWriter, r *http.Request, route Route, server Server, m string) {
+			method = m
+			w.Write([]byte(server.Key))
+		})))
+	g.Update(map[string]string{
+		"Arith/tcp@10.0.0.1:8972": "",
+		"Echo/tcp@10.0.0.2:8972":  "state=draining",
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://api.example.com:8080"+path, nil))
+		return w
+	}
+
+	if w := serve("/Arith/Mul"); w.Code != http.StatusOK || w.Body.String() != "tcp@10.0.0.1:8972" || method != "Mul" {
+		t.Fatalf("unexpected response %d %s of method %s", w.Code, w.Body, method)
+	}
+	if w := serve("/Arith/"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a method but got %d", w.Code)
+	}
+	if w := serve("/Unknown/Mul"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a route but got %d", w.Code)
+	}
+	if w := serve("/Echo/Echo"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a healthy server but got %d", w.Code)
+	}
+	if n := metrics.GetOrRegisterCounter("rpcx_consul.gateway.Echo.no_server", g.Metrics).Count(); n != 1 {
+		t.Fatalf("expected 1 request without a server but got %d", n)
+	}
+}
+
+func TestForwardRPCX(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("6"))
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	g := New(WithMetrics(metrics.NewRegistry()))
+	g.Update(map[string]string{"Arith/tcp@" + net.JoinHostPort(host, port): ""})
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/Arith/Mul", strings.NewReader(`{"A":2,"B":3}`)))
+	if w.Code != http.StatusOK || w.Body.String() != "6" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+	if header.Get(XServicePath) != "Arith" || header.Get(XServiceMethod) != "Mul" || header.Get(XSerializeType) != serializeJSON {
+		t.Fatalf("unexpected headers %v", header)
+	}
+}
+
+type treeStore struct {
+	store.Store
+	pairs   []*store.KVPair
+	watchCh chan []*store.KVPair
+}
+
+func (s *treeStore) List(directory string) ([]*store.KVPair, error) {
+	return s.pairs, nil
+}
+
+func (s *treeStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchCh, nil
+}
+
+func (s *treeStore) Close() {}
+
+func TestWatch(t *testing.T) {
+	kv := &treeStore{
+		pairs:   []*store.KVPair{{Key: "rpcx/Arith/tcp@10.0.0.1:8972"}, {Key: "rpcx/schema/Arith", Value: []byte("{}")}},
+		watchCh: make(chan []*store.KVPair),
+	}
+	d, err := consul.NewConsulDiscoveryStore("/rpcx/", kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	g := New(WithMetrics(metrics.NewRegistry()))
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		g.Watch(d, stopCh)
+		close(done)
+	}()
+
+	routes := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for len(g.Table().Routes()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected routes %+v", g.Table().Routes())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	routes(1)
+	if r := g.Table().Routes()[0]; r.Service != "Arith" {
+		t.Fatalf("unexpected route %+v", r)
+	}
+
+	kv.watchCh <- []*store.KVPair{{Key: "rpcx/Arith/tcp@10.0.0.1:8972"}, {Key: "rpcx/Echo/tcp@10.0.0.2:8972"}, {Key: "rpcx/schema/Echo", Value: []byte("{}")}}
+	routes(2)
+
+	close(stopCh)
+	<-done
+}
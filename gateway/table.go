@@ -0,0 +1,106 @@
+// Package gateway is an example of a dynamic HTTP gateway to rpcx services, built on the registrations in consul.
+// The routing table follows the registered servers: the routes come from the ingress hints
+// the servers publish (meta.Ingress), and only the healthy servers (meta.Hints) receive requests.
+// See cmd/rpcx-gateway for how to run it.
+package gateway
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// Server is a server of a route.
+type Server struct {
+	// Key of the server, e.g. tcp@10.0.0.1:8972
+	Key    string
+	Weight int
+}
+
+// Route routes the requests matching Ingress to the servers of Service.
+type Route struct {
+	Service string
+	Ingress meta.Ingress
+	// Servers are the healthy servers of the service, sorted by key
+	Servers []Server
+}
+
+// Table is the routing table of a gateway, it is safe for concurrent use after Update
+// because every Update replaces the routes.
+type Table struct {
+	// routes sorted by precedence: the routes with a host first, then the longer path prefixes
+	routes []Route
+}
+
+// BuildTable builds the routing table from the servers watched by a discovery of the base path of all services,
+// keyed like Arith/tcp@10.0.0.1:8972 and valued by their metadata. The services without ingress hints
+// are routed at /<service>/. The keys which aren't servers, like the schemas of the services, are skipped.
+func BuildTable(servers map[string]string) *Table {
+	byService := make(map[string]*Route)
+	var keys []string
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		service, server, ok := strings.Cut(key, "/")
+		if !ok || !isServer(server) {
+			continue
+		}
+		metadata := servers[key]
+
+		r := byService[service]
+		if r == nil {
+			r = &Route{Service: service}
+			byService[service] = r
+		}
+		if ingress := meta.IngressOf(metadata); r.Ingress.IsEmpty() && !ingress.IsEmpty() {
+			r.Ingress = ingress
+		}
+		if hints := meta.HintsOf(metadata); hints.Healthy && hints.Weight > 0 {
+			r.Servers = append(r.Servers, Server{Key: server, Weight: hints.Weight})
+		}
+	}
+
+	t := &Table{}
+	for _, r := range byService {
+		if r.Ingress.IsEmpty() {
+			r.Ingress.PathPrefix = "/" + r.Service + "/"
+		}
+		t.routes = append(t.routes, *r)
+	}
+	sort.Slice(t.routes, func(i, j int) bool {
+		a, b := t.routes[i].Ingress, t.routes[j].Ingress
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		return t.routes[i].Service < t.routes[j].Service
+	})
+	return t
+}
+
+// Routes returns the routes by precedence.
+func (t *Table) Routes() []Route {
+	return t.routes
+}
+
+// Match returns the route of a request to host and path.
+func (t *Table) Match(host, path string) (Route, bool) {
+	for _, r := range t.routes {
+		if r.Ingress.Matches(host, path) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// isServer reports whether the key is the key of a server like tcp@10.0.0.1:8972 or unix@/tmp/rpcx.sock.
+func isServer(key string) bool {
+	network, _, _, err := meta.SplitKey(key)
+	return network == "unix" || err == nil
+}
@@ -0,0 +1,111 @@
+// Package hook defines the callbacks to observe the discoveries and the register plugins,
+// so that operators can export metrics and alert when a discovery silently stops receiving updates.
+package hook
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// EventHook is called by the discoveries and the register plugins on their events.
+// The calls are synchronous, so they must return quickly.
+type EventHook interface {
+	// WatchError is called when the watch of path fails.
+	WatchError(path string, err error)
+	// WatchReconnected is called when the watch of path receives the servers again after it failed,
+	// with how long it was disconnected, zero if unknown.
+	WatchReconnected(path string, disconnected time.Duration)
+	// ServicesUpdated is called with the number of servers every time the servers of path are updated.
+	ServicesUpdated(path string, servers int)
+	// NotificationDropped is called when a change of path is dropped because the watcher is slow.
+	NotificationDropped(path, watcher string)
+	// Heartbeat is called after the heartbeat of a registered service, err is nil if it succeeded.
+	Heartbeat(service string, err error)
+}
+
+// ShadowHook is implemented by the EventHooks which record the comparisons of the discoveries with their shadows,
+// see client.WithShadow.
+type ShadowHook interface {
+	// ShadowCompared is called after the servers of path are compared with its shadow,
+	// with the number of servers which have differed for longer than the grace period, zero if they agree.
+	ShadowCompared(path string, divergent int)
+}
+
+// NopHook ignores all events, embed it to implement only some of the events.
+type NopHook struct{}
+
+func (NopHook) WatchError(path string, err error)                        {}
+func (NopHook) WatchReconnected(path string, disconnected time.Duration) {}
+func (NopHook) ServicesUpdated(path string, servers int)                 {}
+func (NopHook) NotificationDropped(path, watcher string)                 {}
+func (NopHook) Heartbeat(service string, err error)                      {}
+func (NopHook) ShadowCompared(path string, divergent int)                {}
+
+// MetricsHook records the events as metrics of a go-metrics registry, which has exporters
+// for Prometheus, Graphite, InfluxDB and more. The metrics are named like
+// rpcx_consul.discovery.<path>.watch_errors:
+//
+//	discovery.<path>.watch_errors       counter of failed watches
+//	discovery.<path>.watch_reconnects   counter of reconnected watches
+//	discovery.<path>.servers            gauge of the number of servers
+//	discovery.<path>.last_update        gauge of the unix time of the last update, to alert on stale discoveries
+//	discovery.<path>.dropped            counter of dropped notifications
+//	discovery.<path>.shadow_divergent   gauge of the servers differing from the shadow discovery
+//	register.<service>.heartbeats       counter of successful heartbeats
+//	register.<service>.heartbeat_errors counter of failed heartbeats
+type MetricsHook struct {
+	Registry metrics.Registry
+	// Prefix of the metric names, rpcx_consul if empty
+	Prefix string
+}
+
+var (
+	_ EventHook  = (*MetricsHook)(nil)
+	_ ShadowHook = (*MetricsHook)(nil)
+)
+
+// NewMetricsHook returns a MetricsHook recording in r, metrics.DefaultRegistry if r is nil.
+func NewMetricsHook(r metrics.Registry) *MetricsHook {
+	if r == nil {
+		r = metrics.DefaultRegistry
+	}
+	return &MetricsHook{Registry: r}
+}
+
+func (h *MetricsHook) name(kind, path, metric string) string {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = "rpcx_consul"
+	}
+	return prefix + "." + kind + "." + path + "." + metric
+}
+
+func (h *MetricsHook) WatchError(path string, err error) {
+	metrics.GetOrRegisterCounter(h.name("discovery", path, "watch_errors"), h.Registry).Inc(1)
+}
+
+func (h *MetricsHook) WatchReconnected(path string, disconnected time.Duration) {
+	metrics.GetOrRegisterCounter(h.name("discovery", path, "watch_reconnects"), h.Registry).Inc(1)
+}
+
+func (h *MetricsHook) ServicesUpdated(path string, servers int) {
+	metrics.GetOrRegisterGauge(h.name("discovery", path, "servers"), h.Registry).Update(int64(servers))
+	metrics.GetOrRegisterGauge(h.name("discovery", path, "last_update"), h.Registry).Update(time.Now().Unix())
+}
+
+func (h *MetricsHook) NotificationDropped(path, watcher string) {
+	metrics.GetOrRegisterCounter(h.name("discovery", path, "dropped"), h.Registry).Inc(1)
+}
+
+func (h *MetricsHook) Heartbeat(service string, err error) {
+	if err != nil {
+		metrics.GetOrRegisterCounter(h.name("register", service, "heartbeat_errors"), h.Registry).Inc(1)
+		return
+	}
+	metrics.GetOrRegisterCounter(h.name("register", service, "heartbeats"), h.Registry).Inc(1)
+}
+
+func (h *MetricsHook) ShadowCompared(path string, divergent int) {
+	metrics.GetOrRegisterGauge(h.name("discovery", path, "shadow_divergent"), h.Registry).Update(int64(divergent))
+}
@@ -0,0 +1,39 @@
+package hook
+
+import (
+	"errors"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestMetricsHook(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := NewMetricsHook(r)
+
+	h.WatchError("rpcx/Arith", errors.New("timeout"))
+	h.ServicesUpdated("rpcx/Arith", 3)
+	h.Heartbeat("Arith", nil)
+	h.Heartbeat("Arith", errors.New("timeout"))
+	h.Heartbeat("Arith", nil)
+	h.ShadowCompared("rpcx/Arith", 2)
+
+	if c := r.Get("rpcx_consul.discovery.rpcx/Arith.watch_errors").(metrics.Counter); c.Count() != 1 {
+		t.Fatalf("expect 1 watch error but got %d", c.Count())
+	}
+	if g := r.Get("rpcx_consul.discovery.rpcx/Arith.servers").(metrics.Gauge); g.Value() != 3 {
+		t.Fatalf("expect 3 servers but got %d", g.Value())
+	}
+	if g := r.Get("rpcx_consul.discovery.rpcx/Arith.last_update").(metrics.Gauge); g.Value() == 0 {
+		t.Fatal("last update is not recorded")
+	}
+	if g := r.Get("rpcx_consul.discovery.rpcx/Arith.shadow_divergent").(metrics.Gauge); g.Value() != 2 {
+		t.Fatalf("expect 2 divergent servers but got %d", g.Value())
+	}
+	if c := r.Get("rpcx_consul.register.Arith.heartbeats").(metrics.Counter); c.Count() != 2 {
+		t.Fatalf("expect 2 heartbeats but got %d", c.Count())
+	}
+	if c := r.Get("rpcx_consul.register.Arith.heartbeat_errors").(metrics.Counter); c.Count() != 1 {
+		t.Fatalf("expect 1 heartbeat error but got %d", c.Count())
+	}
+}
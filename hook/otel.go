@@ -0,0 +1,165 @@
+package hook
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/budget"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/asyncint64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+// instrumentationName is the name of the meter of OTelHook.
+const instrumentationName = "github.com/rpcxio/rpcx-consul"
+
+// Attributes of the OpenTelemetry metrics.
+const (
+	AttrPath    = attribute.Key("path")
+	AttrWatcher = attribute.Key("watcher")
+	AttrService = attribute.Key("service")
+	AttrResult  = attribute.Key("result")
+	AttrKind    = attribute.Key("kind")
+)
+
+// OTelHook records the events as OpenTelemetry metrics, so that they are exported by the SDK
+// the application already configured. The metrics are the same as MetricsHook records,
+// with the paths and services as attributes:
+//
+//	rpcx_consul.discovery.watch_errors      counter of failed watches {path}
+//	rpcx_consul.discovery.watch_reconnects  counter of reconnected watches {path}
+//	rpcx_consul.discovery.disconnected      histogram of how long the watches were disconnected in ms {path}
+//	rpcx_consul.discovery.servers           gauge of the number of servers {path}
+//	rpcx_consul.discovery.last_update       gauge of the unix time of the last update {path}
+//	rpcx_consul.discovery.dropped           counter of dropped notifications {path, watcher}
+//	rpcx_consul.discovery.shadow_divergent  gauge of the servers differing from the shadow discovery {path}
+//	rpcx_consul.register.heartbeats         counter of heartbeats {service, result=ok|error}
+//	rpcx_consul.goroutines                  gauge of the goroutines counted by package budget {kind}
+type OTelHook struct {
+	watchErrors     syncint64.Counter
+	watchReconnects syncint64.Counter
+	disconnected    syncint64.Histogram
+	dropped         syncint64.Counter
+	heartbeats      syncint64.Counter
+	servers         asyncint64.Gauge
+	lastUpdate      asyncint64.Gauge
+	shadowDivergent asyncint64.Gauge
+	goroutines      asyncint64.Gauge
+
+	mu sync.Mutex
+	// the latest number of servers and the unix time of the update by path, observed by the callback
+	latest map[string][2]int64
+	// the latest number of divergent servers by path
+	divergent map[string]int64
+}
+
+var (
+	_ EventHook  = (*OTelHook)(nil)
+	_ ShadowHook = (*OTelHook)(nil)
+)
+
+// NewOTelHook returns an OTelHook recording with meter, the meter of the global MeterProvider if meter is nil.
+func NewOTelHook(meter metric.Meter) (*OTelHook, error) {
+	if meter == nil {
+		meter = global.Meter(instrumentationName)
+	}
+
+	h := &OTelHook{latest: make(map[string][2]int64), divergent: make(map[string]int64)}
+	var err error
+	counter := func(name, desc string) syncint64.Counter {
+		if err != nil {
+			return nil
+		}
+		var c syncint64.Counter
+		c, err = meter.SyncInt64().Counter(name, instrument.WithDescription(desc))
+		return c
+	}
+	gauge := func(name, desc string, u unit.Unit) asyncint64.Gauge {
+		if err != nil {
+			return nil
+		}
+		var g asyncint64.Gauge
+		g, err = meter.AsyncInt64().Gauge(name, instrument.WithDescription(desc), instrument.WithUnit(u))
+		return g
+	}
+
+	h.watchErrors = counter("rpcx_consul.discovery.watch_errors", "failed watches")
+	h.watchReconnects = counter("rpcx_consul.discovery.watch_reconnects", "reconnected watches")
+	h.dropped = counter("rpcx_consul.discovery.dropped", "notifications dropped because the watcher is slow")
+	h.heartbeats = counter("rpcx_consul.register.heartbeats", "heartbeats of the registered services")
+	h.servers = gauge("rpcx_consul.discovery.servers", "number of servers", unit.Dimensionless)
+	h.lastUpdate = gauge("rpcx_consul.discovery.last_update", "unix time of the last update", "s")
+	h.shadowDivergent = gauge("rpcx_consul.discovery.shadow_divergent", "servers differing from the shadow discovery", unit.Dimensionless)
+	h.goroutines = gauge("rpcx_consul.goroutines", "goroutines of the discoveries and the plugins", unit.Dimensionless)
+	if err != nil {
+		return nil, err
+	}
+	h.disconnected, err = meter.SyncInt64().Histogram("rpcx_consul.discovery.disconnected",
+		instrument.WithDescription("how long the watches were disconnected"), instrument.WithUnit(unit.Milliseconds))
+	if err != nil {
+		return nil, err
+	}
+
+	insts := []instrument.Asynchronous{h.servers, h.lastUpdate, h.shadowDivergent, h.goroutines}
+	if err := meter.RegisterCallback(insts, h.observe); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// observe records the gauges.
+func (h *OTelHook) observe(ctx context.Context) {
+	h.mu.Lock()
+	for path, v := range h.latest {
+		h.servers.Observe(ctx, v[0], AttrPath.String(path))
+		h.lastUpdate.Observe(ctx, v[1], AttrPath.String(path))
+	}
+	for path, n := range h.divergent {
+		h.shadowDivergent.Observe(ctx, n, AttrPath.String(path))
+	}
+	h.mu.Unlock()
+
+	for _, u := range budget.Usages() {
+		h.goroutines.Observe(ctx, int64(u.Count), AttrKind.String(u.Kind))
+	}
+}
+
+func (h *OTelHook) WatchError(path string, err error) {
+	h.watchErrors.Add(context.Background(), 1, AttrPath.String(path))
+}
+
+func (h *OTelHook) WatchReconnected(path string, disconnected time.Duration) {
+	h.watchReconnects.Add(context.Background(), 1, AttrPath.String(path))
+	if disconnected > 0 {
+		h.disconnected.Record(context.Background(), disconnected.Milliseconds(), AttrPath.String(path))
+	}
+}
+
+func (h *OTelHook) ServicesUpdated(path string, servers int) {
+	h.mu.Lock()
+	h.latest[path] = [2]int64{int64(servers), time.Now().Unix()}
+	h.mu.Unlock()
+}
+
+func (h *OTelHook) NotificationDropped(path, watcher string) {
+	h.dropped.Add(context.Background(), 1, AttrPath.String(path), AttrWatcher.String(watcher))
+}
+
+func (h *OTelHook) Heartbeat(service string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	h.heartbeats.Add(context.Background(), 1, AttrService.String(service), AttrResult.String(result))
+}
+
+func (h *OTelHook) ShadowCompared(path string, divergent int) {
+	h.mu.Lock()
+	h.divergent[path] = int64(divergent)
+	h.mu.Unlock()
+}
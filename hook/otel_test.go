@@ -0,0 +1,133 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/asyncint64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/nonrecording"
+)
+
+// recordingMeter records the int64 instruments by their names and attributes.
+type recordingMeter struct {
+	metric.Meter
+
+	mu       sync.Mutex
+	values   map[string]int64
+	callback func(context.Context)
+}
+
+type recorded struct {
+	instrument.Synchronous
+	instrument.Asynchronous
+	m    *recordingMeter
+	name string
+}
+
+func (r recorded) Add(ctx context.Context, incr int64, attrs ...attribute.KeyValue) {
+	r.m.record(r.name, incr, true, attrs)
+}
+
+func (r recorded) Record(ctx context.Context, incr int64, attrs ...attribute.KeyValue) {
+	r.m.record(r.name, incr, true, attrs)
+}
+
+func (r recorded) Observe(ctx context.Context, x int64, attrs ...attribute.KeyValue) {
+	r.m.record(r.name, x, false, attrs)
+}
+
+func (m *recordingMeter) record(name string, v int64, add bool, attrs []attribute.KeyValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := attribute.NewSet(attrs...)
+	key := name + set.Encoded(attribute.DefaultEncoder())
+	if add {
+		v += m.values[key]
+	}
+	m.values[key] = v
+}
+
+func (m *recordingMeter) get(key string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+func (m *recordingMeter) SyncInt64() syncint64.InstrumentProvider   { return syncProvider{m} }
+func (m *recordingMeter) AsyncInt64() asyncint64.InstrumentProvider { return asyncProvider{m} }
+
+func (m *recordingMeter) RegisterCallback(insts []instrument.Asynchronous, f func(context.Context)) error {
+	m.callback = f
+	return nil
+}
+
+type syncProvider struct{ m *recordingMeter }
+
+func (p syncProvider) Counter(name string, opts ...instrument.Option) (syncint64.Counter, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+func (p syncProvider) UpDownCounter(name string, opts ...instrument.Option) (syncint64.UpDownCounter, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+func (p syncProvider) Histogram(name string, opts ...instrument.Option) (syncint64.Histogram, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+type asyncProvider struct{ m *recordingMeter }
+
+func (p asyncProvider) Counter(name string, opts ...instrument.Option) (asyncint64.Counter, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+func (p asyncProvider) UpDownCounter(name string, opts ...instrument.Option) (asyncint64.UpDownCounter, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+func (p asyncProvider) Gauge(name string, opts ...instrument.Option) (asyncint64.Gauge, error) {
+	return recorded{m: p.m, name: name}, nil
+}
+
+func TestOTelHook(t *testing.T) {
+	m := &recordingMeter{Meter: nonrecording.NewNoopMeter(), values: make(map[string]int64)}
+	h, err := NewOTelHook(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.WatchError("rpcx/Arith", errors.New("timeout"))
+	h.WatchReconnected("rpcx/Arith", 1500*time.Millisecond)
+	h.ServicesUpdated("rpcx/Arith", 3)
+	h.NotificationDropped("rpcx/Arith", "watcher-1")
+	h.Heartbeat("Arith", nil)
+	h.Heartbeat("Arith", errors.New("timeout"))
+	h.Heartbeat("Arith", nil)
+	h.ShadowCompared("rpcx/Arith", 2)
+	m.callback(context.Background())
+
+	for key, want := range map[string]int64{
+		"rpcx_consul.discovery.watch_errorspath=rpcx/Arith":              1,
+		"rpcx_consul.discovery.watch_reconnectspath=rpcx/Arith":          1,
+		"rpcx_consul.discovery.disconnectedpath=rpcx/Arith":              1500,
+		"rpcx_consul.discovery.serverspath=rpcx/Arith":                   3,
+		"rpcx_consul.discovery.shadow_divergentpath=rpcx/Arith":          2,
+		"rpcx_consul.discovery.droppedpath=rpcx/Arith,watcher=watcher-1": 1,
+		"rpcx_consul.register.heartbeatsresult=ok,service=Arith":         2,
+		"rpcx_consul.register.heartbeatsresult=error,service=Arith":      1,
+	} {
+		if got := m.get(key); got != want {
+			t.Fatalf("expect %s to be %d but got %d", key, want, got)
+		}
+	}
+	if m.get("rpcx_consul.discovery.last_updatepath=rpcx/Arith") == 0 {
+		t.Fatal("last update is not recorded")
+	}
+}
@@ -0,0 +1,56 @@
+package meta
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Fields of the addresses of a server.
+const (
+	Hostname = "hostname"
+	IP       = "ip"
+)
+
+// Addresses is the resolvable hostname and the numeric IP of a server,
+// so that clients in split-horizon DNS environments can choose which to dial.
+type Addresses struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+// Set sets the non-empty addresses in v.
+func (a Addresses) Set(v url.Values) {
+	setIfNotEmpty(v, Hostname, a.Hostname)
+	setIfNotEmpty(v, IP, a.IP)
+}
+
+// AddressesOf returns the addresses in the metadata.
+func AddressesOf(metadata string) Addresses {
+	v := Parse(metadata)
+	return Addresses{Hostname: v.Get(Hostname), IP: v.Get(IP)}
+}
+
+// SplitKey splits the key of a server like tcp@127.0.0.1:8972 into network, host and port.
+func SplitKey(key string) (network, host, port string, err error) {
+	addr := key
+	if i := strings.Index(key, "@"); i >= 0 {
+		network, addr = key[:i], key[i+1:]
+	}
+	host, port, err = net.SplitHostPort(addr)
+	return network, host, port, err
+}
+
+// ReplaceHost returns the key of a server with the host replaced.
+// The key is returned unchanged if it has no port.
+func ReplaceHost(key, host string) string {
+	network, _, port, err := SplitKey(key)
+	if err != nil {
+		return key
+	}
+	addr := net.JoinHostPort(host, port)
+	if network == "" {
+		return addr
+	}
+	return network + "@" + addr
+}
@@ -0,0 +1,55 @@
+package meta
+
+import (
+	"net/url"
+	"runtime/debug"
+)
+
+// Fields of the build information of a server, namespaced not to collide with the version of the service.
+const (
+	BuildVersion = "build_version"
+	Revision     = "vcs_revision"
+	GoVersion    = "go_version"
+)
+
+// BuildInfo is the build information of the binary of a server.
+type BuildInfo struct {
+	// version of the main module
+	Version string `json:"version,omitempty"`
+	// VCS revision the binary is built from
+	Revision  string `json:"vcs_revision,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// ReadBuildInfo returns the build information of the running binary.
+func ReadBuildInfo() BuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{}
+	}
+
+	info := BuildInfo{Version: bi.Main.Version, GoVersion: bi.GoVersion}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			info.Revision = s.Value
+		}
+	}
+	return info
+}
+
+// Set sets the non-empty fields of the build information in v.
+func (b BuildInfo) Set(v url.Values) {
+	setIfNotEmpty(v, BuildVersion, b.Version)
+	setIfNotEmpty(v, Revision, b.Revision)
+	setIfNotEmpty(v, GoVersion, b.GoVersion)
+}
+
+// BuildInfoOf returns the build information in the metadata.
+func BuildInfoOf(metadata string) BuildInfo {
+	v := Parse(metadata)
+	return BuildInfo{
+		Version:   v.Get(BuildVersion),
+		Revision:  v.Get(Revision),
+		GoVersion: v.Get(GoVersion),
+	}
+}
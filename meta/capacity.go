@@ -0,0 +1,42 @@
+package meta
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// Fields of the capacity hints of a server.
+const (
+	MaxQPS         = "max_qps"
+	MaxConcurrency = "max_concurrency"
+)
+
+// Capacity is the capacity hints of a server, zero means unlimited.
+type Capacity struct {
+	MaxQPS         float64 `json:"max_qps,omitempty"`
+	MaxConcurrency int     `json:"max_concurrency,omitempty"`
+}
+
+// Set sets the non-zero fields of the capacity in v.
+func (c Capacity) Set(v url.Values) {
+	if c.MaxQPS > 0 {
+		v.Set(MaxQPS, strconv.FormatFloat(c.MaxQPS, 'f', -1, 64))
+	}
+	if c.MaxConcurrency > 0 {
+		v.Set(MaxConcurrency, strconv.Itoa(c.MaxConcurrency))
+	}
+}
+
+// CapacityOf returns the capacity hints in the metadata, the invalid fields are ignored.
+func CapacityOf(metadata string) Capacity {
+	v := Parse(metadata)
+
+	var c Capacity
+	if qps, err := strconv.ParseFloat(v.Get(MaxQPS), 64); err == nil && qps > 0 {
+		c.MaxQPS = qps
+	}
+	if n, err := strconv.Atoi(v.Get(MaxConcurrency)); err == nil && n > 0 {
+		c.MaxConcurrency = n
+	}
+	return c
+}
@@ -0,0 +1,16 @@
+package meta
+
+import "time"
+
+// DNSTTL is the field of the TTL which consul DNS answers the queries of a service with, e.g. 5s.
+// Clients watching the registry can refresh as often, so that they see the same servers as DNS consumers.
+const DNSTTL = "dns_ttl"
+
+// DNSTTLOf returns the DNS TTL hint in the metadata, zero if it is not published or invalid.
+func DNSTTLOf(metadata string) time.Duration {
+	ttl, err := time.ParseDuration(Parse(metadata).Get(DNSTTL))
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
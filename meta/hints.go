@@ -0,0 +1,51 @@
+package meta
+
+import "strconv"
+
+// Fields used by selectors to balance the traffic. weight and state are the same as rpcx uses.
+const (
+	Weight = "weight"
+	Zone   = "zone"
+	State  = "state"
+	// Datacenter is the consul datacenter of a server, it is set by the multi-datacenter discovery
+	Datacenter = "dc"
+	// Group is the group of a server as rpcx uses, e.g. the version for the traffic shifting by admin.SetGroupWeights
+	Group = "group"
+)
+
+// Hints is what a selector needs to know about a server, derived from its metadata.
+type Hints struct {
+	// Weight is the relative weight of the server, 1 if not published
+	Weight   int      `json:"weight"`
+	Zone     string   `json:"zone,omitempty"`
+	Healthy  bool     `json:"healthy"`
+	Capacity Capacity `json:"capacity"`
+}
+
+// HintsOf returns the selection hints in the metadata.
+func HintsOf(metadata string) Hints {
+	v := Parse(metadata)
+
+	h := Hints{
+		Weight:   1,
+		Zone:     v.Get(Zone),
+		Healthy:  Serving(StateOf(metadata)),
+		Capacity: CapacityOf(metadata),
+	}
+	if w, err := strconv.Atoi(v.Get(Weight)); err == nil && w >= 0 {
+		h.Weight = w
+	}
+	return h
+}
+
+// SelectorHints is the hints of servers by their keys.
+type SelectorHints map[string]Hints
+
+// SelectorHintsOf returns the hints of the servers, which are keyed and valued as rpcx Selector.UpdateServer receives them.
+func SelectorHintsOf(servers map[string]string) SelectorHints {
+	hints := make(SelectorHints, len(servers))
+	for key, metadata := range servers {
+		hints[key] = HintsOf(metadata)
+	}
+	return hints
+}
@@ -0,0 +1,46 @@
+package meta
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Fields of the routing hints of API gateways and HTTP ingresses.
+const (
+	IngressHost = "ingress_host"
+	IngressPath = "ingress_path"
+)
+
+// Ingress is how a service is exposed by API gateways, so that they can be configured from the registrations.
+type Ingress struct {
+	// external hostname, e.g. api.example.com
+	Host string `json:"ingress_host,omitempty"`
+	// path prefix, e.g. /arith
+	PathPrefix string `json:"ingress_path,omitempty"`
+}
+
+// Set sets the non-empty hints in v.
+func (i Ingress) Set(v url.Values) {
+	setIfNotEmpty(v, IngressHost, i.Host)
+	setIfNotEmpty(v, IngressPath, i.PathPrefix)
+}
+
+// IsEmpty reports whether no hint is set.
+func (i Ingress) IsEmpty() bool {
+	return i == Ingress{}
+}
+
+// Matches reports whether a request to host and path is routed to the service.
+// The empty host or path prefix of the ingress matches any.
+func (i Ingress) Matches(host, path string) bool {
+	if i.Host != "" && !strings.EqualFold(i.Host, host) {
+		return false
+	}
+	return strings.HasPrefix(path, i.PathPrefix)
+}
+
+// IngressOf returns the ingress hints in the metadata.
+func IngressOf(metadata string) Ingress {
+	v := Parse(metadata)
+	return Ingress{Host: v.Get(IngressHost), PathPrefix: v.Get(IngressPath)}
+}
@@ -0,0 +1,11 @@
+package meta
+
+// Fields of the instance a server runs on, published by the cloudmeta enrichers.
+const (
+	Region     = "region"
+	InstanceID = "instance_id"
+	Node       = "node"
+	Pod        = "pod"
+	// LabelPrefix prefixes the kubernetes labels of the pod, e.g. label_app=payments
+	LabelPrefix = "label_"
+)
@@ -0,0 +1,58 @@
+// Package meta defines the well-known metadata fields which the register plugin publishes
+// in the value of every server, and typed accessors to read them on the client side.
+//
+// The metadata of a server is url encoded, for example "group=test&team=payments".
+package meta
+
+import "net/url"
+
+// Fields of the ownership of a service.
+const (
+	Owner  = "owner"
+	Team   = "team"
+	Oncall = "oncall"
+)
+
+// Ownership is who is responsible for a service.
+type Ownership struct {
+	Owner  string `json:"owner,omitempty"`
+	Team   string `json:"team,omitempty"`
+	Oncall string `json:"oncall,omitempty"`
+}
+
+// IsEmpty reports whether no ownership is set.
+func (o Ownership) IsEmpty() bool {
+	return o.Owner == "" && o.Team == "" && o.Oncall == ""
+}
+
+// Set sets the non-empty fields of the ownership in v.
+func (o Ownership) Set(v url.Values) {
+	setIfNotEmpty(v, Owner, o.Owner)
+	setIfNotEmpty(v, Team, o.Team)
+	setIfNotEmpty(v, Oncall, o.Oncall)
+}
+
+// OwnershipOf returns the ownership in the metadata.
+func OwnershipOf(metadata string) Ownership {
+	v := Parse(metadata)
+	return Ownership{
+		Owner:  v.Get(Owner),
+		Team:   v.Get(Team),
+		Oncall: v.Get(Oncall),
+	}
+}
+
+// Parse parses the metadata, the malformed parts are ignored.
+func Parse(metadata string) url.Values {
+	v, _ := url.ParseQuery(metadata)
+	if v == nil {
+		v = make(url.Values)
+	}
+	return v
+}
+
+func setIfNotEmpty(v url.Values, key, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
@@ -0,0 +1,233 @@
+package meta
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOwnership(t *testing.T) {
+	v := url.Values{"group": []string{"test"}}
+	Ownership{Team: "payments", Oncall: "pager@example.com"}.Set(v)
+
+	o := OwnershipOf(v.Encode())
+	if o.Owner != "" || o.Team != "payments" || o.Oncall != "pager@example.com" {
+		t.Fatalf("unexpected ownership: %+v", o)
+	}
+	if !OwnershipOf("group=test").IsEmpty() {
+		t.Fatal("expect empty ownership")
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	v := make(url.Values)
+	ReadBuildInfo().Set(v)
+
+	if b := BuildInfoOf(v.Encode()); b.GoVersion == "" {
+		t.Fatalf("expect go version but got %+v", b)
+	}
+}
+
+func TestStartTime(t *testing.T) {
+	v := make(url.Values)
+	start := time.Now().Add(-time.Hour)
+	SetStartTime(v, start)
+
+	uptime, ok := UptimeOf(v.Encode())
+	if !ok || uptime < time.Hour-time.Second || uptime > time.Hour+time.Minute {
+		t.Fatalf("unexpected uptime: %v", uptime)
+	}
+	if _, ok := StartTimeOf("start_time=yesterday"); ok {
+		t.Fatal("expect invalid start time")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	v := make(url.Values)
+	Capacity{MaxQPS: 1500.5, MaxConcurrency: 64}.Set(v)
+
+	if c := CapacityOf(v.Encode()); c.MaxQPS != 1500.5 || c.MaxConcurrency != 64 {
+		t.Fatalf("unexpected capacity: %+v", c)
+	}
+	if c := CapacityOf("max_qps=fast&max_concurrency=-1"); c != (Capacity{}) {
+		t.Fatalf("expect no capacity but got %+v", c)
+	}
+}
+
+func TestReplaceHost(t *testing.T) {
+	cases := map[string]string{
+		"tcp@10.0.0.1:8972":   "tcp@svc.example.com:8972",
+		"10.0.0.1:8972":       "svc.example.com:8972",
+		"quic@[::1]:8972":     "quic@svc.example.com:8972",
+		"unix@/tmp/rpcx.sock": "unix@/tmp/rpcx.sock",
+	}
+	for key, want := range cases {
+		if got := ReplaceHost(key, "svc.example.com"); got != want {
+			t.Errorf("ReplaceHost(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestPorts(t *testing.T) {
+	v := make(url.Values)
+	Ports{RPC: 8972, Metrics: 9090}.Set(v)
+
+	p := PortsOf(v.Encode())
+	if p.RPC != 8972 || p.Metrics != 9090 || p.Pprof != 0 {
+		t.Fatalf("unexpected ports: %+v", p)
+	}
+	if addr := HostPort("tcp@10.0.0.1:8972", p.Metrics); addr != "10.0.0.1:9090" {
+		t.Fatalf("unexpected metrics endpoint: %s", addr)
+	}
+	if p := PortsOf("metrics_port=70000&pprof_port=x"); !p.IsEmpty() {
+		t.Fatalf("expect no ports but got %+v", p)
+	}
+}
+
+func TestSelectorHints(t *testing.T) {
+	hints := SelectorHintsOf(map[string]string{
+		"tcp@10.0.0.1:8972": "weight=5&zone=us-east-1a&max_qps=100",
+		"tcp@10.0.0.2:8972": "state=inactive&weight=x",
+	})
+
+	h := hints["tcp@10.0.0.1:8972"]
+	if h.Weight != 5 || h.Zone != "us-east-1a" || !h.Healthy || h.Capacity.MaxQPS != 100 {
+		t.Fatalf("unexpected hints: %+v", h)
+	}
+	if h := hints["tcp@10.0.0.2:8972"]; h.Weight != 1 || h.Healthy {
+		t.Fatalf("unexpected hints: %+v", h)
+	}
+}
+
+func TestState(t *testing.T) {
+	for metadata, want := range map[string]string{
+		"":                       "active",
+		"state=paused":           "paused",
+		"group=a&state=draining": "draining",
+	} {
+		if state := StateOf(metadata); state != want {
+			t.Errorf("expected state %s of %q but got %s", want, metadata, state)
+		}
+	}
+	if !Serving(StateActive) || Serving(StateDraining) || Serving(StateInactive) {
+		t.Fatal("unexpected serving states")
+	}
+}
+
+func TestTags(t *testing.T) {
+	v := make(url.Values)
+	SetTags(v, []string{"canary", "v2"})
+	if tags := TagsOf(v.Encode()); len(tags) != 2 || tags[0] != "canary" || tags[1] != "v2" {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+	if !HasTag(v.Encode(), "v2") || HasTag(v.Encode(), "v1") || HasTag("", "") {
+		t.Fatal("unexpected HasTag")
+	}
+}
+
+func TestIngress(t *testing.T) {
+	v := make(url.Values)
+	Ingress{Host: "api.example.com", PathPrefix: "/arith"}.Set(v)
+	i := IngressOf(v.Encode())
+	if i.Host != "api.example.com" || i.PathPrefix != "/arith" {
+		t.Fatalf("unexpected ingress: %+v", i)
+	}
+	if !i.Matches("API.example.com", "/arith/mul") || i.Matches("api.example.com", "/echo") || i.Matches("example.com", "/arith") {
+		t.Fatal("unexpected matches")
+	}
+	if !IngressOf("").IsEmpty() {
+		t.Fatal("expect empty ingress")
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Metadata("group=a&api_key=xyz&db_password=p"); got != "api_key=REDACTED&db_password=REDACTED&group=a" {
+		t.Fatalf("unexpected redacted metadata: %s", got)
+	}
+	if got := r.Metadata("group=a&weight=5"); got != "group=a&weight=5" {
+		t.Fatalf("unexpected redacted metadata: %s", got)
+	}
+	if got := r.Metadata("token=%zz"); got != Redacted {
+		t.Fatalf("expect malformed metadata redacted but got %s", got)
+	}
+	if got := RedactAll().Metadata("group=a"); got != "group=REDACTED" {
+		t.Fatalf("unexpected redacted metadata: %s", got)
+	}
+	if got := (*Redactor)(nil).Metadata("token=t"); got != "token=t" {
+		t.Fatalf("expect nil redactor hides nothing but got %s", got)
+	}
+	if _, err := NewRedactor("("); err == nil {
+		t.Fatal("expect error of invalid pattern")
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	expires := time.Now().Add(time.Minute).Truncate(time.Second)
+	metadata := Tombstone(expires)
+	if Serving(StateOf(metadata)) {
+		t.Fatal("tombstone is serving")
+	}
+	got, ok := TombstoneOf(metadata)
+	if !ok || !got.Equal(expires) {
+		t.Fatalf("unexpected expiry: %v, %v", got, ok)
+	}
+	if _, ok := TombstoneOf("state=active"); ok {
+		t.Fatal("active server is a tombstone")
+	}
+}
+
+func TestDNSTTL(t *testing.T) {
+	if ttl := DNSTTLOf("dns_ttl=5s"); ttl != 5*time.Second {
+		t.Fatalf("unexpected TTL %v", ttl)
+	}
+	if ttl := DNSTTLOf("dns_ttl=soon"); ttl != 0 {
+		t.Fatalf("expect invalid TTL ignored but got %v", ttl)
+	}
+}
+
+func TestRing(t *testing.T) {
+	v := make(url.Values)
+	SetRingTokens(v, []uint32{0x10, 0xffffffff})
+	if got := RingTokensOf(v.Encode()); !reflect.DeepEqual(got, []uint32{0x10, 0xffffffff}) {
+		t.Fatalf("unexpected tokens %v", got)
+	}
+
+	a, b := "tcp@10.0.0.1:8972", "tcp@10.0.0.2:8972"
+	h := RingHash("user-1")
+	servers := map[string]string{
+		// a owns the keys hashed up to h, b owns the rest
+		a:                   "ring_tokens=" + strconv.FormatUint(uint64(h), 16),
+		b:                   "ring_tokens=" + strconv.FormatUint(uint64(h)+1, 16),
+		"tcp@10.0.0.3:8972": "state=paused",
+	}
+	r := NewRing(servers)
+	if r.Servers() != 2 {
+		t.Fatalf("expected 2 servers but got %d", r.Servers())
+	}
+	if owner, ok := r.Get("user-1"); !ok || owner != a {
+		t.Fatalf("expected owner %s but got %s", a, owner)
+	}
+	if got := r.GetN("user-1", 3); !reflect.DeepEqual(got, []string{a, b}) {
+		t.Fatalf("unexpected replicas %v", got)
+	}
+
+	// the servers without tokens get virtual nodes
+	r = NewRing(map[string]string{a: "", b: ""})
+	owners := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		owner, _ := r.Get(strconv.Itoa(i))
+		owners[owner]++
+	}
+	if owners[a] < 200 || owners[b] < 200 {
+		t.Fatalf("unbalanced ring %v", owners)
+	}
+	if _, ok := NewRing(nil).Get("user-1"); ok {
+		t.Fatal("empty ring has an owner")
+	}
+}
@@ -0,0 +1,70 @@
+package meta
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Fields of the ports of a server.
+const (
+	RPCPort     = "rpc_port"
+	MetricsPort = "metrics_port"
+	PprofPort   = "pprof_port"
+)
+
+// Ports is the ports a server listens on for different concerns, zero means not served.
+type Ports struct {
+	RPC     int `json:"rpc_port,omitempty"`
+	Metrics int `json:"metrics_port,omitempty"`
+	Pprof   int `json:"pprof_port,omitempty"`
+}
+
+// Set sets the non-zero ports in v.
+func (p Ports) Set(v url.Values) {
+	setPort(v, RPCPort, p.RPC)
+	setPort(v, MetricsPort, p.Metrics)
+	setPort(v, PprofPort, p.Pprof)
+}
+
+// IsEmpty reports whether no port is set.
+func (p Ports) IsEmpty() bool {
+	return p == Ports{}
+}
+
+// PortsOf returns the ports in the metadata, the invalid ports are ignored.
+func PortsOf(metadata string) Ports {
+	v := Parse(metadata)
+	return Ports{
+		RPC:     portOf(v, RPCPort),
+		Metrics: portOf(v, MetricsPort),
+		Pprof:   portOf(v, PprofPort),
+	}
+}
+
+// HostPort returns host:port of the server with the key, e.g. the metrics endpoint of tcp@10.0.0.1:8972
+// is 10.0.0.1:9090 for port 9090. It returns an empty string if the port is zero or the key has no host.
+func HostPort(key string, port int) string {
+	if port == 0 {
+		return ""
+	}
+	_, host, _, err := SplitKey(key)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func setPort(v url.Values, field string, port int) {
+	if port > 0 {
+		v.Set(field, strconv.Itoa(port))
+	}
+}
+
+func portOf(v url.Values, field string) int {
+	port, err := strconv.Atoi(v.Get(field))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0
+	}
+	return port
+}
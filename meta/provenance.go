@@ -0,0 +1,35 @@
+package meta
+
+import "net/url"
+
+// Fields of the provenance of a server replicated from another datacenter.
+const (
+	// ReplicatedFrom is the datacenter the server registered in
+	ReplicatedFrom = "replicated_from"
+	// ReplicatedVia is the datacenter the server was replicated from, it differs from ReplicatedFrom
+	// if the server was replicated through other datacenters
+	ReplicatedVia = "replicated_via"
+)
+
+// Provenance is where a replicated server comes from.
+type Provenance struct {
+	From string `json:"replicated_from,omitempty"`
+	Via  string `json:"replicated_via,omitempty"`
+}
+
+// Set sets the non-empty fields in v.
+func (p Provenance) Set(v url.Values) {
+	setIfNotEmpty(v, ReplicatedFrom, p.From)
+	setIfNotEmpty(v, ReplicatedVia, p.Via)
+}
+
+// IsReplica reports whether the server was replicated from another datacenter.
+func (p Provenance) IsReplica() bool {
+	return p.From != ""
+}
+
+// ProvenanceOf returns the provenance in the metadata, it is empty if the server registered in this datacenter.
+func ProvenanceOf(metadata string) Provenance {
+	v := Parse(metadata)
+	return Provenance{From: v.Get(ReplicatedFrom), Via: v.Get(ReplicatedVia)}
+}
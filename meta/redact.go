@@ -0,0 +1,79 @@
+package meta
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// Redacted replaces the values hidden by a Redactor.
+const Redacted = "REDACTED"
+
+// DefaultRedactPatterns match the names of the fields which usually hold secrets.
+var DefaultRedactPatterns = []string{`(?i)token`, `(?i)secret`, `(?i)passw(or)?d`, `(?i)credential`, `(?i)api_?key`, `(?i)auth`}
+
+// Redactor hides the values of the metadata fields matching its patterns before the metadata
+// is logged or exposed for debugging. A nil Redactor hides nothing.
+type Redactor struct {
+	fields []*regexp.Regexp
+	all    bool
+}
+
+// NewRedactor returns a Redactor hiding the fields whose names match any of the regular expressions,
+// DefaultRedactPatterns if none is given.
+func NewRedactor(patterns ...string) (*Redactor, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultRedactPatterns
+	}
+
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		r.fields = append(r.fields, re)
+	}
+	return r, nil
+}
+
+// RedactAll returns a Redactor hiding the values of all fields.
+func RedactAll() *Redactor {
+	return &Redactor{all: true}
+}
+
+// Metadata returns the metadata with the matched values replaced by Redacted.
+// Malformed metadata is replaced as a whole since its fields are unknown.
+func (r *Redactor) Metadata(metadata string) string {
+	if r == nil || metadata == "" {
+		return metadata
+	}
+
+	v, err := url.ParseQuery(metadata)
+	if err != nil {
+		return Redacted
+	}
+	redacted := false
+	for k, values := range v {
+		if !r.all && !r.matches(k) {
+			continue
+		}
+		for i := range values {
+			values[i] = Redacted
+		}
+		redacted = true
+	}
+	if !redacted {
+		return metadata
+	}
+	return v.Encode()
+}
+
+func (r *Redactor) matches(field string) bool {
+	for _, re := range r.fields {
+		if re.MatchString(field) {
+			return true
+		}
+	}
+	return false
+}
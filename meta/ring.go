@@ -0,0 +1,155 @@
+package meta
+
+import (
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RingTokens is the field of the comma separated hex tokens of a server on a consistent-hash ring,
+// one token per virtual node.
+const RingTokens = "ring_tokens"
+
+// DefaultVirtualNodes is how many tokens a server without published tokens gets on a Ring.
+const DefaultVirtualNodes = 32
+
+// TokenFunc returns the tokens of an instance, e.g. tcp@10.0.0.1:8972.
+type TokenFunc func(instance string) []uint32
+
+// VirtualNodes returns a TokenFunc of n tokens hashed from the instance,
+// so that an instance gets the same tokens after restarts.
+func VirtualNodes(n int) TokenFunc {
+	return func(instance string) []uint32 {
+		tokens := make([]uint32, n)
+		for i := range tokens {
+			tokens[i] = RingHash(instance + "#" + strconv.Itoa(i))
+		}
+		return tokens
+	}
+}
+
+// RingHash hashes a key onto the ring.
+func RingHash(key string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum>>32) ^ uint32(sum)
+}
+
+// SetRingTokens sets the tokens in v, it deletes the field if there are no tokens.
+func SetRingTokens(v url.Values, tokens []uint32) {
+	if len(tokens) == 0 {
+		v.Del(RingTokens)
+		return
+	}
+	s := make([]string, len(tokens))
+	for i, t := range tokens {
+		s[i] = strconv.FormatUint(uint64(t), 16)
+	}
+	v.Set(RingTokens, strings.Join(s, ","))
+}
+
+// RingTokensOf returns the tokens in the metadata, the invalid tokens are ignored.
+func RingTokensOf(metadata string) []uint32 {
+	var tokens []uint32
+	for _, s := range strings.Split(Parse(metadata).Get(RingTokens), ",") {
+		if t, err := strconv.ParseUint(strings.TrimSpace(s), 16, 32); err == nil {
+			tokens = append(tokens, uint32(t))
+		}
+	}
+	return tokens
+}
+
+// Ring is a consistent-hash ring of servers for the key affinity of stateful services.
+// Every server owns the keys hashed between the previous token and its tokens.
+type Ring struct {
+	tokens  []uint32
+	owners  []string
+	servers int
+}
+
+// NewRing assembles the ring of the healthy servers, which are keyed and valued as rpcx Selector.UpdateServer
+// receives them. The servers without published tokens get DefaultVirtualNodes tokens hashed from their keys.
+// If servers publish the same token, the smallest key owns it, so that all clients assemble the same ring.
+func NewRing(servers map[string]string) *Ring {
+	type point struct {
+		token uint32
+		owner string
+	}
+	var points []point
+	r := &Ring{}
+	for key, metadata := range servers {
+		if h := HintsOf(metadata); !h.Healthy || h.Weight == 0 {
+			continue
+		}
+		tokens := RingTokensOf(metadata)
+		if len(tokens) == 0 {
+			tokens = VirtualNodes(DefaultVirtualNodes)(key)
+		}
+		for _, t := range tokens {
+			points = append(points, point{token: t, owner: key})
+		}
+		r.servers++
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].token != points[j].token {
+			return points[i].token < points[j].token
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	for i, p := range points {
+		if i > 0 && p.token == points[i-1].token {
+			continue
+		}
+		r.tokens = append(r.tokens, p.token)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// Servers returns the number of servers on the ring.
+func (r *Ring) Servers() int {
+	return r.servers
+}
+
+// Get returns the server owning the key, false if the ring is empty.
+func (r *Ring) Get(key string) (string, bool) {
+	owners := r.GetN(key, 1)
+	if len(owners) == 0 {
+		return "", false
+	}
+	return owners[0], true
+}
+
+// GetN returns up to n distinct servers of the key clockwise from its owner, e.g. for its replicas.
+func (r *Ring) GetN(key string, n int) []string {
+	if len(r.tokens) == 0 || n <= 0 {
+		return nil
+	}
+	if n > r.servers {
+		n = r.servers
+	}
+
+	h := RingHash(key)
+	i := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i] >= h })
+	owners := make([]string, 0, n)
+	for j := 0; j < len(r.tokens) && len(owners) < n; j++ {
+		owner := r.owners[(i+j)%len(r.tokens)]
+		if !containsString(owners, owner) {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
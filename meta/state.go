@@ -0,0 +1,32 @@
+package meta
+
+// States of a server published in the state field.
+const (
+	// StateActive is the state of a server which receives traffic, it is the default.
+	StateActive = "active"
+	// StatePaused is the state of a server which temporarily receives no traffic, e.g. during maintenance.
+	StatePaused = "paused"
+	// StateDraining is the state of a server which receives no new traffic and is going away.
+	StateDraining = "draining"
+	// StateInactive is the state rpcx uses for a server which should not receive traffic.
+	StateInactive = "inactive"
+	// StateRemoved is the state of a tombstone left by an unregistered server, see Tombstone.
+	StateRemoved = "removed"
+)
+
+// StateOf returns the state in the metadata, StateActive if it is not published.
+func StateOf(metadata string) string {
+	if state := Parse(metadata).Get(State); state != "" {
+		return state
+	}
+	return StateActive
+}
+
+// Serving reports whether a server in the state should receive new traffic.
+func Serving(state string) bool {
+	switch state {
+	case StatePaused, StateDraining, StateInactive, StateRemoved:
+		return false
+	}
+	return true
+}
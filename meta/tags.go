@@ -0,0 +1,43 @@
+package meta
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Tags is the field of the comma separated tags of a server, the same as consul service tags.
+const Tags = "tags"
+
+// TagsOf returns the tags in the metadata.
+func TagsOf(metadata string) []string {
+	return splitTags(Parse(metadata).Get(Tags))
+}
+
+// SetTags sets the tags in v, it deletes the field if there are no tags.
+func SetTags(v url.Values, tags []string) {
+	if len(tags) == 0 {
+		v.Del(Tags)
+		return
+	}
+	v.Set(Tags, strings.Join(tags, ","))
+}
+
+// HasTag reports whether the metadata has the tag.
+func HasTag(metadata, tag string) bool {
+	for _, t := range TagsOf(metadata) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,29 @@
+package meta
+
+import (
+	"net/url"
+	"time"
+)
+
+// Expires is the field of the time when a tombstone expires, in RFC 3339 format.
+const Expires = "expires"
+
+// Tombstone returns the metadata of a tombstone which replaces the key of an unregistered server until expires,
+// so that the discoveries drop the server even if they see an older value of the key later.
+func Tombstone(expires time.Time) string {
+	v := url.Values{}
+	v.Set(State, StateRemoved)
+	v.Set(Expires, expires.UTC().Format(time.RFC3339))
+	return v.Encode()
+}
+
+// TombstoneOf returns when the tombstone in the metadata expires, ok is false if it isn't a tombstone.
+// The expiry is zero if it is not published or malformed.
+func TombstoneOf(metadata string) (expires time.Time, ok bool) {
+	v := Parse(metadata)
+	if v.Get(State) != StateRemoved {
+		return time.Time{}, false
+	}
+	expires, _ = time.Parse(time.RFC3339, v.Get(Expires))
+	return expires, true
+}
@@ -0,0 +1,36 @@
+package meta
+
+import (
+	"net/url"
+	"time"
+)
+
+// StartTime is the field of the time when the server started, in RFC 3339 format.
+const StartTime = "start_time"
+
+// SetStartTime sets the start time in v.
+func SetStartTime(v url.Values, t time.Time) {
+	v.Set(StartTime, t.UTC().Format(time.RFC3339))
+}
+
+// StartTimeOf returns the start time in the metadata.
+func StartTimeOf(metadata string) (time.Time, bool) {
+	s := Parse(metadata).Get(StartTime)
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// UptimeOf returns how long the server has been running according to the metadata.
+func UptimeOf(metadata string) (time.Duration, bool) {
+	t, ok := StartTimeOf(metadata)
+	if !ok {
+		return 0, false
+	}
+	return time.Since(t), true
+}
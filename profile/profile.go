@@ -0,0 +1,58 @@
+// Package profile defines tuned settings for typical deployments, which can be applied to
+// the discovery with client.WithProfile and to the register plugin with serverplugin.WithConsulProfile.
+package profile
+
+import "time"
+
+// Profile bundles the settings which are easy to get wrong.
+type Profile struct {
+	Name string
+
+	// backoff of re-watching consul after a watch fails
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// buffer size of the chans returned by WatchService
+	WatchBuffer int
+	// StaleReads serves the reads of discoveries by any consul server instead of the leader,
+	// it is applied if the discovery uses a consulkv.Store
+	StaleReads bool
+
+	// heartbeat interval and extra TTL of the registered services
+	UpdateInterval time.Duration
+	Expired        time.Duration
+}
+
+var (
+	// ProfileSmallCluster is for a few dozens of servers, it favors fresh results.
+	ProfileSmallCluster = Profile{
+		Name:           "small-cluster",
+		BackoffMin:     500 * time.Millisecond,
+		BackoffMax:     5 * time.Second,
+		WatchBuffer:    10,
+		UpdateInterval: 10 * time.Second,
+		Expired:        10 * time.Second,
+	}
+
+	// ProfileLargeFleet is for thousands of servers and clients, it protects consul servers
+	// with stale reads, longer backoff and less frequent heartbeats.
+	ProfileLargeFleet = Profile{
+		Name:           "large-fleet",
+		BackoffMin:     2 * time.Second,
+		BackoffMax:     time.Minute,
+		WatchBuffer:    64,
+		StaleReads:     true,
+		UpdateInterval: 30 * time.Second,
+		Expired:        30 * time.Second,
+	}
+
+	// ProfileLowLatency reacts fast to changes and failures.
+	ProfileLowLatency = Profile{
+		Name:           "low-latency",
+		BackoffMin:     100 * time.Millisecond,
+		BackoffMax:     2 * time.Second,
+		WatchBuffer:    32,
+		StaleReads:     true,
+		UpdateInterval: 5 * time.Second,
+		Expired:        5 * time.Second,
+	}
+)
@@ -0,0 +1,190 @@
+// Package replicator mirrors the servers registered in one consul datacenter into the KV of another one,
+// for the deployments which cannot enable the native replication of consul.
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// Replicator watches the servers under a base path in the source datacenter and mirrors them
+// into the target datacenter. The replicas carry their provenance (meta.Provenance) and the datacenter
+// they registered in (meta.Datacenter), so that clients in the target datacenter can tell them apart.
+//
+// Only the server keys like Arith/tcp@10.0.0.1:8972 are replicated. The servers registered in the target
+// datacenter are never overwritten, and the replicas of the servers of the target datacenter are not replicated
+// back, so that two replicators in opposite directions don't loop. The replicas are deleted when their servers
+// are gone from the source datacenter, but they stay if the replicator stops.
+type Replicator struct {
+	source, target     store.Store
+	sourceDC, targetDC string
+	prefix             string
+
+	// Hook is called with the failures of the watches and the number of replicated servers after every sync
+	Hook hook.EventHook
+}
+
+// Option configures a Replicator.
+type Option func(*Replicator)
+
+// WithEventHook calls h with the failures and the number of replicated servers.
+func WithEventHook(h hook.EventHook) Option {
+	return func(r *Replicator) {
+		r.Hook = h
+	}
+}
+
+// New returns a Replicator from the base path of source in sourceDC to the same base path of target in targetDC.
+func New(source store.Store, sourceDC string, target store.Store, targetDC, basePath string, opts ...Option) (*Replicator, error) {
+	if sourceDC == "" || targetDC == "" {
+		return nil, errors.New("datacenters can't be empty")
+	}
+	if sourceDC == targetDC {
+		return nil, fmt.Errorf("can't replicate datacenter %s into itself", sourceDC)
+	}
+	r := &Replicator{
+		source:   source,
+		target:   target,
+		sourceDC: sourceDC,
+		targetDC: targetDC,
+		prefix:   strings.Trim(basePath, "/") + "/",
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// Run replicates the servers every time they change until ctx is done.
+// The watch is retried after failures, and Run returns the error of ctx.
+func (r *Replicator) Run(ctx context.Context) error {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	for {
+		c, err := r.source.WatchTree(r.prefix, stopCh)
+		if err == nil {
+			r.follow(ctx, c)
+		} else {
+			r.failed(fmt.Errorf("cannot watch %s in %s: %w", r.prefix, r.sourceDC, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// follow syncs every update of the watch until it or ctx is done.
+func (r *Replicator) follow(ctx context.Context, c <-chan []*store.KVPair) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pairs, ok := <-c:
+			if !ok {
+				return
+			}
+			if err := r.Sync(pairs); err != nil {
+				r.failed(err)
+			}
+		}
+	}
+}
+
+func (r *Replicator) failed(err error) {
+	log.Warnf("replicator from %s to %s: %v", r.sourceDC, r.targetDC, err)
+	if r.Hook != nil {
+		r.Hook.WatchError(r.prefix, err)
+	}
+}
+
+// Sync mirrors the pairs listed under the base path in the source datacenter into the target datacenter once.
+func (r *Replicator) Sync(pairs []*store.KVPair) error {
+	existing, err := r.target.List(r.prefix)
+	if err != nil && err != store.ErrKeyNotFound {
+		return fmt.Errorf("cannot list %s in %s: %w", r.prefix, r.targetDC, err)
+	}
+	current := make(map[string]string, len(existing))
+	for _, p := range existing {
+		current[p.Key] = string(p.Value)
+	}
+
+	replicas := make(map[string]string)
+	for _, p := range pairs {
+		if key, value, ok := r.replica(p); ok {
+			replicas[key] = value
+		}
+	}
+
+	var errs []string
+	for key, value := range replicas {
+		old, ok := current[key]
+		if ok && (old == value || !meta.ProvenanceOf(old).IsReplica()) {
+			continue
+		}
+		if err := r.target.Put(key, []byte(value), nil); err != nil {
+			errs = append(errs, fmt.Sprintf("put %s: %v", key, err))
+		}
+	}
+	for key, value := range current {
+		if _, ok := replicas[key]; ok || meta.ProvenanceOf(value).Via != r.sourceDC {
+			continue
+		}
+		if err := r.target.Delete(key); err != nil && err != store.ErrKeyNotFound {
+			errs = append(errs, fmt.Sprintf("delete %s: %v", key, err))
+		}
+	}
+
+	if r.Hook != nil {
+		r.Hook.ServicesUpdated(r.prefix, len(replicas))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot replicate into %s: %s", r.targetDC, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// replica returns the key and the value of the replica of a server in the target datacenter,
+// false if the pair is not a server or the server is from the target datacenter.
+func (r *Replicator) replica(p *store.KVPair) (string, string, bool) {
+	key := strings.TrimPrefix(p.Key, "/")
+	if !strings.HasPrefix(key, r.prefix) {
+		return "", "", false
+	}
+	rel := key[len(r.prefix):]
+	i := strings.LastIndex(rel, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+	if _, _, _, err := meta.SplitKey(rel[i+1:]); err != nil {
+		return "", "", false
+	}
+
+	metadata := string(p.Value)
+	provenance := meta.ProvenanceOf(metadata)
+	if provenance.From == r.targetDC {
+		return "", "", false
+	}
+	if provenance.From == "" {
+		provenance.From = r.sourceDC
+	}
+	provenance.Via = r.sourceDC
+
+	v := meta.Parse(metadata)
+	provenance.Set(v)
+	if v.Get(meta.Datacenter) == "" {
+		v.Set(meta.Datacenter, provenance.From)
+	}
+	return r.prefix + rel, v.Encode(), true
+}
@@ -0,0 +1,141 @@
+package replicator
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+type memStore struct {
+	store.Store
+	mu      sync.Mutex
+	data    map[string]string
+	watchCh chan []*store.KVPair
+}
+
+func newMemStore(data map[string]string) *memStore {
+	if data == nil {
+		data = make(map[string]string)
+	}
+	return &memStore{data: data, watchCh: make(chan []*store.KVPair)}
+}
+
+func (s *memStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = string(value)
+	return nil
+}
+
+func (s *memStore) value(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memStore) List(directory string) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pairs []*store.KVPair
+	for k, v := range s.data {
+		if strings.HasPrefix(k, directory) {
+			pairs = append(pairs, &store.KVPair{Key: k, Value: []byte(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+func (s *memStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchCh, nil
+}
+
+func TestSync(t *testing.T) {
+	source := newMemStore(map[string]string{
+		"rpcx/Arith":                     "",
+		"rpcx/Arith/tcp@10.0.0.1:8972":   "group=a",
+		"rpcx/Arith/tcp@10.0.0.2:8972":   "group=b",
+		"rpcx/Arith/tcp@10.0.1.1:8972":   "replicated_from=dc2&replicated_via=dc2",
+		"rpcx/Echo/tcp@10.0.0.3:8972":    "replicated_from=dc3&replicated_via=dc3",
+		"rpcx/schema/Arith":              `{"methods":[]}`,
+		"rpcx_other/Arith/tcp@1.1.1.1:1": "",
+	})
+	target := newMemStore(map[string]string{
+		// registered in dc2
+		"rpcx/Arith/tcp@10.0.0.2:8972": "group=local",
+		// the server is gone from dc1
+		"rpcx/Arith/tcp@10.0.0.9:8972": "replicated_from=dc1&replicated_via=dc1",
+	})
+	r, err := New(source, "dc1", target, "dc2", "/rpcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, _ := source.List("")
+	if err := r.Sync(pairs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"rpcx/Arith/tcp@10.0.0.1:8972": "dc=dc1&group=a&replicated_from=dc1&replicated_via=dc1",
+		"rpcx/Arith/tcp@10.0.0.2:8972": "group=local",
+		"rpcx/Echo/tcp@10.0.0.3:8972":  "dc=dc3&replicated_from=dc3&replicated_via=dc1",
+	}
+	if len(target.data) != len(want) {
+		t.Fatalf("unexpected replicas %v", target.data)
+	}
+	for k, v := range want {
+		if got := target.data[k]; got != v {
+			t.Fatalf("expected %s=%s but got %s", k, v, got)
+		}
+	}
+
+	if p := meta.ProvenanceOf(target.data["rpcx/Echo/tcp@10.0.0.3:8972"]); p.From != "dc3" || p.Via != "dc1" || !p.IsReplica() {
+		t.Fatalf("unexpected provenance %+v", p)
+	}
+	if _, err := New(source, "dc1", target, "dc1", "rpcx"); err == nil {
+		t.Fatal("expect error of replicating into the same datacenter")
+	}
+}
+
+func TestRun(t *testing.T) {
+	source, target := newMemStore(nil), newMemStore(nil)
+	r, _ := New(source, "dc1", target, "dc2", "rpcx")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	source.watchCh <- []*store.KVPair{{Key: "rpcx/Arith/tcp@10.0.0.1:8972"}}
+	source.watchCh <- []*store.KVPair{}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := target.value("rpcx/Arith/tcp@10.0.0.1:8972"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replica is not deleted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
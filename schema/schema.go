@@ -0,0 +1,87 @@
+// Package schema describes the methods of rpcx services, which are published to consul
+// by the register plugin so that gateways and docs tooling can introspect the services.
+package schema
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rpcxio/rpcx-consul/admin"
+)
+
+// Method is a rpcx method.
+type Method struct {
+	Name string `json:"name"`
+	// types of the args and the reply
+	Args  string `json:"args"`
+	Reply string `json:"reply"`
+}
+
+// Service is the method list of a rpcx service.
+type Service struct {
+	Name    string   `json:"name"`
+	Methods []Method `json:"methods"`
+}
+
+// Key returns the key of the schema of the service under basePath.
+// The schemas are kept under the administrative prefix, so that they never show up as servers
+// or collide with a service named schema.
+func Key(basePath, service string) string {
+	return Dir(basePath) + "/" + service
+}
+
+// Dir returns the directory of the schemas of the services under basePath, e.g. _rpcx_admin/schema/rpcx.
+func Dir(basePath string) string {
+	return admin.Prefix + "/schema/" + strings.Trim(basePath, "/")
+}
+
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// Methods returns the exported rpcx methods of the receiver, sorted by name.
+func Methods(rcvr interface{}) []Method {
+	typ := reflect.TypeOf(rcvr)
+
+	var methods []Method
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		if m.PkgPath != "" { // unexported
+			continue
+		}
+		// receiver, ctx, args, reply
+		if method, ok := fromFunc(m.Name, m.Type, 1); ok {
+			methods = append(methods, method)
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods
+}
+
+// Function returns the rpcx method of the function, it reports false if fn is not a rpcx function.
+func Function(name string, fn interface{}) (Method, bool) {
+	typ := reflect.TypeOf(fn)
+	if typ == nil || typ.Kind() != reflect.Func {
+		return Method{}, false
+	}
+	return fromFunc(name, typ, 0)
+}
+
+// fromFunc checks the signature func(ctx context.Context, args *Args, reply *Reply) error,
+// skipping the first skip parameters.
+func fromFunc(name string, typ reflect.Type, skip int) (Method, bool) {
+	if typ.NumIn() != 3+skip || typ.NumOut() != 1 || typ.Out(0) != typeOfError {
+		return Method{}, false
+	}
+	if !typ.In(skip).Implements(typeOfContext) {
+		return Method{}, false
+	}
+	reply := typ.In(skip + 2)
+	if reply.Kind() != reflect.Ptr {
+		return Method{}, false
+	}
+	return Method{Name: name, Args: typ.In(skip + 1).String(), Reply: reply.String()}, true
+}
@@ -0,0 +1,50 @@
+package schema
+
+import (
+	"context"
+	"testing"
+)
+
+type Args struct{ A, B int }
+
+type Reply struct{ C int }
+
+type Arith int
+
+func (t *Arith) Mul(ctx context.Context, args *Args, reply *Reply) error { return nil }
+
+func (t *Arith) Add(ctx context.Context, args Args, reply *Reply) error { return nil }
+
+func (t *Arith) Helper() {}
+
+func mul(ctx context.Context, args *Args, reply *Reply) error { return nil }
+
+func TestMethods(t *testing.T) {
+	methods := Methods(new(Arith))
+	if len(methods) != 2 {
+		t.Fatalf("expect 2 methods but got %v", methods)
+	}
+	if methods[0] != (Method{Name: "Add", Args: "schema.Args", Reply: "*schema.Reply"}) {
+		t.Fatalf("unexpected method: %v", methods[0])
+	}
+	if methods[1] != (Method{Name: "Mul", Args: "*schema.Args", Reply: "*schema.Reply"}) {
+		t.Fatalf("unexpected method: %v", methods[1])
+	}
+
+	m, ok := Function("mul", mul)
+	if !ok || m.Args != "*schema.Args" {
+		t.Fatalf("unexpected function: %v", m)
+	}
+	if _, ok := Function("helper", func() {}); ok {
+		t.Fatal("helper is not a rpcx function")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if key := Key("/rpcx/", "schema"); key != "_rpcx_admin/schema/rpcx/schema" {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if dir := Dir("rpcx"); dir != "_rpcx_admin/schema/rpcx" {
+		t.Fatalf("unexpected dir %s", dir)
+	}
+}
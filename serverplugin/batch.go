@@ -0,0 +1,63 @@
+package serverplugin
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithConsulBatchHeartbeats writes the keys of all services in consul transactions of at most size operations
+// at every heartbeat instead of one write per service, 64 if size is not positive. It requires the store to
+// support consul sessions, the keys are held by a session with the TTL of the keys (at least 10s).
+func WithConsulBatchHeartbeats(size int) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.BatchHeartbeats = true
+		o.BatchSize = size
+	}
+}
+
+// refreshBatch writes the metadata and the metrics of all services in transactions.
+// The keys are held by the session, so they are written without reading them first.
+func (p *ConsulRegisterPlugin) refreshBatch(extra map[string]string) {
+	now := time.Now()
+	var (
+		names []string
+		pairs []*store.KVPair
+	)
+	for _, name := range p.services() {
+		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+		if !p.inWindow(name, now) {
+			p.leaveWindow(name, nodePath)
+			continue
+		}
+
+		p.metasLock.RLock()
+		v, _ := url.ParseQuery(p.metas[name])
+		p.metasLock.RUnlock()
+		for key, value := range extra {
+			v.Set(key, value)
+		}
+		p.refreshWeight(name, v)
+		names = append(names, name)
+		pairs = append(pairs, &store.KVPair{Key: nodePath, Value: []byte(v.Encode())})
+	}
+	if len(pairs) == 0 {
+		return
+	}
+
+	err := p.putAll(pairs, nil)
+	if err != nil {
+		if p.PartitionRecovery {
+			p.partitionedSince = time.Now()
+			log.Warnf("consul is unreachable, services will be re-registered after it recovers: %v", err)
+		} else {
+			log.Errorf("cannot write %d services in transactions: %v", len(pairs), err)
+		}
+	}
+	for _, name := range names {
+		p.heartbeat(name, err)
+	}
+}
@@ -0,0 +1,206 @@
+package serverplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/admin"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// PluginConfig is the settings of ConsulRegisterPlugin which can be changed at runtime by ApplyConfig.
+// Zero durations, nil metadata and an empty token keep the current settings.
+type PluginConfig struct {
+	UpdateInterval time.Duration
+	Expired        time.Duration
+
+	// defaults of the well-known metadata fields of all services
+	Ownership *meta.Ownership
+	Capacity  *meta.Capacity
+	Ports     *meta.Ports
+	// state of all services, e.g. meta.StatePaused
+	State string
+
+	// ACL token, it can only be changed if the plugin is created with ConsulConfig
+	Token string
+}
+
+// String describes the config with the token redacted, so that it can be logged.
+func (c PluginConfig) String() string {
+	token := c.Token
+	if token != "" {
+		token = meta.Redacted
+	}
+	return fmt.Sprintf("{UpdateInterval:%v Expired:%v Ownership:%+v Capacity:%+v Ports:%+v State:%s Token:%s}",
+		c.UpdateInterval, c.Expired, c.Ownership, c.Capacity, c.Ports, c.State, token)
+}
+
+// tokenSetter is implemented by the stores whose ACL token can be changed, such as consulkv.Store.
+type tokenSetter interface {
+	SetToken(token string)
+}
+
+// ttl returns the TTL of the registered keys.
+func (p *ConsulRegisterPlugin) ttl() time.Duration {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.UpdateInterval + p.Expired
+}
+
+// ApplyConfig updates the settings without restarting the plugin.
+// The services are registered again only if their metadata or TTL changes.
+func (p *ConsulRegisterPlugin) ApplyConfig(cfg PluginConfig) error {
+	if cfg.Token != "" {
+		ts, ok := p.kv.(tokenSetter)
+		if !ok {
+			return errors.New("token can only be changed if the plugin is created with ConsulConfig")
+		}
+		ts.SetToken(cfg.Token)
+	}
+
+	p.configMu.Lock()
+	oldTTL := p.UpdateInterval + p.Expired
+	intervalChanged := cfg.UpdateInterval > 0 && cfg.UpdateInterval != p.UpdateInterval
+	if cfg.UpdateInterval > 0 {
+		p.UpdateInterval = cfg.UpdateInterval
+	}
+	if cfg.Expired > 0 {
+		p.Expired = cfg.Expired
+	}
+	ttl := p.UpdateInterval + p.Expired
+	interval := p.UpdateInterval
+	if cfg.Ownership != nil {
+		p.Ownership = *cfg.Ownership
+	}
+	if cfg.Capacity != nil {
+		p.Capacity = *cfg.Capacity
+	}
+	if cfg.Ports != nil {
+		p.Ports = *cfg.Ports
+	}
+	if cfg.State != "" {
+		p.State = cfg.State
+	}
+	p.configMu.Unlock()
+
+	if intervalChanged && p.intervalCh != nil {
+		select { // replace the pending interval which is not applied yet
+		case <-p.intervalCh:
+		default:
+		}
+		p.intervalCh <- interval
+	}
+
+	if p.kv == nil {
+		return nil
+	}
+	return p.reregister(ttl != oldTTL, ttl)
+}
+
+// SetState publishes the state of all services, e.g. meta.StatePaused to stop receiving traffic
+// from the clients which filter servers by their states and meta.StateActive to resume.
+func (p *ConsulRegisterPlugin) SetState(state string) error {
+	if state == "" {
+		return errors.New("state can't be empty")
+	}
+	return p.ApplyConfig(PluginConfig{State: state})
+}
+
+// AnnounceShutdown publishes the draining state of all services and waits for delay,
+// so that the clients stop selecting this server before the services are deregistered and its listener closes.
+// delay should cover how long the state takes to propagate to the clients, e.g. a few watch round trips.
+// Call it before shutting down the server.
+func (p *ConsulRegisterPlugin) AnnounceShutdown(delay time.Duration) error {
+	if err := p.SetState(meta.StateDraining); err != nil {
+		log.Errorf("cannot announce the shutdown: %v", err)
+		return err
+	}
+	log.Infof("announced the shutdown, wait %v for the clients to stop selecting %s", delay, p.ServiceAddress)
+	time.Sleep(delay)
+	return nil
+}
+
+// reregister registers the services whose metadata changes again, or all of them if ttlChanged.
+func (p *ConsulRegisterPlugin) reregister(ttlChanged bool, ttl time.Duration) error {
+	p.metasLock.Lock()
+	var pairs []*store.KVPair
+	for _, name := range p.Services {
+		metadata := p.withMetadata(name, p.userMetas[name])
+		if metadata == p.metas[name] && !ttlChanged {
+			continue
+		}
+		p.metas[name] = metadata
+		if !p.inWindow(name, time.Now()) {
+			continue
+		}
+		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+		pairs = append(pairs, &store.KVPair{Key: nodePath, Value: []byte(metadata)})
+	}
+	p.metasLock.Unlock()
+
+	if len(pairs) == 0 {
+		return nil
+	}
+	if err := p.putAll(pairs, &store.WriteOptions{TTL: ttl}); err != nil {
+		return err
+	}
+	log.Infof("registered %d services again after the config changed", len(pairs))
+	p.saveState()
+	return nil
+}
+
+// scopeVerifier is implemented by the stores which can introspect their ACL token, such as consulkv.Store.
+type scopeVerifier interface {
+	VerifyTokenScope(basePath string) ([]string, error)
+}
+
+// verifyTokenScope warns once if the ACL token can write beyond BasePath.
+func (p *ConsulRegisterPlugin) verifyTokenScope() {
+	if !p.VerifyTokenScope {
+		return
+	}
+	p.verifyTokenOnce.Do(func() {
+		v, ok := p.kv.(scopeVerifier)
+		if !ok {
+			log.Warn("cannot verify the scope of the consul token without ConsulConfig")
+			return
+		}
+		problems, err := v.VerifyTokenScope(p.BasePath)
+		if err != nil {
+			log.Warnf("cannot verify the scope of the consul token: %v", err)
+			return
+		}
+		for _, problem := range problems {
+			log.Warnf("consul token is overly broad for %s: %s", p.BasePath, problem)
+		}
+	})
+}
+
+// consulClient is implemented by the stores backed by the consul api client, such as consulkv.Store.
+type consulClient interface {
+	Client() *api.Client
+}
+
+// AcquireRestartSlot blocks until one of the maxConcurrent restart slots of BasePath is free and holds it,
+// see admin.AcquireRestartSlot. Release the slot after the restart, e.g. once the services are registered again.
+// It requires ConsulConfig.
+func (p *ConsulRegisterPlugin) AcquireRestartSlot(ctx context.Context, maxConcurrent int) (*admin.RestartSlot, error) {
+	if p.kv == nil {
+		kv, err := p.newStore()
+		if err != nil {
+			log.Errorf("cannot create consul registry: %v", err)
+			return nil, err
+		}
+		p.kv = kv
+	}
+	c, ok := p.kv.(consulClient)
+	if !ok {
+		return nil, errors.New("restart slots require ConsulConfig")
+	}
+	return admin.AcquireRestartSlot(ctx, c.Client(), p.BasePath, maxConcurrent)
+}
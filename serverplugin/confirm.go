@@ -0,0 +1,119 @@
+package serverplugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/rpcxio/libkv/store"
+)
+
+// backoff of the reads confirming a registration
+const (
+	minConfirmBackoff = 20 * time.Millisecond
+	maxConfirmBackoff = time.Second
+)
+
+// Confirmation is the proof returned by RegisterAndConfirm that a registration is visible to the readers of consul.
+type Confirmation struct {
+	// Key is the KV key or the consul service ID of the registration
+	Key string
+	// Index is the consul index the registration was read at
+	Index uint64
+	// Reads is how many reads it took to see the registration
+	Reads int
+	// Elapsed is how long the write and the reads took
+	Elapsed time.Duration
+}
+
+// confirm reads the registration of key until read sees it or ctx is done.
+func confirm(ctx context.Context, key string, start time.Time, read func() (uint64, bool, error)) (*Confirmation, error) {
+	backoff := minConfirmBackoff
+	var lastErr error
+	for reads := 1; ; reads++ {
+		index, ok, err := read()
+		if ok {
+			return &Confirmation{Key: key, Index: index, Reads: reads, Elapsed: time.Since(start)}, nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return nil, fmt.Errorf("registration %s is not confirmed after %d reads: %w (last error: %v)", key, reads, ctx.Err(), lastErr)
+			}
+			return nil, fmt.Errorf("registration %s is not confirmed after %d reads: %w", key, reads, ctx.Err())
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxConfirmBackoff {
+			backoff = maxConfirmBackoff
+		}
+	}
+}
+
+// RegisterAndConfirm registers the service like Register, and then reads its key until it is visible
+// with the metadata, through ConfirmStore if it is set. It returns an error if ctx is done before,
+// so that deployment pipelines know the service is discoverable when it returns.
+func (p *ConsulRegisterPlugin) RegisterAndConfirm(ctx context.Context, name string, rcvr interface{}, metadata string) (*Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	written, err := p.register(name, rcvr, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if !p.inWindow(name, time.Now()) {
+		return nil, fmt.Errorf("service %s is not registered outside its windows", name)
+	}
+
+	kv := p.ConfirmStore
+	if kv == nil {
+		kv = p.kv
+	}
+	key := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	return confirm(ctx, key, start, func() (uint64, bool, error) {
+		pair, err := kv.Get(key)
+		if err == store.ErrKeyNotFound {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return pair.LastIndex, string(pair.Value) == written, nil
+	})
+}
+
+// RegisterAndConfirm registers the service like Register, and then reads the health of the service until
+// it is listed as passing, which is what the clients discover, with stale reads if ConfirmStale is set. It returns an error if ctx is done before,
+// so that deployment pipelines know the service is discoverable when it returns.
+func (p *ConsulServiceRegisterPlugin) RegisterAndConfirm(ctx context.Context, name string, rcvr interface{}, metadata string) (*Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := p.Register(name, rcvr, metadata); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	id := p.serviceID(name)
+	opts := (&api.QueryOptions{AllowStale: p.ConfirmStale}).WithContext(ctx)
+	return confirm(ctx, id, start, func() (uint64, bool, error) {
+		entries, qm, err := client.Health().Service(name, "", true, opts)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, e := range entries {
+			if e.Service != nil && e.Service.ID == id {
+				return qm.LastIndex, true, nil
+			}
+		}
+		return 0, false, nil
+	})
+}
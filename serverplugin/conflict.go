@@ -0,0 +1,127 @@
+package serverplugin
+
+import (
+	"fmt"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// maxCASRetries is how many times a key is read and written again when it is modified concurrently.
+const maxCASRetries = 5
+
+// ConflictPolicy resolves the value of the key of a service when it was modified by others since the plugin
+// wrote it, e.g. by admin tooling pausing the server. base is the value the plugin wanted at its last write,
+// ours is the value it wants now and theirs is the value in consul.
+type ConflictPolicy interface {
+	Resolve(key, base, ours, theirs string) string
+}
+
+// ConflictPolicyFunc is an adapter to use a function as a ConflictPolicy.
+type ConflictPolicyFunc func(key, base, ours, theirs string) string
+
+// Resolve calls f.
+func (f ConflictPolicyFunc) Resolve(key, base, ours, theirs string) string {
+	return f(key, base, ours, theirs)
+}
+
+var (
+	// OwnerWins overwrites the modifications of others with the value of the plugin.
+	OwnerWins ConflictPolicy = ConflictPolicyFunc(func(key, base, ours, theirs string) string {
+		return ours
+	})
+
+	// LatestWins keeps the modifications of others until the plugin changes the value it wants,
+	// e.g. by UpdateServiceMetadata or ApplyConfig. Note that the heartbeat metrics change it at every heartbeat.
+	LatestWins ConflictPolicy = ConflictPolicyFunc(func(key, base, ours, theirs string) string {
+		if ours != base {
+			return ours
+		}
+		return theirs
+	})
+
+	// MergeMetadata keeps the metadata fields modified by others and takes the other fields from the plugin.
+	MergeMetadata ConflictPolicy = ConflictPolicyFunc(mergeMetadata)
+)
+
+// mergeMetadata merges the fields of theirs which differ from base into ours.
+func mergeMetadata(key, base, ours, theirs string) string {
+	b, o, t := meta.Parse(base), meta.Parse(ours), meta.Parse(theirs)
+	changed := false
+	for k := range t {
+		if t.Get(k) != b.Get(k) {
+			o.Set(k, t.Get(k))
+			changed = true
+		}
+	}
+	for k := range b {
+		if _, ok := t[k]; !ok {
+			o.Del(k)
+			changed = true
+		}
+	}
+	if !changed {
+		return ours
+	}
+	return o.Encode()
+}
+
+// WithConsulConflictPolicy resolves the modifications of the keys of the services by others with policy,
+// the keys are written with CAS, so that the concurrent modifications are never lost.
+// It is not applied to the keys put with WithConsulSession.
+func WithConsulConflictPolicy(policy ConflictPolicy) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.ConflictPolicy = policy
+	}
+}
+
+// resolve returns the value to write to nodePath, theirs is the value in consul.
+func (p *ConsulRegisterPlugin) resolve(nodePath, ours, theirs string) string {
+	p.basesMu.Lock()
+	base, ok := p.bases[nodePath]
+	p.basesMu.Unlock()
+	// the key was not written by this process or not modified by others
+	if !ok || theirs == base || theirs == ours {
+		return ours
+	}
+	return p.ConflictPolicy.Resolve(nodePath, base, ours, theirs)
+}
+
+// setBase records the value the plugin wanted when it wrote nodePath.
+func (p *ConsulRegisterPlugin) setBase(nodePath, ours string) {
+	p.basesMu.Lock()
+	if p.bases == nil {
+		p.bases = make(map[string]string)
+	}
+	p.bases[nodePath] = ours
+	p.basesMu.Unlock()
+}
+
+// casNode writes the key of a service with CAS, resolving the modifications of others by ConflictPolicy.
+func (p *ConsulRegisterPlugin) casNode(nodePath string, value []byte) error {
+	ours := string(value)
+	for i := 0; i < maxCASRetries; i++ {
+		pair, err := p.kv.Get(nodePath)
+		if err == store.ErrKeyNotFound {
+			pair, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resolved := ours
+		if pair != nil {
+			resolved = p.resolve(nodePath, ours, string(pair.Value))
+		}
+		_, _, err = p.kv.AtomicPut(nodePath, []byte(resolved), pair, &store.WriteOptions{TTL: p.ttl()})
+		if err == store.ErrKeyModified || err == store.ErrKeyExists {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.setBase(nodePath, ours)
+		return nil
+	}
+	return fmt.Errorf("%s is modified concurrently %d times", nodePath, maxCASRetries)
+}
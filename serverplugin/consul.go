@@ -2,6 +2,7 @@ package serverplugin
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -11,9 +12,15 @@ import (
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
-	"github.com/rpcxio/libkv"
 	"github.com/rpcxio/libkv/store"
 	"github.com/rpcxio/libkv/store/consul"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/cloudmeta"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/rpcxio/rpcx-consul/profile"
+	"github.com/rpcxio/rpcx-consul/schema"
 	"github.com/smallnest/rpcx/log"
 )
 
@@ -30,15 +37,120 @@ type ConsulRegisterPlugin struct {
 	// base path for rpcx server, for example com/example/rpcx
 	BasePath string
 	Metrics  metrics.Registry
-	// Registered services
+	// Registered services, guarded by metasLock
 	Services       []string
 	metasLock      sync.RWMutex
 	metas          map[string]string
 	UpdateInterval time.Duration
 	Expired        time.Duration
 
+	// guards the settings changed by ApplyConfig
+	configMu sync.RWMutex
+	// metadata passed to Register, without the well-known fields added by the plugin
+	userMetas  map[string]string
+	intervalCh chan time.Duration
+
+	// owner, team and oncall contact published in the metadata of all services
+	Ownership meta.Ownership
+	// max_qps and max_concurrency hints published in the metadata of all services
+	Capacity meta.Capacity
+	// rpc, metrics and pprof ports published in the metadata of all services
+	Ports meta.Ports
+	// Weight of all services for the weighted selectors of rpcx, it is not published if zero.
+	// WeightFunc takes precedence and is called at every heartbeat, e.g. to lower the weight under load.
+	Weight     int
+	WeightFunc func() int
+	// tags of all services and of the individual services, published as meta.Tags
+	Tags        []string
+	ServiceTags map[string][]string
+	// metadata of the individual services, e.g. version, zone and protocol
+	ServiceMeta map[string]map[string]string
+	// routing hints of API gateways of the individual services
+	Ingress map[string]meta.Ingress
+	// HashRing publishes the tokens of the instance on the consistent-hash ring of all services,
+	// which the clients assemble by meta.NewRing for the key affinity of stateful services
+	HashRing meta.TokenFunc
+	// Windows of the individual services, they are only registered in their windows
+	Windows map[string][]Window
+	// State is published in the metadata of all services, e.g. meta.StatePaused, it is not published if empty.
+	// It overrides the state set in the metadata passed to Register.
+	State string
+	// PublishBuildInfo publishes the module version, VCS revision and Go version in the metadata of all services
+	PublishBuildInfo bool
+	// PublishStartTime publishes the start time of the process in the metadata of all services
+	PublishStartTime bool
+	// PublishHostname publishes the hostname and the IP of the service address in the metadata of all services,
+	// the hostname of the host is used if Hostname is empty
+	PublishHostname bool
+	Hostname        string
+	// Enrichers read the metadata of the instance, e.g. its zone, before the first registration.
+	// The fields are published in the metadata of all services unless they are set explicitly.
+	Enrichers  []cloudmeta.Enricher
+	enrichOnce sync.Once
+	enriched   map[string]string
+
+	// Hook is called after every heartbeat, e.g. hook.NewMetricsHook(nil) to export metrics.
+	Hook hook.EventHook
+	// Jitter randomizes the heartbeats within JitterFraction of UpdateInterval, see WithConsulJitter.
+	Jitter         Jitter
+	JitterFraction float64
+
+	// Tombstone is how long the tombstones replacing the keys of the unregistered services last, zero deletes the keys
+	Tombstone time.Duration
+	// timers deleting the tombstones by key
+	tombstoneMu       sync.Mutex
+	tombstones        map[string]*time.Timer
+	tombstonesStopped bool
+
+	// ConflictPolicy resolves the modifications of the keys of the services by others, e.g. admin tooling.
+	// The keys are overwritten without CAS if it is nil.
+	ConflictPolicy ConflictPolicy
+	basesMu        sync.Mutex
+	bases          map[string]string
+
+	// results of the heartbeats of the services
+	statusMu sync.Mutex
+	status   map[string]*heartbeatStatus
+
+	// PublishSchema publishes the methods of registered services at schema.Key(BasePath, serviceName),
+	// which is outside of BasePath, so the ACL token has to be allowed to write schema.Dir(BasePath) too
+	PublishSchema bool
+	schemasLock   sync.Mutex
+	schemas       map[string]*schema.Service
+
+	// PartitionRecovery stops heartbeats when consul is unreachable and re-registers all services
+	// at once after it recovers, OnPartitionRecovered is called with how long they were invisible.
+	PartitionRecovery    bool
+	OnPartitionRecovered func(invisible time.Duration)
+	partitionedSince     time.Time
+
+	// VerifyTokenScope warns before the first write if the ACL token can write beyond BasePath,
+	// it requires ConsulConfig
+	VerifyTokenScope bool
+	verifyTokenOnce  sync.Once
+
+	// SessionTTL registers the services with a consul session of the TTL instead of the TTL of their keys,
+	// so consul deletes them once the process dies and stops renewing the session
+	SessionTTL time.Duration
+	sessionMu  sync.Mutex
+	session    *consulkv.Session
+
+	// BatchHeartbeats writes the keys of all services in consul transactions of at most BatchSize operations
+	// at every heartbeat, 64 if BatchSize is not positive. The keys are held by a consul session.
+	BatchHeartbeats bool
+	BatchSize       int
+
+	// StateFile persists the registered services and their metadata, so that a restarted process
+	// registers the same services (including the dynamically added ones) in Start
+	StateFile string
+
 	Options *store.Config
-	kv      store.Store
+	// consul settings which Options can't express, such as the ACL token
+	ConsulConfig *consulkv.Config
+	kv           store.Store
+	// ConfirmStore reads the registrations confirmed by RegisterAndConfirm, e.g. a store through another agent
+	// or with stale reads, so that the confirmation holds for the readers. The store of the plugin is used if nil.
+	ConfirmStore store.Store
 
 	dying chan struct{}
 	done  chan struct{}
@@ -82,6 +194,179 @@ func WithConsulOptions(options *store.Config) ConsulOpt {
 	}
 }
 
+func WithConsulConfig(config *consulkv.Config) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.ConsulConfig = config
+	}
+}
+
+func WithConsulPartitionRecovery(onRecovered func(invisible time.Duration)) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.PartitionRecovery = true
+		o.OnPartitionRecovered = onRecovered
+	}
+}
+
+func WithConsulOwnership(ownership meta.Ownership) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Ownership = ownership
+	}
+}
+
+func WithConsulCapacity(capacity meta.Capacity) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Capacity = capacity
+	}
+}
+
+func WithConsulPorts(ports meta.Ports) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Ports = ports
+	}
+}
+
+func WithConsulBuildInfo() ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.PublishBuildInfo = true
+	}
+}
+
+func WithConsulStartTime() ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.PublishStartTime = true
+	}
+}
+
+func WithConsulHostname(hostname string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.PublishHostname = true
+		o.Hostname = hostname
+	}
+}
+
+// WithConsulEventHook calls h after every heartbeat of the services.
+func WithConsulEventHook(h hook.EventHook) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Hook = h
+	}
+}
+
+// heartbeat records the heartbeat of service and reports it to the hook.
+func (p *ConsulRegisterPlugin) heartbeat(service string, err error) {
+	p.recordHeartbeat(service, err)
+	if p.Hook != nil {
+		p.Hook.Heartbeat(service, err)
+	}
+}
+
+// WithConsulEnrichers publishes the metadata of the instance read by the enrichers, e.g. &cloudmeta.AWS{}.
+func WithConsulEnrichers(enrichers ...cloudmeta.Enricher) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Enrichers = append(o.Enrichers, enrichers...)
+	}
+}
+
+// WithConsulSession registers the services with a consul session of the TTL, it requires the TTL
+// to be between 10s and 24h. The session is renewed in the background, the heartbeats only update the metadata.
+func WithConsulSession(ttl time.Duration) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.SessionTTL = ttl
+	}
+}
+
+func WithConsulStateFile(file string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.StateFile = file
+	}
+}
+
+// WithConsulProfile applies the heartbeat interval and TTL of the profile.
+func WithConsulProfile(pf profile.Profile) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.UpdateInterval = pf.UpdateInterval
+		o.Expired = pf.Expired
+	}
+}
+
+func WithConsulTokenScopeCheck() ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.VerifyTokenScope = true
+	}
+}
+
+func WithConsulTags(tags ...string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Tags = tags
+	}
+}
+
+func WithConsulServiceTags(name string, tags ...string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		if o.ServiceTags == nil {
+			o.ServiceTags = make(map[string][]string)
+		}
+		o.ServiceTags[name] = tags
+	}
+}
+
+func WithConsulServiceMeta(name string, metadata map[string]string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		if o.ServiceMeta == nil {
+			o.ServiceMeta = make(map[string]map[string]string)
+		}
+		o.ServiceMeta[name] = metadata
+	}
+}
+
+// WithConsulIngress publishes how API gateways expose the service name.
+func WithConsulIngress(name string, ingress meta.Ingress) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		if o.Ingress == nil {
+			o.Ingress = make(map[string]meta.Ingress)
+		}
+		o.Ingress[name] = ingress
+	}
+}
+
+// WithConsulHashRing publishes the tokens of the instance on the consistent-hash ring, e.g. meta.VirtualNodes(64).
+func WithConsulHashRing(tokens meta.TokenFunc) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.HashRing = tokens
+	}
+}
+
+// WithConsulConfirmStore confirms the registrations of RegisterAndConfirm by reading kv.
+func WithConsulConfirmStore(kv store.Store) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.ConfirmStore = kv
+	}
+}
+
+// WithConsulTenancy registers in the namespace and the admin partition of Consul Enterprise.
+func WithConsulTenancy(namespace, partition string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		var c consulkv.Config // don't change the config which may be shared
+		if o.ConsulConfig != nil {
+			c = *o.ConsulConfig
+		}
+		c.Namespace = namespace
+		c.Partition = partition
+		o.ConsulConfig = &c
+	}
+}
+
+func WithConsulState(state string) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.State = state
+	}
+}
+
+func WithConsulSchema() ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.PublishSchema = true
+	}
+}
+
 func NewConsulRegisterPlugin(o ...ConsulOpt) *ConsulRegisterPlugin {
 	consulPlugin := &ConsulRegisterPlugin{}
 	for _, v := range o {
@@ -90,8 +375,19 @@ func NewConsulRegisterPlugin(o ...ConsulOpt) *ConsulRegisterPlugin {
 	return consulPlugin
 }
 
+// newStore creates the store of consul.
+func (p *ConsulRegisterPlugin) newStore() (store.Store, error) {
+	return consulkv.New(p.ConsulServers, p.Options, p.ConsulConfig)
+}
+
 // Start starts to connect consul cluster
 func (p *ConsulRegisterPlugin) Start() error {
+	return p.StartContext(context.Background())
+}
+
+// StartContext starts the plugin like Start, and the heartbeats stop when ctx is done,
+// so that the registered keys expire after their TTL. Call Stop to deregister the services at once.
+func (p *ConsulRegisterPlugin) StartContext(ctx context.Context) error {
 	if p.Expired == 0 {
 		p.Expired = p.UpdateInterval
 	}
@@ -104,7 +400,7 @@ func (p *ConsulRegisterPlugin) Start() error {
 	}
 
 	if p.kv == nil {
-		kv, err := libkv.NewStore(store.CONSUL, p.ConsulServers, p.Options)
+		kv, err := p.newStore()
 		if err != nil {
 			log.Errorf("cannot create consul registry: %v", err)
 			close(p.done)
@@ -116,17 +412,25 @@ func (p *ConsulRegisterPlugin) Start() error {
 	if p.BasePath[0] == '/' {
 		p.BasePath = p.BasePath[1:]
 	}
+	p.verifyTokenScope()
 
-	err := p.kv.Put(p.BasePath, []byte("rpcx_path"), &store.WriteOptions{IsDir: true, TTL: p.UpdateInterval + p.Expired})
+	err := p.kv.Put(p.BasePath, []byte("rpcx_path"), &store.WriteOptions{IsDir: true, TTL: p.ttl()})
 	if err != nil {
 		log.Errorf("cannot create consul path %s: %v", p.BasePath, err)
 		close(p.done)
 		return err
 	}
 
+	if err := p.restoreState(); err != nil {
+		log.Errorf("cannot restore registration state: %v", err)
+	}
+
 	if p.UpdateInterval > 0 {
-		go func() {
-			ticker := time.NewTicker(p.UpdateInterval)
+		p.intervalCh = make(chan time.Duration, 1)
+		jitter := p.jitter()
+		err := budget.Go("heartbeat", func() {
+			interval := p.UpdateInterval
+			ticker := time.NewTicker(nextInterval(jitter, interval, jitterWindow(interval, p.JitterFraction)))
 
 			defer ticker.Stop()
 			defer p.kv.Close()
@@ -137,48 +441,169 @@ func (p *ConsulRegisterPlugin) Start() error {
 				case <-p.dying:
 					close(p.done)
 					return
+				case <-ctx.Done():
+					log.Infof("stop the heartbeats of %s: %v", p.ServiceAddress, ctx.Err())
+					close(p.done)
+					return
+				case interval = <-p.intervalCh:
+					ticker.Reset(nextInterval(jitter, interval, jitterWindow(interval, p.JitterFraction)))
 				case <-ticker.C:
-					extra := make(map[string]string)
-					if p.Metrics != nil {
-						extra["calls"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("calls", p.Metrics).RateMean())
-						extra["connections"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("connections", p.Metrics).RateMean())
-					}
-
-					//set this same metrics for all services at this server
-					for _, name := range p.Services {
-						nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
-						kvPaire, err := p.kv.Get(nodePath)
-						if err != nil {
-							log.Warnf("can't get data of node: %s, will re-create, because of %v", nodePath, err.Error())
-
-							p.metasLock.RLock()
-							meta := p.metas[name]
-							p.metasLock.RUnlock()
-
-							err = p.kv.Put(nodePath, []byte(meta), &store.WriteOptions{TTL: p.UpdateInterval + p.Expired})
-							if err != nil {
-								log.Errorf("cannot re-create consul path %s: %v", nodePath, err)
-							}
-						} else {
-							v, _ := url.ParseQuery(string(kvPaire.Value))
-							for key, value := range extra {
-								v.Set(key, value)
-							}
-							_ = p.kv.Put(nodePath, []byte(v.Encode()), &store.WriteOptions{TTL: p.UpdateInterval + p.Expired})
-						}
+					if jitter != nil {
+						ticker.Reset(nextInterval(jitter, interval, jitterWindow(interval, p.JitterFraction)))
 					}
+					p.refresh()
 				}
 			}
-		}()
+		})
+		if err != nil {
+			log.Errorf("cannot start the heartbeats of %s: %v", p.ServiceAddress, err)
+			close(p.done)
+			return err
+		}
+	} else {
+		close(p.done)
 	}
 
 	return nil
 }
 
+// refresh refreshes the TTL and metrics of all services.
+func (p *ConsulRegisterPlugin) refresh() {
+	if !p.partitionedSince.IsZero() {
+		p.recoverPartition()
+		return
+	}
+
+	extra := make(map[string]string)
+	if p.Metrics != nil {
+		extra["calls"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("calls", p.Metrics).RateMean())
+		extra["connections"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("connections", p.Metrics).RateMean())
+	}
+
+	if p.BatchHeartbeats {
+		p.refreshBatch(extra)
+		return
+	}
+
+	//set this same metrics for all services at this server
+	p.configMu.RLock()
+	window := jitterWindow(p.UpdateInterval, p.JitterFraction)
+	p.configMu.RUnlock()
+	now := time.Now()
+	services := p.services()
+	for i, name := range services {
+		// the writes of the services are spread over the jitter window
+		if !stagger(i, len(services), window, now, p.dying) {
+			return
+		}
+		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+		if !p.inWindow(name, now) {
+			p.leaveWindow(name, nodePath)
+			continue
+		}
+		kvPaire, err := p.kv.Get(nodePath)
+		if err != nil {
+			if p.PartitionRecovery && err != store.ErrKeyNotFound {
+				p.partitionedSince = time.Now()
+				log.Warnf("consul is unreachable, services will be re-registered after it recovers: %v", err)
+				p.heartbeat(name, err)
+				return
+			}
+
+			log.Warnf("can't get data of node: %s, will re-create, because of %v", nodePath, err.Error())
+
+			p.metasLock.RLock()
+			meta := p.metas[name]
+			p.metasLock.RUnlock()
+
+			err = p.putNode(nodePath, []byte(meta))
+			if err != nil {
+				log.Errorf("cannot re-create consul path %s: %v", nodePath, err)
+			}
+			p.heartbeat(name, err)
+		} else {
+			value := string(kvPaire.Value)
+			if p.ConflictPolicy != nil { // the modifications of others are resolved by the policy
+				p.metasLock.RLock()
+				value = p.metas[name]
+				p.metasLock.RUnlock()
+			}
+			v, _ := url.ParseQuery(value)
+			for key, value := range extra {
+				v.Set(key, value)
+			}
+			p.refreshWeight(name, v)
+			p.heartbeat(name, p.putNode(nodePath, []byte(v.Encode())))
+		}
+	}
+}
+
+// recoverPartition re-registers all services at once if consul is reachable again.
+func (p *ConsulRegisterPlugin) recoverPartition() {
+	if _, err := p.kv.Exists(p.BasePath); err != nil {
+		return
+	}
+
+	p.metasLock.RLock()
+	pairs := make([]*store.KVPair, 0, len(p.Services))
+	now := time.Now()
+	for _, name := range p.Services {
+		if !p.inWindow(name, now) {
+			continue
+		}
+		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+		pairs = append(pairs, &store.KVPair{Key: nodePath, Value: []byte(p.metas[name])})
+	}
+	p.metasLock.RUnlock()
+
+	if err := p.putAll(pairs, &store.WriteOptions{TTL: p.ttl()}); err != nil {
+		log.Errorf("cannot re-register services after consul recovered: %v", err)
+		return
+	}
+
+	invisible := time.Since(p.partitionedSince)
+	p.partitionedSince = time.Time{}
+	log.Infof("re-registered %d services after consul recovered, they were invisible for %v", len(pairs), invisible)
+	if p.OnPartitionRecovered != nil {
+		p.OnPartitionRecovered(invisible)
+	}
+}
+
+// batchStore is implemented by the stores which can put many keys in transactions, such as consulkv.Store.
+type batchStore interface {
+	PutAll(pairs []*store.KVPair, opts *store.WriteOptions) error
+}
+
+// putAll puts the pairs in transactions, with the session of the plugin if the keys are held by it.
+// The keys are put one by one with CAS if ConflictPolicy is set. It fails if the store can't put keys in transactions.
+func (p *ConsulRegisterPlugin) putAll(pairs []*store.KVPair, opts *store.WriteOptions) error {
+	if p.SessionTTL > 0 || p.BatchHeartbeats {
+		se, err := p.liveSession()
+		if err != nil {
+			return err
+		}
+		return se.PutAll(pairs, p.BatchSize)
+	}
+	if p.ConflictPolicy != nil {
+		for _, pair := range pairs {
+			if err := p.putNode(pair.Key, pair.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	bs, ok := p.kv.(batchStore)
+	if !ok {
+		return errors.New("consul transactions are not supported by the store")
+	}
+	return bs.PutAll(pairs, opts)
+}
+
 // Stop unregister all services.
 func (p *ConsulRegisterPlugin) Stop() error {
 	if p.kv == nil {
-		kv, err := libkv.NewStore(store.CONSUL, p.ConsulServers, p.Options)
+		kv, err := p.newStore()
 		if err != nil {
 			log.Errorf("cannot create consul registry: %v", err)
 			return err
@@ -190,7 +615,7 @@ func (p *ConsulRegisterPlugin) Stop() error {
 		p.BasePath = p.BasePath[1:]
 	}
 
-	for _, name := range p.Services {
+	for _, name := range p.services() {
 		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
 		exist, err := p.kv.Exists(nodePath)
 		if err != nil {
@@ -198,11 +623,14 @@ func (p *ConsulRegisterPlugin) Stop() error {
 			continue
 		}
 		if exist {
-			_ = p.kv.Delete(nodePath)
+			_ = p.removeNode(nodePath)
 			log.Infof("delete path %s", nodePath, err)
 		}
 	}
 
+	p.stopTombstones()
+	p.destroySession()
+
 	close(p.dying)
 	<-p.done
 	return nil
@@ -227,17 +655,23 @@ func (p *ConsulRegisterPlugin) PreCall(_ context.Context, _, _ string, args inte
 // Register handles registering event.
 // this service is registered at BASE/serviceName/thisIpAddress node
 func (p *ConsulRegisterPlugin) Register(name string, rcvr interface{}, metadata string) (err error) {
+	_, err = p.register(name, rcvr, metadata)
+	return err
+}
+
+// register registers the service like Register, and returns the metadata written to consul.
+func (p *ConsulRegisterPlugin) register(name string, rcvr interface{}, metadata string) (written string, err error) {
 	if strings.TrimSpace(name) == "" {
-		err = errors.New("Register service `name` can't be empty")
-		return
+		return "", errors.New("Register service `name` can't be empty")
 	}
+	userMetadata := metadata
+	metadata = p.withMetadata(name, metadata)
 
 	if p.kv == nil {
-		consul.Register()
-		kv, err := libkv.NewStore(store.CONSUL, p.ConsulServers, nil)
+		kv, err := p.newStore()
 		if err != nil {
 			log.Errorf("cannot create consul registry: %v", err)
-			return err
+			return "", err
 		}
 		p.kv = kv
 	}
@@ -245,43 +679,107 @@ func (p *ConsulRegisterPlugin) Register(name string, rcvr interface{}, metadata
 	if p.BasePath[0] == '/' {
 		p.BasePath = p.BasePath[1:]
 	}
+	p.verifyTokenScope()
 	err = p.kv.Put(p.BasePath, []byte("rpcx_path"), &store.WriteOptions{IsDir: true})
 	if err != nil {
 		log.Errorf("cannot create consul path %s: %v", p.BasePath, err)
-		return err
+		return "", err
 	}
 
 	nodePath := fmt.Sprintf("%s/%s", p.BasePath, name)
 	err = p.kv.Put(nodePath, []byte(name), &store.WriteOptions{IsDir: true})
 	if err != nil {
 		log.Errorf("cannot create consul path %s: %v", nodePath, err)
-		return err
+		return "", err
 	}
 
 	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
-	err = p.kv.Put(nodePath, []byte(metadata), &store.WriteOptions{TTL: p.UpdateInterval + p.Expired})
-	if err != nil {
-		log.Errorf("cannot create consul path %s: %v", nodePath, err)
-		return err
+	if p.inWindow(name, time.Now()) {
+		err = p.putNode(nodePath, []byte(metadata))
+		if err != nil {
+			log.Errorf("cannot create consul path %s: %v", nodePath, err)
+			return "", err
+		}
+		p.recordHeartbeat(name, nil)
+	} else {
+		log.Infof("service %s will be registered in its windows", name)
 	}
 
-	p.Services = append(p.Services, name)
-
 	p.metasLock.Lock()
+	// registering a service again, e.g. by RegisterFunction, only updates its metadata
+	if !containsString(p.Services, name) {
+		p.Services = append(p.Services, name)
+	}
 	if p.metas == nil {
 		p.metas = make(map[string]string)
 	}
 	p.metas[name] = metadata
+	if p.userMetas == nil {
+		p.userMetas = make(map[string]string)
+	}
+	p.userMetas[name] = userMetadata
 	p.metasLock.Unlock()
-	return
+	p.saveState()
+
+	if p.PublishSchema {
+		p.publishSchema(name, schema.Methods(rcvr)...)
+	}
+	return metadata, nil
 }
 
 func (p *ConsulRegisterPlugin) RegisterFunction(serviceName, fname string, fn interface{}, metadata string) error {
-	return p.Register(serviceName, fn, metadata)
+	err := p.Register(serviceName, fn, metadata)
+	if err != nil {
+		return err
+	}
+
+	if p.PublishSchema {
+		if method, ok := schema.Function(fname, fn); ok {
+			p.publishSchema(serviceName, method)
+		}
+	}
+	return nil
+}
+
+// publishSchema adds the methods to the schema of the service and publishes it.
+func (p *ConsulRegisterPlugin) publishSchema(name string, methods ...schema.Method) {
+	p.schemasLock.Lock()
+	defer p.schemasLock.Unlock()
+
+	if p.schemas == nil {
+		p.schemas = make(map[string]*schema.Service)
+	}
+	s := p.schemas[name]
+	if s == nil {
+		s = &schema.Service{Name: name}
+		p.schemas[name] = s
+	}
+	for _, m := range methods {
+		replaced := false
+		for i := range s.Methods {
+			if s.Methods[i].Name == m.Name {
+				s.Methods[i] = m
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.Methods = append(s.Methods, m)
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Errorf("cannot marshal schema of %s: %v", name, err)
+		return
+	}
+	key := schema.Key(p.BasePath, name)
+	if err := p.kv.Put(key, data, nil); err != nil {
+		log.Errorf("cannot publish schema %s: %v", key, err)
+	}
 }
 
 func (p *ConsulRegisterPlugin) Unregister(name string) (err error) {
-	if len(p.Services) == 0 {
+	if len(p.services()) == 0 {
 		return nil
 	}
 	if strings.TrimSpace(name) == "" {
@@ -290,8 +788,7 @@ func (p *ConsulRegisterPlugin) Unregister(name string) (err error) {
 	}
 
 	if p.kv == nil {
-		consul.Register()
-		kv, err := libkv.NewStore(store.CONSUL, p.ConsulServers, nil)
+		kv, err := p.newStore()
 		if err != nil {
 			log.Errorf("cannot create consul registry: %v", err)
 			return err
@@ -318,25 +815,27 @@ func (p *ConsulRegisterPlugin) Unregister(name string) (err error) {
 
 	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
 
-	err = p.kv.Delete(nodePath)
+	err = p.removeNode(nodePath)
 	if err != nil {
 		log.Errorf("cannot remove consul path %s: %v", nodePath, err)
 		return err
 	}
 
-	var services = make([]string, 0, len(p.Services)-1)
+	p.metasLock.Lock()
+	var services = make([]string, 0, len(p.Services))
 	for _, s := range p.Services {
 		if s != name {
 			services = append(services, s)
 		}
 	}
 	p.Services = services
-
-	p.metasLock.Lock()
 	if p.metas == nil {
 		p.metas = make(map[string]string)
 	}
 	delete(p.metas, name)
+	delete(p.userMetas, name)
 	p.metasLock.Unlock()
+	p.forgetHeartbeats(name)
+	p.saveState()
 	return
 }
@@ -0,0 +1,531 @@
+package serverplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/rpcxio/rpcx-consul/budget"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// MetaNetwork is the consul service meta field of the network of the service address, e.g. tcp.
+const MetaNetwork = "rpcx_network"
+
+// valid keys of consul service meta
+var metaKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// maxServiceMetaValue is the max length of a consul service meta value.
+const maxServiceMetaValue = 512
+
+// ConsulServiceRegisterPlugin registers rpcx services as consul services through the agent API
+// instead of KV pairs, so that they can be used by consul DNS, the UI and other consul native tools.
+// The metadata of a service is published as the service meta, without the keys and the values
+// which consul doesn't accept.
+type ConsulServiceRegisterPlugin struct {
+	// service address, for example, tcp@127.0.0.1:8972
+	ServiceAddress string
+	// consul agent address, only the first one is used
+	ConsulServers []string
+	// consul settings such as the ACL token
+	ConsulConfig *consulkv.Config
+	// tags of all services
+	Tags    []string
+	Metrics metrics.Registry
+	// Registered services
+	Services []string
+	// how often the TTL checks are passed
+	UpdateInterval time.Duration
+	Expired        time.Duration
+	// how long consul keeps the services whose default TTL checks are critical, zero means never
+	DeregisterCriticalServiceAfter time.Duration
+	// health check of all services, it is a TTL check if it is nil and UpdateInterval is set
+	HealthCheck *HealthCheck
+	// health checks of the individual services
+	ServiceChecks map[string]*HealthCheck
+	// routing hints of API gateways of the individual services, published in the service meta
+	Ingress map[string]meta.Ingress
+	// DNSTTL is the DNS TTL hints of the individual services, "*" for all services, published in the service meta.
+	// Consul DNS only answers with them if the agents are configured by DNSConfig.
+	DNSTTL map[string]time.Duration
+	// HashRing publishes the tokens of the instance on the consistent-hash ring in the service meta,
+	// at most maxServiceMetaValue bytes of them fit, e.g. meta.VirtualNodes(48)
+	HashRing meta.TokenFunc
+	// Connect registers the services in consul Connect, natively or with sidecar proxies
+	Connect *api.AgentServiceConnect
+	// Weight of all services published as the consul service weights, the default of consul if zero.
+	// WeightFunc takes precedence, the services are registered again when the weight it computes changes.
+	Weight     int
+	WeightFunc func() int
+	// Hook is called after every heartbeat, e.g. hook.NewMetricsHook(nil) to export metrics.
+	Hook hook.EventHook
+	// Jitter randomizes the TTL checks within JitterFraction of UpdateInterval, see WithCatalogJitter.
+	Jitter         Jitter
+	JitterFraction float64
+	// ConfirmStale confirms the registrations of RegisterAndConfirm with stale reads,
+	// which any consul server can answer, instead of consistent reads of the leader
+	ConfirmStale bool
+
+	mu     sync.Mutex
+	metas  map[string]string
+	client *api.Client
+	// the weight computed by WeightFunc which the services are registered with
+	computedWeight int
+
+	dying chan struct{}
+	done  chan struct{}
+}
+
+type ConsulServiceOpt func(*ConsulServiceRegisterPlugin)
+
+func WithCatalogServers(consulServers []string) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.ConsulServers = consulServers
+	}
+}
+
+func WithCatalogServiceAddress(serviceAddress string) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.ServiceAddress = serviceAddress
+	}
+}
+
+func WithCatalogConfig(config *consulkv.Config) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.ConsulConfig = config
+	}
+}
+
+func WithCatalogTags(tags ...string) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.Tags = tags
+	}
+}
+
+func WithCatalogMetrics(me metrics.Registry) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.Metrics = me
+	}
+}
+
+// WithCatalogEventHook calls h after every heartbeat of the services.
+func WithCatalogEventHook(h hook.EventHook) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.Hook = h
+	}
+}
+
+func WithCatalogUpdateInterval(updateInterval time.Duration) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.UpdateInterval = updateInterval
+	}
+}
+
+// WithCatalogTenancy registers in the namespace and the admin partition of Consul Enterprise.
+func WithCatalogTenancy(namespace, partition string) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		var c consulkv.Config // don't change the config which may be shared
+		if o.ConsulConfig != nil {
+			c = *o.ConsulConfig
+		}
+		c.Namespace = namespace
+		c.Partition = partition
+		o.ConsulConfig = &c
+	}
+}
+
+// WithCatalogIngress publishes how API gateways expose the service name.
+func WithCatalogIngress(name string, ingress meta.Ingress) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		if o.Ingress == nil {
+			o.Ingress = make(map[string]meta.Ingress)
+		}
+		o.Ingress[name] = ingress
+	}
+}
+
+// WithCatalogDNSTTL publishes the DNS TTL hint of the service name, "*" for all services.
+// Deploy DNSConfig to the agents, so that the DNS consumers cache the services as long as the hint.
+func WithCatalogDNSTTL(name string, ttl time.Duration) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		if o.DNSTTL == nil {
+			o.DNSTTL = make(map[string]time.Duration)
+		}
+		o.DNSTTL[name] = ttl
+	}
+}
+
+// WithCatalogHashRing publishes the tokens of the instance on the consistent-hash ring, see HashRing.
+func WithCatalogHashRing(tokens meta.TokenFunc) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.HashRing = tokens
+	}
+}
+
+// WithCatalogConfirmStale confirms the registrations of RegisterAndConfirm with stale reads.
+func WithCatalogConfirmStale() ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.ConfirmStale = true
+	}
+}
+
+// WithCatalogConnectNative registers the services as Connect native, the server must serve mTLS
+// with the leaf certificates, see consulkv.ConnectTLS.
+func WithCatalogConnectNative() ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.Connect = &api.AgentServiceConnect{Native: true}
+	}
+}
+
+// WithCatalogConnectSidecar registers the services with sidecar proxies, sidecar is the registration
+// of the proxy and can be empty to use the defaults of consul.
+func WithCatalogConnectSidecar(sidecar *api.AgentServiceRegistration) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		if sidecar == nil {
+			sidecar = &api.AgentServiceRegistration{}
+		}
+		o.Connect = &api.AgentServiceConnect{SidecarService: sidecar}
+	}
+}
+
+func NewConsulServiceRegisterPlugin(o ...ConsulServiceOpt) *ConsulServiceRegisterPlugin {
+	p := &ConsulServiceRegisterPlugin{}
+	for _, v := range o {
+		v(p)
+	}
+	return p
+}
+
+// agent returns the consul agent API client.
+func (p *ConsulServiceRegisterPlugin) agent() (*api.Agent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client == nil {
+		if len(p.ConsulServers) == 0 {
+			return nil, errors.New("consul servers are not specified")
+		}
+		s, err := consulkv.New(p.ConsulServers[:1], nil, p.ConsulConfig)
+		if err != nil {
+			log.Errorf("cannot create consul client: %v", err)
+			return nil, err
+		}
+		p.client = s.Client()
+	}
+	return p.client.Agent(), nil
+}
+
+// Start starts to pass the TTL checks of the registered services.
+func (p *ConsulServiceRegisterPlugin) Start() error {
+	return p.StartContext(context.Background())
+}
+
+// StartContext starts the plugin like Start, and the TTL checks are no longer passed when ctx is done.
+func (p *ConsulServiceRegisterPlugin) StartContext(ctx context.Context) error {
+	if p.Expired == 0 {
+		p.Expired = p.UpdateInterval
+	}
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	if p.dying == nil {
+		p.dying = make(chan struct{})
+	}
+
+	agent, err := p.agent()
+	if err != nil {
+		close(p.done)
+		return err
+	}
+
+	if p.UpdateInterval > 0 {
+		jitter, window := p.jitter(), jitterWindow(p.UpdateInterval, p.JitterFraction)
+		err := budget.Go("heartbeat", func() {
+			ticker := time.NewTicker(nextInterval(jitter, p.UpdateInterval, window))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-p.dying:
+					close(p.done)
+					return
+				case <-ctx.Done():
+					close(p.done)
+					return
+				case <-ticker.C:
+					if jitter != nil {
+						ticker.Reset(nextInterval(jitter, p.UpdateInterval, window))
+					}
+					p.passChecks(agent, window)
+					p.updateWeight(agent)
+				}
+			}
+		})
+		if err != nil {
+			close(p.done)
+			return err
+		}
+	} else {
+		close(p.done)
+	}
+	return nil
+}
+
+// passChecks passes the TTL checks of all services, the services are registered again if the agent lost them.
+// The checks are spread over window.
+func (p *ConsulServiceRegisterPlugin) passChecks(agent *api.Agent, window time.Duration) {
+	p.mu.Lock()
+	services := append([]string(nil), p.Services...)
+	p.mu.Unlock()
+
+	start := time.Now()
+	for i, name := range services {
+		if !stagger(i, len(services), window, start, p.dying) {
+			return
+		}
+		if check := p.healthCheck(name); check == nil || check.Type != CheckTTL {
+			continue
+		}
+		id := p.serviceID(name)
+		err := agent.UpdateTTL("service:"+id, "", api.HealthPassing)
+		if err == nil {
+			p.heartbeat(name, nil)
+			continue
+		}
+		log.Warnf("cannot pass the check of service %s, will re-register: %v", id, err)
+
+		p.mu.Lock()
+		metadata := p.metas[name]
+		p.mu.Unlock()
+		reg, err := p.registration(name, metadata)
+		if err == nil {
+			err = agent.ServiceRegister(reg)
+		}
+		if err != nil {
+			log.Errorf("cannot re-register service %s: %v", id, err)
+		}
+		p.heartbeat(name, err)
+	}
+}
+
+// heartbeat reports the heartbeat of service to the hook.
+func (p *ConsulServiceRegisterPlugin) heartbeat(service string, err error) {
+	if p.Hook != nil {
+		p.Hook.Heartbeat(service, err)
+	}
+}
+
+// Stop deregisters all services.
+func (p *ConsulServiceRegisterPlugin) Stop() error {
+	// stop passing checks first, otherwise they may register the services again
+	if p.dying != nil {
+		close(p.dying)
+		<-p.done
+	}
+
+	agent, err := p.agent()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	services := append([]string(nil), p.Services...)
+	p.mu.Unlock()
+	for _, name := range services {
+		if err := agent.ServiceDeregister(p.serviceID(name)); err != nil {
+			log.Errorf("cannot deregister service %s: %v", p.serviceID(name), err)
+		}
+	}
+	return nil
+}
+
+// HandleConnAccept handles connections from clients
+func (p *ConsulServiceRegisterPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	if p.Metrics != nil {
+		metrics.GetOrRegisterMeter("connections", p.Metrics).Mark(1)
+	}
+	return conn, true
+}
+
+// PreCall handles rpc call from clients
+func (p *ConsulServiceRegisterPlugin) PreCall(_ context.Context, _, _ string, args interface{}) (interface{}, error) {
+	if p.Metrics != nil {
+		metrics.GetOrRegisterMeter("calls", p.Metrics).Mark(1)
+	}
+	return args, nil
+}
+
+// Register registers the service as a consul service.
+func (p *ConsulServiceRegisterPlugin) Register(name string, rcvr interface{}, metadata string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("Register service `name` can't be empty")
+	}
+
+	reg, err := p.registration(name, metadata)
+	if err != nil {
+		return err
+	}
+	agent, err := p.agent()
+	if err != nil {
+		return err
+	}
+	if err := agent.ServiceRegister(reg); err != nil {
+		log.Errorf("cannot register service %s: %v", reg.ID, err)
+		return err
+	}
+
+	p.mu.Lock()
+	if !containsString(p.Services, name) {
+		p.Services = append(p.Services, name)
+	}
+	if p.metas == nil {
+		p.metas = make(map[string]string)
+	}
+	p.metas[name] = metadata
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *ConsulServiceRegisterPlugin) RegisterFunction(serviceName, fname string, fn interface{}, metadata string) error {
+	return p.Register(serviceName, fn, metadata)
+}
+
+// Unregister deregisters the consul service.
+func (p *ConsulServiceRegisterPlugin) Unregister(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("Unregister service `name` can't be empty")
+	}
+
+	agent, err := p.agent()
+	if err != nil {
+		return err
+	}
+	if err := agent.ServiceDeregister(p.serviceID(name)); err != nil {
+		log.Errorf("cannot deregister service %s: %v", p.serviceID(name), err)
+		return err
+	}
+
+	p.mu.Lock()
+	services := make([]string, 0, len(p.Services))
+	for _, s := range p.Services {
+		if s != name {
+			services = append(services, s)
+		}
+	}
+	p.Services = services
+	delete(p.metas, name)
+	p.mu.Unlock()
+	return nil
+}
+
+// UnregisterService deregisters the service at runtime, it returns ErrNotRegistered if the service isn't registered.
+func (p *ConsulServiceRegisterPlugin) UnregisterService(name string) error {
+	p.mu.Lock()
+	registered := containsString(p.Services, name)
+	p.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	}
+	return p.Unregister(name)
+}
+
+// UpdateServiceMetadata replaces the metadata of the registered service at runtime,
+// it returns ErrNotRegistered if the service isn't registered.
+func (p *ConsulServiceRegisterPlugin) UpdateServiceMetadata(name, metadata string) error {
+	p.mu.Lock()
+	registered := containsString(p.Services, name)
+	p.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	}
+	return p.Register(name, nil, metadata)
+}
+
+// serviceID returns the consul service ID of the service on this server.
+func (p *ConsulServiceRegisterPlugin) serviceID(name string) string {
+	_, host, port, _ := meta.SplitKey(p.ServiceAddress)
+	return name + "-" + host + "-" + port
+}
+
+// registration returns the agent registration of the service.
+func (p *ConsulServiceRegisterPlugin) registration(name, metadata string) (*api.AgentServiceRegistration, error) {
+	network, host, port, err := meta.SplitKey(p.ServiceAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service address %s: %w", p.ServiceAddress, err)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port of service address %s: %w", p.ServiceAddress, err)
+	}
+
+	reg := &api.AgentServiceRegistration{
+		ID:      p.serviceID(name),
+		Name:    name,
+		Tags:    p.Tags,
+		Address: host,
+		Port:    portNum,
+		Meta:    serviceMeta(name, metadata),
+		Connect: p.Connect,
+	}
+	if w := p.weight(); w > 0 {
+		reg.Weights = &api.AgentWeights{Passing: w, Warning: 1}
+	}
+	if network != "" {
+		reg.Meta[MetaNetwork] = network
+	}
+	hints := make(url.Values)
+	p.Ingress[name].Set(hints)
+	if ttl := p.dnsTTL(name); ttl > 0 {
+		hints.Set(meta.DNSTTL, ttl.String())
+	}
+	if p.HashRing != nil {
+		meta.SetRingTokens(hints, p.HashRing(p.ServiceAddress))
+	}
+	for k := range hints {
+		if _, ok := reg.Meta[k]; ok {
+			continue
+		}
+		// the hints are needed by the clients, so they are not dropped like the metadata
+		if len(hints.Get(k)) > maxServiceMetaValue {
+			return nil, fmt.Errorf("%s of service %s exceeds %d bytes of a consul service meta value", k, name, maxServiceMetaValue)
+		}
+		reg.Meta[k] = hints.Get(k)
+	}
+	if check := p.healthCheck(name); check != nil {
+		reg.Check, err = p.agentCheck(reg.ID, check)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check of service %s: %w", name, err)
+		}
+	}
+	return reg, nil
+}
+
+// serviceMeta converts the url encoded metadata to the consul service meta.
+func serviceMeta(name, metadata string) map[string]string {
+	v := meta.Parse(metadata)
+	m := make(map[string]string, len(v)+1)
+	for key := range v {
+		if !metaKeyPattern.MatchString(key) {
+			log.Warnf("ignore metadata %s of service %s, it is not a valid consul service meta key", key, name)
+			continue
+		}
+		if value := v.Get(key); len(value) > maxServiceMetaValue {
+			log.Warnf("ignore metadata %s of service %s, its %d bytes exceed %d bytes of a consul service meta value", key, name, len(value), maxServiceMetaValue)
+			continue
+		}
+		m[key] = v.Get(key)
+	}
+	return m
+}
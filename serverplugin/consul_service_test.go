@@ -0,0 +1,365 @@
+package serverplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// fakeAgent is a consul agent which records the registered services and passed checks.
+type fakeAgent struct {
+	mu       sync.Mutex
+	services map[string]*api.AgentServiceRegistration
+	passed   map[string]int
+}
+
+func newFakeAgent() (*fakeAgent, *httptest.Server) {
+	a := &fakeAgent{services: make(map[string]*api.AgentServiceRegistration), passed: make(map[string]int)}
+	return a, httptest.NewServer(a)
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.services[reg.ID] = &reg
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		delete(a.services, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+		if a.services[strings.TrimPrefix(id, "service:")] == nil {
+			http.Error(w, "unknown check", http.StatusNotFound)
+			return
+		}
+		a.passed[id]++
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		passing := r.URL.Query().Get("passing") == "1"
+		entries := []*api.ServiceEntry{}
+		for _, reg := range a.services {
+			if reg.Name != name {
+				continue
+			}
+			// the checks other than TTL ones are critical until consul runs them
+			if passing && reg.Check != nil && reg.Check.Status != api.HealthPassing {
+				continue
+			}
+			entries = append(entries, &api.ServiceEntry{Service: &api.AgentService{ID: reg.ID, Service: reg.Name}})
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *fakeAgent) service(id string) *api.AgentServiceRegistration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.services[id]
+}
+
+func TestConsulServiceRegister(t *testing.T) {
+	agent, srv := newFakeAgent()
+	defer srv.Close()
+
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogTags("rpcx"),
+		WithCatalogUpdateInterval(10*time.Millisecond),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Register("Arith", new(Arith), "group=a&bad.key=x&doc="+strings.Repeat("x", maxServiceMetaValue+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := agent.service("Arith-127.0.0.1-8972")
+	if reg == nil {
+		t.Fatal("service is not registered")
+	}
+	if reg.Name != "Arith" || reg.Address != "127.0.0.1" || reg.Port != 8972 || len(reg.Tags) != 1 {
+		t.Fatalf("unexpected registration: %+v", reg)
+	}
+	if len(reg.Meta) != 2 || reg.Meta["group"] != "a" || reg.Meta[MetaNetwork] != "tcp" {
+		t.Fatalf("unexpected meta: %v", reg.Meta)
+	}
+	if reg.Check == nil || reg.Check.TTL != "20ms" {
+		t.Fatalf("unexpected check: %+v", reg.Check)
+	}
+
+	// the service is registered again if the agent lost it
+	agent.mu.Lock()
+	delete(agent.services, "Arith-127.0.0.1-8972")
+	agent.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if agent.service("Arith-127.0.0.1-8972") == nil {
+		t.Fatal("service is not registered again")
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if agent.service("Arith-127.0.0.1-8972") != nil {
+		t.Fatal("service is not deregistered")
+	}
+}
+
+func TestConsulServiceHealthCheck(t *testing.T) {
+	agent, srv := newFakeAgent()
+	defer srv.Close()
+
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogUpdateInterval(10*time.Millisecond),
+		WithCatalogDeregisterCriticalAfter(time.Minute),
+		WithCatalogServiceHealthCheck("Web", &HealthCheck{Type: CheckHTTP, HTTP: "http://127.0.0.1:8080/health", Interval: time.Second}),
+		WithCatalogServiceHealthCheck("Grpc", &HealthCheck{Type: CheckGRPC, GRPC: "127.0.0.1:9090", Interval: time.Second}),
+		WithCatalogServiceHealthCheck("Bad", &HealthCheck{Type: CheckHTTP}),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for _, name := range []string{"Arith", "Web", "Grpc"} {
+		if err := p.Register(name, new(Arith), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Register("Bad", new(Arith), ""); err == nil {
+		t.Fatal("expected the error of the invalid check")
+	}
+
+	if c := agent.service("Arith-127.0.0.1-8972").Check; c.TTL != "20ms" || c.Status != api.HealthPassing || c.DeregisterCriticalServiceAfter != "1m0s" {
+		t.Fatalf("unexpected TTL check: %+v", c)
+	}
+	if c := agent.service("Web-127.0.0.1-8972").Check; c.HTTP != "http://127.0.0.1:8080/health" || c.Interval != "1s" || c.TTL != "" {
+		t.Fatalf("unexpected HTTP check: %+v", c)
+	}
+	if c := agent.service("Grpc-127.0.0.1-8972").Check; c.GRPC != "127.0.0.1:9090" || c.Interval != "1s" {
+		t.Fatalf("unexpected gRPC check: %+v", c)
+	}
+
+	// only TTL checks are passed by the plugin
+	time.Sleep(50 * time.Millisecond)
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.passed["service:Arith-127.0.0.1-8972"] == 0 || agent.passed["service:Web-127.0.0.1-8972"] != 0 {
+		t.Fatalf("unexpected passed checks: %v", agent.passed)
+	}
+}
+
+func TestConsulServiceConnect(t *testing.T) {
+	agent, srv := newFakeAgent()
+	defer srv.Close()
+
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogConnectSidecar(nil),
+		WithCatalogIngress("Arith", meta.Ingress{Host: "api.example.com", PathPrefix: "/arith"}),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if err := p.Register("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := agent.service("Arith-127.0.0.1-8972")
+	if reg == nil || reg.Connect == nil || reg.Connect.SidecarService == nil || reg.Connect.Native {
+		t.Fatalf("unexpected registration: %+v", reg)
+	}
+	if reg.Meta[meta.IngressHost] != "api.example.com" || reg.Meta[meta.IngressPath] != "/arith" {
+		t.Fatalf("unexpected meta: %v", reg.Meta)
+	}
+}
+
+func TestCatalogHashRing(t *testing.T) {
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogHashRing(meta.VirtualNodes(48)),
+	)
+	reg, err := p.registration("Arith", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := meta.RingTokensOf(url.Values{meta.RingTokens: {reg.Meta[meta.RingTokens]}}.Encode()); len(tokens) != 48 {
+		t.Fatalf("unexpected tokens: %v", tokens)
+	}
+
+	p.HashRing = meta.VirtualNodes(64)
+	if _, err := p.registration("Arith", ""); err == nil {
+		t.Fatal("expect error of tokens exceeding the service meta value")
+	}
+}
+
+func TestCatalogRegisterAndConfirm(t *testing.T) {
+	_, srv := newFakeAgent()
+	defer srv.Close()
+
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogConfirmStale(),
+	)
+	c, err := p.RegisterAndConfirm(context.Background(), "Arith", new(Arith), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Key != "Arith-127.0.0.1-8972" || c.Index != 7 || c.Reads != 1 {
+		t.Fatalf("unexpected confirmation: %+v", c)
+	}
+
+	// the service isn't discoverable until its HTTP check passes
+	p.ServiceChecks = map[string]*HealthCheck{"Web": {Type: CheckHTTP, HTTP: "http://127.0.0.1:8080/health", Interval: time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.RegisterAndConfirm(ctx, "Web", new(Arith), ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded but got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.RegisterAndConfirm(ctx, "Echo", new(Arith), ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled but got %v", err)
+	}
+}
+
+func TestCatalogDNSTTL(t *testing.T) {
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogDNSTTL("*", 30*time.Second),
+		WithCatalogDNSTTL("Arith", 5*time.Second),
+	)
+	for name, want := range map[string]time.Duration{"Arith": 5 * time.Second, "Echo": 30 * time.Second} {
+		reg, err := p.registration(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := meta.DNSTTLOf(url.Values{meta.DNSTTL: {reg.Meta[meta.DNSTTL]}}.Encode()); ttl != want {
+			t.Fatalf("expected DNS TTL %v of %s but got %v", want, name, ttl)
+		}
+	}
+
+	c := p.DNSConfig()
+	want := "dns_config {\n  service_ttl {\n    \"*\" = \"30s\"\n    \"Arith\" = \"5s\"\n  }\n}\n"
+	if got := c.HCL(); got != want {
+		t.Fatalf("unexpected HCL:\n%s", got)
+	}
+	data, err := c.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		DNSConfig struct {
+			ServiceTTL map[string]string `json:"service_ttl"`
+		} `json:"dns_config"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil || v.DNSConfig.ServiceTTL["Arith"] != "5s" {
+		t.Fatalf("unexpected JSON %s: %v", data, err)
+	}
+}
+
+func TestCatalogTenancy(t *testing.T) {
+	cfg := &consulkv.Config{Token: "secret"}
+	p := NewConsulServiceRegisterPlugin(WithCatalogConfig(cfg), WithCatalogTenancy("team-a", "tenant-1"))
+	if c := p.ConsulConfig; c.Token != "secret" || c.Namespace != "team-a" || c.Partition != "tenant-1" {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if cfg.Namespace != "" {
+		t.Fatal("the shared config is changed")
+	}
+}
+
+func TestConsulServiceUpdate(t *testing.T) {
+	agent, srv := newFakeAgent()
+	defer srv.Close()
+
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+	)
+	if err := p.RegisterFunction("Arith", "Add", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RegisterFunction("Arith", "Mul", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Services) != 1 {
+		t.Fatalf("expect the service registered once but got %v", p.Services)
+	}
+
+	if err := p.UpdateServiceMetadata("Arith", "group=b"); err != nil {
+		t.Fatal(err)
+	}
+	if reg := agent.service("Arith-127.0.0.1-8972"); reg == nil || reg.Meta["group"] != "b" {
+		t.Fatalf("unexpected registration: %+v", reg)
+	}
+
+	if err := p.UnregisterService("Echo"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expect ErrNotRegistered but got %v", err)
+	}
+	if err := p.UnregisterService("Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if agent.service("Arith-127.0.0.1-8972") != nil || len(p.Services) != 0 {
+		t.Fatal("service is not deregistered")
+	}
+	if err := p.UpdateServiceMetadata("Arith", "group=c"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expect ErrNotRegistered but got %v", err)
+	}
+}
+
+func TestConsulServiceWeight(t *testing.T) {
+	agent, srv := newFakeAgent()
+	defer srv.Close()
+
+	var weight int32 = 5
+	p := NewConsulServiceRegisterPlugin(
+		WithCatalogServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithCatalogServiceAddress("tcp@127.0.0.1:8972"),
+		WithCatalogUpdateInterval(10*time.Millisecond),
+		WithCatalogWeightFunc(func() int { return int(atomic.LoadInt32(&weight)) }),
+	)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if err := p.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if reg := agent.service("Arith-127.0.0.1-8972"); reg.Weights == nil || reg.Weights.Passing != 5 {
+		t.Fatalf("unexpected weights: %+v", reg.Weights)
+	}
+
+	atomic.StoreInt32(&weight, 2)
+	time.Sleep(50 * time.Millisecond)
+	if reg := agent.service("Arith-127.0.0.1-8972"); reg.Weights == nil || reg.Weights.Passing != 2 {
+		t.Fatalf("weights are not updated: %+v", reg.Weights)
+	}
+}
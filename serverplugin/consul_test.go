@@ -1,10 +1,27 @@
 package serverplugin
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	api "github.com/hashicorp/consul/api"
 	metrics "github.com/rcrowley/go-metrics"
+	"github.com/rpcxio/rpcx-consul/cloudmeta"
+	"github.com/rpcxio/rpcx-consul/hook"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/rpcxio/rpcx-consul/schema"
 	"github.com/smallnest/rpcx/server"
 )
 
@@ -35,3 +52,846 @@ func TestConsulRegistry(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestConsulPartitionRecovery(t *testing.T) {
+	kv := newMemStore()
+	var invisible time.Duration
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulPartitionRecovery(func(d time.Duration) { invisible = d }),
+	)
+	r.kv = kv
+
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+
+	kv.setDown(true)
+	r.refresh()
+	if r.partitionedSince.IsZero() {
+		t.Fatal("partition is not detected")
+	}
+	r.refresh()
+
+	kv.setDown(false)
+	delete(kv.data, "rpcx_test/Arith/tcp@127.0.0.1:8972")
+	r.refresh()
+	if !r.partitionedSince.IsZero() || invisible <= 0 {
+		t.Fatalf("partition is not recovered, invisible: %v", invisible)
+	}
+	if string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]) != "group=a" {
+		t.Fatal("service is not re-registered")
+	}
+}
+
+func TestConsulSchema(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulSchema(),
+	)
+	r.kv = kv
+
+	if err := r.Register("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	mul := func(ctx context.Context, args *Args, reply *Reply) error { return nil }
+	if err := r.RegisterFunction("Arith", "MulFunc", mul, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var s schema.Service
+	if err := json.Unmarshal(kv.data[schema.Key("rpcx_test", "Arith")], &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Methods) != 2 || s.Methods[0].Name != "Mul" || s.Methods[1].Name != "MulFunc" {
+		t.Fatalf("unexpected schema: %+v", s)
+	}
+}
+
+func TestConsulOwnership(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulOwnership(meta.Ownership{Team: "payments"}),
+	)
+	r.kv = kv
+
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != "group=a&team=payments" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+}
+
+func TestConsulHashRing(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulHashRing(meta.VirtualNodes(4)),
+	)
+	r.kv = kv
+
+	if err := r.Register("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	tokens := meta.RingTokensOf(string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]))
+	if !reflect.DeepEqual(tokens, meta.VirtualNodes(4)("tcp@127.0.0.1:8972")) {
+		t.Fatalf("unexpected tokens: %v", tokens)
+	}
+}
+
+func TestConsulRegisterAndConfirm(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulConfirmStore(&laggingStore{Store: kv, lag: 2}),
+	)
+	r.kv = kv
+
+	c, err := r.RegisterAndConfirm(context.Background(), "Arith", new(Arith), "group=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Key != "rpcx_test/Arith/tcp@127.0.0.1:8972" || c.Reads != 3 || c.Index == 0 {
+		t.Fatalf("unexpected confirmation: %+v", c)
+	}
+
+	// the confirm store never sees the registration
+	r.ConfirmStore = newMemStore()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.RegisterAndConfirm(ctx, "Echo", new(Arith), ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded but got %v", err)
+	}
+}
+
+func TestConsulStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rpcx.state")
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulStateFile(file),
+	)
+	r.kv = newMemStore()
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted process registers the same services in Start
+	kv := newMemStore()
+	restarted := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulStateFile(file),
+	)
+	restarted.kv = kv
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != "group=a" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+	if len(restarted.Services) != 1 || restarted.Services[0] != "Arith" {
+		t.Fatalf("unexpected services: %v", restarted.Services)
+	}
+}
+
+func TestConsulApplyConfig(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Minute),
+		WithConsulOwnership(meta.Ownership{Team: "payments"}),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "rpcx_test/Arith/tcp@127.0.0.1:8972"
+	puts := kv.puts
+	if err := r.ApplyConfig(PluginConfig{Ownership: &meta.Ownership{Team: "payments"}}); err != nil {
+		t.Fatal(err)
+	}
+	if kv.puts != puts {
+		t.Fatal("expect no registration if nothing changes")
+	}
+
+	if err := r.ApplyConfig(PluginConfig{Ownership: &meta.Ownership{Team: "billing"}, Expired: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data[key]); v != "group=a&team=billing" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+	if ttl := kv.ttls[key].TTL; ttl != 2*time.Minute {
+		t.Fatalf("unexpected ttl: %v", ttl)
+	}
+	if err := r.ApplyConfig(PluginConfig{Token: "secret"}); err == nil {
+		t.Fatal("expect error when changing the token of a libkv store")
+	}
+}
+
+func TestConsulSetState(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Minute),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a&state=active"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "rpcx_test/Arith/tcp@127.0.0.1:8972"
+	if err := r.SetState(meta.StateDraining); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data[key]); v != "group=a&state=draining" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+	if err := r.SetState(meta.StateActive); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data[key]); v != "group=a&state=active" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+}
+
+func TestConsulAnnounceShutdown(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Minute),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := r.AnnounceShutdown(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("expect to wait for the delay")
+	}
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != "group=a&state=draining" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+}
+
+func TestConsulRestoreAfterShutdown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rpcx.state")
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulStateFile(file),
+		WithConsulOwnership(meta.Ownership{Team: "payments"}),
+	)
+	r.kv = newMemStore()
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AnnounceShutdown(0); err != nil {
+		t.Fatal(err)
+	}
+	r.saveState()
+
+	// the restarted process publishes its own state and plugin fields, not the ones of the previous process
+	kv := newMemStore()
+	restarted := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulStateFile(file),
+		WithConsulOwnership(meta.Ownership{Team: "search"}),
+	)
+	restarted.kv = kv
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := restarted.withMetadata("Arith", "group=a")
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != want || meta.Parse(v).Get(meta.State) != "" {
+		t.Fatalf("expected metadata %s but got %s", want, v)
+	}
+	if restarted.userMetas["Arith"] != "group=a" || restarted.metas["Arith"] != want {
+		t.Fatalf("unexpected metadata %q, user metadata %q", restarted.metas["Arith"], restarted.userMetas["Arith"])
+	}
+}
+
+func TestConsulTags(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulTags("rpcx"),
+		WithConsulServiceTags("Arith", "canary"),
+		WithConsulServiceMeta("Arith", map[string]string{"version": "v2", "group": "b"}),
+		WithConsulIngress("Echo", meta.Ingress{PathPrefix: "/echo"}),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Echo", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != "group=a&tags=rpcx%2Ccanary&version=v2" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+	if v := string(kv.data["rpcx_test/Echo/tcp@127.0.0.1:8972"]); v != "ingress_path=%2Fecho&tags=rpcx" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+}
+
+func TestConsulBuildInfo(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulServiceMeta("Arith", map[string]string{"version": "v2", meta.GoVersion: "custom"}),
+		WithConsulBuildInfo(),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Echo", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := url.ParseQuery(string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]))
+	if v.Get("version") != "v2" || v.Get(meta.GoVersion) != "custom" {
+		t.Fatalf("expect the service meta to be kept but got %v", v)
+	}
+	v, _ = url.ParseQuery(string(kv.data["rpcx_test/Echo/tcp@127.0.0.1:8972"]))
+	if v.Get("version") != "" || v.Get(meta.GoVersion) == "" {
+		t.Fatalf("expect the build info but got %v", v)
+	}
+}
+
+func TestConsulEnrichers(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulServiceMeta("Arith", map[string]string{"region": "eu-west-1"}),
+		WithConsulEnrichers(cloudmeta.EnricherFunc(func(context.Context) (map[string]string, error) {
+			return map[string]string{"zone": "us-east-1a", "region": "us-east-1"}, nil
+		})),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "zone=us-east-1b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Echo", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := string(kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]); v != "region=eu-west-1&zone=us-east-1b" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+	if v := string(kv.data["rpcx_test/Echo/tcp@127.0.0.1:8972"]); v != "region=us-east-1&zone=us-east-1a" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+}
+
+func TestConsulSession(t *testing.T) {
+	var mu sync.Mutex
+	acquired := make(map[string]string)
+	sessions, destroyed := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/v1/session/create":
+			sessions++
+			fmt.Fprintf(w, `{"ID":"s%d"}`, sessions)
+		case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+			destroyed++
+			w.Write([]byte(`true`))
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			if session := r.URL.Query().Get("acquire"); session != "" {
+				acquired[strings.TrimPrefix(r.URL.Path, "/v1/kv/")] = session
+			}
+			w.Write([]byte(`true`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulSession(time.Minute),
+	)
+	if err := r.Register("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Echo", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	r.destroySession()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sessions != 1 || destroyed != 1 {
+		t.Fatalf("expect one session created and destroyed but got %d created, %d destroyed", sessions, destroyed)
+	}
+	if acquired["rpcx_test/Arith/tcp@127.0.0.1:8972"] != "s1" || acquired["rpcx_test/Echo/tcp@127.0.0.1:8972"] != "s1" {
+		t.Fatalf("expect the services put with the session but got %v", acquired)
+	}
+}
+
+func TestConsulUpdateService(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulSchema(),
+	)
+	r.kv = kv
+	if err := r.RegisterFunction("Arith", "Add", func(ctx context.Context, args *int, reply *int) error { return nil }, "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterFunction("Arith", "Mul", func(ctx context.Context, args *int, reply *int) error { return nil }, "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Services) != 1 {
+		t.Fatalf("expect the service registered once but got %v", r.Services)
+	}
+
+	key := "rpcx_test/Arith/tcp@127.0.0.1:8972"
+	if err := r.UpdateServiceMetadata("Arith", "group=b"); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(kv.data[key]); v != "group=b" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+
+	if err := r.UnregisterService("Echo"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expect ErrNotRegistered but got %v", err)
+	}
+	if err := r.UnregisterService("Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.data[key]; ok || len(r.Services) != 0 {
+		t.Fatal("service is not unregistered")
+	}
+	if _, ok := kv.data[schema.Key("rpcx_test", "Arith")]; ok {
+		t.Fatal("schema is not removed")
+	}
+}
+
+type heartbeatHook struct {
+	hook.NopHook
+	errs []error
+}
+
+func (h *heartbeatHook) Heartbeat(service string, err error) {
+	h.errs = append(h.errs, err)
+}
+
+func TestConsulEventHook(t *testing.T) {
+	kv := newMemStore()
+	h := &heartbeatHook{}
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulEventHook(h),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.refresh()
+	kv.setDown(true)
+	r.refresh()
+	if len(h.errs) != 2 || h.errs[0] != nil || h.errs[1] == nil {
+		t.Fatalf("unexpected heartbeats: %v", h.errs)
+	}
+}
+
+func TestConsulStartContext(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Hour),
+	)
+	r.kv = kv
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.StartContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("heartbeats are not stopped")
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulTombstone(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulTombstone(50*time.Millisecond),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unregister("Arith"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "rpcx_test/Arith/tcp@127.0.0.1:8972"
+	kv.mu.Lock()
+	value := string(kv.data[key])
+	kv.mu.Unlock()
+	if _, ok := meta.TombstoneOf(value); !ok {
+		t.Fatalf("expect a tombstone but got %s", value)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	kv.mu.Lock()
+	_, ok := kv.data[key]
+	kv.mu.Unlock()
+	if ok {
+		t.Fatal("tombstone is not removed")
+	}
+}
+
+func TestConsulTombstoneRegisteredAgain(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulTombstone(50*time.Millisecond),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unregister("Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Arith", new(Arith), "group=b"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	kv.mu.Lock()
+	value, ok := kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]
+	kv.mu.Unlock()
+	if !ok {
+		t.Fatal("the service registered again is removed")
+	}
+	if _, ok := meta.TombstoneOf(string(value)); ok {
+		t.Fatalf("expect the registered service but got %s", value)
+	}
+}
+
+func TestConsulTombstoneStop(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Hour),
+		WithConsulTombstone(50*time.Millisecond),
+	)
+	r.kv = kv
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store is closed, the tombstone expires with its TTL
+	time.Sleep(200 * time.Millisecond)
+	kv.mu.Lock()
+	_, ok := kv.data["rpcx_test/Arith/tcp@127.0.0.1:8972"]
+	kv.mu.Unlock()
+	if !ok {
+		t.Fatal("tombstone is removed after Stop")
+	}
+}
+
+func TestConsulWeight(t *testing.T) {
+	kv := newMemStore()
+	weight := 3
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulWeightFunc(func() int { return weight }),
+	)
+	r.kv = kv
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Echo", new(Arith), "weight=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	arith, echo := "rpcx_test/Arith/tcp@127.0.0.1:8972", "rpcx_test/Echo/tcp@127.0.0.1:8972"
+	if v := string(kv.data[arith]); v != "group=a&weight=3" {
+		t.Fatalf("unexpected metadata: %s", v)
+	}
+
+	weight = 1
+	r.refresh()
+	if v := string(kv.data[arith]); v != "group=a&weight=1" {
+		t.Fatalf("weight is not refreshed: %s", v)
+	}
+	if v := string(kv.data[echo]); v != "weight=10" {
+		t.Fatalf("explicit weight is overridden: %s", v)
+	}
+}
+
+func TestConsulConflictPolicy(t *testing.T) {
+	key := "rpcx_test/Arith/tcp@127.0.0.1:8972"
+	cases := []struct {
+		policy ConflictPolicy
+		// the value after an admin pauses the server and a heartbeat, and after the metadata is updated
+		heartbeat, updated string
+	}{
+		{OwnerWins, "group=a", "group=b"},
+		{LatestWins, "group=a&state=paused", "group=b"},
+		{MergeMetadata, "group=a&state=paused", "group=b&state=paused"},
+	}
+	for _, c := range cases {
+		kv := newMemStore()
+		r := NewConsulRegisterPlugin(
+			WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+			WithConsulBasePath("/rpcx_test"),
+			WithConsulConflictPolicy(c.policy),
+		)
+		r.kv = kv
+		if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = kv.Put(key, []byte("group=a&state=paused"), nil)
+		r.refresh()
+		if v := string(kv.data[key]); v != c.heartbeat {
+			t.Fatalf("unexpected value after the heartbeat: %s, want %s", v, c.heartbeat)
+		}
+		if err := r.UpdateServiceMetadata("Arith", "group=b"); err != nil {
+			t.Fatal(err)
+		}
+		if v := string(kv.data[key]); v != c.updated {
+			t.Fatalf("unexpected value after the update: %s, want %s", v, c.updated)
+		}
+	}
+}
+
+func TestConsulRegisteredServices(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+	)
+	r.kv = kv
+	if err := r.Register("Echo", new(Arith), "token=secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Arith", new(Arith), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	kv.setDown(true)
+	r.refresh()
+	kv.setDown(false)
+
+	services := r.RegisteredServices()
+	if len(services) != 2 || services[0].Name != "Arith" || services[0].Key != "rpcx_test/Arith/tcp@127.0.0.1:8972" || services[0].Metadata != "group=a" {
+		t.Fatalf("unexpected services: %+v", services)
+	}
+	if services[0].LastHeartbeat.IsZero() || services[0].LastError == "" || services[0].LastErrorAt.IsZero() {
+		t.Fatalf("unexpected heartbeats: %+v", services[0])
+	}
+
+	rec := httptest.NewRecorder()
+	RegistrationHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var got []RegisteredService
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Metadata != "token="+meta.Redacted {
+		t.Fatalf("unexpected response: %s", rec.Body)
+	}
+
+	if err := r.Unregister("Echo"); err != nil {
+		t.Fatal(err)
+	}
+	if services := r.RegisteredServices(); len(services) != 1 {
+		t.Fatalf("unexpected services: %+v", services)
+	}
+}
+
+func TestConsulBatchHeartbeats(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		txns []api.TxnOps
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/v1/session/create":
+			w.Write([]byte(`{"ID":"s1"}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+			w.Write([]byte(`true`))
+		case r.URL.Path == "/v1/txn":
+			var ops api.TxnOps
+			_ = json.NewDecoder(r.Body).Decode(&ops)
+			txns = append(txns, ops)
+			w.Write([]byte(`{}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			w.Write([]byte(`true`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulServers([]string{strings.TrimPrefix(srv.URL, "http://")}),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulBatchHeartbeats(2),
+	)
+	for _, name := range []string{"Arith", "Echo", "Hello"} {
+		if err := r.Register(name, new(Arith), "group=a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer r.destroySession()
+
+	r.refresh()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(txns) != 2 || len(txns[0]) != 2 || len(txns[1]) != 1 {
+		t.Fatalf("expect the heartbeat in 2 transactions but got %d", len(txns))
+	}
+	op := txns[0][0].KV
+	if op.Verb != api.KVLock || op.Session != "s1" || op.Key != "rpcx_test/Arith/tcp@127.0.0.1:8972" || string(op.Value) != "group=a" {
+		t.Fatalf("unexpected operation: %+v", op)
+	}
+	if services := r.RegisteredServices(); services[2].LastHeartbeat.IsZero() {
+		t.Fatal("heartbeat is not recorded")
+	}
+}
+
+func TestConsulJitter(t *testing.T) {
+	a, b := NewJitter("i-1"), NewJitter("i-1")
+	for i := 0; i < 10; i++ {
+		d := a.Delay(time.Second)
+		if d < 0 || d >= time.Second || d != b.Delay(time.Second) {
+			t.Fatalf("delays of the same seed differ or out of range: %v", d)
+		}
+	}
+	if jitterWindow(time.Second, 0.9) != 500*time.Millisecond {
+		t.Fatal("jitter fraction is not capped")
+	}
+	for i := 0; i < 10; i++ {
+		if next := nextInterval(a, time.Second, 200*time.Millisecond); next < 800*time.Millisecond || next > time.Second {
+			t.Fatalf("next interval %v is out of range", next)
+		}
+	}
+
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(200*time.Millisecond),
+		WithConsulJitter(0.5, nil),
+	)
+	r.kv = kv
+	r.dying = make(chan struct{})
+	for _, name := range []string{"A", "B", "C", "D"} {
+		if err := r.Register(name, new(Arith), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.jitter() == nil {
+		t.Fatal("jitter is not seeded by the service address")
+	}
+
+	start := time.Now()
+	r.refresh()
+	// the writes of 4 services are spread over 100ms
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Fatalf("writes are not staggered, took %v", elapsed)
+	}
+
+	close(r.dying)
+	start = time.Now()
+	r.refresh()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("refresh is not stopped, took %v", elapsed)
+	}
+}
+
+func TestConsulRegisterDuringHeartbeat(t *testing.T) {
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+	)
+	r.kv = kv
+	r.dying = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			name := "Arith" + strconv.Itoa(i)
+			if err := r.Register(name, new(Arith), ""); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 {
+				if err := r.Unregister(name); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if services := r.services(); len(services) != 25 {
+				t.Fatalf("unexpected services %v", services)
+			}
+			return
+		default:
+			r.refresh()
+		}
+	}
+}
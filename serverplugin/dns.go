@@ -0,0 +1,71 @@
+package serverplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dnsTTLWildcard is the name of the DNS TTL of all services, as consul uses in service_ttl.
+const dnsTTLWildcard = "*"
+
+// DNSConfig is the dns_config of the consul agent configuration which sets the DNS TTLs of services.
+type DNSConfig struct {
+	// ServiceTTL is the TTL by service name, "*" for all services
+	ServiceTTL map[string]time.Duration
+}
+
+// NewDNSConfig returns the DNS configuration of the TTLs by service name.
+func NewDNSConfig(ttls map[string]time.Duration) DNSConfig {
+	c := DNSConfig{ServiceTTL: make(map[string]time.Duration, len(ttls))}
+	for name, ttl := range ttls {
+		if ttl > 0 {
+			c.ServiceTTL[name] = ttl
+		}
+	}
+	return c
+}
+
+// JSON returns the configuration in the JSON format of the consul agent configuration files.
+func (c DNSConfig) JSON() ([]byte, error) {
+	ttls := make(map[string]string, len(c.ServiceTTL))
+	for name, ttl := range c.ServiceTTL {
+		ttls[name] = ttl.String()
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"dns_config": map[string]interface{}{"service_ttl": ttls},
+	}, "", "  ")
+}
+
+// HCL returns the configuration in the HCL format of the consul agent configuration files.
+func (c DNSConfig) HCL() string {
+	names := make([]string, 0, len(c.ServiceTTL))
+	for name := range c.ServiceTTL {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("dns_config {\n  service_ttl {\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "    %q = %q\n", name, c.ServiceTTL[name].String())
+	}
+	b.WriteString("  }\n}\n")
+	return b.String()
+}
+
+// dnsTTL returns the DNS TTL hint of the service name, zero if there is none.
+func (p *ConsulServiceRegisterPlugin) dnsTTL(name string) time.Duration {
+	if ttl, ok := p.DNSTTL[name]; ok {
+		return ttl
+	}
+	return p.DNSTTL[dnsTTLWildcard]
+}
+
+// DNSConfig returns the consul DNS configuration matching the DNS TTL hints of the plugin,
+// to be deployed to the agents answering the DNS queries of the services.
+func (p *ConsulServiceRegisterPlugin) DNSConfig() DNSConfig {
+	return NewDNSConfig(p.DNSTTL)
+}
@@ -0,0 +1,115 @@
+package serverplugin
+
+import (
+	"errors"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// CheckType is the type of the consul health check of a service.
+type CheckType int
+
+const (
+	// CheckTTL is passed by the update loop of the plugin.
+	CheckTTL CheckType = iota
+	// CheckHTTP is passed when the consul agent gets a 2xx response from the URL.
+	CheckHTTP
+	// CheckGRPC is passed when the gRPC health service reports SERVING.
+	CheckGRPC
+)
+
+// HealthCheck is the consul health check attached to a registered service.
+type HealthCheck struct {
+	Type CheckType
+	// URL of the HTTP check, e.g. http://127.0.0.1:8080/health
+	HTTP string
+	// endpoint of the gRPC check, e.g. 127.0.0.1:9090 or 127.0.0.1:9090/my.Service
+	GRPC       string
+	GRPCUseTLS bool
+	// how often the agent runs the HTTP or gRPC check, the TTL check is passed every UpdateInterval
+	Interval time.Duration
+	Timeout  time.Duration
+	// consul deregisters the service if the check is critical for longer than it, zero means never
+	DeregisterCriticalServiceAfter time.Duration
+}
+
+// WithCatalogHealthCheck sets the health check of all services.
+func WithCatalogHealthCheck(check *HealthCheck) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.HealthCheck = check
+	}
+}
+
+// WithCatalogServiceHealthCheck sets the health check of the service name, it overrides the one of all services.
+func WithCatalogServiceHealthCheck(name string, check *HealthCheck) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		if o.ServiceChecks == nil {
+			o.ServiceChecks = make(map[string]*HealthCheck)
+		}
+		o.ServiceChecks[name] = check
+	}
+}
+
+// WithCatalogDeregisterCriticalAfter sets how long consul keeps the services whose checks are critical.
+// It applies to the default TTL checks.
+func WithCatalogDeregisterCriticalAfter(d time.Duration) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.DeregisterCriticalServiceAfter = d
+	}
+}
+
+// healthCheck returns the health check of the service, nil means the service is registered without checks.
+func (p *ConsulServiceRegisterPlugin) healthCheck(name string) *HealthCheck {
+	if check, ok := p.ServiceChecks[name]; ok {
+		return check
+	}
+	if p.HealthCheck != nil {
+		return p.HealthCheck
+	}
+	if p.UpdateInterval > 0 {
+		return &HealthCheck{Type: CheckTTL, DeregisterCriticalServiceAfter: p.DeregisterCriticalServiceAfter}
+	}
+	return nil
+}
+
+// agentCheck converts the health check of the service to the consul agent check.
+func (p *ConsulServiceRegisterPlugin) agentCheck(id string, check *HealthCheck) (*api.AgentServiceCheck, error) {
+	c := &api.AgentServiceCheck{CheckID: "service:" + id}
+	if check.DeregisterCriticalServiceAfter > 0 {
+		c.DeregisterCriticalServiceAfter = check.DeregisterCriticalServiceAfter.String()
+	}
+	if check.Timeout > 0 {
+		c.Timeout = check.Timeout.String()
+	}
+
+	switch check.Type {
+	case CheckTTL:
+		if p.UpdateInterval <= 0 {
+			return nil, errors.New("TTL check requires UpdateInterval")
+		}
+		c.TTL = (p.UpdateInterval + p.Expired).String()
+		// passing until the first heartbeat, otherwise the service is critical and hidden until it is updated
+		c.Status = api.HealthPassing
+		return c, nil
+	case CheckHTTP:
+		if check.HTTP == "" {
+			return nil, errors.New("HTTP check requires the URL")
+		}
+		c.HTTP = check.HTTP
+	case CheckGRPC:
+		if check.GRPC == "" {
+			return nil, errors.New("gRPC check requires the endpoint")
+		}
+		c.GRPC = check.GRPC
+		c.GRPCUseTLS = check.GRPCUseTLS
+	default:
+		return nil, errors.New("unknown check type")
+	}
+
+	if check.Interval <= 0 {
+		return nil, errors.New("HTTP and gRPC checks require the interval")
+	}
+	c.Interval = check.Interval.String()
+	return c, nil
+}
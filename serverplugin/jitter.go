@@ -0,0 +1,142 @@
+package serverplugin
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+)
+
+// maxJitterFraction keeps the writes of the services staggered within a heartbeat from overlapping the next one.
+const maxJitterFraction = 0.5
+
+// Jitter randomizes the timing of the heartbeats, so that the servers started together, e.g. by a deployment,
+// don't write consul at the same moments of every interval.
+type Jitter interface {
+	// Delay returns a delay in [0, window).
+	Delay(window time.Duration) time.Duration
+}
+
+// JitterFunc is an adapter to use a function as a Jitter.
+type JitterFunc func(window time.Duration) time.Duration
+
+// Delay calls f.
+func (f JitterFunc) Delay(window time.Duration) time.Duration {
+	return f(window)
+}
+
+type randJitter struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NewJitter returns a Jitter of uniformly random delays seeded by seed, e.g. the instance id,
+// so that the servers get different delays even if they start at the same time.
+func NewJitter(seed string) Jitter {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return &randJitter{r: rand.New(rand.NewSource(int64(h.Sum64())))}
+}
+
+func (j *randJitter) Delay(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Duration(j.r.Int63n(int64(window)))
+}
+
+// jitterWindow returns the part of interval which the heartbeats are randomized in,
+// fraction is capped at maxJitterFraction.
+func jitterWindow(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return 0
+	}
+	if fraction > maxJitterFraction {
+		fraction = maxJitterFraction
+	}
+	return time.Duration(float64(interval) * fraction)
+}
+
+// nextInterval returns the time until the next heartbeat. It is shortened by a random part of the window,
+// so that the keys never wait longer than interval and don't expire.
+func nextInterval(jitter Jitter, interval, window time.Duration) time.Duration {
+	if jitter == nil || window <= 0 {
+		return interval
+	}
+	next := interval - window + jitter.Delay(window)
+	if next <= 0 {
+		return interval
+	}
+	return next
+}
+
+// stagger waits until the i-th of n services is due in the heartbeat started at start, their writes are spread
+// evenly over window. The offset of each service is the same in every heartbeat, so the time between its writes
+// stays at most the interval. It returns false if stop is closed while waiting.
+func stagger(i, n int, window time.Duration, start time.Time, stop <-chan struct{}) bool {
+	if window <= 0 || n <= 1 || i <= 0 {
+		return true
+	}
+	wait := time.Until(start.Add(window * time.Duration(i) / time.Duration(n)))
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// WithConsulJitter randomizes the heartbeats within fraction of the update interval (at most 0.5): every interval
+// is shortened by a random part of it, and the writes of the services are spread over it. jitter is seeded
+// by the instance id read by the enrichers, or by the service address if it is nil.
+func WithConsulJitter(fraction float64, jitter Jitter) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.JitterFraction = fraction
+		o.Jitter = jitter
+	}
+}
+
+// jitter returns the Jitter of the heartbeats, nil if they are not randomized.
+func (p *ConsulRegisterPlugin) jitter() Jitter {
+	if p.JitterFraction <= 0 {
+		return nil
+	}
+	if p.Jitter == nil {
+		p.enrich()
+		seed := p.enriched[meta.InstanceID]
+		if seed == "" {
+			seed = p.ServiceAddress
+		}
+		p.Jitter = NewJitter(seed)
+	}
+	return p.Jitter
+}
+
+// WithCatalogJitter randomizes the TTL checks within fraction of the update interval (at most 0.5) like
+// WithConsulJitter, jitter is seeded by the service address if it is nil.
+func WithCatalogJitter(fraction float64, jitter Jitter) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.JitterFraction = fraction
+		o.Jitter = jitter
+	}
+}
+
+// jitter returns the Jitter of the TTL checks, nil if they are not randomized.
+func (p *ConsulServiceRegisterPlugin) jitter() Jitter {
+	if p.JitterFraction <= 0 {
+		return nil
+	}
+	if p.Jitter == nil {
+		p.Jitter = NewJitter(p.ServiceAddress)
+	}
+	return p.Jitter
+}
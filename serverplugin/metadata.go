@@ -0,0 +1,119 @@
+package serverplugin
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/cloudmeta"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// processStart is published as the start time, so it is stable across registrations and heartbeats.
+var processStart = time.Now()
+
+// withMetadata adds the well-known metadata fields, the tags and the metadata configured on the plugin
+// to the metadata of the service name. The fields set explicitly in the metadata are kept,
+// and the fields of ServiceMeta are never overwritten by the published ones.
+func (p *ConsulRegisterPlugin) withMetadata(name, metadata string) string {
+	p.enrich()
+
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	published := make(url.Values)
+	for k, v := range p.enriched {
+		published.Set(k, v)
+	}
+	meta.SetTags(published, p.tags(name))
+	p.Ingress[name].Set(published)
+	p.Ownership.Set(published)
+	p.Capacity.Set(published)
+	p.Ports.Set(published)
+	if p.HashRing != nil {
+		meta.SetRingTokens(published, p.HashRing(p.ServiceAddress))
+	}
+	if w := p.weight(); w > 0 {
+		published.Set(meta.Weight, strconv.Itoa(w))
+	}
+	if p.PublishBuildInfo {
+		meta.ReadBuildInfo().Set(published)
+	}
+	if p.PublishStartTime {
+		meta.SetStartTime(published, processStart)
+	}
+	if p.PublishHostname {
+		p.addresses().Set(published)
+	}
+
+	fields := make(url.Values)
+	for k, v := range p.ServiceMeta[name] {
+		fields.Set(k, v)
+	}
+	for k := range published {
+		if _, ok := fields[k]; !ok {
+			fields[k] = published[k]
+		}
+	}
+	if len(fields) == 0 && p.State == "" {
+		return metadata
+	}
+
+	v := meta.Parse(metadata)
+	for k := range fields {
+		if _, ok := v[k]; !ok {
+			v.Set(k, fields.Get(k))
+		}
+	}
+	if p.State != "" {
+		v.Set(meta.State, p.State)
+	}
+	return v.Encode()
+}
+
+// enrich reads the metadata of the instance once.
+func (p *ConsulRegisterPlugin) enrich() {
+	if len(p.Enrichers) == 0 {
+		return
+	}
+	p.enrichOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cloudmeta.DefaultTimeout)
+		defer cancel()
+
+		var errs []error
+		p.enriched, errs = cloudmeta.Enrich(ctx, p.Enrichers...)
+		for _, err := range errs {
+			log.Warnf("cannot read instance metadata: %v", err)
+		}
+	})
+}
+
+// addresses returns the hostname of this host and the IP of the service address.
+func (p *ConsulRegisterPlugin) addresses() meta.Addresses {
+	var a meta.Addresses
+	if _, host, _, err := meta.SplitKey(p.ServiceAddress); err == nil && net.ParseIP(host) != nil {
+		a.IP = host
+	}
+
+	a.Hostname = p.Hostname
+	if a.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Warnf("cannot get hostname: %v", err)
+		}
+		a.Hostname = hostname
+	}
+	return a
+}
+
+// tags returns the tags of all services followed by the tags of the service name.
+func (p *ConsulRegisterPlugin) tags(name string) []string {
+	if len(p.ServiceTags[name]) == 0 {
+		return p.Tags
+	}
+	return append(append([]string(nil), p.Tags...), p.ServiceTags[name]...)
+}
@@ -0,0 +1,111 @@
+package serverplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// RegisteredService is the registration of a service as the plugin sees it.
+type RegisteredService struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Metadata string `json:"metadata"`
+	// time of the last successful registration or heartbeat, zero if none
+	LastHeartbeat time.Time `json:"last_heartbeat,omitempty"`
+	// the last failure of the heartbeats and when it happened, empty if none
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// heartbeatStatus is the result of the heartbeats of a service.
+type heartbeatStatus struct {
+	last        time.Time
+	lastErr     error
+	lastErrorAt time.Time
+}
+
+// RegisteredServices returns the services registered by the plugin, sorted by their names,
+// so that the registration can be displayed without reading consul.
+func (p *ConsulRegisterPlugin) RegisteredServices() []RegisteredService {
+	p.metasLock.RLock()
+	services := make([]RegisteredService, 0, len(p.Services))
+	for _, name := range p.Services {
+		services = append(services, RegisteredService{
+			Name:     name,
+			Key:      fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress),
+			Metadata: p.metas[name],
+		})
+	}
+	p.metasLock.RUnlock()
+
+	p.statusMu.Lock()
+	for i := range services {
+		s := p.status[services[i].Name]
+		if s == nil {
+			continue
+		}
+		services[i].LastHeartbeat = s.last
+		if s.lastErr != nil {
+			services[i].LastError = s.lastErr.Error()
+			services[i].LastErrorAt = s.lastErrorAt
+		}
+	}
+	p.statusMu.Unlock()
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// recordHeartbeat records the result of the registration or a heartbeat of service.
+func (p *ConsulRegisterPlugin) recordHeartbeat(service string, err error) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+
+	if p.status == nil {
+		p.status = make(map[string]*heartbeatStatus)
+	}
+	s := p.status[service]
+	if s == nil {
+		s = &heartbeatStatus{}
+		p.status[service] = s
+	}
+	if err != nil {
+		s.lastErr, s.lastErrorAt = err, time.Now()
+		return
+	}
+	s.last = time.Now()
+}
+
+// forgetHeartbeats removes the heartbeats of an unregistered service.
+func (p *ConsulRegisterPlugin) forgetHeartbeats(service string) {
+	p.statusMu.Lock()
+	delete(p.status, service)
+	p.statusMu.Unlock()
+}
+
+// RegistrationHandler serves the RegisteredServices of p as JSON for debugging,
+// the metadata fields which usually hold secrets are redacted, see meta.DefaultRedactPatterns.
+func RegistrationHandler(p *ConsulRegisterPlugin) http.Handler {
+	redactor, _ := meta.NewRedactor()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		services := p.RegisteredServices()
+		for i := range services {
+			services[i].Metadata = redactor.Metadata(services[i].Metadata)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(services); err != nil {
+			log.Warnf("cannot write registered services: %v", err)
+		}
+	})
+}
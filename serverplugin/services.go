@@ -0,0 +1,75 @@
+package serverplugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rpcxio/rpcx-consul/schema"
+	"github.com/smallnest/rpcx/log"
+)
+
+// ErrNotRegistered is returned when a service which isn't registered is unregistered or updated.
+var ErrNotRegistered = errors.New("service is not registered")
+
+// UnregisterService removes the service and its schema from consul at runtime,
+// it returns ErrNotRegistered if the service isn't registered.
+func (p *ConsulRegisterPlugin) UnregisterService(name string) error {
+	if !p.isRegistered(name) {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	}
+	if err := p.Unregister(name); err != nil {
+		return err
+	}
+
+	if p.PublishSchema {
+		p.schemasLock.Lock()
+		delete(p.schemas, name)
+		p.schemasLock.Unlock()
+		key := schema.Key(p.BasePath, name)
+		if err := p.kv.Delete(key); err != nil {
+			log.Warnf("cannot remove schema %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// UpdateServiceMetadata replaces the metadata of the registered service at runtime, the well-known fields
+// are added as Register does. It returns ErrNotRegistered if the service isn't registered.
+func (p *ConsulRegisterPlugin) UpdateServiceMetadata(name, metadata string) error {
+	if !p.isRegistered(name) {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	}
+
+	full := p.withMetadata(name, metadata)
+	nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	if p.inWindow(name, time.Now()) {
+		if err := p.putNode(nodePath, []byte(full)); err != nil {
+			log.Errorf("cannot update consul path %s: %v", nodePath, err)
+			return err
+		}
+	}
+
+	p.metasLock.Lock()
+	if p.metas == nil {
+		p.metas = make(map[string]string)
+	}
+	p.metas[name] = full
+	if p.userMetas == nil {
+		p.userMetas = make(map[string]string)
+	}
+	p.userMetas[name] = metadata
+	p.metasLock.Unlock()
+	p.saveState()
+	return nil
+}
+
+// containsString reports whether s is in ss.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
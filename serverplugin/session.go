@@ -0,0 +1,83 @@
+package serverplugin
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/consulkv"
+	"github.com/smallnest/rpcx/log"
+)
+
+// sessionStore is implemented by the stores which can create consul sessions, such as consulkv.Store.
+type sessionStore interface {
+	NewSession(ttl time.Duration) (*consulkv.Session, error)
+}
+
+// putNode puts the key of a registered service, with the session if SessionTTL is set,
+// otherwise with the TTL which is renewed by the heartbeats, with CAS if ConflictPolicy is set.
+func (p *ConsulRegisterPlugin) putNode(nodePath string, value []byte) error {
+	if p.SessionTTL <= 0 && !p.BatchHeartbeats {
+		if p.ConflictPolicy != nil {
+			return p.casNode(nodePath, value)
+		}
+		return p.kv.Put(nodePath, value, &store.WriteOptions{TTL: p.ttl()})
+	}
+
+	se, err := p.liveSession()
+	if err != nil {
+		return err
+	}
+	return se.Put(nodePath, value)
+}
+
+// liveSession returns the session of the services, a new session is created if it is lost.
+func (p *ConsulRegisterPlugin) liveSession() (*consulkv.Session, error) {
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+
+	if p.session != nil {
+		select {
+		case <-p.session.Lost():
+			log.Warnf("consul session %s is lost, services are registered with a new session", p.session.ID)
+		default:
+			return p.session, nil
+		}
+	}
+
+	ss, ok := p.kv.(sessionStore)
+	if !ok {
+		return nil, errors.New("consul sessions are not supported by the store")
+	}
+	se, err := ss.NewSession(p.sessionTTL())
+	if err != nil {
+		return nil, err
+	}
+	p.session = se
+	return se, nil
+}
+
+// minSessionTTL is the minimum TTL of consul sessions.
+const minSessionTTL = 10 * time.Second
+
+// sessionTTL returns the TTL of the session, which is the TTL of the keys if SessionTTL is not set.
+func (p *ConsulRegisterPlugin) sessionTTL() time.Duration {
+	if p.SessionTTL > 0 {
+		return p.SessionTTL
+	}
+	if ttl := p.ttl(); ttl > minSessionTTL {
+		return ttl
+	}
+	return minSessionTTL
+}
+
+// destroySession destroys the session, consul deletes the keys put with it.
+func (p *ConsulRegisterPlugin) destroySession() {
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+
+	if p.session != nil {
+		p.session.Destroy()
+		p.session = nil
+	}
+}
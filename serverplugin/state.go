@@ -0,0 +1,136 @@
+package serverplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/smallnest/rpcx/log"
+)
+
+// registrationState is the registered services persisted in the state file.
+type registrationState struct {
+	SavedAt  time.Time           `json:"saved_at"`
+	Services []registeredService `json:"services"`
+}
+
+type registeredService struct {
+	Name string `json:"name"`
+	// Metadata is the metadata passed to Register, without the fields added by the plugin
+	Metadata string `json:"metadata"`
+}
+
+// saveState writes the registered services to the state file.
+func (p *ConsulRegisterPlugin) saveState() {
+	if p.StateFile == "" {
+		return
+	}
+
+	state := registrationState{SavedAt: time.Now()}
+	p.metasLock.RLock()
+	for _, name := range p.Services {
+		state.Services = append(state.Services, registeredService{Name: name, Metadata: p.userMetas[name]})
+	}
+	p.metasLock.RUnlock()
+
+	if err := writeState(p.StateFile, &state); err != nil {
+		log.Errorf("cannot save registration state: %v", err)
+	}
+}
+
+// writeState writes the state to a temporary file and renames it, so that a crash never leaves a partial file.
+func writeState(file string, state *registrationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// restoreState registers the services saved in the state file again,
+// with the fields added by the current configuration of the plugin.
+func (p *ConsulRegisterPlugin) restoreState() error {
+	if p.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state registrationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("malformed state file %s: %w", p.StateFile, err)
+	}
+
+	// the services are registered at once in transactions if the heartbeats are batched
+	var batch []*store.KVPair
+	for _, s := range state.Services {
+		if p.isRegistered(s.Name) {
+			continue
+		}
+
+		metadata := p.withMetadata(s.Name, s.Metadata)
+		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, s.Name, p.ServiceAddress)
+		// the services outside their windows are registered by the heartbeats when the windows open
+		if p.inWindow(s.Name, time.Now()) {
+			if p.BatchHeartbeats {
+				batch = append(batch, &store.KVPair{Key: nodePath, Value: []byte(metadata)})
+			} else if err := p.putNode(nodePath, []byte(metadata)); err != nil {
+				return fmt.Errorf("cannot restore consul path %s: %w", nodePath, err)
+			}
+		}
+
+		p.metasLock.Lock()
+		p.Services = append(p.Services, s.Name)
+		if p.metas == nil {
+			p.metas = make(map[string]string)
+		}
+		p.metas[s.Name] = metadata
+		if p.userMetas == nil {
+			p.userMetas = make(map[string]string)
+		}
+		p.userMetas[s.Name] = s.Metadata
+		p.metasLock.Unlock()
+	}
+	if len(batch) > 0 {
+		if err := p.putAll(batch, nil); err != nil {
+			return fmt.Errorf("cannot restore %d services: %w", len(batch), err)
+		}
+	}
+	log.Infof("restored %d services saved at %s from %s", len(state.Services), state.SavedAt.Format(time.RFC3339), p.StateFile)
+	return nil
+}
+
+func (p *ConsulRegisterPlugin) isRegistered(name string) bool {
+	p.metasLock.RLock()
+	defer p.metasLock.RUnlock()
+	return containsString(p.Services, name)
+}
+
+// services returns a copy of the registered services, which Register and Unregister may change meanwhile.
+func (p *ConsulRegisterPlugin) services() []string {
+	p.metasLock.RLock()
+	defer p.metasLock.RUnlock()
+	return append([]string(nil), p.Services...)
+}
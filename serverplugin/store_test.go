@@ -0,0 +1,185 @@
+package serverplugin
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/rpcxio/libkv/store"
+)
+
+var errUnreachable = errors.New("consul is unreachable")
+
+// memStore is an in-memory store.Store for tests.
+type memStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]*store.WriteOptions
+	down bool
+	puts int
+	// modify indexes of the keys
+	index   uint64
+	indexes map[string]uint64
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string][]byte), ttls: make(map[string]*store.WriteOptions), indexes: make(map[string]uint64)}
+}
+
+func (s *memStore) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *memStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errUnreachable
+	}
+	s.puts++
+	s.data[key] = value
+	s.ttls[key] = options
+	s.index++
+	s.indexes[key] = s.index
+	return nil
+}
+
+// PutAll puts the pairs at once like the transactions of consulkv.Store.
+func (s *memStore) PutAll(pairs []*store.KVPair, options *store.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errUnreachable
+	}
+	for _, p := range pairs {
+		s.puts++
+		s.data[p.Key] = p.Value
+		s.ttls[p.Key] = options
+		s.index++
+		s.indexes[p.Key] = s.index
+	}
+	return nil
+}
+
+func (s *memStore) Get(key string) (*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return nil, errUnreachable
+	}
+	v, ok := s.data[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return &store.KVPair{Key: key, Value: v, LastIndex: s.indexes[key]}, nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errUnreachable
+	}
+	if _, ok := s.data[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	delete(s.data, key)
+	delete(s.indexes, key)
+	return nil
+}
+
+func (s *memStore) Exists(key string) (bool, error) {
+	_, err := s.Get(key)
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *memStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) List(directory string) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return nil, errUnreachable
+	}
+	var pairs []*store.KVPair
+	for k, v := range s.data {
+		if strings.HasPrefix(k, directory+"/") {
+			pairs = append(pairs, &store.KVPair{Key: k, Value: v})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+func (s *memStore) DeleteTree(directory string) error {
+	return store.ErrCallNotSupported
+}
+
+func (s *memStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	s.mu.Lock()
+	index := s.indexes[key]
+	_, ok := s.data[key]
+	s.mu.Unlock()
+	if previous == nil && ok {
+		return false, nil, store.ErrKeyExists
+	}
+	if previous != nil && (!ok || previous.LastIndex != index) {
+		return false, nil, store.ErrKeyModified
+	}
+	if err := s.Put(key, value, options); err != nil {
+		return false, nil, err
+	}
+	pair, err := s.Get(key)
+	return err == nil, pair, err
+}
+
+func (s *memStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return false, errUnreachable
+	}
+	if _, ok := s.data[key]; !ok {
+		return false, store.ErrKeyNotFound
+	}
+	if previous == nil || s.indexes[key] != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	delete(s.data, key)
+	delete(s.ttls, key)
+	delete(s.indexes, key)
+	return true, nil
+}
+
+func (s *memStore) Close() {}
+
+// laggingStore doesn't see the keys in the first lag reads.
+type laggingStore struct {
+	store.Store
+	lag int
+}
+
+func (s *laggingStore) Get(key string) (*store.KVPair, error) {
+	if s.lag > 0 {
+		s.lag--
+		return nil, store.ErrKeyNotFound
+	}
+	return s.Store.Get(key)
+}
@@ -0,0 +1,77 @@
+package serverplugin
+
+import (
+	"time"
+
+	"github.com/rpcxio/libkv/store"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithConsulTombstone replaces the keys of the unregistered services with tombstones which expire after ttl
+// instead of deleting them, so that the discoveries which see an older value of a key later still drop the server.
+func WithConsulTombstone(ttl time.Duration) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Tombstone = ttl
+	}
+}
+
+// removeNode deletes the key of a service, or replaces it with a tombstone if Tombstone is set.
+func (p *ConsulRegisterPlugin) removeNode(nodePath string) error {
+	if p.Tombstone <= 0 {
+		return p.kv.Delete(nodePath)
+	}
+
+	value := meta.Tombstone(time.Now().Add(p.Tombstone))
+	if err := p.kv.Put(nodePath, []byte(value), &store.WriteOptions{TTL: p.Tombstone}); err != nil {
+		return err
+	}
+	pair, err := p.kv.Get(nodePath)
+	if err != nil {
+		log.Warnf("cannot get tombstone %s, it expires with its TTL: %v", nodePath, err)
+		return nil
+	}
+	if _, ok := meta.TombstoneOf(string(pair.Value)); !ok { // registered again
+		return nil
+	}
+
+	// the TTL of the key is at least Tombstone, delete it in time unless the service is registered again
+	p.tombstoneMu.Lock()
+	defer p.tombstoneMu.Unlock()
+	if p.tombstonesStopped {
+		return nil
+	}
+	if t := p.tombstones[nodePath]; t != nil {
+		t.Stop()
+	}
+	if p.tombstones == nil {
+		p.tombstones = make(map[string]*time.Timer)
+	}
+	var t *time.Timer
+	t = time.AfterFunc(p.Tombstone, func() {
+		p.tombstoneMu.Lock()
+		defer p.tombstoneMu.Unlock()
+		if p.tombstonesStopped || p.tombstones[nodePath] != t {
+			return
+		}
+		delete(p.tombstones, nodePath)
+		// the key is modified if the service is registered again
+		if _, err := p.kv.AtomicDelete(nodePath, pair); err != nil && err != store.ErrKeyModified && err != store.ErrKeyNotFound {
+			log.Warnf("cannot remove tombstone %s: %v", nodePath, err)
+		}
+	})
+	p.tombstones[nodePath] = t
+	return nil
+}
+
+// stopTombstones cancels the deletions of the tombstones, which expire with their TTLs after the plugin stops.
+func (p *ConsulRegisterPlugin) stopTombstones() {
+	p.tombstoneMu.Lock()
+	defer p.tombstoneMu.Unlock()
+
+	p.tombstonesStopped = true
+	for _, t := range p.tombstones {
+		t.Stop()
+	}
+	p.tombstones = nil
+}
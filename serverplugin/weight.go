@@ -0,0 +1,114 @@
+package serverplugin
+
+import (
+	"net/url"
+	"strconv"
+
+	api "github.com/hashicorp/consul/api"
+	"github.com/rpcxio/rpcx-consul/meta"
+	"github.com/smallnest/rpcx/log"
+)
+
+// WithConsulWeight publishes the weight of all services for the weighted selectors of rpcx.
+func WithConsulWeight(weight int) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.Weight = weight
+	}
+}
+
+// WithConsulWeightFunc publishes the weight computed by f at every heartbeat, e.g. from the load or the CPU usage.
+// The weights which are not positive are not published.
+func WithConsulWeightFunc(f func() int) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		o.WeightFunc = f
+	}
+}
+
+// weight returns the weight to publish, zero if none.
+func (p *ConsulRegisterPlugin) weight() int {
+	if p.WeightFunc != nil {
+		return p.WeightFunc()
+	}
+	return p.Weight
+}
+
+// refreshWeight sets the weight computed by WeightFunc in the metadata v of the service name at a heartbeat,
+// unless the weight is set explicitly in the metadata passed to Register.
+func (p *ConsulRegisterPlugin) refreshWeight(name string, v url.Values) {
+	if p.WeightFunc == nil {
+		return
+	}
+	p.metasLock.RLock()
+	userMeta := p.userMetas[name]
+	p.metasLock.RUnlock()
+	if _, ok := meta.Parse(userMeta)[meta.Weight]; ok {
+		return
+	}
+
+	if w := p.WeightFunc(); w > 0 {
+		v.Set(meta.Weight, strconv.Itoa(w))
+	}
+}
+
+// WithCatalogWeight publishes the weight of all services as the consul service weights.
+func WithCatalogWeight(weight int) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.Weight = weight
+	}
+}
+
+// WithCatalogWeightFunc publishes the weight computed by f, e.g. from the load or the CPU usage.
+// It is computed at every heartbeat and the services are registered again when it changes.
+func WithCatalogWeightFunc(f func() int) ConsulServiceOpt {
+	return func(o *ConsulServiceRegisterPlugin) {
+		o.WeightFunc = f
+	}
+}
+
+// weight returns the weight to register the services with, zero if none.
+func (p *ConsulServiceRegisterPlugin) weight() int {
+	if p.WeightFunc == nil {
+		return p.Weight
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.computedWeight <= 0 {
+		p.computedWeight = p.WeightFunc()
+	}
+	return p.computedWeight
+}
+
+// updateWeight registers the services again if the weight computed by WeightFunc changes.
+func (p *ConsulServiceRegisterPlugin) updateWeight(agent *api.Agent) {
+	if p.WeightFunc == nil {
+		return
+	}
+	w := p.WeightFunc()
+	if w <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	if w == p.computedWeight {
+		p.mu.Unlock()
+		return
+	}
+	p.computedWeight = w
+	services := append([]string(nil), p.Services...)
+	metas := make(map[string]string, len(services))
+	for _, name := range services {
+		metas[name] = p.metas[name]
+	}
+	p.mu.Unlock()
+
+	for _, name := range services {
+		reg, err := p.registration(name, metas[name])
+		if err == nil {
+			err = agent.ServiceRegister(reg)
+		}
+		if err != nil {
+			log.Errorf("cannot update the weight of service %s: %v", p.serviceID(name), err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package serverplugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smallnest/rpcx/log"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Window is a daily time window in which a service is registered, e.g. 09:00-18:00 on weekdays.
+// A window whose end is before its start crosses midnight, e.g. 22:00-06:00.
+type Window struct {
+	// offsets since midnight, End can be 24h
+	Start time.Duration
+	End   time.Duration
+	// days on which the window starts, every day if empty
+	Days []time.Weekday
+	// time zone of the window, time.Local if nil
+	Location *time.Location
+}
+
+// ParseWindow parses a window like "09:00-18:00", "Mon-Fri 09:00-18:00" or "Sat,Sun 22:00-06:00".
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("invalid window %q: %w", s, err)
+		}
+		w.Days = days
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("invalid window %q", s)
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid window %q", s)
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	return w, nil
+}
+
+// Contains reports whether t is in the window.
+func (w Window) Contains(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	} else {
+		t = t.Local()
+	}
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End && w.onDay(t.Weekday())
+	}
+	// crosses midnight, the part after midnight belongs to the window started on the previous day
+	if offset >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	return offset < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDays parses days like "Mon-Fri" or "Sat,Sun".
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return nil, fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a clock like "09:30", up to "24:00".
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid clock %q", s)
+	}
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid clock %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// WithConsulWindows only registers the service name in the windows and deregisters it outside them,
+// e.g. for batch services which should only receive traffic during certain hours.
+// The windows are checked on every update, so UpdateInterval must be set.
+func WithConsulWindows(name string, windows ...Window) ConsulOpt {
+	return func(o *ConsulRegisterPlugin) {
+		if o.Windows == nil {
+			o.Windows = make(map[string][]Window)
+		}
+		o.Windows[name] = windows
+	}
+}
+
+// inWindow reports whether the service should be registered at t, it is always true for the services without windows.
+func (p *ConsulRegisterPlugin) inWindow(name string, t time.Time) bool {
+	windows, ok := p.Windows[name]
+	if !ok {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaveWindow deregisters the service whose window is closed.
+func (p *ConsulRegisterPlugin) leaveWindow(name, nodePath string) {
+	exist, err := p.kv.Exists(nodePath)
+	if err != nil || !exist {
+		return
+	}
+	if err := p.kv.Delete(nodePath); err != nil {
+		log.Errorf("cannot deregister service %s outside its windows: %v", name, err)
+		return
+	}
+	log.Infof("deregistered service %s outside its windows", name)
+}
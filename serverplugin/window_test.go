@@ -0,0 +1,85 @@
+package serverplugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	days := map[string]int{"Mon": 1, "Tue": 2, "Wed": 3, "Thu": 4, "Fri": 5, "Sat": 6, "Sun": 7}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("15:04", s[4:], time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 2024-01-01 is a Monday
+		return time.Date(2024, 1, days[s[:3]], tm.Hour(), tm.Minute(), 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		window string
+		t      string
+		want   bool
+	}{
+		{"09:00-18:00", "Sun 09:00", true},
+		{"09:00-18:00", "Mon 18:00", false},
+		{"Mon-Fri 09:00-18:00", "Fri 17:59", true},
+		{"Mon-Fri 09:00-18:00", "Sat 10:00", false},
+		{"Fri-Mon 00:00-24:00", "Sun 23:59", true},
+		{"Fri-Mon 00:00-24:00", "Tue 00:00", false},
+		{"Fri 22:00-06:00", "Fri 23:00", true},
+		{"Fri 22:00-06:00", "Sat 05:59", true},
+		{"Fri 22:00-06:00", "Sat 22:30", false},
+		{"Fri 22:00-06:00", "Fri 05:00", false},
+	}
+	for _, c := range cases {
+		w, err := ParseWindow(c.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Location = time.UTC
+		if got := w.Contains(at(c.t)); got != c.want {
+			t.Errorf("window %s contains %s: expect %v but got %v", c.window, c.t, c.want, got)
+		}
+	}
+
+	for _, s := range []string{"", "9-18", "Xyz 09:00-18:00", "09:00-25:00", "Mon 09:00-18:00 UTC"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("expect error of window %q", s)
+		}
+	}
+}
+
+func TestConsulWindows(t *testing.T) {
+	now := time.Now().UTC()
+	open := Window{Start: 0, End: 24 * time.Hour, Location: time.UTC}
+	closed := Window{Start: 0, End: 24 * time.Hour, Days: []time.Weekday{(now.Weekday() + 1) % 7}, Location: time.UTC}
+
+	kv := newMemStore()
+	r := NewConsulRegisterPlugin(
+		WithConsulServiceAddress("tcp@127.0.0.1:8972"),
+		WithConsulBasePath("/rpcx_test"),
+		WithConsulUpdateInterval(time.Minute),
+		WithConsulWindows("Report", closed),
+	)
+	r.kv = kv
+	if err := r.Register("Report", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	key := "rpcx_test/Report/tcp@127.0.0.1:8972"
+	if _, ok := kv.data[key]; ok {
+		t.Fatal("expect no registration outside the window")
+	}
+
+	r.Windows["Report"] = []Window{open}
+	r.refresh()
+	if _, ok := kv.data[key]; !ok {
+		t.Fatal("expect registration in the window")
+	}
+
+	r.Windows["Report"] = []Window{closed}
+	r.refresh()
+	if _, ok := kv.data[key]; ok {
+		t.Fatal("expect deregistration outside the window")
+	}
+}